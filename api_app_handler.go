@@ -8,6 +8,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/codec"
 	"github.com/brocaar/lorawan"
 	"github.com/gorilla/mux"
 )
@@ -44,6 +45,13 @@ func (h *ApplicationCreateHandler) ServeHTTP(w http.ResponseWriter, r *http.Requ
 		}.write(w)
 		return
 	}
+	if _, err := codec.FromConfig(app.Config.String); err != nil {
+		APIError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}.write(w)
+		return
+	}
 	if err := h.Client.Application().Create(app); err != nil {
 		if err == loracontrol.ErrObjectExists {
 			APIError{
@@ -161,6 +169,14 @@ func (h *ApplicationObjectHandler) servePUT(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if _, err := codec.FromConfig(app.Config.String); err != nil {
+		APIError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}.write(w)
+		return
+	}
+
 	if err := h.Client.Application().Update(app); err != nil {
 		if err == loracontrol.ErrObjectDoesNotExist {
 			APIError{
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/codec"
 	"github.com/gorilla/mux"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -41,6 +42,18 @@ func TestApplicationCreateHandler(t *testing.T) {
 				})
 			})
 
+			Convey("When posting an application with an invalid codec", func() {
+				app.Config.String = map[string]string{codec.TypeConfigKey: "INVALID"}
+				jsonBytes, err := json.Marshal(app)
+				So(err, ShouldBeNil)
+				resp, err := http.Post(s.URL, "application/json", bytes.NewReader(jsonBytes))
+				So(err, ShouldBeNil)
+
+				Convey("Then a 400 status is returned", func() {
+					So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				})
+			})
+
 			Convey("When posting valid JSON", func() {
 				resp, err := http.Post(s.URL, "application/json", bytes.NewReader(jsonBytes))
 				So(err, ShouldBeNil)
@@ -5,16 +5,31 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/gateway/gwconfig"
+	"github.com/brocaar/loraserver/gateway/multiplexer"
+	"github.com/brocaar/loraserver/gateway/profile"
+	"github.com/brocaar/loraserver/gateway/txconfig"
 	"github.com/brocaar/lorawan"
 	"github.com/gorilla/mux"
 )
 
 // GatewayObjectHandler is a http.Handler which handles requests
-// on a single object.
+// on a single object. When Watcher is set, the response will contain
+// the status of the gateway.
 type GatewayObjectHandler struct {
-	Client *loracontrol.Client
+	Client  *loracontrol.Client
+	Watcher *GatewayWatcher
+}
+
+// gatewayResponse is the gateway object returned by GatewayObjectHandler.
+type gatewayResponse struct {
+	loracontrol.Gateway
+	Status *GatewayStatus `json:"status,omitempty"`
 }
 
 func (h *GatewayObjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -32,8 +47,7 @@ func (h *GatewayObjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var mac lorawan.EUI64
-	b, err := hex.DecodeString(id)
+	mac, err := parseEUI64(id, "gateway MAC")
 	if err != nil {
 		APIError{
 			Code:    http.StatusBadRequest,
@@ -41,14 +55,6 @@ func (h *GatewayObjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		}.write(w)
 		return
 	}
-	if len(b) != len(mac) {
-		APIError{
-			Code:    http.StatusBadRequest,
-			Message: fmt.Sprintf("a gateway MAC is exactly %d bytes", len(mac)),
-		}.write(w)
-		return
-	}
-	copy(mac[:], b)
 
 	switch r.Method {
 	case "GET":
@@ -78,11 +84,320 @@ func (h *GatewayObjectHandler) serveGET(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	resp := gatewayResponse{Gateway: gw}
+	if h.Watcher != nil {
+		status, err := h.Watcher.Status(mac)
+		if err != nil && err != ErrGatewayStatusUnknown {
+			APIError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			}.write(w)
+			return
+		}
+		if err == nil {
+			resp.Status = &status
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		APIError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}.write(w)
+	}
+}
+
+// GatewayStatsHandler is a http.Handler which returns the aggregated
+// stats of a single gateway. It expects the interval (minute, hour or day),
+// start and end (RFC3339) query parameters.
+type GatewayStatsHandler struct {
+	Storage *GatewayStatsStorage
+}
+
+func (h *GatewayStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		APIError{
+			Code:    http.StatusInternalServerError,
+			Message: "no id parameter",
+		}.write(w)
+		return
+	}
+
+	mac, err := parseEUI64(id, "gateway MAC")
+	if err != nil {
+		APIError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}.write(w)
+		return
+	}
+
+	query := r.URL.Query()
+	start, err := time.Parse(time.RFC3339, query.Get("start"))
+	if err != nil {
+		APIError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("invalid start parameter: %s", err),
+		}.write(w)
+		return
+	}
+	end, err := time.Parse(time.RFC3339, query.Get("end"))
+	if err != nil {
+		APIError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("invalid end parameter: %s", err),
+		}.write(w)
+		return
+	}
+
+	stats, err := h.Storage.Get(mac, GatewayStatsInterval(query.Get("interval")), start, end)
+	if err != nil {
+		if err == ErrInvalidGatewayStatsInterval || err == ErrInvalidGatewayStatsRange {
+			APIError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}.write(w)
+			return
+		}
+		APIError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}.write(w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(stats); err != nil {
+		APIError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}.write(w)
+	}
+}
+
+// gatewayConfigKeys contains the gateway config keys which can be updated
+// through the GatewayConfigHandler.
+var gatewayConfigKeys = map[string]bool{
+	txconfig.TXPowerMaxConfigKey:  true,
+	txconfig.AntennaGainConfigKey: true,
+	txconfig.TXPreambleConfigKey:  true,
+	profile.ConfigKey:             true,
+	multiplexer.BackendConfigKey:  true,
+}
+
+// reservedGatewayConfigKeys contains the gateway config keys which are
+// managed by the gateway backends and can't be updated through the
+// GatewayConfigHandler.
+var reservedGatewayConfigKeys = map[string]bool{
+	"udp_addr": true, // set by the semtech backend
+}
+
+// GatewayConfigPusher is implemented by the gateway backends which are able
+// to push the gateway config (channel plan) to the gateway.
+type GatewayConfigPusher interface {
+	PushConfig(gw loracontrol.Gateway) error
+}
+
+// GatewayConfigHandler is a http.Handler which handles the config of a
+// single gateway (the tx_power_max, antenna_gain and tx_preamble settings,
+// the channel_plan profile and the backend). A PUT request updates the given
+// keys, keys with an empty value are removed. Unknown and reserved keys are
+// rejected. When Pusher is set, the updated config is pushed to the gateway
+// (when supported by its backend).
+type GatewayConfigHandler struct {
+	Client *loracontrol.Client
+	Pusher GatewayConfigPusher
+
+	// Storage (optional) stores the updated config under its own key, so
+	// that the update is not overwritten by a gateway backend storing the
+	// gateway stats at the same time (see the gwconfig package).
+	Storage *gwconfig.Storage
+
+	// Backends contains the names of the gateway backends. When set, the
+	// backend config value must be one of these.
+	Backends []string
+}
+
+func (h *GatewayConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		APIError{
+			Code:    http.StatusInternalServerError,
+			Message: "no id parameter",
+		}.write(w)
+		return
+	}
+
+	mac, err := parseEUI64(id, "gateway MAC")
+	if err != nil {
+		APIError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}.write(w)
+		return
+	}
+
+	gw, err := h.Client.Gateway().Get(mac)
+	if err != nil {
+		if err == loracontrol.ErrObjectDoesNotExist {
+			APIError{
+				Code:    http.StatusNotFound,
+				Message: err.Error(),
+			}.write(w)
+			return
+		}
+		APIError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}.write(w)
+		return
+	}
+	if gw.Config.String == nil {
+		gw.Config.String = make(map[string]string)
+	}
+	if h.Storage != nil {
+		if err := h.Storage.Merge(&gw); err != nil {
+			APIError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			}.write(w)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		config := make(map[string]string)
+		dec := json.NewDecoder(r.Body)
+		if err := dec.Decode(&config); err != nil {
+			APIError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}.write(w)
+			return
+		}
+		if err := ValidateGatewayConfig(config, h.Backends); err != nil {
+			APIError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}.write(w)
+			return
+		}
+
+		for k, v := range config {
+			if v == "" {
+				delete(gw.Config.String, k)
+				continue
+			}
+			gw.Config.String[k] = v
+		}
+		if h.Storage != nil {
+			if err := h.Storage.Update(mac, config); err != nil {
+				APIError{
+					Code:    http.StatusInternalServerError,
+					Message: err.Error(),
+				}.write(w)
+				return
+			}
+		}
+		if err := h.Client.Gateway().Upsert(gw); err != nil {
+			APIError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			}.write(w)
+			return
+		}
+
+		// the gateway receives the config on its next connect when it
+		// can't be pushed now
+		if h.Pusher != nil {
+			if err := h.Pusher.PushConfig(gw); err != nil && err != profile.ErrPushNotSupported {
+				log.WithField("mac", mac).Warningf("could not push gateway config: %s", err)
+			}
+		}
+	default:
+		APIError{
+			Code:    http.StatusMethodNotAllowed,
+			Message: "method not allowed",
+		}.write(w)
+		return
+	}
+
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(gw); err != nil {
+	if err := enc.Encode(gw.Config.String); err != nil {
 		APIError{
 			Code:    http.StatusInternalServerError,
 			Message: err.Error(),
 		}.write(w)
 	}
 }
+
+// ValidateGatewayConfig validates the given gateway config update. It
+// returns an error on unknown or reserved keys and on values which can't be
+// parsed by the gateway backends. When backends is not empty, the backend
+// value must be one of the given backend names. Empty values (removing the
+// key) are not validated.
+func ValidateGatewayConfig(config map[string]string, backends []string) error {
+	values := make(map[string]string)
+	for k, v := range config {
+		if reservedGatewayConfigKeys[k] {
+			return fmt.Errorf("%s is a reserved config key", k)
+		}
+		if !gatewayConfigKeys[k] {
+			return fmt.Errorf("unknown config key: %s", k)
+		}
+		if v != "" {
+			values[k] = v
+		}
+	}
+
+	if _, err := txconfig.Parse(values); err != nil {
+		return err
+	}
+	if v, ok := values[profile.ConfigKey]; ok {
+		if _, err := profile.Parse(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := values[multiplexer.BackendConfigKey]; ok && len(backends) != 0 {
+		var known bool
+		for _, name := range backends {
+			if v == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown backend: %s (expected one of: %s)", v, strings.Join(backends, ", "))
+		}
+	}
+	return nil
+}
+
+// parseEUI64 parses the given hex encoded EUI64. The name is used in the
+// error message.
+func parseEUI64(id, name string) (lorawan.EUI64, error) {
+	var eui lorawan.EUI64
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return eui, err
+	}
+	if len(b) != len(eui) {
+		return eui, fmt.Errorf("a %s is exactly %d bytes", name, len(eui))
+	}
+	copy(eui[:], b)
+	return eui, nil
+}
@@ -1,13 +1,17 @@
 package loraserver
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/gateway/gwconfig"
 	"github.com/brocaar/lorawan"
 	"github.com/gorilla/mux"
 	. "github.com/smartystreets/goconvey/convey"
@@ -27,7 +31,7 @@ func TestGatewayObjectHandler(t *testing.T) {
 
 		Convey("Given a test server serving the handler", func() {
 			r := mux.NewRouter()
-			r.Handle("/{id}", &GatewayObjectHandler{c})
+			r.Handle("/{id}", &GatewayObjectHandler{Client: c})
 			s := httptest.NewServer(r)
 
 			Convey("Getting a non-existing gateway returns a 404", func() {
@@ -65,7 +69,291 @@ func TestGatewayObjectHandler(t *testing.T) {
 					So(dec.Decode(&out), ShouldBeNil)
 					So(out, ShouldResemble, gw)
 				})
+
+				Convey("Given a GatewayWatcher which has seen the gateway", func() {
+					watcher, err := NewGatewayWatcher(NewRedisPool(conf.RedisServer, conf.RedisPassword), time.Minute, "")
+					So(err, ShouldBeNil)
+					defer watcher.Close()
+					So(watcher.Seen(gw.MAC), ShouldBeNil)
+
+					r := mux.NewRouter()
+					r.Handle("/{id}", &GatewayObjectHandler{Client: c, Watcher: watcher})
+					s := httptest.NewServer(r)
+
+					Convey("Then GET returns the gateway including its status", func() {
+						resp, err := http.Get(s.URL + "/0102030405060708")
+						So(err, ShouldBeNil)
+						So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+						out := gatewayResponse{}
+						dec := json.NewDecoder(resp.Body)
+						So(dec.Decode(&out), ShouldBeNil)
+						So(out.Gateway, ShouldResemble, gw)
+						So(out.Status, ShouldNotBeNil)
+						So(out.Status.State, ShouldEqual, GatewayOnline)
+					})
+				})
+			})
+		})
+	})
+}
+
+func TestGatewayStatsHandler(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a GatewayStatsStorage connected to a clean Redis database", t, func() {
+		p := NewRedisPool(conf.RedisServer, conf.RedisPassword)
+		c := p.Get()
+		_, err := c.Do("FLUSHALL")
+		So(err, ShouldBeNil)
+		c.Close()
+		storage := NewGatewayStatsStorage(p)
+
+		Convey("Given a test server serving the handler", func() {
+			r := mux.NewRouter()
+			r.Handle("/{id}/stats", &GatewayStatsHandler{storage})
+			s := httptest.NewServer(r)
+
+			Convey("Getting stats with an invalid interval returns 400", func() {
+				resp, err := http.Get(s.URL + "/0102030405060708/stats?interval=week&start=2016-03-01T10:00:00Z&end=2016-03-01T12:00:00Z")
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("Getting stats without start returns 400", func() {
+				resp, err := http.Get(s.URL + "/0102030405060708/stats?interval=hour&end=2016-03-01T12:00:00Z")
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("Given stats for the gateway in the database", func() {
+				So(storage.Save(loracontrol.Gateway{
+					UpdatedAt:               time.Date(2016, 3, 1, 10, 30, 0, 0, time.UTC),
+					MAC:                     lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+					UpstreamPacketsReceived: 10,
+				}), ShouldBeNil)
+
+				Convey("Then GET returns the stats per hour", func() {
+					resp, err := http.Get(s.URL + "/0102030405060708/stats?interval=hour&start=2016-03-01T10:00:00Z&end=2016-03-01T12:00:00Z")
+					So(err, ShouldBeNil)
+					So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+					var out []GatewayStats
+					dec := json.NewDecoder(resp.Body)
+					So(dec.Decode(&out), ShouldBeNil)
+					So(out, ShouldHaveLength, 3)
+					So(out[0].UpstreamPacketsReceived, ShouldEqual, 10)
+					So(out[0].StatsCount, ShouldEqual, 1)
+					So(out[1].StatsCount, ShouldEqual, 0)
+				})
+			})
+		})
+	})
+}
+
+type testGatewayConfigPusher struct {
+	gateways []loracontrol.Gateway
+}
+
+func (p *testGatewayConfigPusher) PushConfig(gw loracontrol.Gateway) error {
+	p.gateways = append(p.gateways, gw)
+	return nil
+}
+
+func TestGatewayConfigHandler(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a Client connected to a clean Redis database", t, func() {
+		c, err := loracontrol.NewClient(
+			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
+			loracontrol.SetApplicationBackend(&loracontrol.DummyApplicationBackend{}),
+			loracontrol.SetGatewayBackend(&loracontrol.DummyGatewayBackend{}),
+		)
+		So(err, ShouldBeNil)
+		So(c.Storage().FlushAll(), ShouldBeNil)
+
+		Convey("Given a test server serving the handler", func() {
+			r := mux.NewRouter()
+			pusher := &testGatewayConfigPusher{}
+			configStorage := gwconfig.NewStorage(NewRedisPool(conf.RedisServer, conf.RedisPassword))
+			r.Handle("/{id}/config", &GatewayConfigHandler{
+				Client:   c,
+				Pusher:   pusher,
+				Storage:  configStorage,
+				Backends: []string{"semtech", "mqtt"},
+			})
+			s := httptest.NewServer(r)
+
+			Convey("Getting the config of a non-existing gateway returns a 404", func() {
+				resp, err := http.Get(s.URL + "/0102030405060708/config")
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+			})
+
+			Convey("Given a gateway with udp_addr config in the database", func() {
+				gw := loracontrol.Gateway{
+					MAC: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+					Config: loracontrol.PropertyBag{
+						String: map[string]string{
+							"udp_addr": "127.0.0.1:1234",
+						},
+					},
+				}
+				So(c.Gateway().Upsert(gw), ShouldBeNil)
+
+				Convey("When updating the TX power settings", func() {
+					req, err := http.NewRequest("PUT", s.URL+"/0102030405060708/config", strings.NewReader(`{"tx_power_max": "14", "antenna_gain": "3"}`))
+					So(err, ShouldBeNil)
+					resp, err := http.DefaultClient.Do(req)
+					So(err, ShouldBeNil)
+					So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+					Convey("Then the config has been merged", func() {
+						gw, err := c.Gateway().Get(gw.MAC)
+						So(err, ShouldBeNil)
+						So(gw.Config.String, ShouldResemble, map[string]string{
+							"udp_addr":     "127.0.0.1:1234",
+							"tx_power_max": "14",
+							"antenna_gain": "3",
+						})
+					})
+
+					Convey("Then the updated keys are stored under their own key", func() {
+						config, err := configStorage.Get(gw.MAC)
+						So(err, ShouldBeNil)
+						So(config, ShouldResemble, map[string]string{
+							"tx_power_max": "14",
+							"antenna_gain": "3",
+						})
+					})
+
+					Convey("When a gateway backend stores a stale gateway object", func() {
+						stale := loracontrol.Gateway{
+							MAC: gw.MAC,
+							Config: loracontrol.PropertyBag{
+								String: map[string]string{
+									"udp_addr": "127.0.0.1:1234",
+								},
+							},
+						}
+						So(configStorage.Merge(&stale), ShouldBeNil)
+						So(c.Gateway().Upsert(stale), ShouldBeNil)
+
+						Convey("Then the updated config is kept", func() {
+							gw, err := c.Gateway().Get(gw.MAC)
+							So(err, ShouldBeNil)
+							So(gw.Config.String, ShouldResemble, map[string]string{
+								"udp_addr":     "127.0.0.1:1234",
+								"tx_power_max": "14",
+								"antenna_gain": "3",
+							})
+						})
+					})
+
+					Convey("When removing the antenna_gain", func() {
+						req, err := http.NewRequest("PUT", s.URL+"/0102030405060708/config", strings.NewReader(`{"antenna_gain": ""}`))
+						So(err, ShouldBeNil)
+						resp, err := http.DefaultClient.Do(req)
+						So(err, ShouldBeNil)
+						So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+						Convey("Then GET returns the config without antenna_gain", func() {
+							resp, err := http.Get(s.URL + "/0102030405060708/config")
+							So(err, ShouldBeNil)
+							So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+							var out map[string]string
+							So(json.NewDecoder(resp.Body).Decode(&out), ShouldBeNil)
+							So(out, ShouldResemble, map[string]string{
+								"udp_addr":     "127.0.0.1:1234",
+								"tx_power_max": "14",
+							})
+						})
+					})
+				})
+
+				Convey("When updating the channel plan", func() {
+					plan := `{"channels":[{"frequency":868.1},{"frequency":868.3},{"frequency":868.5}]}`
+					b, err := json.Marshal(map[string]string{"channel_plan": plan})
+					So(err, ShouldBeNil)
+					req, err := http.NewRequest("PUT", s.URL+"/0102030405060708/config", bytes.NewReader(b))
+					So(err, ShouldBeNil)
+					resp, err := http.DefaultClient.Do(req)
+					So(err, ShouldBeNil)
+					So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+					Convey("Then the updated config is pushed to the gateway", func() {
+						So(pusher.gateways, ShouldHaveLength, 1)
+						So(pusher.gateways[0].MAC, ShouldEqual, gw.MAC)
+						So(pusher.gateways[0].Config.String["channel_plan"], ShouldEqual, plan)
+					})
+				})
+
+				Convey("Then updating with an invalid channel_plan returns a 400", func() {
+					req, err := http.NewRequest("PUT", s.URL+"/0102030405060708/config", strings.NewReader(`{"channel_plan": "{\"channels\":[]}"}`))
+					So(err, ShouldBeNil)
+					resp, err := http.DefaultClient.Do(req)
+					So(err, ShouldBeNil)
+					So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				})
+
+				Convey("Then updating with an invalid tx_power_max returns a 400", func() {
+					req, err := http.NewRequest("PUT", s.URL+"/0102030405060708/config", strings.NewReader(`{"tx_power_max": "high"}`))
+					So(err, ShouldBeNil)
+					resp, err := http.DefaultClient.Do(req)
+					So(err, ShouldBeNil)
+					So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				})
+
+				Convey("Then updating with an unknown backend returns a 400", func() {
+					req, err := http.NewRequest("PUT", s.URL+"/0102030405060708/config", strings.NewReader(`{"backend": "basicstation"}`))
+					So(err, ShouldBeNil)
+					resp, err := http.DefaultClient.Do(req)
+					So(err, ShouldBeNil)
+					So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				})
+
+				Convey("Then updating the udp_addr returns a 400", func() {
+					req, err := http.NewRequest("PUT", s.URL+"/0102030405060708/config", strings.NewReader(`{"udp_addr": "127.0.0.1:4321"}`))
+					So(err, ShouldBeNil)
+					resp, err := http.DefaultClient.Do(req)
+					So(err, ShouldBeNil)
+					So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				})
 			})
 		})
 	})
 }
+
+func TestValidateGatewayConfig(t *testing.T) {
+	Convey("Given a set of gateway config updates", t, func() {
+		testTable := []struct {
+			Config   map[string]string
+			Backends []string
+			ExpError bool
+		}{
+			{map[string]string{"tx_power_max": "14", "antenna_gain": "-2", "tx_preamble": "8"}, nil, false},
+			{map[string]string{"tx_power_max": "", "backend": "mqtt"}, nil, false},
+			{map[string]string{"backend": "mqtt"}, []string{"semtech", "mqtt"}, false},
+			{map[string]string{"backend": "mqtt"}, []string{"semtech"}, true},
+			{map[string]string{"backend": ""}, []string{"semtech"}, false},
+			{map[string]string{"tx_power_max": "high"}, nil, true},
+			{map[string]string{"tx_preamble": "-1"}, nil, true},
+			{map[string]string{"tx_preamble": "70000"}, nil, true},
+			{map[string]string{"udp_addr": "127.0.0.1:1234"}, nil, true},
+			{map[string]string{"udp_addr": ""}, nil, true},
+			{map[string]string{"foo": "bar"}, nil, true},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Then validating %v with backends %v returns an error: %t [%d]", test.Config, test.Backends, test.ExpError, i), func() {
+				err := ValidateGatewayConfig(test.Config, test.Backends)
+				if test.ExpError {
+					So(err, ShouldNotBeNil)
+				} else {
+					So(err, ShouldBeNil)
+				}
+			})
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/brocaar/loracontrol"
@@ -180,3 +181,67 @@ func (h *NodeObjectHandler) serveDELETE(w http.ResponseWriter, r *http.Request,
 	log.WithField("dev_eui", devEUI).Info("node deleted")
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// NodeDeliveryHandler is a http.Handler which returns the status of the
+// delivery of a single frame (identified by the DevEUI and FCnt) to the
+// application.
+type NodeDeliveryHandler struct {
+	Storage *DeliveryStorage
+}
+
+func (h *NodeDeliveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		APIError{
+			Code:    http.StatusInternalServerError,
+			Message: "no id parameter",
+		}.write(w)
+		return
+	}
+
+	devEUI, err := parseEUI64(id, "DevEUI")
+	if err != nil {
+		APIError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}.write(w)
+		return
+	}
+
+	fCnt, err := strconv.ParseUint(vars["fcnt"], 10, 32)
+	if err != nil {
+		APIError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("invalid fcnt parameter: %s", err),
+		}.write(w)
+		return
+	}
+
+	d, err := h.Storage.Get(devEUI, uint32(fCnt))
+	if err != nil {
+		if err == ErrFrameDeliveryDoesNotExist {
+			APIError{
+				Code:    http.StatusNotFound,
+				Message: err.Error(),
+			}.write(w)
+			return
+		}
+		APIError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}.write(w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(d); err != nil {
+		APIError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}.write(w)
+	}
+}
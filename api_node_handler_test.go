@@ -6,8 +6,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
 	"github.com/gorilla/mux"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -184,3 +186,57 @@ func TestNodeObjectHandler(t *testing.T) {
 		})
 	})
 }
+
+func TestNodeDeliveryHandler(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a DeliveryStorage connected to a clean Redis database", t, func() {
+		p := NewRedisPool(conf.RedisServer, conf.RedisPassword)
+		c := p.Get()
+		_, err := c.Do("FLUSHALL")
+		So(err, ShouldBeNil)
+		c.Close()
+		storage := NewDeliveryStorage(p)
+
+		Convey("Given a test server serving the handler", func() {
+			r := mux.NewRouter()
+			r.Handle("/{id}/delivery/{fcnt}", &NodeDeliveryHandler{storage})
+			s := httptest.NewServer(r)
+
+			Convey("Getting the delivery of an unknown frame returns a 404", func() {
+				resp, err := http.Get(s.URL + "/0102030405060708/delivery/10")
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+			})
+
+			Convey("Getting the delivery with an invalid fcnt returns a 400", func() {
+				resp, err := http.Get(s.URL + "/0102030405060708/delivery/abc")
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("Given a delivery status in the database", func() {
+				d := FrameDelivery{
+					DevEUI:    lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+					FCnt:      10,
+					Status:    DeliveryFailed,
+					Attempts:  3,
+					Error:     "BOOM!",
+					UpdatedAt: time.Date(2016, 3, 1, 10, 0, 0, 0, time.UTC),
+				}
+				So(storage.Save(d), ShouldBeNil)
+
+				Convey("Then GET returns the delivery status", func() {
+					resp, err := http.Get(s.URL + "/0102030405060708/delivery/10")
+					So(err, ShouldBeNil)
+					So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+					var out FrameDelivery
+					dec := json.NewDecoder(resp.Body)
+					So(dec.Decode(&out), ShouldBeNil)
+					So(out, ShouldResemble, d)
+				})
+			})
+		})
+	})
+}
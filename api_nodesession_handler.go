@@ -9,13 +9,17 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/session"
 	"github.com/brocaar/lorawan"
 	"github.com/gorilla/mux"
 )
 
 // NodeSessionCreateHandler is a http.Handler which creates NodeSession objects.
+// When Sessions is set, the node-session is added to the index used by the
+// application backends.
 type NodeSessionCreateHandler struct {
-	Client *loracontrol.Client
+	Client   *loracontrol.Client
+	Sessions *session.Index
 }
 
 func (h *NodeSessionCreateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -43,14 +47,25 @@ func (h *NodeSessionCreateHandler) ServeHTTP(w http.ResponseWriter, r *http.Requ
 		}.write(w)
 		return
 	}
+	if h.Sessions != nil {
+		if err := h.Sessions.Save(nodeSession); err != nil {
+			APIError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			}.write(w)
+			return
+		}
+	}
 	log.WithField("dev_addr", nodeSession.DevAddr).Info("node-session created")
 	w.WriteHeader(http.StatusCreated)
 }
 
 // NodeSessionObjectHandler is a http.Handler which handles GET, PUT and
-// DELETE requests on a single object.
+// DELETE requests on a single object. When Sessions is set, updated
+// node-sessions are added to the index used by the application backends.
 type NodeSessionObjectHandler struct {
-	Client *loracontrol.Client
+	Client   *loracontrol.Client
+	Sessions *session.Index
 }
 
 func (h *NodeSessionObjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -143,6 +158,11 @@ func (h *NodeSessionObjectHandler) servePUT(w http.ResponseWriter, r *http.Reque
 		}
 		return http.StatusInternalServerError, err
 	}
+	if h.Sessions != nil {
+		if err := h.Sessions.Save(nodeSession); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
 
 	log.WithField("dev_addr", devAddr).Info("node-session updated")
 	return http.StatusNoContent, nil
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/session"
 	"github.com/gorilla/mux"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -25,7 +26,8 @@ func TestNodeSessionCreateHandler(t *testing.T) {
 		So(c.Storage().FlushAll(), ShouldBeNil)
 
 		Convey("Given a test http server serving the handler and test json", func() {
-			s := httptest.NewServer(&NodeSessionCreateHandler{c})
+			sessions := session.NewIndex(NewRedisPool(conf.RedisServer, conf.RedisPassword))
+			s := httptest.NewServer(&NodeSessionCreateHandler{Client: c, Sessions: sessions})
 			nodeSession := loracontrol.NodeSession{
 				DevAddr: [4]byte{1, 2, 3, 4},
 				DevEUI:  [8]byte{8, 7, 6, 5, 4, 3, 2, 1},
@@ -53,6 +55,10 @@ func TestNodeSessionCreateHandler(t *testing.T) {
 					So(err, ShouldBeNil)
 					So(out, ShouldResemble, nodeSession)
 
+					out, err = sessions.Get(c, nodeSession.DevEUI)
+					So(err, ShouldBeNil)
+					So(out, ShouldResemble, nodeSession)
+
 					Convey("Then creating the same node-session again fails", func() {
 						resp, err := http.Post(s.URL, "application/json", bytes.NewReader(jsonBytes))
 						So(err, ShouldBeNil)
@@ -78,7 +84,7 @@ func TestNodeSessionObjectHandler(t *testing.T) {
 
 		Convey("Given a test server serving the handler", func() {
 			r := mux.NewRouter()
-			r.Handle("/{id}", &NodeSessionObjectHandler{c})
+			r.Handle("/{id}", &NodeSessionObjectHandler{Client: c})
 			s := httptest.NewServer(r)
 
 			Convey("Getting a non-existing node-session returns a 404", func() {
@@ -0,0 +1,470 @@
+package loraserver
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/delivery"
+	"github.com/brocaar/lorawan"
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// deliveryQueueLength contains the number of frames waiting to be
+	// delivered to the applications.
+	deliveryQueueLength = expvar.NewInt("app_delivery_queue_length")
+
+	// deliveryRetryCount contains the number of delivery attempts which
+	// were retried.
+	deliveryRetryCount = expvar.NewInt("app_delivery_retries")
+
+	// deliveryFailedCount contains the number of frames which could not be
+	// delivered to the application.
+	deliveryFailedCount = expvar.NewInt("app_delivery_failed")
+
+	// deliveryDroppedCount contains the number of frames which were dropped
+	// because the delivery queue of the application was full.
+	deliveryDroppedCount = expvar.NewInt("app_delivery_dropped")
+)
+
+// maxDeliveryRetryInterval defines the max. interval between two delivery
+// attempts.
+const maxDeliveryRetryInterval = time.Minute
+
+// deliveryStatusTTL defines how long the delivery status of a frame is kept.
+const deliveryStatusTTL = time.Hour * 24
+
+// ErrFrameDeliveryDoesNotExist is returned when there is no delivery status
+// for the requested frame.
+var ErrFrameDeliveryDoesNotExist = errors.New("frame delivery does not exist")
+
+// DeliveryStatus defines the status of the delivery of a frame to the
+// application.
+type DeliveryStatus string
+
+// Available delivery statuses.
+const (
+	DeliveryPending   DeliveryStatus = "pending"   // the frame is queued or being retried
+	DeliveryDelivered DeliveryStatus = "delivered" // the frame was accepted by the application backend
+	DeliveryQueued    DeliveryStatus = "queued"    // the frame was queued by the application backend (e.g. for a retry or batch), until it reports the final status
+	DeliveryFailed    DeliveryStatus = "failed"    // all delivery attempts failed
+)
+
+// FrameDelivery contains the delivery status of a single (uplink) frame.
+type FrameDelivery struct {
+	DevEUI    lorawan.EUI64  `json:"devEUI"`
+	FCnt      uint32         `json:"fCnt"`
+	Status    DeliveryStatus `json:"status"`
+	Attempts  int            `json:"attempts"`
+	Error     string         `json:"error,omitempty"` // error of the last attempt
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+// DeliveryStorage stores the delivery status of the frames in Redis.
+type DeliveryStorage struct {
+	pool *redis.Pool
+}
+
+// NewDeliveryStorage creates a new DeliveryStorage.
+func NewDeliveryStorage(p *redis.Pool) *DeliveryStorage {
+	return &DeliveryStorage{pool: p}
+}
+
+// Save saves the given delivery status.
+func (s *DeliveryStorage) Save(d FrameDelivery) error {
+	c := s.pool.Get()
+	defer c.Close()
+
+	key := frameDeliveryKey(d.DevEUI, d.FCnt)
+	if err := c.Send("MULTI"); err != nil {
+		return err
+	}
+	c.Send("HMSET", key,
+		"status", string(d.Status),
+		"attempts", d.Attempts,
+		"error", d.Error,
+		"updated_at", d.UpdatedAt.UnixNano(),
+	)
+	c.Send("PEXPIRE", key, int64(deliveryStatusTTL/time.Millisecond))
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// Get returns the delivery status of the given frame.
+func (s *DeliveryStorage) Get(devEUI lorawan.EUI64, fCnt uint32) (FrameDelivery, error) {
+	d := FrameDelivery{DevEUI: devEUI, FCnt: fCnt}
+
+	c := s.pool.Get()
+	defer c.Close()
+
+	values, err := redis.StringMap(c.Do("HGETALL", frameDeliveryKey(devEUI, fCnt)))
+	if err != nil {
+		return d, err
+	}
+	if len(values) == 0 {
+		return d, ErrFrameDeliveryDoesNotExist
+	}
+
+	d.Status = DeliveryStatus(values["status"])
+	d.Error = values["error"]
+	if d.Attempts, err = strconv.Atoi(values["attempts"]); err != nil {
+		return d, fmt.Errorf("could not parse frame delivery field attempts: %s", err)
+	}
+	updatedAt, err := strconv.ParseInt(values["updated_at"], 10, 64)
+	if err != nil {
+		return d, fmt.Errorf("could not parse frame delivery field updated_at: %s", err)
+	}
+	d.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	return d, nil
+}
+
+func frameDeliveryKey(devEUI lorawan.EUI64, fCnt uint32) string {
+	return fmt.Sprintf("frame_delivery_%s_%d", devEUI, fCnt)
+}
+
+// DeliveryConfig contains the configuration of the (asynchronous) delivery
+// of the received frames to the applications. The frames waiting to be
+// delivered are kept in memory only: the frames which are still queued when
+// loraserver is stopped without a graceful shutdown are lost (their delivery
+// status stays pending).
+type DeliveryConfig struct {
+	Workers       int           // number of frames delivered concurrently (min. 1)
+	QueueSize     int           // number of frames (per application) waiting to be delivered (min. 1)
+	Attempts      int           // max. number of delivery attempts (min. 1)
+	RetryInterval time.Duration // interval before the first retry, doubled after every retry
+
+	// Storage (optional) stores the delivery status of every frame.
+	Storage *DeliveryStorage
+
+	// Sender (optional) sends the frames instead of the application
+	// backend of the client. The final status of the frames it queues
+	// (delivery.ErrQueued) is reported by its callback, the status of
+	// these frames stays queued otherwise.
+	Sender delivery.Sender
+}
+
+// frameDelivery is a frame waiting to be delivered to the application.
+type frameDelivery struct {
+	appEUI  lorawan.EUI64
+	devEUI  lorawan.EUI64
+	fCnt    uint32
+	packets loracontrol.RXPackets
+
+	attempts int
+	interval time.Duration // interval before the next retry
+}
+
+// appQueue contains the frames waiting to be delivered to a single
+// application. The frames are delivered in order, the first frame is being
+// delivered or waiting for a retry while the queue is busy.
+type appQueue struct {
+	appEUI lorawan.EUI64
+	frames []*frameDelivery
+	busy   bool
+}
+
+// appDeliverer delivers the accepted frames to the applications using a
+// bounded pool of workers. Every application has its own queue, so that an
+// application which is failing (and is waiting for a retry) does not delay
+// the delivery to the other applications. The retries are scheduled with a
+// timer, the workers never wait for them. When the queue of an application
+// is full, new frames for this application are marked as failed.
+type appDeliverer struct {
+	client *loracontrol.Client
+	conf   DeliveryConfig
+
+	mu     sync.Mutex // protects the fields below
+	cond   *sync.Cond // signals a queue becoming ready or closing
+	apps   map[lorawan.EUI64]*appQueue
+	ready  []*appQueue // queues of which the first frame can be delivered
+	length int         // total number of queued frames
+	closed bool
+
+	pending sync.WaitGroup // frames which are not delivered or failed yet
+	wg      sync.WaitGroup // workers
+}
+
+// newAppDeliverer creates a new appDeliverer and starts its workers.
+func newAppDeliverer(c *loracontrol.Client, conf DeliveryConfig) *appDeliverer {
+	if conf.Workers < 1 {
+		conf.Workers = 1
+	}
+	if conf.QueueSize < 1 {
+		conf.QueueSize = 1
+	}
+	if conf.Attempts < 1 {
+		conf.Attempts = 1
+	}
+
+	d := &appDeliverer{
+		client: c,
+		conf:   conf,
+		apps:   make(map[lorawan.EUI64]*appQueue),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	d.wg.Add(conf.Workers)
+	for i := 0; i < conf.Workers; i++ {
+		go func() {
+			defer d.wg.Done()
+			d.work()
+		}()
+	}
+	return d
+}
+
+// enqueue queues the given frame for delivery. It never blocks: when the
+// queue of the application is full, the frame is marked as failed.
+func (d *appDeliverer) enqueue(f frameDelivery) {
+	d.saveStatus(FrameDelivery{
+		DevEUI: f.devEUI,
+		FCnt:   f.fCnt,
+		Status: DeliveryPending,
+	})
+
+	d.mu.Lock()
+	q, ok := d.apps[f.appEUI]
+	if !ok {
+		q = &appQueue{appEUI: f.appEUI}
+		d.apps[f.appEUI] = q
+	}
+	if len(q.frames) >= d.conf.QueueSize {
+		d.mu.Unlock()
+		deliveryDroppedCount.Add(1)
+		log.WithFields(log.Fields{
+			"dev_eui": f.devEUI,
+			"app_eui": f.appEUI,
+			"fcnt":    f.fCnt,
+		}).Error("application delivery queue is full, dropping frame")
+		d.saveStatus(FrameDelivery{
+			DevEUI: f.devEUI,
+			FCnt:   f.fCnt,
+			Status: DeliveryFailed,
+			Error:  "application delivery queue is full",
+		})
+		return
+	}
+
+	f.interval = d.conf.RetryInterval
+	q.frames = append(q.frames, &f)
+	d.length++
+	d.pending.Add(1)
+	if !q.busy {
+		q.busy = true
+		d.ready = append(d.ready, q)
+		d.cond.Signal()
+	}
+	deliveryQueueLength.Set(int64(d.length))
+	d.mu.Unlock()
+}
+
+// close stops the workers after all queued frames have been delivered (or
+// all attempts failed).
+func (d *appDeliverer) close() {
+	d.pending.Wait()
+
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// work delivers the first frame of the ready queues until the deliverer is
+// closed.
+func (d *appDeliverer) work() {
+	for {
+		d.mu.Lock()
+		for len(d.ready) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if len(d.ready) == 0 {
+			d.mu.Unlock()
+			return
+		}
+		q := d.ready[0]
+		d.ready = d.ready[1:]
+		f := q.frames[0]
+		d.mu.Unlock()
+
+		if !d.deliver(f) {
+			d.scheduleRetry(q, f)
+			continue
+		}
+
+		d.mu.Lock()
+		q.frames = q.frames[1:]
+		d.length--
+		if len(q.frames) > 0 {
+			d.ready = append(d.ready, q)
+			d.cond.Signal()
+		} else {
+			delete(d.apps, q.appEUI)
+		}
+		deliveryQueueLength.Set(int64(d.length))
+		d.mu.Unlock()
+		d.pending.Done()
+	}
+}
+
+// scheduleRetry makes the given queue ready again after the retry interval
+// of its first frame.
+func (d *appDeliverer) scheduleRetry(q *appQueue, f *frameDelivery) {
+	time.AfterFunc(f.interval, func() {
+		d.mu.Lock()
+		d.ready = append(d.ready, q)
+		d.cond.Signal()
+		d.mu.Unlock()
+	})
+	if f.interval *= 2; f.interval > maxDeliveryRetryInterval {
+		f.interval = maxDeliveryRetryInterval
+	}
+}
+
+// deliver makes a single attempt to send the given frame to the application.
+// It returns false when the frame must be retried.
+func (d *appDeliverer) deliver(f *frameDelivery) bool {
+	f.attempts++
+	status := FrameDelivery{
+		DevEUI:   f.devEUI,
+		FCnt:     f.fCnt,
+		Attempts: f.attempts,
+	}
+
+	var err error
+	attempts := f.attempts
+	result := &queuedResult{complete: func(err error) {
+		d.complete(f.appEUI, f.devEUI, f.fCnt, attempts, err)
+	}}
+	if d.conf.Sender != nil {
+		err = d.conf.Sender.SendWithCallback(f.appEUI, f.packets, result.report)
+	} else {
+		err = d.client.Application().Send(f.appEUI, f.packets)
+	}
+	switch err {
+	case nil:
+		status.Status = DeliveryDelivered
+		d.saveStatus(status)
+		return true
+	case delivery.ErrQueued:
+		// the application backend delivers (and retries) the frame
+		result.queue(func() {
+			status.Status = DeliveryQueued
+			d.saveStatus(status)
+		})
+		return true
+	}
+
+	final := f.attempts >= d.conf.Attempts
+	// retrying would deliver the frame again to the destinations which
+	// already accepted it
+	if _, ok := err.(*delivery.PartialError); ok {
+		final = true
+	}
+	// an unknown application will not appear by retrying
+	if err == loracontrol.ErrObjectDoesNotExist {
+		err = errors.New("AppEUI does not exist")
+		final = true
+	}
+	status.Error = err.Error()
+
+	ctx := log.WithFields(log.Fields{
+		"dev_eui": f.devEUI,
+		"app_eui": f.appEUI,
+		"fcnt":    f.fCnt,
+		"attempt": f.attempts,
+	})
+	if final {
+		deliveryFailedCount.Add(1)
+		ctx.Errorf("could not deliver frame to application: %s", err)
+		status.Status = DeliveryFailed
+		d.saveStatus(status)
+		return true
+	}
+
+	ctx.Warningf("could not deliver frame to application, retrying: %s", err)
+	deliveryRetryCount.Add(1)
+	status.Status = DeliveryPending
+	d.saveStatus(status)
+	return false
+}
+
+// queuedResult makes sure that the final status of a frame queued by the
+// application backend is stored after its queued status, as the backend can
+// report it before Send has returned.
+type queuedResult struct {
+	complete func(err error) // stores the final status
+
+	mu       sync.Mutex
+	queued   bool // the queued status has been stored
+	reported bool // the final result has been reported before
+	err      error
+}
+
+// queue stores the queued status using save, or the final status when it
+// has already been reported.
+func (r *queuedResult) queue(save func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reported {
+		r.complete(r.err)
+		return
+	}
+	save()
+	r.queued = true
+}
+
+// report stores the final status when the queued status has been stored,
+// or keeps it for queue otherwise.
+func (r *queuedResult) report(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.queued {
+		r.reported = true
+		r.err = err
+		return
+	}
+	r.complete(err)
+}
+
+// complete stores the final status of a frame which was queued by the
+// application backend.
+func (d *appDeliverer) complete(appEUI, devEUI lorawan.EUI64, fCnt uint32, attempts int, err error) {
+	status := FrameDelivery{
+		DevEUI:   devEUI,
+		FCnt:     fCnt,
+		Status:   DeliveryDelivered,
+		Attempts: attempts,
+	}
+	if err != nil {
+		deliveryFailedCount.Add(1)
+		log.WithFields(log.Fields{
+			"dev_eui": devEUI,
+			"app_eui": appEUI,
+			"fcnt":    fCnt,
+		}).Errorf("application backend could not deliver queued frame: %s", err)
+		status.Status = DeliveryFailed
+		status.Error = err.Error()
+	}
+	d.saveStatus(status)
+}
+
+// saveStatus saves the given delivery status when a storage has been
+// configured. Errors are logged.
+func (d *appDeliverer) saveStatus(status FrameDelivery) {
+	if d.conf.Storage == nil {
+		return
+	}
+	status.UpdatedAt = time.Now().UTC()
+	if err := d.conf.Storage.Save(status); err != nil {
+		log.WithFields(log.Fields{
+			"dev_eui": status.DevEUI,
+			"fcnt":    status.FCnt,
+		}).Errorf("could not save frame delivery status: %s", err)
+	}
+}
@@ -0,0 +1,267 @@
+package loraserver
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/delivery"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testDeliveryBackend is an application backend returning the configured
+// error per application. The applications of the frames which were
+// delivered are sent to the delivered channel, the callbacks of the queued
+// frames to the callbacks channel.
+type testDeliveryBackend struct {
+	testApplicationBackend
+
+	sync.Mutex
+	errs      map[lorawan.EUI64]error
+	delivered chan lorawan.EUI64
+	callbacks chan delivery.Callback
+}
+
+func (b *testDeliveryBackend) Send(appEUI lorawan.EUI64, rxPackets loracontrol.RXPackets) error {
+	b.Lock()
+	err := b.errs[appEUI]
+	b.Unlock()
+	if err == nil {
+		b.delivered <- appEUI
+	}
+	return err
+}
+
+func (b *testDeliveryBackend) SendWithCallback(appEUI lorawan.EUI64, rxPackets loracontrol.RXPackets, cb delivery.Callback) error {
+	err := b.Send(appEUI, rxPackets)
+	if err == delivery.ErrQueued {
+		b.callbacks <- cb
+	}
+	return err
+}
+
+// testReportingSender reports the delivery of the frames before returning
+// delivery.ErrQueued.
+type testReportingSender struct{}
+
+func (s testReportingSender) SendWithCallback(appEUI lorawan.EUI64, rxPackets loracontrol.RXPackets, cb delivery.Callback) error {
+	cb(nil)
+	return delivery.ErrQueued
+}
+
+func TestDeliveryStorage(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a DeliveryStorage connected to a clean Redis database", t, func() {
+		p := NewRedisPool(conf.RedisServer, conf.RedisPassword)
+		c := p.Get()
+		_, err := c.Do("FLUSHALL")
+		So(err, ShouldBeNil)
+		c.Close()
+
+		s := NewDeliveryStorage(p)
+		devEUI := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+		Convey("Then Get returns an error for an unknown frame", func() {
+			_, err := s.Get(devEUI, 10)
+			So(err, ShouldEqual, ErrFrameDeliveryDoesNotExist)
+		})
+
+		Convey("When saving a pending delivery", func() {
+			d := FrameDelivery{
+				DevEUI:    devEUI,
+				FCnt:      10,
+				Status:    DeliveryPending,
+				Attempts:  1,
+				Error:     "BOOM!",
+				UpdatedAt: time.Date(2016, 3, 1, 10, 0, 0, 0, time.UTC),
+			}
+			So(s.Save(d), ShouldBeNil)
+
+			Convey("Then Get returns the delivery", func() {
+				out, err := s.Get(devEUI, 10)
+				So(err, ShouldBeNil)
+				So(out, ShouldResemble, d)
+			})
+
+			Convey("When updating the delivery as delivered", func() {
+				d.Status = DeliveryDelivered
+				d.Attempts = 2
+				d.Error = ""
+				So(s.Save(d), ShouldBeNil)
+
+				Convey("Then Get returns the updated delivery", func() {
+					out, err := s.Get(devEUI, 10)
+					So(err, ShouldBeNil)
+					So(out, ShouldResemble, d)
+				})
+			})
+		})
+	})
+}
+
+func TestAppDeliverer(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a Client with a test application backend and a clean Redis database", t, func() {
+		appBackend := &testDeliveryBackend{
+			errs:      make(map[lorawan.EUI64]error),
+			delivered: make(chan lorawan.EUI64, 10),
+			callbacks: make(chan delivery.Callback, 10),
+		}
+		client, err := loracontrol.NewClient(
+			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
+			loracontrol.SetApplicationBackend(appBackend),
+			loracontrol.SetGatewayBackend(&loracontrol.DummyGatewayBackend{}),
+		)
+		So(err, ShouldBeNil)
+		So(client.Storage().FlushAll(), ShouldBeNil)
+
+		storage := NewDeliveryStorage(NewRedisPool(conf.RedisServer, conf.RedisPassword))
+		failingApp := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+		app := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+		failingDev := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 1}
+		dev := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 2}
+
+		Convey("Given a deliverer with a single worker", func() {
+			deliverer := newAppDeliverer(client, DeliveryConfig{
+				Workers:       1,
+				QueueSize:     2,
+				Attempts:      3,
+				RetryInterval: 100 * time.Millisecond,
+				Storage:       storage,
+			})
+
+			Convey("When the backend of one application keeps failing", func() {
+				appBackend.errs[failingApp] = errors.New("BOOM!")
+				deliverer.enqueue(frameDelivery{appEUI: failingApp, devEUI: failingDev, fCnt: 1})
+				deliverer.enqueue(frameDelivery{appEUI: failingApp, devEUI: failingDev, fCnt: 2})
+				deliverer.enqueue(frameDelivery{appEUI: failingApp, devEUI: failingDev, fCnt: 3})
+				for fCnt := uint32(1); fCnt <= 2; fCnt++ {
+					deliverer.enqueue(frameDelivery{appEUI: app, devEUI: dev, fCnt: fCnt})
+				}
+
+				Convey("Then the frames of the other application are delivered without waiting for the retries", func() {
+					for i := 0; i < 2; i++ {
+						select {
+						case appEUI := <-appBackend.delivered:
+							So(appEUI, ShouldEqual, app)
+						case <-time.After(50 * time.Millisecond):
+							t.Fatal("frame of the other application was not delivered")
+						}
+					}
+					deliverer.close()
+
+					for fCnt := uint32(1); fCnt <= 2; fCnt++ {
+						d, err := storage.Get(dev, fCnt)
+						So(err, ShouldBeNil)
+						So(d.Status, ShouldEqual, DeliveryDelivered)
+						So(d.Attempts, ShouldEqual, 1)
+					}
+
+					Convey("Then the frames of the failing application are marked as failed after all attempts", func() {
+						for fCnt := uint32(1); fCnt <= 2; fCnt++ {
+							d, err := storage.Get(failingDev, fCnt)
+							So(err, ShouldBeNil)
+							So(d.Status, ShouldEqual, DeliveryFailed)
+							So(d.Attempts, ShouldEqual, 3)
+							So(d.Error, ShouldEqual, "BOOM!")
+						}
+					})
+
+					Convey("Then the frame exceeding the queue size of the failing application is marked as failed", func() {
+						d, err := storage.Get(failingDev, 3)
+						So(err, ShouldBeNil)
+						So(d.Status, ShouldEqual, DeliveryFailed)
+						So(d.Attempts, ShouldEqual, 0)
+						So(d.Error, ShouldEqual, "application delivery queue is full")
+					})
+				})
+			})
+
+			Convey("When the backend queues the frame", func() {
+				appBackend.errs[app] = delivery.ErrQueued
+				deliverer.enqueue(frameDelivery{appEUI: app, devEUI: dev, fCnt: 1})
+				deliverer.close()
+
+				Convey("Then the frame is marked as queued without a retry", func() {
+					d, err := storage.Get(dev, 1)
+					So(err, ShouldBeNil)
+					So(d.Status, ShouldEqual, DeliveryQueued)
+					So(d.Attempts, ShouldEqual, 1)
+				})
+			})
+
+			Convey("When the backend delivers the frame to a part of the destinations", func() {
+				appBackend.errs[app] = &delivery.PartialError{Err: errors.New("BOOM!")}
+				deliverer.enqueue(frameDelivery{appEUI: app, devEUI: dev, fCnt: 1})
+				deliverer.close()
+
+				Convey("Then the frame is marked as failed without a retry", func() {
+					d, err := storage.Get(dev, 1)
+					So(err, ShouldBeNil)
+					So(d.Status, ShouldEqual, DeliveryFailed)
+					So(d.Attempts, ShouldEqual, 1)
+				})
+			})
+		})
+
+		Convey("Given a deliverer using the backend as sender", func() {
+			deliverer := newAppDeliverer(client, DeliveryConfig{
+				Attempts: 3,
+				Storage:  storage,
+				Sender:   appBackend,
+			})
+
+			Convey("When the backend queues the frame", func() {
+				appBackend.errs[app] = delivery.ErrQueued
+				deliverer.enqueue(frameDelivery{appEUI: app, devEUI: dev, fCnt: 1})
+				deliverer.close()
+				cb := <-appBackend.callbacks
+
+				Convey("Then the frame is marked as queued", func() {
+					d, err := storage.Get(dev, 1)
+					So(err, ShouldBeNil)
+					So(d.Status, ShouldEqual, DeliveryQueued)
+				})
+
+				Convey("Then the frame is marked as delivered when the backend reports the delivery", func() {
+					cb(nil)
+					d, err := storage.Get(dev, 1)
+					So(err, ShouldBeNil)
+					So(d.Status, ShouldEqual, DeliveryDelivered)
+					So(d.Attempts, ShouldEqual, 1)
+				})
+
+				Convey("Then the frame is marked as failed when the backend reports an error", func() {
+					cb(errors.New("BOOM!"))
+					d, err := storage.Get(dev, 1)
+					So(err, ShouldBeNil)
+					So(d.Status, ShouldEqual, DeliveryFailed)
+					So(d.Error, ShouldEqual, "BOOM!")
+				})
+			})
+		})
+
+		Convey("Given a deliverer using a sender reporting the delivery before returning", func() {
+			deliverer := newAppDeliverer(client, DeliveryConfig{
+				Storage: storage,
+				Sender:  testReportingSender{},
+			})
+
+			Convey("When delivering a frame", func() {
+				deliverer.enqueue(frameDelivery{appEUI: app, devEUI: dev, fCnt: 1})
+				deliverer.close()
+
+				Convey("Then the frame is marked as delivered", func() {
+					d, err := storage.Get(dev, 1)
+					So(err, ShouldBeNil)
+					So(d.Status, ShouldEqual, DeliveryDelivered)
+				})
+			})
+		})
+	})
+}
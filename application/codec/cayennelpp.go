@@ -0,0 +1,276 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Cayenne LPP data types (IPSO object id - 3200).
+const (
+	lppDigitalInput      uint8 = 0
+	lppDigitalOutput     uint8 = 1
+	lppAnalogInput       uint8 = 2
+	lppAnalogOutput      uint8 = 3
+	lppIlluminanceSensor uint8 = 101
+	lppPresenceSensor    uint8 = 102
+	lppTemperatureSensor uint8 = 103
+	lppHumiditySensor    uint8 = 104
+	lppAccelerometer     uint8 = 113
+	lppBarometer         uint8 = 115
+	lppGyrometer         uint8 = 134
+	lppGPSLocation       uint8 = 136
+)
+
+// lppValue defines the size (in bytes), signedness and resolution of a
+// Cayenne LPP value.
+type lppValue struct {
+	size       int
+	signed     bool
+	resolution float64
+}
+
+var (
+	lppScalarValues = map[uint8]lppValue{
+		lppDigitalInput:      {1, false, 1},
+		lppDigitalOutput:     {1, false, 1},
+		lppAnalogInput:       {2, true, 0.01},
+		lppAnalogOutput:      {2, true, 0.01},
+		lppIlluminanceSensor: {2, false, 1},
+		lppPresenceSensor:    {1, false, 1},
+		lppTemperatureSensor: {2, true, 0.1},
+		lppHumiditySensor:    {1, false, 0.5},
+		lppBarometer:         {2, false, 0.1},
+	}
+	lppAccelerometerValue = lppValue{2, true, 0.001}
+	lppGyrometerValue     = lppValue{2, true, 0.01}
+	lppLatLonValue        = lppValue{3, true, 0.0001}
+	lppAltitudeValue      = lppValue{3, true, 0.01}
+)
+
+// ChannelValue contains the value of a channel.
+type ChannelValue struct {
+	Channel uint8   `json:"channel"`
+	Value   float64 `json:"value"`
+}
+
+// ChannelXYZ contains the X, Y and Z values of a channel.
+type ChannelXYZ struct {
+	Channel uint8   `json:"channel"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Z       float64 `json:"z"`
+}
+
+// ChannelGPSLocation contains the GPS location of a channel.
+type ChannelGPSLocation struct {
+	Channel   uint8   `json:"channel"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// CayenneLPP is the object of a Cayenne LPP payload.
+type CayenneLPP struct {
+	DigitalInput      []ChannelValue       `json:"digitalInput,omitempty"`
+	DigitalOutput     []ChannelValue       `json:"digitalOutput,omitempty"`
+	AnalogInput       []ChannelValue       `json:"analogInput,omitempty"`
+	AnalogOutput      []ChannelValue       `json:"analogOutput,omitempty"`
+	IlluminanceSensor []ChannelValue       `json:"illuminanceSensor,omitempty"`
+	PresenceSensor    []ChannelValue       `json:"presenceSensor,omitempty"`
+	TemperatureSensor []ChannelValue       `json:"temperatureSensor,omitempty"`
+	HumiditySensor    []ChannelValue       `json:"humiditySensor,omitempty"`
+	Accelerometer     []ChannelXYZ         `json:"accelerometer,omitempty"`
+	Barometer         []ChannelValue       `json:"barometer,omitempty"`
+	Gyrometer         []ChannelXYZ         `json:"gyrometer,omitempty"`
+	GPSLocation       []ChannelGPSLocation `json:"gpsLocation,omitempty"`
+}
+
+// scalarValues returns a pointer to the values of the given scalar type.
+func (c *CayenneLPP) scalarValues(typ uint8) *[]ChannelValue {
+	switch typ {
+	case lppDigitalInput:
+		return &c.DigitalInput
+	case lppDigitalOutput:
+		return &c.DigitalOutput
+	case lppAnalogInput:
+		return &c.AnalogInput
+	case lppAnalogOutput:
+		return &c.AnalogOutput
+	case lppIlluminanceSensor:
+		return &c.IlluminanceSensor
+	case lppPresenceSensor:
+		return &c.PresenceSensor
+	case lppTemperatureSensor:
+		return &c.TemperatureSensor
+	case lppHumiditySensor:
+		return &c.HumiditySensor
+	case lppBarometer:
+		return &c.Barometer
+	}
+	return nil
+}
+
+// MarshalBinary encodes the object into a Cayenne LPP payload.
+func (c CayenneLPP) MarshalBinary() ([]byte, error) {
+	var out []byte
+
+	for _, typ := range []uint8{lppDigitalInput, lppDigitalOutput, lppAnalogInput, lppAnalogOutput, lppIlluminanceSensor, lppPresenceSensor, lppTemperatureSensor, lppHumiditySensor, lppBarometer} {
+		for _, v := range *c.scalarValues(typ) {
+			b, err := lppScalarValues[typ].encode(v.Value)
+			if err != nil {
+				return nil, fmt.Errorf("application/codec: channel %d: %s", v.Channel, err)
+			}
+			out = append(out, v.Channel, typ)
+			out = append(out, b...)
+		}
+	}
+
+	for _, xyz := range []struct {
+		typ    uint8
+		value  lppValue
+		values []ChannelXYZ
+	}{
+		{lppAccelerometer, lppAccelerometerValue, c.Accelerometer},
+		{lppGyrometer, lppGyrometerValue, c.Gyrometer},
+	} {
+		for _, v := range xyz.values {
+			out = append(out, v.Channel, xyz.typ)
+			for _, f := range []float64{v.X, v.Y, v.Z} {
+				b, err := xyz.value.encode(f)
+				if err != nil {
+					return nil, fmt.Errorf("application/codec: channel %d: %s", v.Channel, err)
+				}
+				out = append(out, b...)
+			}
+		}
+	}
+
+	for _, v := range c.GPSLocation {
+		out = append(out, v.Channel, lppGPSLocation)
+		for i, f := range []float64{v.Latitude, v.Longitude, v.Altitude} {
+			value := lppLatLonValue
+			if i == 2 {
+				value = lppAltitudeValue
+			}
+			b, err := value.encode(f)
+			if err != nil {
+				return nil, fmt.Errorf("application/codec: channel %d: %s", v.Channel, err)
+			}
+			out = append(out, b...)
+		}
+	}
+
+	return out, nil
+}
+
+// UnmarshalBinary decodes the given Cayenne LPP payload.
+func (c *CayenneLPP) UnmarshalBinary(data []byte) error {
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return fmt.Errorf("application/codec: expected channel and type, got %d byte(s)", len(data))
+		}
+		channel, typ := data[0], data[1]
+		data = data[2:]
+
+		var values []lppValue
+		switch typ {
+		case lppAccelerometer:
+			values = []lppValue{lppAccelerometerValue, lppAccelerometerValue, lppAccelerometerValue}
+		case lppGyrometer:
+			values = []lppValue{lppGyrometerValue, lppGyrometerValue, lppGyrometerValue}
+		case lppGPSLocation:
+			values = []lppValue{lppLatLonValue, lppLatLonValue, lppAltitudeValue}
+		default:
+			value, ok := lppScalarValues[typ]
+			if !ok {
+				return fmt.Errorf("application/codec: invalid data type: %d", typ)
+			}
+			values = []lppValue{value}
+		}
+
+		f := make([]float64, len(values))
+		for i, value := range values {
+			if len(data) < value.size {
+				return fmt.Errorf("application/codec: channel %d: expected %d byte(s), got %d", channel, value.size, len(data))
+			}
+			f[i] = value.decode(data[:value.size])
+			data = data[value.size:]
+		}
+
+		switch typ {
+		case lppAccelerometer:
+			c.Accelerometer = append(c.Accelerometer, ChannelXYZ{Channel: channel, X: f[0], Y: f[1], Z: f[2]})
+		case lppGyrometer:
+			c.Gyrometer = append(c.Gyrometer, ChannelXYZ{Channel: channel, X: f[0], Y: f[1], Z: f[2]})
+		case lppGPSLocation:
+			c.GPSLocation = append(c.GPSLocation, ChannelGPSLocation{Channel: channel, Latitude: f[0], Longitude: f[1], Altitude: f[2]})
+		default:
+			values := c.scalarValues(typ)
+			*values = append(*values, ChannelValue{Channel: channel, Value: f[0]})
+		}
+	}
+	return nil
+}
+
+// decode decodes the given (big endian) bytes.
+func (v lppValue) decode(b []byte) float64 {
+	var i int64
+	for _, x := range b {
+		i = i<<8 | int64(x)
+	}
+	if v.signed && i&(1<<uint(len(b)*8-1)) != 0 {
+		i -= 1 << uint(len(b)*8)
+	}
+	// round to the resolution to avoid floating point artifacts
+	return float64(i) / math.Floor(1/v.resolution+0.5)
+}
+
+// encode encodes the given value into (big endian) bytes.
+func (v lppValue) encode(f float64) ([]byte, error) {
+	i := int64(round(f / v.resolution))
+	min, max := int64(0), int64(1)<<uint(v.size*8)-1
+	if v.signed {
+		min, max = -(int64(1) << uint(v.size*8-1)), int64(1)<<uint(v.size*8-1)-1
+	}
+	if i < min || i > max {
+		return nil, fmt.Errorf("value %v out of range", f)
+	}
+
+	b := make([]byte, v.size)
+	for j := v.size - 1; j >= 0; j-- {
+		b[j] = byte(i)
+		i >>= 8
+	}
+	return b, nil
+}
+
+// round rounds half away from zero.
+func round(f float64) float64 {
+	if f < 0 {
+		return math.Ceil(f - 0.5)
+	}
+	return math.Floor(f + 0.5)
+}
+
+// CayenneLPPCodec implements the Cayenne LPP codec. The decoded object is of
+// type CayenneLPP.
+type CayenneLPPCodec struct{}
+
+// Decode decodes the given Cayenne LPP payload.
+func (c CayenneLPPCodec) Decode(fPort uint8, b []byte) (interface{}, error) {
+	var obj CayenneLPP
+	if err := obj.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Encode encodes the given CayenneLPP JSON object.
+func (c CayenneLPPCodec) Encode(fPort uint8, obj json.RawMessage) ([]byte, error) {
+	var lpp CayenneLPP
+	if err := json.Unmarshal(obj, &lpp); err != nil {
+		return nil, fmt.Errorf("application/codec: invalid CayenneLPP object: %s", err)
+	}
+	return lpp.MarshalBinary()
+}
@@ -0,0 +1,92 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCayenneLPP(t *testing.T) {
+	Convey("Given a set of test payloads", t, func() {
+		testTable := []struct {
+			Bytes  []byte
+			Object CayenneLPP
+		}{
+			{
+				Bytes:  []byte{3, 103, 1, 16, 5, 103, 0, 255},
+				Object: CayenneLPP{TemperatureSensor: []ChannelValue{{3, 27.2}, {5, 25.5}}},
+			},
+			{
+				Bytes: []byte{1, 0, 100, 2, 1, 1, 3, 2, 255, 156, 4, 101, 1, 44, 5, 102, 1, 6, 104, 97, 7, 115, 39, 16},
+				Object: CayenneLPP{
+					DigitalInput:      []ChannelValue{{1, 100}},
+					DigitalOutput:     []ChannelValue{{2, 1}},
+					AnalogInput:       []ChannelValue{{3, -1}},
+					IlluminanceSensor: []ChannelValue{{4, 300}},
+					PresenceSensor:    []ChannelValue{{5, 1}},
+					HumiditySensor:    []ChannelValue{{6, 48.5}},
+					Barometer:         []ChannelValue{{7, 1000}},
+				},
+			},
+			{
+				Bytes:  []byte{6, 113, 4, 210, 251, 46, 0, 0},
+				Object: CayenneLPP{Accelerometer: []ChannelXYZ{{6, 1.234, -1.234, 0}}},
+			},
+			{
+				Bytes:  []byte{1, 136, 6, 118, 95, 242, 150, 10, 0, 3, 232},
+				Object: CayenneLPP{GPSLocation: []ChannelGPSLocation{{1, 42.3519, -87.9094, 10}}},
+			},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Then test %d is decoded as expected", i), func() {
+				var obj CayenneLPP
+				So(obj.UnmarshalBinary(test.Bytes), ShouldBeNil)
+				So(obj, ShouldResemble, test.Object)
+			})
+
+			Convey(fmt.Sprintf("Then test %d is encoded as expected", i), func() {
+				b, err := test.Object.MarshalBinary()
+				So(err, ShouldBeNil)
+				So(b, ShouldResemble, test.Bytes)
+			})
+		}
+	})
+
+	Convey("Then decoding a payload with an invalid type returns an error", t, func() {
+		var obj CayenneLPP
+		So(obj.UnmarshalBinary([]byte{1, 200, 0}), ShouldNotBeNil)
+	})
+
+	Convey("Then decoding a truncated payload returns an error", t, func() {
+		var obj CayenneLPP
+		So(obj.UnmarshalBinary([]byte{1, 103, 1}), ShouldNotBeNil)
+	})
+
+	Convey("Then encoding an out of range value returns an error", t, func() {
+		_, err := CayenneLPP{HumiditySensor: []ChannelValue{{1, 200}}}.MarshalBinary()
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestCayenneLPPCodec(t *testing.T) {
+	Convey("Given a CayenneLPPCodec", t, func() {
+		var c CayenneLPPCodec
+
+		Convey("Then a JSON object is encoded as expected", func() {
+			b, err := c.Encode(1, json.RawMessage(`{"temperatureSensor": [{"channel": 3, "value": 27.2}]}`))
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, []byte{3, 103, 1, 16})
+		})
+
+		Convey("Then the decoded payload is JSON encoded as expected", func() {
+			obj, err := c.Decode(1, []byte{3, 103, 1, 16})
+			So(err, ShouldBeNil)
+			b, err := json.Marshal(obj)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"temperatureSensor":[{"channel":3,"value":27.2}]}`)
+		})
+	})
+}
@@ -0,0 +1,94 @@
+// Package codec implements the application payload codecs.
+//
+// The codec of an application is configured by the codec config string of
+// the application, e.g.:
+//
+//	loracontrol.Application{
+//		...
+//		Config: loracontrol.PropertyBag{
+//			String: map[string]string{
+//				"codec":             "CUSTOM_JS",
+//				"codecDecodeScript": "function Decode(fPort, bytes) { return {temperature: bytes[0]}; }",
+//				"codecEncodeScript": "function Encode(fPort, obj) { return [obj.interval]; }",
+//			},
+//		},
+//	}
+//
+// The decoded object is included as object field in the uplink payloads sent
+// to the application. Downlink payloads can be submitted as JSON object
+// which is then encoded by the codec.
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Config keys of the application config.
+const (
+	TypeConfigKey         = "codec"
+	DecodeScriptConfigKey = "codecDecodeScript"
+	EncodeScriptConfigKey = "codecEncodeScript"
+)
+
+// Type defines the codec type.
+type Type string
+
+// Available codec types.
+const (
+	CayenneLPPType Type = "CAYENNE_LPP"
+	CustomJSType   Type = "CUSTOM_JS"
+)
+
+// ErrNoCodec is returned when encoding an object for an application without
+// codec.
+var ErrNoCodec = errors.New("application/codec: application has no codec configured")
+
+// Codec defines the interface of a payload codec.
+type Codec interface {
+	// Decode decodes the given payload into an object which can be JSON
+	// encoded.
+	Decode(fPort uint8, b []byte) (interface{}, error)
+
+	// Encode encodes the given JSON object into a payload.
+	Encode(fPort uint8, obj json.RawMessage) ([]byte, error)
+}
+
+// FromConfig returns the codec configured by the given application config.
+// It returns nil when no codec is configured.
+func FromConfig(config map[string]string) (Codec, error) {
+	switch Type(config[TypeConfigKey]) {
+	case "":
+		return nil, nil
+	case CayenneLPPType:
+		return CayenneLPPCodec{}, nil
+	case CustomJSType:
+		return NewCustomJSCodec(config[DecodeScriptConfigKey], config[EncodeScriptConfigKey]), nil
+	default:
+		return nil, fmt.Errorf("application/codec: invalid codec: %s", config[TypeConfigKey])
+	}
+}
+
+// Decode decodes the given payload with the codec configured by the given
+// application config. It returns nil when no codec is configured.
+func Decode(config map[string]string, fPort uint8, b []byte) (interface{}, error) {
+	c, err := FromConfig(config)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	return c.Decode(fPort, b)
+}
+
+// Encode encodes the given JSON object with the codec configured by the
+// given application config.
+func Encode(config map[string]string, fPort uint8, obj json.RawMessage) ([]byte, error) {
+	c, err := FromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, ErrNoCodec
+	}
+	return c.Encode(fPort, obj)
+}
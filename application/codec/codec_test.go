@@ -0,0 +1,41 @@
+package codec
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFromConfig(t *testing.T) {
+	Convey("Then FromConfig returns nil when no codec is configured", t, func() {
+		c, err := FromConfig(map[string]string{})
+		So(err, ShouldBeNil)
+		So(c, ShouldBeNil)
+	})
+
+	Convey("Then FromConfig returns the CayenneLPPCodec", t, func() {
+		c, err := FromConfig(map[string]string{TypeConfigKey: string(CayenneLPPType)})
+		So(err, ShouldBeNil)
+		So(c, ShouldResemble, CayenneLPPCodec{})
+	})
+
+	Convey("Then FromConfig returns the CustomJSCodec", t, func() {
+		c, err := FromConfig(map[string]string{
+			TypeConfigKey:         string(CustomJSType),
+			DecodeScriptConfigKey: "function Decode(fPort, bytes) { return {}; }",
+		})
+		So(err, ShouldBeNil)
+		So(c, ShouldResemble, NewCustomJSCodec("function Decode(fPort, bytes) { return {}; }", ""))
+	})
+
+	Convey("Then FromConfig returns an error for an invalid codec", t, func() {
+		_, err := FromConfig(map[string]string{TypeConfigKey: "INVALID"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Then Encode returns ErrNoCodec when no codec is configured", t, func() {
+		_, err := Encode(map[string]string{}, 1, json.RawMessage(`{}`))
+		So(err, ShouldEqual, ErrNoCodec)
+	})
+}
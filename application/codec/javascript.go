@@ -0,0 +1,164 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+// ErrTimeout is returned when a script does not complete within the maximum
+// execution time.
+var ErrTimeout = errors.New("application/codec: script execution timed out")
+
+// maxExecutionTime defines the maximum execution time of a script.
+var maxExecutionTime = 100 * time.Millisecond
+
+// errHalt is used to interrupt the script execution.
+var errHalt = errors.New("halt")
+
+// CustomJSCodec implements a codec using user-supplied JavaScript functions:
+//
+//	// Decode returns the object (e.g. {temperature: 21.5}) of the
+//	// given payload (an array of bytes).
+//	function Decode(fPort, bytes) { ... }
+//
+//	// Encode returns the payload (an array of bytes) of the given
+//	// object.
+//	function Encode(fPort, obj) { ... }
+//
+// The scripts are executed in an embedded interpreter without access to the
+// file-system or network and are interrupted after the maximum execution
+// time.
+type CustomJSCodec struct {
+	decodeScript string
+	encodeScript string
+}
+
+// NewCustomJSCodec creates a new CustomJSCodec.
+func NewCustomJSCodec(decodeScript, encodeScript string) *CustomJSCodec {
+	return &CustomJSCodec{
+		decodeScript: decodeScript,
+		encodeScript: encodeScript,
+	}
+}
+
+// Decode calls the Decode function of the decode script.
+func (c *CustomJSCodec) Decode(fPort uint8, b []byte) (interface{}, error) {
+	if c.decodeScript == "" {
+		return nil, errors.New("application/codec: no decode script configured")
+	}
+
+	bytes := make([]interface{}, len(b))
+	for i, x := range b {
+		bytes[i] = int(x)
+	}
+
+	v, err := run(c.decodeScript+"\n\nDecode(fPort, bytes);", map[string]interface{}{
+		"fPort": int(fPort),
+		"bytes": bytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Encode calls the Encode function of the encode script. The function must
+// return an array of bytes.
+func (c *CustomJSCodec) Encode(fPort uint8, obj json.RawMessage) ([]byte, error) {
+	if c.encodeScript == "" {
+		return nil, errors.New("application/codec: no encode script configured")
+	}
+
+	var o interface{}
+	if err := json.Unmarshal(obj, &o); err != nil {
+		return nil, fmt.Errorf("application/codec: invalid object: %s", err)
+	}
+
+	v, err := run(c.encodeScript+"\n\nEncode(fPort, obj);", map[string]interface{}{
+		"fPort": int(fPort),
+		"obj":   o,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toBytes(v)
+}
+
+// run executes the given script with the given variables set and returns
+// the exported value of the last statement.
+func run(script string, vars map[string]interface{}) (out interface{}, err error) {
+	vm := otto.New()
+	vm.Interrupt = make(chan func(), 1)
+	for k, v := range vars {
+		if err := vm.Set(k, v); err != nil {
+			return nil, fmt.Errorf("application/codec: could not set %s: %s", k, err)
+		}
+	}
+
+	defer func() {
+		if caught := recover(); caught != nil {
+			if caught == errHalt {
+				out, err = nil, ErrTimeout
+				return
+			}
+			panic(caught)
+		}
+	}()
+
+	timer := time.AfterFunc(maxExecutionTime, func() {
+		vm.Interrupt <- func() {
+			panic(errHalt)
+		}
+	})
+	defer timer.Stop()
+
+	v, err := vm.Run(script)
+	if err != nil {
+		return nil, fmt.Errorf("application/codec: script error: %s", err)
+	}
+	out, err = v.Export()
+	if err != nil {
+		return nil, fmt.Errorf("application/codec: could not export value: %s", err)
+	}
+	return out, nil
+}
+
+// toBytes converts the given (exported) array of numbers to a byte slice.
+func toBytes(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("application/codec: expected an array of bytes, got %T", v)
+	}
+
+	out := make([]byte, rv.Len())
+	for i := range out {
+		var f float64
+		switch x := rv.Index(i).Interface().(type) {
+		case int:
+			f = float64(x)
+		case int32:
+			f = float64(x)
+		case int64:
+			f = float64(x)
+		case uint8:
+			f = float64(x)
+		case float32:
+			f = float64(x)
+		case float64:
+			f = x
+		default:
+			return nil, fmt.Errorf("application/codec: expected a number at index %d, got %T", i, x)
+		}
+		if f < 0 || f > 255 || f != math.Floor(f) {
+			return nil, fmt.Errorf("application/codec: value %v at index %d is not a byte", f, i)
+		}
+		out[i] = byte(f)
+	}
+	return out, nil
+}
@@ -0,0 +1,72 @@
+package codec
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCustomJSCodec(t *testing.T) {
+	Convey("Given a CustomJSCodec", t, func() {
+		c := NewCustomJSCodec(`
+			function Decode(fPort, bytes) {
+				return {
+					port: fPort,
+					temperature: ((bytes[0] << 8) | bytes[1]) / 10
+				};
+			}
+		`, `
+			function Encode(fPort, obj) {
+				return [fPort, obj.interval >> 8, obj.interval & 0xff];
+			}
+		`)
+
+		Convey("Then the payload is decoded as expected", func() {
+			obj, err := c.Decode(5, []byte{1, 16})
+			So(err, ShouldBeNil)
+			b, err := json.Marshal(obj)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"port":5,"temperature":27.2}`)
+		})
+
+		Convey("Then the object is encoded as expected", func() {
+			b, err := c.Encode(5, json.RawMessage(`{"interval": 300}`))
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, []byte{5, 1, 44})
+		})
+	})
+
+	Convey("Given a CustomJSCodec with an endless loop", t, func() {
+		c := NewCustomJSCodec("function Decode(fPort, bytes) { while (true) {} }", "")
+
+		Convey("Then Decode returns ErrTimeout", func() {
+			start := time.Now()
+			_, err := c.Decode(1, []byte{1})
+			So(err, ShouldEqual, ErrTimeout)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+		})
+	})
+
+	Convey("Given a CustomJSCodec returning invalid bytes", t, func() {
+		c := NewCustomJSCodec("", "function Encode(fPort, obj) { return [256]; }")
+
+		Convey("Then Encode returns an error", func() {
+			_, err := c.Encode(1, json.RawMessage(`{}`))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Then toBytes converts the exported numbers", t, func() {
+		b, err := toBytes([]interface{}{int64(1), float64(2), 3})
+		So(err, ShouldBeNil)
+		So(b, ShouldResemble, []byte{1, 2, 3})
+
+		_, err = toBytes([]interface{}{1.5})
+		So(err, ShouldNotBeNil)
+
+		_, err = toBytes("foo")
+		So(err, ShouldNotBeNil)
+	})
+}
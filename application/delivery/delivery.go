@@ -0,0 +1,42 @@
+// Package delivery defines the results of the application backends for the
+// payloads which were not (or not only) delivered synchronously. The uplink
+// delivery uses them to decide whether a payload must be retried.
+package delivery
+
+import (
+	"errors"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+)
+
+// ErrQueued is returned by the application backends which did not deliver the
+// payload yet, but queued it for delivery by the backend itself (e.g. for a
+// retry or within a batch). The payload must not be retried by the caller.
+var ErrQueued = errors.New("application/delivery: payload queued by the application backend")
+
+// PartialError is returned by the application backends when the payload was
+// delivered to (or queued for) a part of the destinations of the application
+// only. The payload must not be retried by the caller, as it would be
+// delivered again to the destinations which already accepted it.
+type PartialError struct {
+	Err error // error of the first destination which failed
+}
+
+func (e *PartialError) Error() string {
+	return "application/delivery: payload not delivered to all destinations: " + e.Err.Error()
+}
+
+// Callback is called by the application backend with the final result of a
+// payload for which ErrQueued was returned: nil when it has been delivered,
+// the error otherwise. It is called exactly once.
+type Callback func(err error)
+
+// Sender is implemented by the application backends which report the final
+// result of the payloads they queued.
+type Sender interface {
+	// SendWithCallback sends the given packets like Send. When ErrQueued
+	// is returned, the given callback is called with the final result of
+	// the delivery. It is not called when an other value is returned.
+	SendWithCallback(appEUI lorawan.EUI64, packets loracontrol.RXPackets, cb Callback) error
+}
@@ -0,0 +1,155 @@
+// Package dispatcher implements an application backend which dispatches the
+// received packets to the application backend configured for the
+// application, e.g. to integrate one application over HTTP and an other over
+// MQTT.
+package dispatcher
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/delivery"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/lorawan"
+)
+
+// BackendConfigKey is the application config key (loracontrol.Application
+// Config.String) holding the name of the application backend to use.
+const BackendConfigKey = "backend"
+
+// Backend implements a dispatching application backend. The packets
+// received from the applications by all backends are merged into a single
+// Receive channel.
+type Backend struct {
+	client         *loracontrol.Client
+	defaultBackend string
+	backends       map[string]loracontrol.ApplicationBackend
+	txPacketChan   chan loracontrol.TXPacket
+	wg             sync.WaitGroup
+}
+
+// NewBackend creates a new Backend dispatching to the given (named)
+// backends. The default backend is used for the applications without
+// backend config.
+func NewBackend(defaultBackend string, backends map[string]loracontrol.ApplicationBackend) (*Backend, error) {
+	if _, ok := backends[defaultBackend]; !ok {
+		return nil, fmt.Errorf("application/dispatcher: default backend %s is not given", defaultBackend)
+	}
+
+	b := &Backend{
+		defaultBackend: defaultBackend,
+		backends:       backends,
+		txPacketChan:   make(chan loracontrol.TXPacket),
+	}
+
+	for _, backend := range backends {
+		txPacketChan := backend.Receive()
+		if txPacketChan == nil {
+			continue
+		}
+		b.wg.Add(1)
+		go func(txPacketChan chan loracontrol.TXPacket) {
+			for txPacket := range txPacketChan {
+				b.txPacketChan <- txPacket
+			}
+			b.wg.Done()
+		}(txPacketChan)
+	}
+
+	go func() {
+		b.wg.Wait()
+		close(b.txPacketChan)
+	}()
+
+	return b, nil
+}
+
+// SetClient sets the loracontrol.Client on the dispatcher and all backends
+// and is automatically called by loracontrol.SetApplicationBackend.
+func (b *Backend) SetClient(c *loracontrol.Client) {
+	b.client = c
+	for _, backend := range b.backends {
+		backend.SetClient(c)
+	}
+}
+
+// Close closes all backends.
+func (b *Backend) Close() error {
+	var firstErr error
+	for _, backend := range b.backends {
+		if err := backend.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Receive returns the (merged) TXPacket channel.
+func (b *Backend) Receive() chan loracontrol.TXPacket {
+	return b.txPacketChan
+}
+
+// Send sends the given packets to the backend configured for the
+// application.
+func (b *Backend) Send(appEUI lorawan.EUI64, packets loracontrol.RXPackets) error {
+	app, err := b.client.Application().Get(appEUI)
+	if err != nil {
+		return err
+	}
+	backend, err := b.getBackend(app)
+	if err != nil {
+		return err
+	}
+	return backend.Send(appEUI, packets)
+}
+
+// SendWithCallback sends the given packets to the backend configured for
+// the application. The callback is passed to this backend when it
+// implements delivery.Sender.
+func (b *Backend) SendWithCallback(appEUI lorawan.EUI64, packets loracontrol.RXPackets, cb delivery.Callback) error {
+	app, err := b.client.Application().Get(appEUI)
+	if err != nil {
+		return err
+	}
+	backend, err := b.getBackend(app)
+	if err != nil {
+		return err
+	}
+	if sender, ok := backend.(delivery.Sender); ok {
+		return sender.SendWithCallback(appEUI, packets, cb)
+	}
+	return backend.Send(appEUI, packets)
+}
+
+// getBackend returns the backend configured for the given application.
+func (b *Backend) getBackend(app loracontrol.Application) (loracontrol.ApplicationBackend, error) {
+	name := app.Config.String[BackendConfigKey]
+	if name == "" {
+		name = b.defaultBackend
+	}
+	backend, ok := b.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("application/dispatcher: unknown backend %s configured for application %s", name, app.AppEUI)
+	}
+	return backend, nil
+}
+
+// SendEvent sends the given event to the backend configured for the
+// application. It returns event.ErrNotSupported when this backend does not
+// support events.
+func (b *Backend) SendEvent(appEUI lorawan.EUI64, e event.Event) error {
+	app, err := b.client.Application().Get(appEUI)
+	if err != nil {
+		return err
+	}
+	backend, err := b.getBackend(app)
+	if err != nil {
+		return err
+	}
+	sender, ok := backend.(event.Sender)
+	if !ok {
+		return event.ErrNotSupported
+	}
+	return sender.SendEvent(appEUI, e)
+}
@@ -0,0 +1,187 @@
+package dispatcher
+
+import (
+	"os"
+	"testing"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/delivery"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type config struct {
+	RedisServer   string
+	RedisPassword string
+}
+
+func getConfig() *config {
+	c := &config{
+		RedisServer:   "localhost:6379",
+		RedisPassword: "",
+	}
+
+	if v := os.Getenv("TEST_REDIS_SERVER"); v != "" {
+		c.RedisServer = v
+	}
+	if v := os.Getenv("TEST_REDIS_PASSWORD"); v != "" {
+		c.RedisPassword = v
+	}
+
+	return c
+}
+
+type testApplicationBackend struct {
+	txPacketChan chan loracontrol.TXPacket
+	sent         []lorawan.EUI64
+}
+
+func newTestApplicationBackend() *testApplicationBackend {
+	return &testApplicationBackend{
+		txPacketChan: make(chan loracontrol.TXPacket),
+	}
+}
+
+func (b *testApplicationBackend) SetClient(c *loracontrol.Client) {}
+
+func (b *testApplicationBackend) Send(appEUI lorawan.EUI64, packets loracontrol.RXPackets) error {
+	b.sent = append(b.sent, appEUI)
+	return nil
+}
+
+func (b *testApplicationBackend) Receive() chan loracontrol.TXPacket {
+	return b.txPacketChan
+}
+
+func (b *testApplicationBackend) Close() error {
+	close(b.txPacketChan)
+	return nil
+}
+
+type testEventApplicationBackend struct {
+	*testApplicationBackend
+	events    []event.Event
+	callbacks []delivery.Callback
+}
+
+func (b *testEventApplicationBackend) SendEvent(appEUI lorawan.EUI64, e event.Event) error {
+	b.events = append(b.events, e)
+	return nil
+}
+
+func (b *testEventApplicationBackend) SendWithCallback(appEUI lorawan.EUI64, packets loracontrol.RXPackets, cb delivery.Callback) error {
+	b.callbacks = append(b.callbacks, cb)
+	return delivery.ErrQueued
+}
+
+func TestBackend(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a Backend dispatching to two test backends", t, func() {
+		backendA := newTestApplicationBackend()
+		backendB := &testEventApplicationBackend{testApplicationBackend: newTestApplicationBackend()}
+
+		b, err := NewBackend("a", map[string]loracontrol.ApplicationBackend{
+			"a": backendA,
+			"b": backendB,
+		})
+		So(err, ShouldBeNil)
+
+		c, err := loracontrol.NewClient(
+			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
+			loracontrol.SetGatewayBackend(&loracontrol.DummyGatewayBackend{}),
+			loracontrol.SetApplicationBackend(b),
+		)
+		So(err, ShouldBeNil)
+		So(c.Storage().FlushAll(), ShouldBeNil)
+
+		appA := loracontrol.Application{
+			AppEUI: lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1},
+		}
+		appB := loracontrol.Application{
+			AppEUI: lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+			Config: loracontrol.PropertyBag{
+				String: map[string]string{BackendConfigKey: "b"},
+			},
+		}
+		appC := loracontrol.Application{
+			AppEUI: lorawan.EUI64{3, 3, 3, 3, 3, 3, 3, 3},
+			Config: loracontrol.PropertyBag{
+				String: map[string]string{BackendConfigKey: "c"},
+			},
+		}
+		for _, app := range []loracontrol.Application{appA, appB, appC} {
+			So(c.Application().Create(app), ShouldBeNil)
+		}
+
+		Convey("Then the packets of an application without backend config are sent to the default backend", func() {
+			So(b.Send(appA.AppEUI, nil), ShouldBeNil)
+			So(backendA.sent, ShouldResemble, []lorawan.EUI64{appA.AppEUI})
+			So(backendB.sent, ShouldHaveLength, 0)
+		})
+
+		Convey("Then the packets of an application are sent to the configured backend", func() {
+			So(b.Send(appB.AppEUI, nil), ShouldBeNil)
+			So(backendA.sent, ShouldHaveLength, 0)
+			So(backendB.sent, ShouldResemble, []lorawan.EUI64{appB.AppEUI})
+		})
+
+		Convey("Then sending the packets of an application with an unknown backend returns an error", func() {
+			So(b.Send(appC.AppEUI, nil), ShouldNotBeNil)
+		})
+
+		Convey("Then sending the packets of an unknown application returns an error", func() {
+			So(b.Send(lorawan.EUI64{4, 4, 4, 4, 4, 4, 4, 4}, nil), ShouldEqual, loracontrol.ErrObjectDoesNotExist)
+		})
+
+		Convey("Then the events of an application are sent to the configured backend", func() {
+			e := event.Event{Type: event.Error, DevEUI: lorawan.EUI64{5, 5, 5, 5, 5, 5, 5, 5}, Reason: "invalid MIC"}
+			So(b.SendEvent(appB.AppEUI, e), ShouldBeNil)
+			So(backendB.events, ShouldResemble, []event.Event{e})
+		})
+
+		Convey("Then the callback is passed to the configured backend", func() {
+			So(b.SendWithCallback(appB.AppEUI, nil, func(error) {}), ShouldEqual, delivery.ErrQueued)
+			So(backendB.callbacks, ShouldHaveLength, 1)
+		})
+
+		Convey("Then the packets are sent to a backend without callback support", func() {
+			So(b.SendWithCallback(appA.AppEUI, nil, func(error) {}), ShouldBeNil)
+			So(backendA.sent, ShouldResemble, []lorawan.EUI64{appA.AppEUI})
+		})
+
+		Convey("Then sending an event to a backend without event support returns an error", func() {
+			So(b.SendEvent(appA.AppEUI, event.Event{Type: event.Error}), ShouldEqual, event.ErrNotSupported)
+		})
+
+		Convey("When backend B receives a packet from the application", func() {
+			go func() {
+				backendB.txPacketChan <- loracontrol.TXPacket{TXInfo: loracontrol.TXInfo{Frequency: 868.1}}
+			}()
+
+			Convey("Then it is returned by Receive", func() {
+				txPacket := <-b.Receive()
+				So(txPacket.TXInfo.Frequency, ShouldEqual, 868.1)
+			})
+		})
+
+		Convey("When closing the backend", func() {
+			So(b.Close(), ShouldBeNil)
+
+			Convey("Then the Receive channel is closed", func() {
+				_, ok := <-b.Receive()
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestNewBackend(t *testing.T) {
+	Convey("Then NewBackend returns an error when the default backend is not given", t, func() {
+		_, err := NewBackend("http", map[string]loracontrol.ApplicationBackend{
+			"mqtt": newTestApplicationBackend(),
+		})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,42 @@
+// Package event defines the node events sent to the applications.
+package event
+
+import (
+	"errors"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+// ErrNotSupported is returned when the application backend does not support
+// events.
+var ErrNotSupported = errors.New("application/event: events are not supported by the application backend")
+
+// Type defines the event type.
+type Type string
+
+// Available event types.
+const (
+	Join   Type = "join"   // the node has joined the network
+	ACK    Type = "ack"    // the node acknowledged a confirmed downlink
+	Error  Type = "error"  // a frame of the node was rejected
+	Status Type = "status" // the node reported its (battery / link) status
+)
+
+// Event is an event related to a node.
+type Event struct {
+	Type    Type             `json:"type"`
+	DevEUI  lorawan.EUI64    `json:"devEUI"`
+	Time    time.Time        `json:"time"`
+	Reason  string           `json:"reason,omitempty"`  // error events
+	DevAddr *lorawan.DevAddr `json:"devAddr,omitempty"` // join events
+	FCnt    *uint32          `json:"fCnt,omitempty"`    // ack events, the FCnt of the acknowledged downlink
+	Battery *uint8           `json:"battery,omitempty"` // status events
+	Margin  *int8            `json:"margin,omitempty"`  // status events
+}
+
+// Sender is implemented by the application backends delivering the events
+// to the applications.
+type Sender interface {
+	SendEvent(appEUI lorawan.EUI64, e Event) error
+}
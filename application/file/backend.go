@@ -0,0 +1,160 @@
+// Package file implements an application backend which appends the received
+// payloads to a file per application. When the application has a codec
+// configured (see the codec package), the decoded payload is included as
+// object.
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/codec"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/lorawan"
+)
+
+// ErrBackendClosed is returned when the backend has been closed.
+var ErrBackendClosed = errors.New("application/file: backend is closed")
+
+// RXPayload is the payload written (JSON encoded, one per line) to the file
+// of the application.
+type RXPayload struct {
+	DevEUI       lorawan.EUI64 `json:"devEUI"`
+	TimeReceived time.Time     `json:"timeReceived"`
+	GatewayCount int           `json:"gatewayCount"`
+	FCnt         uint32        `json:"fCnt"`
+	Port         int           `json:"port"`
+	Payload      []byte        `json:"payload"`
+	Object       interface{}   `json:"object,omitempty"` // decoded by the codec of the application
+}
+
+// Backend implements a file application backend. The payloads are written
+// to the [AppEUI].json file and the events to the [AppEUI].events.json file
+// in the configured directory. As this backend
+// does not receive packets from the application, the Receive channel is
+// only closed when the backend is closed.
+type Backend struct {
+	client       *loracontrol.Client
+	dir          string
+	txPacketChan chan loracontrol.TXPacket
+
+	mu     sync.Mutex // protects closed and serializes the writes
+	closed bool
+}
+
+// NewBackend creates a new Backend writing to the given directory.
+func NewBackend(dir string) (*Backend, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("application/file: %s is not a directory", dir)
+	}
+	return &Backend{
+		dir:          dir,
+		txPacketChan: make(chan loracontrol.TXPacket),
+	}, nil
+}
+
+// SetClient sets the loracontrol.Client and is automatically called by
+// loracontrol.SetApplicationBackend.
+func (b *Backend) SetClient(c *loracontrol.Client) {
+	b.client = c
+}
+
+// Close closes the backend. Close is safe to call multiple times.
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.txPacketChan)
+	}
+	return nil
+}
+
+// Receive returns the TXPacket channel (on which no packets are sent).
+func (b *Backend) Receive() chan loracontrol.TXPacket {
+	return b.txPacketChan
+}
+
+// Send appends the given packets as one RXPayload to the file of the
+// application.
+func (b *Backend) Send(appEUI lorawan.EUI64, packets loracontrol.RXPackets) error {
+	if len(packets) == 0 {
+		return errors.New("application/file: packets should have length > 0")
+	}
+
+	macPL, ok := packets[0].PHYPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return fmt.Errorf("application/file: expected *lorawan.MACPayload, got %T", packets[0].PHYPayload.MACPayload)
+	}
+	if len(macPL.FRMPayload) != 1 {
+		return errors.New("application/file: expected exactly 1 FRMPayload")
+	}
+	data, err := macPL.FRMPayload[0].MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	ns, err := b.client.NodeSession().Get(macPL.FHDR.DevAddr)
+	if err != nil {
+		return err
+	}
+
+	pl := RXPayload{
+		DevEUI:       ns.DevEUI,
+		TimeReceived: packets[0].RXInfo.Time,
+		GatewayCount: len(packets),
+		FCnt:         macPL.FHDR.FCnt,
+		Port:         int(macPL.FPort),
+		Payload:      data,
+	}
+	if app, err := b.client.Application().Get(appEUI); err != nil {
+		log.WithField("app_eui", appEUI).Errorf("application/file: could not get application: %s", err)
+	} else if pl.Object, err = codec.Decode(app.Config.String, macPL.FPort, data); err != nil {
+		log.WithField("app_eui", appEUI).Errorf("application/file: could not decode payload: %s", err)
+	}
+
+	bytes, err := json.Marshal(pl)
+	if err != nil {
+		return err
+	}
+	return b.appendLine(appEUI.String()+".json", bytes)
+}
+
+// SendEvent writes the given event to the [AppEUI].events.json file.
+func (b *Backend) SendEvent(appEUI lorawan.EUI64, e event.Event) error {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return b.appendLine(appEUI.String()+".events.json", bytes)
+}
+
+// appendLine appends the given line to the given file.
+func (b *Backend) appendLine(name string, line []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBackendClosed
+	}
+
+	f, err := os.OpenFile(filepath.Join(b.dir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
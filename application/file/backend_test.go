@@ -0,0 +1,180 @@
+package file
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/codec"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type config struct {
+	RedisServer   string
+	RedisPassword string
+}
+
+func getConfig() *config {
+	c := &config{
+		RedisServer:   "localhost:6379",
+		RedisPassword: "",
+	}
+
+	if v := os.Getenv("TEST_REDIS_SERVER"); v != "" {
+		c.RedisServer = v
+	}
+	if v := os.Getenv("TEST_REDIS_PASSWORD"); v != "" {
+		c.RedisPassword = v
+	}
+
+	return c
+}
+
+func TestBackend(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a temporary directory and a Backend", t, func() {
+		dir, err := ioutil.TempDir("", "loraserver")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		backend, err := NewBackend(dir)
+		So(err, ShouldBeNil)
+
+		c, err := loracontrol.NewClient(
+			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
+			loracontrol.SetGatewayBackend(&loracontrol.DummyGatewayBackend{}),
+			loracontrol.SetApplicationBackend(backend),
+		)
+		So(err, ShouldBeNil)
+		So(c.Storage().FlushAll(), ShouldBeNil)
+
+		appEUI := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+		devEUI := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+		devAddr := lorawan.DevAddr{1, 2, 3, 4}
+		So(c.NodeSession().CreateExpire(loracontrol.NodeSession{
+			DevAddr: devAddr,
+			DevEUI:  devEUI,
+		}), ShouldBeNil)
+
+		macPL := lorawan.NewMACPayload(true)
+		macPL.FHDR = lorawan.FHDR{
+			DevAddr: devAddr,
+			FCnt:    10,
+		}
+		macPL.FPort = 1
+		macPL.FRMPayload = []lorawan.Payload{
+			&lorawan.DataPayload{Bytes: []byte("hello")},
+		}
+		phy := lorawan.NewPHYPayload(true)
+		phy.MHDR = lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataUp,
+			Major: lorawan.LoRaWANR1,
+		}
+		phy.MACPayload = macPL
+
+		now := time.Now().UTC()
+		packets := loracontrol.RXPackets{
+			{RXInfo: loracontrol.RXInfo{Time: now}, PHYPayload: phy},
+		}
+
+		Convey("When sending packets twice", func() {
+			So(backend.Send(appEUI, packets), ShouldBeNil)
+			So(backend.Send(appEUI, packets), ShouldBeNil)
+
+			Convey("Then two payloads are written to the file of the application", func() {
+				b, err := ioutil.ReadFile(filepath.Join(dir, "0101010101010101.json"))
+				So(err, ShouldBeNil)
+
+				lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+				So(lines, ShouldHaveLength, 2)
+
+				var pl RXPayload
+				So(json.Unmarshal([]byte(lines[1]), &pl), ShouldBeNil)
+				So(pl.TimeReceived.Equal(now), ShouldBeTrue)
+				pl.TimeReceived = now
+				So(pl, ShouldResemble, RXPayload{
+					DevEUI:       devEUI,
+					TimeReceived: now,
+					GatewayCount: 1,
+					FCnt:         10,
+					Port:         1,
+					Payload:      []byte("hello"),
+				})
+			})
+		})
+
+		Convey("Given the application has a codec", func() {
+			So(c.Application().Create(loracontrol.Application{
+				AppEUI: appEUI,
+				Config: loracontrol.PropertyBag{
+					String: map[string]string{
+						codec.TypeConfigKey:         string(codec.CustomJSType),
+						codec.DecodeScriptConfigKey: "function Decode(fPort, bytes) { return {length: bytes.length}; }",
+					},
+				},
+			}), ShouldBeNil)
+
+			Convey("When sending packets", func() {
+				So(backend.Send(appEUI, packets), ShouldBeNil)
+
+				Convey("Then the decoded object is written", func() {
+					b, err := ioutil.ReadFile(filepath.Join(dir, "0101010101010101.json"))
+					So(err, ShouldBeNil)
+
+					var pl RXPayload
+					So(json.Unmarshal(b, &pl), ShouldBeNil)
+					So(pl.Object, ShouldResemble, map[string]interface{}{"length": float64(5)})
+				})
+			})
+		})
+
+		Convey("When sending an error event", func() {
+			e := event.Event{
+				Type:   event.Error,
+				DevEUI: devEUI,
+				Time:   now,
+				Reason: "invalid MIC",
+			}
+			So(backend.SendEvent(appEUI, e), ShouldBeNil)
+
+			Convey("Then the event is written to the events file of the application", func() {
+				b, err := ioutil.ReadFile(filepath.Join(dir, "0101010101010101.events.json"))
+				So(err, ShouldBeNil)
+
+				var out event.Event
+				So(json.Unmarshal(b, &out), ShouldBeNil)
+				So(out.Time.Equal(now), ShouldBeTrue)
+				out.Time = now
+				So(out, ShouldResemble, e)
+			})
+		})
+
+		Convey("When closing the backend", func() {
+			So(backend.Close(), ShouldBeNil)
+
+			Convey("Then the Receive channel is closed", func() {
+				_, ok := <-backend.Receive()
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Then Send returns ErrBackendClosed", func() {
+				So(backend.Send(appEUI, packets), ShouldEqual, ErrBackendClosed)
+			})
+		})
+	})
+}
+
+func TestNewBackend(t *testing.T) {
+	Convey("Then NewBackend returns an error when the directory does not exist", t, func() {
+		_, err := NewBackend("/does/not/exist")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,281 @@
+// Code generated by protoc-gen-go.
+// source: application.proto
+// DO NOT EDIT!
+
+/*
+Package api is a generated protocol buffer package.
+
+It is generated from these files:
+
+	application.proto
+
+It has these top-level messages:
+
+	UplinkPayload
+	Event
+	DownlinkPayload
+	StreamRequest
+	StreamResponse
+*/
+package api
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+// UplinkPayload contains the payload received from a node.
+type UplinkPayload struct {
+	DevEUI       []byte `protobuf:"bytes,1,opt,name=devEUI,proto3" json:"devEUI,omitempty"`
+	TimeReceived string `protobuf:"bytes,2,opt,name=timeReceived" json:"timeReceived,omitempty"`
+	GatewayCount uint32 `protobuf:"varint,3,opt,name=gatewayCount" json:"gatewayCount,omitempty"`
+	FCnt         uint32 `protobuf:"varint,4,opt,name=fCnt" json:"fCnt,omitempty"`
+	Port         uint32 `protobuf:"varint,5,opt,name=port" json:"port,omitempty"`
+	Payload      []byte `protobuf:"bytes,6,opt,name=payload,proto3" json:"payload,omitempty"`
+	Object       string `protobuf:"bytes,7,opt,name=object" json:"object,omitempty"`
+}
+
+func (m *UplinkPayload) Reset()                    { *m = UplinkPayload{} }
+func (m *UplinkPayload) String() string            { return proto.CompactTextString(m) }
+func (*UplinkPayload) ProtoMessage()               {}
+func (*UplinkPayload) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+// Event contains an event (join, ack, error or status) related to a node.
+type Event struct {
+	Type    string `protobuf:"bytes,1,opt,name=type" json:"type,omitempty"`
+	DevEUI  []byte `protobuf:"bytes,2,opt,name=devEUI,proto3" json:"devEUI,omitempty"`
+	Error   string `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
+	Time    string `protobuf:"bytes,4,opt,name=time" json:"time,omitempty"`
+	DevAddr []byte `protobuf:"bytes,5,opt,name=devAddr,proto3" json:"devAddr,omitempty"`
+	FCnt    uint32 `protobuf:"varint,6,opt,name=fCnt" json:"fCnt,omitempty"`
+	Battery uint32 `protobuf:"varint,7,opt,name=battery" json:"battery,omitempty"`
+	Margin  int32  `protobuf:"varint,8,opt,name=margin" json:"margin,omitempty"`
+}
+
+func (m *Event) Reset()                    { *m = Event{} }
+func (m *Event) String() string            { return proto.CompactTextString(m) }
+func (*Event) ProtoMessage()               {}
+func (*Event) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+// DownlinkPayload contains the payload to send to a node.
+type DownlinkPayload struct {
+	DevEUI    []byte `protobuf:"bytes,1,opt,name=devEUI,proto3" json:"devEUI,omitempty"`
+	Confirmed bool   `protobuf:"varint,2,opt,name=confirmed" json:"confirmed,omitempty"`
+	Port      uint32 `protobuf:"varint,3,opt,name=port" json:"port,omitempty"`
+	Payload   []byte `protobuf:"bytes,4,opt,name=payload,proto3" json:"payload,omitempty"`
+	Object    string `protobuf:"bytes,5,opt,name=object" json:"object,omitempty"`
+}
+
+func (m *DownlinkPayload) Reset()                    { *m = DownlinkPayload{} }
+func (m *DownlinkPayload) String() string            { return proto.CompactTextString(m) }
+func (*DownlinkPayload) ProtoMessage()               {}
+func (*DownlinkPayload) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+// StreamRequest is sent by the application.
+type StreamRequest struct {
+	Downlink *DownlinkPayload `protobuf:"bytes,1,opt,name=downlink" json:"downlink,omitempty"`
+}
+
+func (m *StreamRequest) Reset()                    { *m = StreamRequest{} }
+func (m *StreamRequest) String() string            { return proto.CompactTextString(m) }
+func (*StreamRequest) ProtoMessage()               {}
+func (*StreamRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *StreamRequest) GetDownlink() *DownlinkPayload {
+	if m != nil {
+		return m.Downlink
+	}
+	return nil
+}
+
+// StreamResponse is sent by the server and contains either an uplink payload
+// or an event.
+type StreamResponse struct {
+	Uplink *UplinkPayload `protobuf:"bytes,1,opt,name=uplink" json:"uplink,omitempty"`
+	Event  *Event         `protobuf:"bytes,2,opt,name=event" json:"event,omitempty"`
+}
+
+func (m *StreamResponse) Reset()                    { *m = StreamResponse{} }
+func (m *StreamResponse) String() string            { return proto.CompactTextString(m) }
+func (*StreamResponse) ProtoMessage()               {}
+func (*StreamResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *StreamResponse) GetUplink() *UplinkPayload {
+	if m != nil {
+		return m.Uplink
+	}
+	return nil
+}
+
+func (m *StreamResponse) GetEvent() *Event {
+	if m != nil {
+		return m.Event
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*UplinkPayload)(nil), "api.UplinkPayload")
+	proto.RegisterType((*Event)(nil), "api.Event")
+	proto.RegisterType((*DownlinkPayload)(nil), "api.DownlinkPayload")
+	proto.RegisterType((*StreamRequest)(nil), "api.StreamRequest")
+	proto.RegisterType((*StreamResponse)(nil), "api.StreamResponse")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for Application service
+
+type ApplicationClient interface {
+	// Stream opens a bidirectional stream. The AppEUI (HEX encoded) must be
+	// set as app-eui metadata. When the application has an access key
+	// configured, it must be set as access-key metadata.
+	Stream(ctx context.Context, opts ...grpc.CallOption) (Application_StreamClient, error)
+}
+
+type applicationClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewApplicationClient(cc *grpc.ClientConn) ApplicationClient {
+	return &applicationClient{cc}
+}
+
+func (c *applicationClient) Stream(ctx context.Context, opts ...grpc.CallOption) (Application_StreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Application_serviceDesc.Streams[0], c.cc, "/api.Application/Stream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &applicationStreamClient{stream}
+	return x, nil
+}
+
+type Application_StreamClient interface {
+	Send(*StreamRequest) error
+	Recv() (*StreamResponse, error)
+	grpc.ClientStream
+}
+
+type applicationStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *applicationStreamClient) Send(m *StreamRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *applicationStreamClient) Recv() (*StreamResponse, error) {
+	m := new(StreamResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Application service
+
+type ApplicationServer interface {
+	// Stream opens a bidirectional stream. The AppEUI (HEX encoded) must be
+	// set as app-eui metadata. When the application has an access key
+	// configured, it must be set as access-key metadata.
+	Stream(Application_StreamServer) error
+}
+
+func RegisterApplicationServer(s *grpc.Server, srv ApplicationServer) {
+	s.RegisterService(&_Application_serviceDesc, srv)
+}
+
+func _Application_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ApplicationServer).Stream(&applicationStreamServer{stream})
+}
+
+type Application_StreamServer interface {
+	Send(*StreamResponse) error
+	Recv() (*StreamRequest, error)
+	grpc.ServerStream
+}
+
+type applicationStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *applicationStreamServer) Send(m *StreamResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *applicationStreamServer) Recv() (*StreamRequest, error) {
+	m := new(StreamRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Application_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "api.Application",
+	HandlerType: (*ApplicationServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _Application_Stream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "application.proto",
+}
+
+func init() { proto.RegisterFile("application.proto", fileDescriptor0) }
+
+var fileDescriptor0 = []byte{
+	// 418 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x93, 0xcf, 0x8e, 0xd3, 0x30,
+	0x10, 0xc6, 0xf1, 0xb6, 0x49, 0xdb, 0x69, 0x0b, 0xc2, 0xac, 0x90, 0x85, 0x38, 0x44, 0x39, 0x45,
+	0x1c, 0xaa, 0x55, 0x39, 0x70, 0xae, 0x96, 0x45, 0xe2, 0x86, 0x8c, 0xf6, 0x8a, 0xe4, 0x36, 0xb3,
+	0x2b, 0x43, 0x63, 0x1b, 0xd7, 0x4d, 0x95, 0x87, 0xe0, 0x91, 0x78, 0x00, 0xde, 0x0a, 0x65, 0x9c,
+	0xfe, 0x09, 0x02, 0x89, 0x9b, 0xe7, 0xf3, 0xe8, 0xcb, 0xef, 0x9b, 0x71, 0xe0, 0xb9, 0x72, 0x6e,
+	0xab, 0x37, 0x2a, 0x68, 0x6b, 0x16, 0xce, 0xdb, 0x60, 0xf9, 0x40, 0x39, 0x9d, 0xff, 0x62, 0x30,
+	0xbf, 0x77, 0x5b, 0x6d, 0xbe, 0x7d, 0x52, 0xcd, 0xd6, 0xaa, 0x92, 0xbf, 0x84, 0xb4, 0xc4, 0xfa,
+	0xee, 0xfe, 0xa3, 0x60, 0x19, 0x2b, 0x66, 0xb2, 0xab, 0x78, 0x0e, 0xb3, 0xa0, 0x2b, 0x94, 0xb8,
+	0x41, 0x5d, 0x63, 0x29, 0xae, 0x32, 0x56, 0x4c, 0x64, 0x4f, 0x6b, 0x7b, 0x1e, 0x55, 0xc0, 0x83,
+	0x6a, 0x6e, 0xed, 0xde, 0x04, 0x31, 0xc8, 0x58, 0x31, 0x97, 0x3d, 0x8d, 0x73, 0x18, 0x3e, 0xdc,
+	0x9a, 0x20, 0x86, 0x74, 0x47, 0xe7, 0x56, 0x73, 0xd6, 0x07, 0x91, 0x44, 0xad, 0x3d, 0x73, 0x01,
+	0x23, 0x17, 0x91, 0x44, 0x4a, 0x20, 0x23, 0x77, 0x26, 0xb4, 0xeb, 0xaf, 0xb8, 0x09, 0x62, 0x44,
+	0x0c, 0x5d, 0x95, 0xff, 0x64, 0x90, 0xdc, 0xd5, 0x18, 0xfd, 0x42, 0xe3, 0x90, 0x12, 0x4c, 0x24,
+	0x9d, 0x2f, 0x72, 0x5d, 0xf5, 0x72, 0x5d, 0x43, 0x82, 0xde, 0x5b, 0x4f, 0xb0, 0x13, 0x19, 0x0b,
+	0x72, 0xd0, 0x15, 0x8a, 0x61, 0xe7, 0xa0, 0x2b, 0x6c, 0x89, 0x4a, 0xac, 0x57, 0x65, 0xe9, 0x09,
+	0x74, 0x26, 0x8f, 0xe5, 0x29, 0x53, 0x7a, 0x91, 0x49, 0xc0, 0x68, 0xad, 0x42, 0x40, 0xdf, 0x10,
+	0xe6, 0x5c, 0x1e, 0xcb, 0x96, 0xa4, 0x52, 0xfe, 0x51, 0x1b, 0x31, 0xce, 0x58, 0x91, 0xc8, 0xae,
+	0xca, 0x7f, 0x30, 0x78, 0xf6, 0xde, 0x1e, 0xcc, 0xff, 0x6c, 0xe3, 0x35, 0x4c, 0x36, 0xd6, 0x3c,
+	0x68, 0x5f, 0x75, 0xab, 0x18, 0xcb, 0xb3, 0x70, 0x9a, 0xe7, 0xe0, 0xef, 0xf3, 0x1c, 0xfe, 0x6b,
+	0x9e, 0x49, 0x6f, 0x9e, 0x2b, 0x98, 0x7f, 0x0e, 0x1e, 0x55, 0x25, 0xf1, 0xfb, 0x1e, 0x77, 0x81,
+	0xdf, 0xc0, 0xb8, 0xec, 0xf8, 0x08, 0x67, 0xba, 0xbc, 0x5e, 0x28, 0xa7, 0x17, 0x7f, 0x40, 0xcb,
+	0x53, 0x57, 0xfe, 0x05, 0x9e, 0x1e, 0x2d, 0x76, 0xce, 0x9a, 0x1d, 0xf2, 0x37, 0x90, 0xee, 0xdd,
+	0x85, 0x03, 0x27, 0x87, 0xde, 0x13, 0x94, 0x5d, 0x07, 0xcf, 0x20, 0xc1, 0x76, 0x9f, 0x14, 0x70,
+	0xba, 0x04, 0x6a, 0xa5, 0x0d, 0xcb, 0x78, 0xb1, 0xfc, 0x00, 0xd3, 0xd5, 0xf9, 0x61, 0xf3, 0x77,
+	0x90, 0xc6, 0xcf, 0xf1, 0x68, 0xdb, 0xc3, 0x7f, 0xf5, 0xa2, 0xa7, 0x45, 0x9e, 0xfc, 0x49, 0xc1,
+	0x6e, 0xd8, 0x3a, 0xa5, 0x5f, 0xe2, 0xed, 0xef, 0x01, 0x00, 0xf3, 0xb2, 0xf6, 0xf3, 0x27, 0x03,
+	0x00, 0x00,
+}
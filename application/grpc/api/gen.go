@@ -0,0 +1,3 @@
+//go:generate protoc --go_out=plugins=grpc:. application.proto
+
+package api
@@ -0,0 +1,469 @@
+// Package grpc implements a gRPC application backend.
+//
+// The backend implements the api.Application service. An application opens
+// a bidirectional stream, authenticated by the AppEUI set as app-eui
+// metadata (and the access key set as access-key metadata when the
+// application config contains an accessKey). The uplink payloads and events
+// of the nodes of the application are sent to all the open streams of the
+// application. The downlink payloads sent by the application are returned
+// by Receive. When the application has a codec configured (see the codec
+// package), the decoded payload is included as (JSON) object and the
+// downlink payload can be given as (JSON) object.
+package grpc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/codec"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/loraserver/application/grpc/api"
+	"github.com/brocaar/loraserver/application/session"
+	"github.com/brocaar/lorawan"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// AccessKeyConfigKey is the key of the application config containing the
+// access key of the application.
+const AccessKeyConfigKey = "accessKey"
+
+// Metadata keys used to authenticate the stream.
+const (
+	AppEUIMetadataKey    = "app-eui"
+	AccessKeyMetadataKey = "access-key"
+)
+
+// ErrBackendClosed is returned when the backend has been closed.
+var ErrBackendClosed = errors.New("application/grpc: backend is closed")
+
+// ErrNotConnected is returned when an uplink payload is sent for an
+// application without open streams.
+var ErrNotConnected = errors.New("application/grpc: application is not connected")
+
+// ErrUnknownNode is returned when a downlink payload is sent for a node
+// which has no node-session.
+var ErrUnknownNode = errors.New("application/grpc: no node-session known for node")
+
+// drainTimeout defines how long a received payload is offered on the Receive
+// channel after the backend has been closed.
+const drainTimeout = time.Second
+
+// stream is an open stream of an application.
+type stream struct {
+	appEUI lorawan.EUI64
+	srv    api.Application_StreamServer
+	mu     sync.Mutex // Send may not be called concurrently
+}
+
+func (s *stream) send(resp *api.StreamResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.srv.Send(resp)
+}
+
+// Backend implements a gRPC application backend.
+type Backend struct {
+	client       *loracontrol.Client
+	txPacketChan chan loracontrol.TXPacket
+	sessions     *session.Index
+
+	mu      sync.RWMutex // protects closed and streams
+	closed  bool
+	streams map[lorawan.EUI64]map[*stream]struct{}
+	closing chan struct{}
+	wg      sync.WaitGroup // in-flight downlink handlers
+}
+
+// Option defines a Backend option.
+type Option func(*Backend)
+
+// SetSessionIndex sets the index used to resolve the node-session of the
+// downlink payloads. Without index, these payloads are rejected with
+// ErrUnknownNode.
+func SetSessionIndex(i *session.Index) Option {
+	return func(b *Backend) {
+		b.sessions = i
+	}
+}
+
+// NewBackend creates a new Backend. Use Register to register the backend
+// as api.Application service on a grpc.Server.
+func NewBackend(opts ...Option) *Backend {
+	b := &Backend{
+		txPacketChan: make(chan loracontrol.TXPacket),
+		streams:      make(map[lorawan.EUI64]map[*stream]struct{}),
+		closing:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Register registers the backend as api.Application service on the given
+// server.
+func (b *Backend) Register(s *grpc.Server) {
+	api.RegisterApplicationServer(s, b)
+}
+
+// SetClient sets the loracontrol.Client and is automatically called by
+// loracontrol.SetApplicationBackend.
+func (b *Backend) SetClient(c *loracontrol.Client) {
+	b.client = c
+}
+
+// Close closes the backend. It waits until the in-flight downlink payloads
+// have been handled and closes the Receive channel. The open streams are
+// ended with an Unavailable error. Close is safe to call multiple times.
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.closing)
+	b.mu.Unlock()
+
+	log.Info("application/grpc: closing backend")
+	b.wg.Wait()
+	close(b.txPacketChan)
+	return nil
+}
+
+// Receive returns the channel with the packets received from the
+// applications. The TXPacket contains the DevAddr, FPort and the
+// (unencrypted) FRMPayload. The network server must set the TXInfo, FCnt
+// and MIC and encrypt the FRMPayload before sending it to the gateway.
+func (b *Backend) Receive() chan loracontrol.TXPacket {
+	return b.txPacketChan
+}
+
+// Send sends the given packets as one UplinkPayload to the open streams of
+// the application. It returns an error when the payload could not be sent
+// to any stream.
+func (b *Backend) Send(appEUI lorawan.EUI64, packets loracontrol.RXPackets) error {
+	if len(packets) == 0 {
+		return errors.New("application/grpc: packets should have length > 0")
+	}
+
+	macPL, ok := packets[0].PHYPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return fmt.Errorf("application/grpc: expected *lorawan.MACPayload, got %T", packets[0].PHYPayload.MACPayload)
+	}
+	if len(macPL.FRMPayload) != 1 {
+		return errors.New("application/grpc: expected exactly 1 FRMPayload")
+	}
+	data, err := macPL.FRMPayload[0].MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	ns, err := b.client.NodeSession().Get(macPL.FHDR.DevAddr)
+	if err != nil {
+		return err
+	}
+
+	pl := &api.UplinkPayload{
+		DevEUI:       ns.DevEUI[:],
+		TimeReceived: packets[0].RXInfo.Time.Format(time.RFC3339Nano),
+		GatewayCount: uint32(len(packets)),
+		FCnt:         macPL.FHDR.FCnt,
+		Port:         uint32(macPL.FPort),
+		Payload:      data,
+	}
+	if app, err := b.client.Application().Get(appEUI); err != nil {
+		log.WithField("app_eui", appEUI).Errorf("application/grpc: could not get application: %s", err)
+	} else if obj, err := codec.Decode(app.Config.String, macPL.FPort, data); err != nil {
+		log.WithField("app_eui", appEUI).Errorf("application/grpc: could not decode payload: %s", err)
+	} else if obj != nil {
+		objJSON, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		pl.Object = string(objJSON)
+	}
+
+	return b.sendToStreams(appEUI, &api.StreamResponse{Uplink: pl})
+}
+
+// SendEvent sends the given event to the open streams of the application.
+func (b *Backend) SendEvent(appEUI lorawan.EUI64, e event.Event) error {
+	pe := &api.Event{
+		Type:   string(e.Type),
+		DevEUI: e.DevEUI[:],
+		Error:  e.Reason,
+		Time:   e.Time.Format(time.RFC3339Nano),
+	}
+	if e.DevAddr != nil {
+		pe.DevAddr = e.DevAddr[:]
+	}
+	if e.FCnt != nil {
+		pe.FCnt = *e.FCnt
+	}
+	if e.Battery != nil {
+		pe.Battery = uint32(*e.Battery)
+	}
+	if e.Margin != nil {
+		pe.Margin = int32(*e.Margin)
+	}
+	return b.sendToStreams(appEUI, &api.StreamResponse{Event: pe})
+}
+
+func (b *Backend) sendToStreams(appEUI lorawan.EUI64, resp *api.StreamResponse) error {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrBackendClosed
+	}
+	var streams []*stream
+	for s := range b.streams[appEUI] {
+		streams = append(streams, s)
+	}
+	b.mu.RUnlock()
+
+	if len(streams) == 0 {
+		return ErrNotConnected
+	}
+
+	var sent int
+	for _, s := range streams {
+		if err := s.send(resp); err != nil {
+			log.WithField("app_eui", appEUI).Errorf("application/grpc: could not send to stream: %s", err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return fmt.Errorf("application/grpc: could not send to any of the %d streams", len(streams))
+	}
+	return nil
+}
+
+// Stream implements the api.ApplicationServer interface.
+func (b *Backend) Stream(srv api.Application_StreamServer) error {
+	appEUI, err := b.authenticate(srv.Context())
+	if err != nil {
+		return err
+	}
+
+	s := &stream{appEUI: appEUI, srv: srv}
+	if err := b.addStream(s); err != nil {
+		return err
+	}
+	defer b.removeStream(s)
+	log.WithField("app_eui", appEUI).Info("application/grpc: stream opened")
+
+	// Recv blocks, so it is called from a separate goroutine in order to end
+	// the stream when the backend is closed.
+	reqChan := make(chan *api.StreamRequest)
+	errChan := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			req, err := srv.Recv()
+			if err != nil {
+				errChan <- err
+				return
+			}
+			select {
+			case reqChan <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case req := <-reqChan:
+			b.handleStreamRequest(s, req)
+		case err := <-errChan:
+			log.WithField("app_eui", appEUI).Info("application/grpc: stream closed")
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-b.closing:
+			return grpc.Errorf(codes.Unavailable, "backend is closed")
+		}
+	}
+}
+
+// authenticate returns the AppEUI of the application when the metadata of
+// the given context contains valid credentials.
+func (b *Backend) authenticate(ctx context.Context) (lorawan.EUI64, error) {
+	var appEUI lorawan.EUI64
+
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		return appEUI, grpc.Errorf(codes.Unauthenticated, "no metadata")
+	}
+	appEUI, err := getAppEUI(md)
+	if err != nil {
+		return appEUI, grpc.Errorf(codes.Unauthenticated, "%s", err)
+	}
+
+	app, err := b.client.Application().Get(appEUI)
+	if err != nil {
+		if err == loracontrol.ErrObjectDoesNotExist {
+			return appEUI, grpc.Errorf(codes.Unauthenticated, "unknown application")
+		}
+		return appEUI, grpc.Errorf(codes.Internal, "%s", err)
+	}
+	if accessKey, ok := app.Config.String[AccessKeyConfigKey]; ok && accessKey != "" {
+		if v := md[AccessKeyMetadataKey]; len(v) != 1 || v[0] != accessKey {
+			return appEUI, grpc.Errorf(codes.Unauthenticated, "invalid access key")
+		}
+	}
+	return appEUI, nil
+}
+
+func (b *Backend) addStream(s *stream) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return grpc.Errorf(codes.Unavailable, "backend is closed")
+	}
+	if _, ok := b.streams[s.appEUI]; !ok {
+		b.streams[s.appEUI] = make(map[*stream]struct{})
+	}
+	b.streams[s.appEUI][s] = struct{}{}
+	return nil
+}
+
+func (b *Backend) removeStream(s *stream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.streams[s.appEUI], s)
+	if len(b.streams[s.appEUI]) == 0 {
+		delete(b.streams, s.appEUI)
+	}
+}
+
+func (b *Backend) handleStreamRequest(s *stream, req *api.StreamRequest) {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return
+	}
+	b.wg.Add(1)
+	b.mu.RUnlock()
+	defer b.wg.Done()
+
+	if req.Downlink == nil {
+		return
+	}
+
+	if err := b.handleDownlinkPayload(s.appEUI, req.Downlink); err != nil {
+		log.WithField("app_eui", s.appEUI).Errorf("application/grpc: could not handle downlink payload: %s", err)
+		if err := s.send(&api.StreamResponse{
+			Event: &api.Event{
+				Type:   string(event.Error),
+				DevEUI: req.Downlink.DevEUI,
+				Error:  err.Error(),
+				Time:   time.Now().Format(time.RFC3339Nano),
+			},
+		}); err != nil {
+			log.WithField("app_eui", s.appEUI).Errorf("application/grpc: could not send error event: %s", err)
+		}
+	}
+}
+
+func (b *Backend) handleDownlinkPayload(appEUI lorawan.EUI64, pl *api.DownlinkPayload) error {
+	var devEUI lorawan.EUI64
+	if len(pl.DevEUI) != len(devEUI) {
+		return fmt.Errorf("application/grpc: a DevEUI is exactly %d bytes", len(devEUI))
+	}
+	copy(devEUI[:], pl.DevEUI)
+	if pl.Port == 0 || pl.Port > 255 {
+		return errors.New("application/grpc: port must be between 1 and 255")
+	}
+
+	// an application is only allowed to send to its own nodes
+	node, err := b.client.Node().Get(devEUI)
+	if err != nil {
+		return err
+	}
+	if node.AppEUI != appEUI {
+		return fmt.Errorf("application/grpc: node %s does not belong to application %s", devEUI, appEUI)
+	}
+
+	if pl.Object != "" {
+		app, err := b.client.Application().Get(appEUI)
+		if err != nil {
+			return err
+		}
+		if pl.Payload, err = codec.Encode(app.Config.String, uint8(pl.Port), json.RawMessage(pl.Object)); err != nil {
+			return err
+		}
+	}
+
+	if b.sessions == nil {
+		return ErrUnknownNode
+	}
+	ns, err := b.sessions.Get(b.client, devEUI)
+	if err != nil {
+		if err == loracontrol.ErrObjectDoesNotExist {
+			return ErrUnknownNode
+		}
+		return err
+	}
+
+	macPL := lorawan.NewMACPayload(false)
+	macPL.FHDR.DevAddr = ns.DevAddr
+	macPL.FPort = uint8(pl.Port)
+	macPL.FRMPayload = []lorawan.Payload{&lorawan.DataPayload{Bytes: pl.Payload}}
+
+	phy := lorawan.NewPHYPayload(false)
+	phy.MHDR = lorawan.MHDR{
+		MType: lorawan.UnconfirmedDataDown,
+		Major: lorawan.LoRaWANR1,
+	}
+	if pl.Confirmed {
+		phy.MHDR.MType = lorawan.ConfirmedDataDown
+	}
+	phy.MACPayload = macPL
+
+	p := loracontrol.TXPacket{PHYPayload: phy}
+	select {
+	case b.txPacketChan <- p:
+	case <-b.closing:
+		// give the consumer some time to receive the in-flight packets
+		select {
+		case b.txPacketChan <- p:
+		case <-time.After(drainTimeout):
+			return ErrBackendClosed
+		}
+	}
+	return nil
+}
+
+// getAppEUI returns the AppEUI from the given metadata.
+func getAppEUI(md metadata.MD) (lorawan.EUI64, error) {
+	var appEUI lorawan.EUI64
+	v := md[AppEUIMetadataKey]
+	if len(v) != 1 {
+		return appEUI, fmt.Errorf("application/grpc: expected exactly one %s metadata value", AppEUIMetadataKey)
+	}
+	b, err := hex.DecodeString(v[0])
+	if err != nil {
+		return appEUI, fmt.Errorf("application/grpc: invalid AppEUI: %s", err)
+	}
+	if len(b) != len(appEUI) {
+		return appEUI, fmt.Errorf("application/grpc: an AppEUI is exactly %d bytes", len(appEUI))
+	}
+	copy(appEUI[:], b)
+	return appEUI, nil
+}
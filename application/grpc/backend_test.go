@@ -0,0 +1,294 @@
+package grpc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/loraserver/application/grpc/api"
+	"github.com/brocaar/loraserver/application/session"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+type config struct {
+	RedisServer   string
+	RedisPassword string
+}
+
+func getConfig() *config {
+	c := &config{
+		RedisServer:   "localhost:6379",
+		RedisPassword: "",
+	}
+
+	if v := os.Getenv("TEST_REDIS_SERVER"); v != "" {
+		c.RedisServer = v
+	}
+	if v := os.Getenv("TEST_REDIS_PASSWORD"); v != "" {
+		c.RedisPassword = v
+	}
+
+	return c
+}
+
+func TestBackend(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a Backend served by a gRPC server", t, func() {
+		sessions := session.NewIndex(loraserver.NewRedisPool(conf.RedisServer, conf.RedisPassword))
+		backend := NewBackend(SetSessionIndex(sessions))
+		server := grpc.NewServer()
+		backend.Register(server)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go server.Serve(ln)
+		defer server.Stop()
+		defer backend.Close()
+
+		c, err := loracontrol.NewClient(
+			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
+			loracontrol.SetGatewayBackend(&loracontrol.DummyGatewayBackend{}),
+			loracontrol.SetApplicationBackend(backend),
+		)
+		So(err, ShouldBeNil)
+		So(c.Storage().FlushAll(), ShouldBeNil)
+
+		appEUI := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+		devEUI := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+		devAddr := lorawan.DevAddr{1, 2, 3, 4}
+		So(c.Application().Create(loracontrol.Application{
+			AppEUI: appEUI,
+			Config: loracontrol.PropertyBag{
+				String: map[string]string{AccessKeyConfigKey: "secret"},
+			},
+		}), ShouldBeNil)
+		So(c.Node().Create(loracontrol.Node{
+			DevEUI: devEUI,
+			AppEUI: appEUI,
+		}), ShouldBeNil)
+		ns := loracontrol.NodeSession{
+			DevAddr: devAddr,
+			DevEUI:  devEUI,
+		}
+		So(c.NodeSession().CreateExpire(ns), ShouldBeNil)
+		So(sessions.Save(ns), ShouldBeNil)
+
+		conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		apiClient := api.NewApplicationClient(conn)
+
+		macPL := lorawan.NewMACPayload(true)
+		macPL.FHDR = lorawan.FHDR{
+			DevAddr: devAddr,
+			FCnt:    10,
+		}
+		macPL.FPort = 1
+		macPL.FRMPayload = []lorawan.Payload{
+			&lorawan.DataPayload{Bytes: []byte("hello")},
+		}
+		phy := lorawan.NewPHYPayload(true)
+		phy.MHDR = lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataUp,
+			Major: lorawan.LoRaWANR1,
+		}
+		phy.MACPayload = macPL
+
+		now := time.Now().UTC()
+		packets := loracontrol.RXPackets{
+			{RXInfo: loracontrol.RXInfo{Time: now}, PHYPayload: phy},
+		}
+
+		Convey("Then Send returns ErrNotConnected when no stream is open", func() {
+			So(backend.Send(appEUI, packets), ShouldEqual, ErrNotConnected)
+		})
+
+		Convey("When opening a stream with an invalid access key", func() {
+			ctx := metadata.NewContext(context.Background(), metadata.Pairs(
+				AppEUIMetadataKey, appEUI.String(),
+				AccessKeyMetadataKey, "invalid",
+			))
+			stream, err := apiClient.Stream(ctx)
+			So(err, ShouldBeNil)
+
+			Convey("Then the stream is ended with an Unauthenticated error", func() {
+				_, err := stream.Recv()
+				So(grpc.Code(err), ShouldEqual, codes.Unauthenticated)
+			})
+		})
+
+		Convey("When opening a stream with valid credentials", func() {
+			ctx := metadata.NewContext(context.Background(), metadata.Pairs(
+				AppEUIMetadataKey, appEUI.String(),
+				AccessKeyMetadataKey, "secret",
+			))
+			stream, err := apiClient.Stream(ctx)
+			So(err, ShouldBeNil)
+
+			// wait until the stream has been registered
+			for i := 0; i < 100; i++ {
+				backend.mu.RLock()
+				n := len(backend.streams[appEUI])
+				backend.mu.RUnlock()
+				if n > 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			Convey("When sending packets", func() {
+				So(backend.Send(appEUI, packets), ShouldBeNil)
+
+				Convey("Then the uplink payload is received by the application", func() {
+					resp, err := stream.Recv()
+					So(err, ShouldBeNil)
+					So(resp.Uplink, ShouldResemble, &api.UplinkPayload{
+						DevEUI:       devEUI[:],
+						TimeReceived: now.Format(time.RFC3339Nano),
+						GatewayCount: 1,
+						FCnt:         10,
+						Port:         1,
+						Payload:      []byte("hello"),
+					})
+				})
+
+				Convey("When the application sends a downlink payload", func() {
+					So(stream.Send(&api.StreamRequest{
+						Downlink: &api.DownlinkPayload{
+							DevEUI:    devEUI[:],
+							Confirmed: true,
+							Port:      5,
+							Payload:   []byte("world"),
+						},
+					}), ShouldBeNil)
+
+					Convey("Then the expected TXPacket is received", func() {
+						txPacket := <-backend.Receive()
+						So(txPacket.PHYPayload.MHDR.MType, ShouldEqual, lorawan.ConfirmedDataDown)
+						txMACPL, ok := txPacket.PHYPayload.MACPayload.(*lorawan.MACPayload)
+						So(ok, ShouldBeTrue)
+						So(txMACPL.FHDR.DevAddr, ShouldEqual, devAddr)
+						So(txMACPL.FPort, ShouldEqual, 5)
+						So(txMACPL.FRMPayload, ShouldResemble, []lorawan.Payload{
+							&lorawan.DataPayload{Bytes: []byte("world")},
+						})
+					})
+				})
+			})
+
+			Convey("When sending an error event", func() {
+				So(backend.SendEvent(appEUI, event.Event{
+					Type:   event.Error,
+					DevEUI: devEUI,
+					Time:   now,
+					Reason: "invalid MIC",
+				}), ShouldBeNil)
+
+				Convey("Then the event is received by the application", func() {
+					resp, err := stream.Recv()
+					So(err, ShouldBeNil)
+					So(resp.Event, ShouldResemble, &api.Event{
+						Type:   string(event.Error),
+						DevEUI: devEUI[:],
+						Error:  "invalid MIC",
+						Time:   now.Format(time.RFC3339Nano),
+					})
+				})
+			})
+
+			Convey("When sending a status event", func() {
+				battery, margin := uint8(200), int8(-3)
+				So(backend.SendEvent(appEUI, event.Event{
+					Type:    event.Status,
+					DevEUI:  devEUI,
+					Time:    now,
+					Battery: &battery,
+					Margin:  &margin,
+				}), ShouldBeNil)
+
+				Convey("Then the event is received by the application", func() {
+					resp, err := stream.Recv()
+					So(err, ShouldBeNil)
+					So(resp.Event, ShouldResemble, &api.Event{
+						Type:    string(event.Status),
+						DevEUI:  devEUI[:],
+						Time:    now.Format(time.RFC3339Nano),
+						Battery: 200,
+						Margin:  -3,
+					})
+				})
+			})
+
+			Convey("When the application sends a downlink payload for an unknown node", func() {
+				unknownEUI := lorawan.EUI64{3, 3, 3, 3, 3, 3, 3, 3}
+				So(stream.Send(&api.StreamRequest{
+					Downlink: &api.DownlinkPayload{
+						DevEUI:  unknownEUI[:],
+						Port:    5,
+						Payload: []byte("world"),
+					},
+				}), ShouldBeNil)
+
+				Convey("Then an error event is received", func() {
+					resp, err := stream.Recv()
+					So(err, ShouldBeNil)
+					So(resp.Event, ShouldNotBeNil)
+					So(resp.Event.Type, ShouldEqual, string(event.Error))
+					So(resp.Event.DevEUI, ShouldResemble, unknownEUI[:])
+				})
+			})
+
+			Convey("When closing the backend", func() {
+				So(backend.Close(), ShouldBeNil)
+
+				Convey("Then the stream is ended with an Unavailable error", func() {
+					_, err := stream.Recv()
+					So(grpc.Code(err), ShouldEqual, codes.Unavailable)
+				})
+
+				Convey("Then the Receive channel is closed", func() {
+					_, ok := <-backend.Receive()
+					So(ok, ShouldBeFalse)
+				})
+
+				Convey("Then Send returns ErrBackendClosed", func() {
+					So(backend.Send(appEUI, packets), ShouldEqual, ErrBackendClosed)
+				})
+			})
+		})
+	})
+}
+
+func TestGetAppEUI(t *testing.T) {
+	Convey("Given a set of test metadata", t, func() {
+		testTable := []struct {
+			MD     metadata.MD
+			AppEUI lorawan.EUI64
+			Error  bool
+		}{
+			{metadata.Pairs(AppEUIMetadataKey, "0102030405060708"), lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, false},
+			{metadata.Pairs(), lorawan.EUI64{}, true},
+			{metadata.Pairs(AppEUIMetadataKey, "zz02030405060708"), lorawan.EUI64{}, true},
+			{metadata.Pairs(AppEUIMetadataKey, "01020304"), lorawan.EUI64{}, true},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Then test %d returns the expected result", i), func() {
+				appEUI, err := getAppEUI(test.MD)
+				So(err != nil, ShouldEqual, test.Error)
+				So(appEUI, ShouldEqual, test.AppEUI)
+			})
+		}
+	})
+}
@@ -2,46 +2,163 @@
 package http
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	h "net/http"
+	"strings"
+	"sync"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/codec"
+	"github.com/brocaar/loraserver/application/delivery"
+	"github.com/brocaar/loraserver/application/event"
 	"github.com/brocaar/lorawan"
 )
 
 // RXPayload is the payload sent to the application backend.
 type RXPayload struct {
-	TimeReceived time.Time `json:"timeReceived"`
-	GatewayCount int       `json:"gatewayCount"`
-	Port         int       `json:"port"`
-	Payload      []byte    `json:"payload"`
+	DevEUI       lorawan.EUI64 `json:"devEUI"`
+	TimeReceived time.Time     `json:"timeReceived"`
+	GatewayCount int           `json:"gatewayCount"`
+	FCnt         uint32        `json:"fCnt"`
+	Port         int           `json:"port"`
+	Payload      []byte        `json:"payload"`
+	Object       interface{}   `json:"object,omitempty"` // decoded by the codec of the application
+}
+
+// Config keys of the urls to which the payloads and events are posted.
+// Each key can contain a comma separated list of urls, in which case the
+// payload or event is posted to all of them.
+const (
+	UplinkURLConfigKey = "uplinkURL"
+	JoinURLConfigKey   = "joinURL"
+	ACKURLConfigKey    = "ackURL"
+	ErrorURLConfigKey  = "errorURL"
+	StatusURLConfigKey = "statusURL"
+
+	// CallbackURLConfigKey is used for the uplink payloads when
+	// UplinkURLConfigKey is not set.
+	CallbackURLConfigKey = "callbackURL"
+
+	// EventCallbackURLConfigKey is used for the events for which no
+	// event specific url is set.
+	EventCallbackURLConfigKey = "eventCallbackURL"
+)
+
+// eventURLConfigKeys maps the event types to the config key of their urls.
+var eventURLConfigKeys = map[event.Type]string{
+	event.Join:   JoinURLConfigKey,
+	event.ACK:    ACKURLConfigKey,
+	event.Error:  ErrorURLConfigKey,
+	event.Status: StatusURLConfigKey,
+}
+
+// Option sets an option on the Backend.
+type Option func(*Backend) error
+
+// SetRetry enables retrying the payloads and events which could not be
+// delivered. Each url has its own retry queue of the given size. A payload
+// is posted at most the given number of attempts, with the given interval
+// (doubled after every attempt) between the attempts.
+func SetRetry(attempts int, interval time.Duration, queueSize int) Option {
+	return func(b *Backend) error {
+		if attempts < 1 {
+			return errors.New("application/http: attempts must be >= 1")
+		}
+		if interval <= 0 {
+			return errors.New("application/http: retry interval must be > 0")
+		}
+		if queueSize < 1 {
+			return errors.New("application/http: retry queue size must be >= 1")
+		}
+		b.retry = retryConfig{
+			attempts:  attempts,
+			interval:  interval,
+			queueSize: queueSize,
+		}
+		return nil
+	}
+}
+
+// SetBatching enables batching of the uplink payloads. The payloads are
+// grouped per application (and url) and posted as a JSON array when the
+// batch contains the given number of payloads or when the given interval
+// has elapsed. See BatchItemStatus for handling partial failures.
+func SetBatching(size int, interval time.Duration) Option {
+	return func(b *Backend) error {
+		if size < 1 {
+			return errors.New("application/http: batch size must be >= 1")
+		}
+		if interval <= 0 {
+			return errors.New("application/http: batch interval must be > 0")
+		}
+		b.batchSize = size
+		b.batchInterval = interval
+		return nil
+	}
 }
 
 // Backend implements a HTTP application backend.
-// It expects that the "callbackURL" config string is set to the url
-// to which it should send the payload for the application. E.g.
+// It expects that the "uplinkURL" (or "callbackURL") config string is set
+// to the url to which it should send the payload for the application. The
+// node events (event.Event) are sent to the "joinURL", "ackURL", "errorURL"
+// and "statusURL" config strings, falling back to "eventCallbackURL" when
+// no url is set for the event type. Each config string can contain a comma
+// separated list of urls. E.g.
 // 		loracontrol.Application{
 //			...
 //			Config: loracontrol.PropertyBag{
 //				String: map[string]string{
-//					"callbackURL": "http://example.com/handler",
+//					"uplinkURL":        "http://example.com/handler,http://staging.example.com/handler",
+//					"joinURL":          "http://example.com/joins",
+//					"errorURL":         "http://example.com/errors",
+//					"eventCallbackURL": "http://example.com/events",
 //				},
 //			},
 //		}
+// When retries are enabled (see SetRetry), every url has its own retry
+// queue, so that a failing url does not affect the delivery to other urls.
+// When batching is enabled (see SetBatching), the uplink payloads are posted
+// as a JSON array and the items which could not be delivered are retried
+// (before the newer payloads) after the retry interval of SetRetry.
+// Send and SendEvent return delivery.ErrQueued when the payload is queued
+// for a retry or batch and a *delivery.PartialError when it could be
+// delivered to a part of the urls only.
+// The zero value posts the payloads without retries or batching, use
+// NewBackend to set these options.
 type Backend struct {
-	client       *loracontrol.Client
-	txPacketChan chan loracontrol.TXPacket
+	client        *loracontrol.Client
+	txPacketChan  chan loracontrol.TXPacket
+	retry         retryConfig
+	batchSize     int
+	batchInterval time.Duration
+	batcher       *batcher
+
+	mu           sync.Mutex // protects destinations
+	destinations map[string]*destination
+	closing      chan struct{}
+	closeOnce    sync.Once
+	wg           sync.WaitGroup
 }
 
 // NewBackend creates a new Backend.
-func NewBackend() *Backend {
-	return &Backend{
+func NewBackend(opts ...Option) (*Backend, error) {
+	b := &Backend{
 		txPacketChan: make(chan loracontrol.TXPacket),
+		retry:        retryConfig{attempts: 1},
+		closing:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+	if b.batchSize > 0 {
+		b.batcher = newBatcher(b.batchSize, b.batchInterval, b.retry.attempts, b.retry.interval)
 	}
+	return b, nil
 }
 
 // SetClient sets the loracontrol.Client and is automatically called by
@@ -50,20 +167,39 @@ func (b *Backend) SetClient(c *loracontrol.Client) {
 	b.client = c
 }
 
-// Close closes the application backend.
+// Close closes the application backend. The pending batches are flushed,
+// payloads still waiting for a retry are dropped (and reported as failed to
+// their callback). Calling Close more than once is a no-op.
 func (b *Backend) Close() error {
+	b.closeOnce.Do(func() {
+		if b.batcher != nil {
+			b.batcher.close()
+		}
+		if b.closing != nil {
+			close(b.closing)
+		}
+		b.wg.Wait()
+	})
 	return nil
 }
 
 // Send sends the given packets as one packet to the application handler.
 func (b *Backend) Send(appEUI lorawan.EUI64, packets loracontrol.RXPackets) error {
+	return b.SendWithCallback(appEUI, packets, nil)
+}
+
+// SendWithCallback sends the given packets like Send. When
+// delivery.ErrQueued is returned, the given callback (when not nil) is
+// called once the payload has been delivered to all urls, or with the first
+// error when it could not be delivered to one of them.
+func (b *Backend) SendWithCallback(appEUI lorawan.EUI64, packets loracontrol.RXPackets, cb delivery.Callback) error {
 	app, err := b.client.Application().Get(appEUI)
 	if err != nil {
 		return err
 	}
-	callbackURL, ok := app.Config.String["callbackURL"]
-	if !ok {
-		return errors.New("application/http: application config does not contain callbackURL")
+	urls := getURLs(app.Config.String, UplinkURLConfigKey, CallbackURLConfigKey)
+	if len(urls) == 0 {
+		return errors.New("application/http: application config does not contain uplinkURL or callbackURL")
 	}
 	if len(packets) == 0 {
 		return errors.New("application/http: packets should have length > 0")
@@ -83,24 +219,194 @@ func (b *Backend) Send(appEUI lorawan.EUI64, packets loracontrol.RXPackets) erro
 		return err
 	}
 
+	ns, err := b.client.NodeSession().Get(macPL.FHDR.DevAddr)
+	if err != nil {
+		return err
+	}
+
 	pl := RXPayload{
+		DevEUI:       ns.DevEUI,
 		TimeReceived: packets[0].RXInfo.Time,
 		GatewayCount: len(packets),
+		FCnt:         macPL.FHDR.FCnt,
 		Port:         int(macPL.FPort),
 		Payload:      data,
 	}
-	data, err = json.Marshal(&pl)
+	if pl.Object, err = codec.Decode(app.Config.String, macPL.FPort, data); err != nil {
+		log.WithField("app_eui", appEUI).Errorf("application/http: could not decode payload: %s", err)
+	}
+
+	if b.batcher != nil {
+		body, err := json.Marshal(&pl)
+		if err != nil {
+			return err
+		}
+		c := newCompletion(cb)
+		for _, url := range urls {
+			b.batcher.add(batchKey{appEUI: appEUI, url: url}, batchItem{body: body, done: c.add()})
+		}
+		c.release()
+		return delivery.ErrQueued
+	}
+	return b.post(urls, &pl, cb)
+}
+
+// SendEvent posts the given event to the url(s) configured for the type
+// of the event.
+func (b *Backend) SendEvent(appEUI lorawan.EUI64, e event.Event) error {
+	app, err := b.client.Application().Get(appEUI)
 	if err != nil {
 		return err
 	}
+	urls := getURLs(app.Config.String, eventURLConfigKeys[e.Type], EventCallbackURLConfigKey)
+	if len(urls) == 0 {
+		return fmt.Errorf("application/http: application config does not contain a url for %s events", e.Type)
+	}
+	return b.post(urls, e, nil)
+}
 
-	resp, err := h.Post(callbackURL, "application/json", bytes.NewReader(data))
+// post posts the given value (JSON encoded) to all the given urls. When
+// the value could not be delivered to any of the urls, the first error is
+// returned. When it was delivered to (or queued for) a part of the urls only,
+// a *delivery.PartialError is returned, so that the caller does not deliver
+// it again to the other urls. delivery.ErrQueued is returned when it was
+// queued for a retry for one or more urls, in which case the given callback
+// (when not nil) is called with the final result.
+func (b *Backend) post(urls []string, v interface{}, cb delivery.Callback) error {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != h.StatusOK && resp.StatusCode != h.StatusCreated {
-		return fmt.Errorf("application/http: expected 200 or 201 response code, got: %d", resp.StatusCode)
+
+	c := newCompletion(cb)
+	var firstErr error
+	var accepted, queued int
+	for _, url := range urls {
+		done := c.add()
+		err := b.getDestination(url).send(data, done)
+		if err != delivery.ErrQueued {
+			done(err)
+		}
+		switch err {
+		case nil:
+			accepted++
+		case delivery.ErrQueued:
+			accepted++
+			queued++
+		default:
+			log.WithField("url", url).Errorf("application/http: delivery failed: %s", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	switch {
+	case firstErr != nil && accepted > 0:
+		c.cancel()
+		return &delivery.PartialError{Err: firstErr}
+	case firstErr != nil:
+		c.cancel()
+		return firstErr
+	case queued > 0:
+		c.release()
+		return delivery.ErrQueued
+	}
+	c.cancel()
+	return nil
+}
+
+// completion calls the callback of a payload once the payload has been
+// handled for all its urls (with the first error, if any).
+type completion struct {
+	mu        sync.Mutex
+	cb        delivery.Callback
+	remaining int // number of pending results, including the sender
+	err       error
+}
+
+// newCompletion returns a new completion for the given callback (which can
+// be nil). The callback is not called until release has been called.
+func newCompletion(cb delivery.Callback) *completion {
+	return &completion{cb: cb, remaining: 1}
+}
+
+// add adds a pending result and returns the function to call with it.
+func (c *completion) add() func(error) {
+	c.mu.Lock()
+	c.remaining++
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() { c.done(err) })
+	}
+}
+
+// release releases the sender, so that the callback is called when all
+// pending results have been reported.
+func (c *completion) release() {
+	c.done(nil)
+}
+
+// cancel releases the sender without calling the callback, as the result
+// has been returned to the caller.
+func (c *completion) cancel() {
+	c.mu.Lock()
+	c.cb = nil
+	c.mu.Unlock()
+	c.done(nil)
+}
+
+func (c *completion) done(err error) {
+	c.mu.Lock()
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	c.remaining--
+	var cb delivery.Callback
+	if c.remaining == 0 {
+		cb = c.cb
+	}
+	c.mu.Unlock()
+
+	if cb != nil {
+		cb(c.err)
+	}
+}
+
+// getDestination returns the destination for the given url, creating it
+// when it does not exist yet.
+func (b *Backend) getDestination(url string) *destination {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.destinations == nil {
+		b.destinations = make(map[string]*destination)
+	}
+	d, ok := b.destinations[url]
+	if !ok {
+		d = newDestination(url, b.retry, b.closing, &b.wg)
+		b.destinations[url] = d
+	}
+	return d
+}
+
+// getURLs returns the urls of the first of the given config keys which is
+// set.
+func getURLs(config map[string]string, keys ...string) []string {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		var urls []string
+		for _, url := range strings.Split(config[key], ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			return urls
+		}
 	}
 	return nil
 }
@@ -3,6 +3,7 @@ package http
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +12,8 @@ import (
 	"time"
 
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/codec"
+	"github.com/brocaar/loraserver/application/event"
 	"github.com/brocaar/lorawan"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -40,6 +43,7 @@ type testApplicationHandler struct {
 	responseCode int
 	time         time.Time
 	data         []byte
+	object       interface{}
 }
 
 func (h *testApplicationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -60,11 +64,17 @@ func (h *testApplicationHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if pl.DevEUI != (lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	if pl.GatewayCount != 2 {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	h.object = pl.Object
 	w.WriteHeader(h.responseCode)
 }
 
@@ -72,10 +82,13 @@ func TestBackend(t *testing.T) {
 	conf := getConfig()
 
 	Convey("Given a Client, clean Redis database an HTTP application backend", t, func() {
+		backend, err := NewBackend()
+		So(err, ShouldBeNil)
+		defer backend.Close()
 		c, err := loracontrol.NewClient(
 			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
 			loracontrol.SetGatewayBackend(&loracontrol.DummyGatewayBackend{}),
-			loracontrol.SetApplicationBackend(&Backend{}),
+			loracontrol.SetApplicationBackend(backend),
 		)
 		So(err, ShouldBeNil)
 		So(c.Storage().FlushAll(), ShouldBeNil)
@@ -84,6 +97,124 @@ func TestBackend(t *testing.T) {
 			h := &testApplicationHandler{}
 			s := httptest.NewServer(h)
 
+			Convey("Given an application with an eventCallbackURL in the database", func() {
+				eventChan := make(chan event.Event, 1)
+				es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					var e event.Event
+					if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+					eventChan <- e
+				}))
+				defer es.Close()
+
+				app := loracontrol.Application{
+					AppEUI: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+					Config: loracontrol.PropertyBag{
+						String: map[string]string{
+							"callbackURL":      s.URL,
+							"eventCallbackURL": es.URL,
+						},
+					},
+				}
+				So(c.Application().Create(app), ShouldBeNil)
+
+				Convey("Given an errorURL with two urls for the application", func() {
+					errorChan := make(chan event.Event, 2)
+					errorHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						var e event.Event
+						if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+							w.WriteHeader(http.StatusBadRequest)
+							return
+						}
+						errorChan <- e
+					})
+					es1 := httptest.NewServer(errorHandler)
+					defer es1.Close()
+					es2 := httptest.NewServer(errorHandler)
+					defer es2.Close()
+
+					app.Config.String[ErrorURLConfigKey] = es1.URL + "," + es2.URL
+					So(c.Application().Update(app), ShouldBeNil)
+
+					Convey("Then SendEvent posts error events to both urls", func() {
+						So(backend.SendEvent(app.AppEUI, event.Event{Type: event.Error, Reason: "invalid MIC"}), ShouldBeNil)
+						So((<-errorChan).Reason, ShouldEqual, "invalid MIC")
+						So((<-errorChan).Reason, ShouldEqual, "invalid MIC")
+						So(eventChan, ShouldHaveLength, 0)
+					})
+				})
+
+				Convey("Given a joinURL and an ackURL for the application", func() {
+					joinChan := make(chan event.Event, 1)
+					js := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						var e event.Event
+						if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+							w.WriteHeader(http.StatusBadRequest)
+							return
+						}
+						joinChan <- e
+					}))
+					defer js.Close()
+					ackChan := make(chan event.Event, 1)
+					as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						var e event.Event
+						if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+							w.WriteHeader(http.StatusBadRequest)
+							return
+						}
+						ackChan <- e
+					}))
+					defer as.Close()
+
+					app.Config.String[JoinURLConfigKey] = js.URL
+					app.Config.String[ACKURLConfigKey] = as.URL
+					So(c.Application().Update(app), ShouldBeNil)
+
+					Convey("Then SendEvent posts join events to the joinURL", func() {
+						devAddr := lorawan.DevAddr{1, 2, 3, 4}
+						So(backend.SendEvent(app.AppEUI, event.Event{Type: event.Join, DevAddr: &devAddr}), ShouldBeNil)
+						e := <-joinChan
+						So(e.Type, ShouldEqual, event.Join)
+						So(*e.DevAddr, ShouldEqual, devAddr)
+						So(ackChan, ShouldHaveLength, 0)
+						So(eventChan, ShouldHaveLength, 0)
+					})
+
+					Convey("Then SendEvent posts ack events to the ackURL", func() {
+						fCnt := uint32(12)
+						So(backend.SendEvent(app.AppEUI, event.Event{Type: event.ACK, FCnt: &fCnt}), ShouldBeNil)
+						e := <-ackChan
+						So(e.Type, ShouldEqual, event.ACK)
+						So(*e.FCnt, ShouldEqual, 12)
+						So(joinChan, ShouldHaveLength, 0)
+						So(eventChan, ShouldHaveLength, 0)
+					})
+
+					Convey("Then SendEvent posts status events to the eventCallbackURL", func() {
+						So(backend.SendEvent(app.AppEUI, event.Event{Type: event.Status}), ShouldBeNil)
+						So((<-eventChan).Type, ShouldEqual, event.Status)
+						So(joinChan, ShouldHaveLength, 0)
+						So(ackChan, ShouldHaveLength, 0)
+					})
+				})
+
+				Convey("Then SendEvent posts the event to the eventCallbackURL", func() {
+					e := event.Event{
+						Type:   event.Error,
+						DevEUI: lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1},
+						Time:   time.Now().UTC(),
+						Reason: "invalid MIC",
+					}
+					So(backend.SendEvent(app.AppEUI, e), ShouldBeNil)
+					out := <-eventChan
+					So(out.Time.Equal(e.Time), ShouldBeTrue)
+					out.Time = e.Time
+					So(out, ShouldResemble, e)
+				})
+			})
+
 			Convey("Given a test RXPackets", func() {
 				macPl := lorawan.NewMACPayload(true)
 				macPl.FHDR = lorawan.FHDR{
@@ -101,6 +232,11 @@ func TestBackend(t *testing.T) {
 				}
 				phy.MACPayload = macPl
 
+				So(c.NodeSession().CreateExpire(loracontrol.NodeSession{
+					DevAddr: macPl.FHDR.DevAddr,
+					DevEUI:  lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+				}), ShouldBeNil)
+
 				now := time.Now().UTC()
 				packets := loracontrol.RXPackets{
 					loracontrol.RXPacket{RXInfo: loracontrol.RXInfo{Time: now}, PHYPayload: phy},
@@ -136,6 +272,26 @@ func TestBackend(t *testing.T) {
 					})
 				})
 
+				Convey("Given an application with a codec in the database", func() {
+					app := loracontrol.Application{
+						AppEUI: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+						Config: loracontrol.PropertyBag{
+							String: map[string]string{
+								"callbackURL":               s.URL,
+								codec.TypeConfigKey:         string(codec.CustomJSType),
+								codec.DecodeScriptConfigKey: "function Decode(fPort, bytes) { return {length: bytes.length}; }",
+							},
+						},
+					}
+					So(c.Application().Create(app), ShouldBeNil)
+
+					Convey("Then the decoded object is sent to the handler", func() {
+						h.responseCode = 200
+						So(c.Application().Send(app.AppEUI, packets), ShouldBeNil)
+						So(h.object, ShouldResemble, map[string]interface{}{"length": float64(5)})
+					})
+				})
+
 				Convey("When sending to a non-existing application, Send returns an error", func() {
 					So(c.Application().Send(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, packets), ShouldResemble, loracontrol.ErrObjectDoesNotExist)
 				})
@@ -143,3 +299,86 @@ func TestBackend(t *testing.T) {
 		})
 	})
 }
+
+func TestGetURLs(t *testing.T) {
+	Convey("Given an application config", t, func() {
+		config := map[string]string{
+			UplinkURLConfigKey:        "http://a/uplink, http://b/uplink",
+			CallbackURLConfigKey:      "http://a/callback",
+			JoinURLConfigKey:          " ",
+			ErrorURLConfigKey:         "http://a/errors",
+			EventCallbackURLConfigKey: "http://a/events",
+		}
+
+		Convey("Then getURLs returns the urls of the first key which is set", func() {
+			So(getURLs(config, UplinkURLConfigKey, CallbackURLConfigKey), ShouldResemble, []string{"http://a/uplink", "http://b/uplink"})
+			So(getURLs(config, JoinURLConfigKey, EventCallbackURLConfigKey), ShouldResemble, []string{"http://a/events"})
+			So(getURLs(config, ErrorURLConfigKey, EventCallbackURLConfigKey), ShouldResemble, []string{"http://a/errors"})
+			So(getURLs(config, "", EventCallbackURLConfigKey), ShouldResemble, []string{"http://a/events"})
+			So(getURLs(config, JoinURLConfigKey), ShouldHaveLength, 0)
+		})
+	})
+}
+
+func TestBackendClose(t *testing.T) {
+	Convey("Given a backend with retries and batching enabled", t, func() {
+		backend, err := NewBackend(SetRetry(3, time.Millisecond, 10), SetBatching(10, time.Second))
+		So(err, ShouldBeNil)
+
+		Convey("Then it can be closed more than once", func() {
+			So(backend.Close(), ShouldBeNil)
+			So(backend.Close(), ShouldBeNil)
+		})
+	})
+}
+
+func TestBackendZeroValue(t *testing.T) {
+	Convey("Given a zero value Backend", t, func() {
+		backend := &Backend{}
+
+		Convey("Then getDestination creates the destination", func() {
+			d := backend.getDestination("http://localhost/")
+			So(d, ShouldNotBeNil)
+			So(backend.getDestination("http://localhost/"), ShouldEqual, d)
+		})
+
+		Convey("Then it can be closed", func() {
+			So(backend.Close(), ShouldBeNil)
+		})
+	})
+}
+
+func TestCompletion(t *testing.T) {
+	Convey("Given a completion with a callback", t, func() {
+		results := make(chan error, 10)
+		c := newCompletion(func(err error) { results <- err })
+
+		Convey("When two pending results are added", func() {
+			done1 := c.add()
+			done2 := c.add()
+
+			Convey("Then the callback is called with the first error after the release", func() {
+				done1(nil)
+				done2(errors.New("BOOM!"))
+				So(results, ShouldHaveLength, 0)
+				c.release()
+				So(<-results, ShouldResemble, errors.New("BOOM!"))
+			})
+
+			Convey("Then the callback is called after the last result when released first", func() {
+				c.release()
+				done1(nil)
+				So(results, ShouldHaveLength, 0)
+				done2(nil)
+				So(<-results, ShouldBeNil)
+			})
+
+			Convey("Then the callback is not called when canceled", func() {
+				c.cancel()
+				done1(nil)
+				done2(nil)
+				So(results, ShouldHaveLength, 0)
+			})
+		})
+	})
+}
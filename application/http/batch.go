@@ -0,0 +1,328 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	h "net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/lorawan"
+)
+
+// BatchItemStatus is the status of a single item of a batch. When only a
+// part of the items of a batch could be handled, the endpoint must respond
+// with 207 (Multi-Status) and a JSON array containing the status of each
+// item (in the order of the batch).
+type BatchItemStatus struct {
+	Status int    `json:"status"`          // 200 or 201 when the item was handled
+	Error  string `json:"error,omitempty"` // optional description of the error
+}
+
+// batchKey identifies a batch.
+type batchKey struct {
+	appEUI lorawan.EUI64
+	url    string
+}
+
+// batchItem is a (JSON encoded) payload within a batch.
+type batchItem struct {
+	body     json.RawMessage
+	attempts int
+	done     func(error) // called with the final result (can be nil)
+}
+
+// complete reports the final result of the item.
+func (i batchItem) complete(err error) {
+	if i.done != nil {
+		i.done(err)
+	}
+}
+
+// batch contains the items waiting to be posted to an url, in the order in
+// which they must be delivered.
+type batch struct {
+	items    []batchItem
+	timer    *time.Timer   // pending (interval or retry) flush, nil when not scheduled
+	flushing bool          // a flush of the batch is in progress
+	delay    time.Duration // delay before retrying the rejected items, 0 when the last flush succeeded
+}
+
+// batcher groups the payloads per application and url into batches, which
+// are posted as a JSON array when the batch contains size items or when
+// the interval since the first item was added has elapsed. At most one
+// batch per application and url is posted at a time. The items which were
+// rejected are put in front of the pending items and are retried after the
+// retry interval (doubled after every failed flush), until the max. number
+// of attempts has been reached. This way the items of a node are posted in
+// order, except for the items which follow a rejected item within the same
+// batch.
+type batcher struct {
+	size          int
+	interval      time.Duration
+	attempts      int
+	retryInterval time.Duration
+
+	mu      sync.Mutex // protects batches, their state and closed
+	batches map[batchKey]*batch
+	closed  bool
+	wg      sync.WaitGroup // pending timers
+}
+
+func newBatcher(size int, interval time.Duration, attempts int, retryInterval time.Duration) *batcher {
+	return &batcher{
+		size:          size,
+		interval:      interval,
+		attempts:      attempts,
+		retryInterval: retryInterval,
+		batches:       make(map[batchKey]*batch),
+	}
+}
+
+// add adds the given items to the batch of the given key. When the batch
+// is full (and no retry is pending), it is flushed.
+func (b *batcher) add(key batchKey, items ...batchItem) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		retryDroppedCount.Add(key.url, int64(len(items)))
+		log.WithField("url", key.url).Warning("application/http: backend closed, dropping batch items")
+		for _, item := range items {
+			item.complete(errClosed)
+		}
+		return
+	}
+
+	bt, ok := b.batches[key]
+	if !ok {
+		bt = &batch{}
+		b.batches[key] = bt
+	}
+	bt.items = append(bt.items, items...)
+
+	switch {
+	case bt.flushing:
+		// the items are handled when the flush has completed
+	case b.ready(bt):
+		if bt.timer != nil {
+			if !bt.timer.Stop() {
+				return // the timer has fired and flushes the batch
+			}
+			b.wg.Done()
+			bt.timer = nil
+		}
+		b.flush(key, bt)
+	default:
+		b.schedule(key, bt)
+	}
+}
+
+// ready returns true when the items of the given batch can be flushed
+// immediately. It must be called with the lock held.
+func (b *batcher) ready(bt *batch) bool {
+	if len(bt.items) == 0 {
+		return false
+	}
+	return b.closed || (bt.delay == 0 && len(bt.items) >= b.size)
+}
+
+// schedule starts the timer flushing the given batch after the interval
+// (or the retry delay), or removes the batch when it is empty. It must be
+// called with the lock held.
+func (b *batcher) schedule(key batchKey, bt *batch) {
+	if len(bt.items) == 0 {
+		delete(b.batches, key)
+		return
+	}
+	if bt.timer != nil {
+		return
+	}
+
+	d := b.interval
+	if bt.delay > 0 {
+		d = bt.delay
+	}
+	b.wg.Add(1)
+	bt.timer = time.AfterFunc(d, func() {
+		defer b.wg.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		bt.timer = nil
+		b.flush(key, bt)
+	})
+}
+
+// flush posts the items of the given batch (at most size items per post)
+// until the remaining items are not ready to be posted. It must be called
+// with the lock held, which is released while posting.
+func (b *batcher) flush(key batchKey, bt *batch) {
+	for {
+		n := len(bt.items)
+		if n > b.size {
+			n = b.size
+		}
+		items := make([]batchItem, n)
+		copy(items, bt.items)
+		bt.items = bt.items[n:]
+		bt.flushing = true
+		closed := b.closed
+
+		b.mu.Unlock()
+		retry := b.post(key.url, items, closed)
+		b.mu.Lock()
+
+		bt.flushing = false
+		if len(retry) > 0 {
+			bt.items = append(retry, bt.items...)
+			bt.delay = b.nextDelay(bt.delay)
+		} else {
+			bt.delay = 0
+		}
+
+		if !b.ready(bt) {
+			b.schedule(key, bt)
+			return
+		}
+	}
+}
+
+// nextDelay returns the retry delay following the given delay.
+func (b *batcher) nextDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return b.retryInterval
+	}
+	if delay *= 2; delay > maxRetryInterval {
+		delay = maxRetryInterval
+	}
+	return delay
+}
+
+// post posts the given items to the given url and returns the (rejected)
+// items which must be retried. The rejected items are dropped when the max.
+// number of attempts has been reached or when dropRejected is set.
+func (b *batcher) post(url string, items []batchItem, dropRejected bool) []batchItem {
+	bodies := make([]json.RawMessage, len(items))
+	for i := range items {
+		items[i].attempts++
+		bodies[i] = items[i].body
+	}
+
+	failed, err := postBatch(url, bodies)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":   url,
+			"items": len(items),
+		}).Warningf("application/http: batch delivery failed: %s", err)
+		failed = make([]int, len(items))
+		for i := range failed {
+			failed[i] = i
+		}
+	}
+
+	rejected := make([]bool, len(items))
+	for _, i := range failed {
+		rejected[i] = true
+	}
+
+	var retry []batchItem
+	for i, item := range items {
+		if !rejected[i] {
+			item.complete(nil)
+			continue
+		}
+		if !dropRejected && item.attempts < b.attempts {
+			retry = append(retry, item)
+			continue
+		}
+		retryDroppedCount.Add(url, 1)
+		log.WithField("url", url).Errorf("application/http: delivery of batch item failed after %d attempts, dropping item", item.attempts)
+		if err == nil {
+			err = errors.New("application/http: batch item rejected")
+		}
+		item.complete(err)
+	}
+	if len(retry) > 0 {
+		retryQueuedCount.Add(url, int64(len(retry)))
+	}
+	return retry
+}
+
+// close flushes the pending batches (without waiting for the retry delay)
+// and waits until the flushes have completed. Items which could not be
+// delivered are dropped.
+func (b *batcher) close() {
+	b.mu.Lock()
+	b.closed = true
+	keys := make([]batchKey, 0, len(b.batches))
+	for key := range b.batches {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		bt, ok := b.batches[key]
+		if !ok || bt.flushing {
+			continue
+		}
+		if bt.timer != nil {
+			if !bt.timer.Stop() {
+				continue // the timer has fired and flushes the batch
+			}
+			b.wg.Done()
+			bt.timer = nil
+		}
+		b.flush(key, bt)
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+}
+
+// postBatch posts the given items as a JSON array to the given url. It
+// returns the indices of the items which were rejected by the endpoint, or
+// an error when the batch as a whole could not be delivered. When a 207
+// response does not contain a status for every item, the items without
+// status are considered rejected.
+func postBatch(url string, items []json.RawMessage) ([]int, error) {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case h.StatusOK, h.StatusCreated:
+		return nil, nil
+	case 207: // Multi-Status
+		var statuses []BatchItemStatus
+		if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+			return nil, fmt.Errorf("application/http: decode item statuses error: %s", err)
+		}
+		if len(statuses) != len(items) {
+			log.WithField("url", url).Warningf("application/http: expected %d item statuses, got: %d (items without status are retried)", len(items), len(statuses))
+		}
+		var failed []int
+		for i := range items {
+			if i >= len(statuses) {
+				failed = append(failed, i)
+				continue
+			}
+			if s := statuses[i]; s.Status != h.StatusOK && s.Status != h.StatusCreated {
+				log.WithFields(log.Fields{
+					"url":    url,
+					"status": s.Status,
+				}).Warningf("application/http: batch item rejected: %s", s.Error)
+				failed = append(failed, i)
+			}
+		}
+		return failed, nil
+	default:
+		return nil, fmt.Errorf("application/http: expected 200, 201 or 207 response code, got: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,234 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testBatchHandler struct {
+	sync.Mutex
+	statuses [][]BatchItemStatus // responses (207) for the next batches, 200 when empty
+	batches  chan []string
+}
+
+func (h *testBatchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var items []string
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	h.Lock()
+	var statuses []BatchItemStatus
+	if len(h.statuses) > 0 {
+		statuses = h.statuses[0]
+		h.statuses = h.statuses[1:]
+	}
+	h.Unlock()
+
+	h.batches <- items
+	if statuses == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(207)
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func TestBatcher(t *testing.T) {
+	Convey("Given a test batch handler server", t, func() {
+		h := &testBatchHandler{batches: make(chan []string, 10)}
+		s := httptest.NewServer(h)
+		defer s.Close()
+
+		key := batchKey{appEUI: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, url: s.URL}
+		item := func(v string) batchItem {
+			return batchItem{body: json.RawMessage(`"` + v + `"`)}
+		}
+
+		Convey("Given a batcher with size 2", func() {
+			b := newBatcher(2, time.Hour, 2, 100*time.Millisecond)
+
+			Convey("When adding two items", func() {
+				b.add(key, item("a"))
+				b.add(key, item("b"))
+
+				Convey("Then the batch is posted", func() {
+					So(<-h.batches, ShouldResemble, []string{"a", "b"})
+					So(b.batches, ShouldHaveLength, 0)
+				})
+			})
+
+			Convey("When adding one item and closing the batcher", func() {
+				b.add(key, item("a"))
+				b.close()
+
+				Convey("Then the pending batch is posted", func() {
+					So(<-h.batches, ShouldResemble, []string{"a"})
+				})
+			})
+
+			Convey("When the handler rejects one item of the batch", func() {
+				h.statuses = [][]BatchItemStatus{
+					{{Status: 200}, {Status: 500, Error: "storage error"}},
+				}
+				b.add(key, item("a"))
+				b.add(key, item("b"))
+				So(<-h.batches, ShouldResemble, []string{"a", "b"})
+
+				Convey("Then the rejected item is retried before the new items after the retry interval", func() {
+					b.add(key, item("c"))
+					b.add(key, item("d"))
+					So(h.batches, ShouldHaveLength, 0)
+					So(<-h.batches, ShouldResemble, []string{"b", "c"})
+					b.close()
+					So(<-h.batches, ShouldResemble, []string{"d"})
+				})
+			})
+
+			Convey("When the handler returns a status for the first item only", func() {
+				h.statuses = [][]BatchItemStatus{
+					{{Status: 200}},
+				}
+				b.add(key, item("a"))
+				b.add(key, item("b"))
+				So(<-h.batches, ShouldResemble, []string{"a", "b"})
+
+				Convey("Then only the item without status is retried", func() {
+					b.close()
+					So(<-h.batches, ShouldResemble, []string{"b"})
+				})
+			})
+
+			Convey("When the handler rejects the item again after the max. attempts", func() {
+				h.statuses = [][]BatchItemStatus{
+					{{Status: 500}, {Status: 200}},
+					{{Status: 500}, {Status: 200}},
+				}
+				b.add(key, item("a"))
+				b.add(key, item("b"))
+				So(<-h.batches, ShouldResemble, []string{"a", "b"})
+				b.add(key, item("c"))
+				So(<-h.batches, ShouldResemble, []string{"a", "c"})
+
+				Convey("Then the item is dropped", func() {
+					b.close()
+					So(h.batches, ShouldHaveLength, 0)
+					So(b.batches, ShouldHaveLength, 0)
+				})
+			})
+		})
+
+		Convey("Given a batcher reporting the results of the items", func() {
+			b := newBatcher(2, time.Hour, 2, time.Millisecond)
+			results := make(chan error, 10)
+			reported := func(v string) batchItem {
+				i := item(v)
+				i.done = func(err error) { results <- err }
+				return i
+			}
+
+			Convey("When the handler rejects an item for all attempts", func() {
+				h.statuses = [][]BatchItemStatus{
+					{{Status: 200}, {Status: 500}},
+					{{Status: 500}},
+				}
+				b.add(key, reported("a"))
+				b.add(key, reported("b"))
+				So(<-h.batches, ShouldResemble, []string{"a", "b"})
+				So(<-results, ShouldBeNil)
+
+				Convey("Then the failure of the rejected item is reported", func() {
+					b.close()
+					So(<-h.batches, ShouldResemble, []string{"b"})
+					So(<-results, ShouldNotBeNil)
+				})
+			})
+
+			Convey("When adding an item after closing", func() {
+				b.close()
+				b.add(key, reported("a"))
+
+				Convey("Then the item is reported as dropped", func() {
+					So(<-results, ShouldEqual, errClosed)
+				})
+			})
+		})
+
+		Convey("Given a batcher with a short interval", func() {
+			b := newBatcher(10, 10*time.Millisecond, 1, 0)
+			defer b.close()
+
+			Convey("Then the batch is posted after the interval", func() {
+				b.add(key, item("a"))
+				So(<-h.batches, ShouldResemble, []string{"a"})
+			})
+		})
+	})
+}
+
+func TestPostBatch(t *testing.T) {
+	Convey("Given a test server responding with the configured status", t, func() {
+		var code int
+		var body string
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			w.Write([]byte(body))
+		}))
+		defer s.Close()
+
+		items := []json.RawMessage{json.RawMessage(`1`), json.RawMessage(`2`)}
+
+		Convey("Then postBatch returns no failed items on 200", func() {
+			code = 200
+			failed, err := postBatch(s.URL, items)
+			So(err, ShouldBeNil)
+			So(failed, ShouldHaveLength, 0)
+		})
+
+		Convey("Then postBatch returns the failed items on 207", func() {
+			code = 207
+			body = `[{"status": 201}, {"status": 400, "error": "invalid"}]`
+			failed, err := postBatch(s.URL, items)
+			So(err, ShouldBeNil)
+			So(failed, ShouldResemble, []int{1})
+		})
+
+		Convey("Then postBatch returns the items without status as failed on 207", func() {
+			code = 207
+			body = `[{"status": 201}]`
+			failed, err := postBatch(s.URL, items)
+			So(err, ShouldBeNil)
+			So(failed, ShouldResemble, []int{1})
+		})
+
+		Convey("Then postBatch returns an error on 500", func() {
+			code = 500
+			_, err := postBatch(s.URL, items)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Then postBatch returns an error when the server does not respond in time", func() {
+			block := make(chan struct{})
+			slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-block
+			}))
+			defer slow.Close()
+			defer close(block)
+
+			client := httpClient
+			httpClient = &http.Client{Timeout: 10 * time.Millisecond}
+			defer func() { httpClient = client }()
+
+			_, err := postBatch(slow.URL, items)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
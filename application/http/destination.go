@@ -0,0 +1,220 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	h "net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loraserver/application/delivery"
+)
+
+var (
+	// retryQueuedCount contains the number of payloads (per url) queued
+	// for a retry.
+	retryQueuedCount = expvar.NewMap("application_http_retry_queued")
+
+	// retryDroppedCount contains the number of payloads (per url) dropped
+	// because the retry queue was full or all attempts failed.
+	retryDroppedCount = expvar.NewMap("application_http_retry_dropped")
+)
+
+const (
+	// maxRetryInterval defines the max. interval between two attempts.
+	maxRetryInterval = time.Minute
+
+	// postTimeout defines the max. duration of a post (including reading
+	// the response).
+	postTimeout = 10 * time.Second
+)
+
+// httpClient is the client used to post the payloads and batches. Its
+// timeout makes sure that a hanging endpoint does not block the delivery
+// (and the lock of the destination) forever.
+var httpClient = &h.Client{Timeout: postTimeout}
+
+// ErrRetryQueueFull is returned when a payload could not be delivered and
+// the retry queue of the destination is full.
+var ErrRetryQueueFull = errors.New("application/http: retry queue is full")
+
+// retryConfig contains the retry configuration of the destinations.
+type retryConfig struct {
+	attempts  int           // max. number of delivery attempts (1 = no retry)
+	interval  time.Duration // interval before the first retry, doubled after every retry
+	queueSize int           // max. number of payloads waiting for a retry
+}
+
+// errClosed is reported for the queued payloads which are dropped because
+// the backend has been closed.
+var errClosed = errors.New("application/http: backend closed before the payload was delivered")
+
+// retryItem is a payload waiting for a retry.
+type retryItem struct {
+	body     []byte
+	attempts int
+	done     func(error) // called with the final result (can be nil)
+}
+
+// complete reports the final result of the item.
+func (i retryItem) complete(err error) {
+	if i.done != nil {
+		i.done(err)
+	}
+}
+
+// destination is an url to which payloads are posted. Each destination has
+// its own retry state: the payloads which could not be delivered are retried
+// (in order) by the goroutine of the destination, without blocking the
+// delivery to other destinations. While payloads are waiting for a retry,
+// new payloads are queued behind them.
+type destination struct {
+	url     string
+	retry   retryConfig
+	queue   chan retryItem
+	closing chan struct{}
+
+	mu      sync.Mutex // protects pending and serializes send
+	pending int        // number of queued payloads (including the one being retried)
+}
+
+// newDestination creates a new destination. When retries are enabled, the
+// retry goroutine is started (and wg.Done is called when it returns after
+// closing has been closed).
+func newDestination(url string, retry retryConfig, closing chan struct{}, wg *sync.WaitGroup) *destination {
+	d := &destination{
+		url:     url,
+		retry:   retry,
+		closing: closing,
+	}
+	if retry.attempts > 1 {
+		d.queue = make(chan retryItem, retry.queueSize)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.retryLoop()
+		}()
+	}
+	return d
+}
+
+// send posts the given body. When retries are enabled, the body is queued
+// for a retry when it could not be delivered (or when other bodies are
+// waiting for a retry) and delivery.ErrQueued is returned. In this case,
+// done (when not nil) is called with the final result. An other error is
+// returned when the body could not be delivered or queued.
+// The lock is held while posting, so that a body can't overtake a body which
+// is queued by a concurrent send (the payloads are delivered in order).
+func (d *destination) send(body []byte, done func(error)) error {
+	if d.queue == nil {
+		return post(d.url, body)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	item := retryItem{body: body, done: done}
+	if d.pending == 0 {
+		item.attempts++
+		err := post(d.url, body)
+		if err == nil {
+			return nil
+		}
+		log.WithField("url", d.url).Warningf("application/http: delivery failed, queueing for retry: %s", err)
+	}
+	return d.enqueue(item)
+}
+
+// enqueue queues the given item for a retry. The caller must hold the lock.
+func (d *destination) enqueue(item retryItem) error {
+	select {
+	case d.queue <- item:
+		d.pending++
+		retryQueuedCount.Add(d.url, 1)
+		return delivery.ErrQueued
+	default:
+		retryDroppedCount.Add(d.url, 1)
+		return ErrRetryQueueFull
+	}
+}
+
+func (d *destination) retryLoop() {
+	for {
+		select {
+		case item := <-d.queue:
+			d.deliver(item)
+			d.mu.Lock()
+			d.pending--
+			d.mu.Unlock()
+		case <-d.closing:
+			d.drop()
+			return
+		}
+	}
+}
+
+// drop drops the items which are still queued.
+func (d *destination) drop() {
+	for {
+		select {
+		case item := <-d.queue:
+			retryDroppedCount.Add(d.url, 1)
+			item.complete(errClosed)
+		default:
+			return
+		}
+	}
+}
+
+// deliver posts the given item until it has been delivered or the max.
+// number of attempts has been reached.
+func (d *destination) deliver(item retryItem) {
+	var err error
+	interval := d.retry.interval
+	for item.attempts < d.retry.attempts {
+		if item.attempts > 0 {
+			select {
+			case <-time.After(interval):
+			case <-d.closing:
+				retryDroppedCount.Add(d.url, 1)
+				log.WithField("url", d.url).Warning("application/http: backend closed, dropping queued payload")
+				item.complete(errClosed)
+				return
+			}
+			if interval *= 2; interval > maxRetryInterval {
+				interval = maxRetryInterval
+			}
+		}
+
+		item.attempts++
+		err = post(d.url, item.body)
+		if err == nil {
+			item.complete(nil)
+			return
+		}
+		log.WithFields(log.Fields{
+			"url":     d.url,
+			"attempt": item.attempts,
+		}).Warningf("application/http: delivery failed: %s", err)
+	}
+
+	retryDroppedCount.Add(d.url, 1)
+	log.WithField("url", d.url).Errorf("application/http: delivery failed after %d attempts, dropping payload", item.attempts)
+	item.complete(err)
+}
+
+// post posts the given JSON body to the given url.
+func post(url string, body []byte) error {
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != h.StatusOK && resp.StatusCode != h.StatusCreated {
+		return fmt.Errorf("application/http: expected 200 or 201 response code, got: %d", resp.StatusCode)
+	}
+	return nil
+}
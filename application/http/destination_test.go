@@ -0,0 +1,135 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brocaar/loraserver/application/delivery"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testDestinationHandler struct {
+	sync.Mutex
+	failures int // number of requests to fail before responding with 200
+	bodies   chan string
+}
+
+func (h *testDestinationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	if h.failures > 0 {
+		h.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	buf := make([]byte, r.ContentLength)
+	r.Body.Read(buf)
+	h.bodies <- string(buf)
+}
+
+func TestDestination(t *testing.T) {
+	Convey("Given a test handler server", t, func() {
+		h := &testDestinationHandler{bodies: make(chan string, 10)}
+		s := httptest.NewServer(h)
+		defer s.Close()
+
+		closing := make(chan struct{})
+		var wg sync.WaitGroup
+
+		Convey("Given a destination without retry", func() {
+			d := newDestination(s.URL, retryConfig{attempts: 1}, closing, &wg)
+
+			Convey("Then send returns the error when the handler fails", func() {
+				h.failures = 1
+				So(d.send([]byte(`"a"`), nil), ShouldNotBeNil)
+			})
+
+			Convey("Then send posts the body", func() {
+				So(d.send([]byte(`"a"`), nil), ShouldBeNil)
+				So(<-h.bodies, ShouldEqual, `"a"`)
+			})
+		})
+
+		Convey("Given a handler which does not respond in time", func() {
+			block := make(chan struct{})
+			slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-block
+			}))
+			defer slow.Close()
+			defer close(block)
+
+			client := httpClient
+			httpClient = &http.Client{Timeout: 10 * time.Millisecond}
+			defer func() { httpClient = client }()
+
+			Convey("Then post returns an error", func() {
+				So(post(slow.URL, []byte(`"a"`)), ShouldNotBeNil)
+			})
+		})
+
+		Convey("Given a destination with retry", func() {
+			retry := retryConfig{attempts: 3, interval: time.Millisecond, queueSize: 1}
+			var closeOnce sync.Once
+			closeAll := func() {
+				closeOnce.Do(func() {
+					close(closing)
+					wg.Wait()
+				})
+			}
+			defer closeAll()
+
+			results := make(chan error, 10)
+			done := func(err error) { results <- err }
+
+			Convey("When the handler fails twice", func() {
+				h.failures = 2
+				d := newDestination(s.URL, retry, closing, &wg)
+
+				Convey("Then the body is delivered by the retry and the next body is delivered after it", func() {
+					So(d.send([]byte(`"a"`), done), ShouldEqual, delivery.ErrQueued)
+					So(d.send([]byte(`"b"`), done), ShouldEqual, delivery.ErrQueued)
+					So(<-h.bodies, ShouldEqual, `"a"`)
+					So(<-h.bodies, ShouldEqual, `"b"`)
+
+					Convey("Then the deliveries are reported", func() {
+						So(<-results, ShouldBeNil)
+						So(<-results, ShouldBeNil)
+					})
+				})
+			})
+
+			Convey("When the handler fails for all attempts", func() {
+				h.failures = 3
+				d := newDestination(s.URL, retry, closing, &wg)
+
+				Convey("Then the failure is reported", func() {
+					So(d.send([]byte(`"a"`), done), ShouldEqual, delivery.ErrQueued)
+					So(<-results, ShouldNotBeNil)
+				})
+			})
+
+			Convey("When the handler keeps failing", func() {
+				h.failures = 100
+				retry.interval = time.Second
+				d := newDestination(s.URL, retry, closing, &wg)
+
+				Convey("Then send returns an error when the retry queue is full", func() {
+					So(d.send([]byte(`"a"`), nil), ShouldEqual, delivery.ErrQueued)
+					So(d.send([]byte(`"b"`), nil), ShouldEqual, delivery.ErrQueued)
+					So(d.send([]byte(`"c"`), nil), ShouldEqual, ErrRetryQueueFull)
+				})
+
+				Convey("Then the queued bodies are reported as dropped when closing", func() {
+					So(d.send([]byte(`"a"`), done), ShouldEqual, delivery.ErrQueued)
+					So(d.send([]byte(`"b"`), done), ShouldEqual, delivery.ErrQueued)
+					closeAll()
+					So(<-results, ShouldEqual, errClosed)
+					So(<-results, ShouldEqual, errClosed)
+				})
+			})
+		})
+	})
+}
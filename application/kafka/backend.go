@@ -0,0 +1,286 @@
+// Package kafka implements a Kafka application backend.
+//
+// The received payloads (RXPayload) are written to the topic given by the
+// topic template, with the DevEUI as message key. As the messages are
+// partitioned by key, the ordering of the payloads of a node is preserved.
+// The payloads are JSON encoded, the (FRM)Payload is encoded as base64. When
+// the application has a codec configured (see the codec package), the decoded
+// payload is included as object. The node events (event.Event) are written to
+// the topic given by the event topic template.
+//
+// The producer is idempotent and Send returns after the message has been
+// acknowledged by all in-sync replicas. When batching is enabled, Send
+// blocks until the batch has been flushed.
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/codec"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/lorawan"
+)
+
+// ErrBackendClosed is returned when the backend has been closed.
+var ErrBackendClosed = errors.New("application/kafka: backend is closed")
+
+// Default topic templates.
+const (
+	DefaultTopicTemplate      = "application.{{ .AppEUI }}.rx"
+	DefaultEventTopicTemplate = "application.{{ .AppEUI }}.event"
+)
+
+// RXPayload is the payload written to the topic.
+type RXPayload struct {
+	AppEUI       lorawan.EUI64 `json:"appEUI"`
+	DevEUI       lorawan.EUI64 `json:"devEUI"`
+	TimeReceived time.Time     `json:"timeReceived"`
+	GatewayCount int           `json:"gatewayCount"`
+	FCnt         uint32        `json:"fCnt"`
+	Port         int           `json:"port"`
+	Payload      []byte        `json:"payload"`
+	Object       interface{}   `json:"object,omitempty"` // decoded by the codec of the application
+}
+
+// topicData contains the data available in the topic template.
+type topicData struct {
+	AppEUI lorawan.EUI64
+	DevEUI lorawan.EUI64
+}
+
+// Option defines a Backend option.
+type Option func(*Backend) error
+
+// SetTopicTemplate sets the (text/template) template of the topic to which
+// the payloads are written. The AppEUI and DevEUI are available in the
+// template, e.g. "application.{{ .AppEUI }}.node.{{ .DevEUI }}.rx".
+func SetTopicTemplate(tmpl string) Option {
+	return func(b *Backend) error {
+		t, err := template.New("topic").Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("application/kafka: invalid topic template: %s", err)
+		}
+		b.topicTemplate = t
+		return nil
+	}
+}
+
+// SetEventTopicTemplate sets the (text/template) template of the topic to
+// which the events are written. The AppEUI and DevEUI are available in the
+// template.
+func SetEventTopicTemplate(tmpl string) Option {
+	return func(b *Backend) error {
+		t, err := template.New("event_topic").Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("application/kafka: invalid event topic template: %s", err)
+		}
+		b.eventTopicTemplate = t
+		return nil
+	}
+}
+
+// SetBatching enables batching of the messages. A batch is flushed when it
+// contains the given number of messages or after the given frequency.
+func SetBatching(messages int, frequency time.Duration) Option {
+	return func(b *Backend) error {
+		b.config.Producer.Flush.Messages = messages
+		b.config.Producer.Flush.Frequency = frequency
+		return nil
+	}
+}
+
+// Backend implements a Kafka application backend.
+type Backend struct {
+	client             *loracontrol.Client
+	config             *sarama.Config
+	producer           sarama.SyncProducer
+	topicTemplate      *template.Template
+	eventTopicTemplate *template.Template
+	txPacketChan       chan loracontrol.TXPacket
+
+	mu     sync.RWMutex // protects closed
+	closed bool
+}
+
+// NewBackend creates a new Backend connected to the given Kafka brokers
+// (e.g. localhost:9092).
+func NewBackend(brokers []string, opts ...Option) (*Backend, error) {
+	b, err := newBackend(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithField("brokers", brokers).Info("application/kafka: connecting to kafka brokers")
+	b.producer, err = sarama.NewSyncProducer(brokers, b.config)
+	if err != nil {
+		return nil, fmt.Errorf("application/kafka: could not create producer: %s", err)
+	}
+	return b, nil
+}
+
+// newBackend creates a new Backend (without producer) with the given options
+// applied.
+func newBackend(opts ...Option) (*Backend, error) {
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+	config.Producer.Idempotent = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 5
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.Return.Successes = true
+	config.Net.MaxOpenRequests = 1 // required by the idempotent producer
+
+	b := &Backend{
+		config:             config,
+		topicTemplate:      template.Must(template.New("topic").Parse(DefaultTopicTemplate)),
+		eventTopicTemplate: template.Must(template.New("event_topic").Parse(DefaultEventTopicTemplate)),
+		txPacketChan:       make(chan loracontrol.TXPacket),
+	}
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("application/kafka: invalid producer config: %s", err)
+	}
+	return b, nil
+}
+
+// SetClient sets the loracontrol.Client and is automatically called by
+// loracontrol.SetApplicationBackend.
+func (b *Backend) SetClient(c *loracontrol.Client) {
+	b.client = c
+}
+
+// Close closes the producer and the Receive channel. Close is safe to call
+// multiple times.
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.txPacketChan)
+
+	log.Info("application/kafka: closing backend")
+	return b.producer.Close()
+}
+
+// Receive returns the TXPacket channel (on which no packets are sent, as
+// this backend only writes the received payloads).
+func (b *Backend) Receive() chan loracontrol.TXPacket {
+	return b.txPacketChan
+}
+
+// Send writes the given packets as one RXPayload to the topic of the
+// application and waits until the message has been acknowledged.
+func (b *Backend) Send(appEUI lorawan.EUI64, packets loracontrol.RXPackets) error {
+	if len(packets) == 0 {
+		return errors.New("application/kafka: packets should have length > 0")
+	}
+
+	macPL, ok := packets[0].PHYPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return fmt.Errorf("application/kafka: expected *lorawan.MACPayload, got %T", packets[0].PHYPayload.MACPayload)
+	}
+	if len(macPL.FRMPayload) != 1 {
+		return errors.New("application/kafka: expected exactly 1 FRMPayload")
+	}
+	data, err := macPL.FRMPayload[0].MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	ns, err := b.client.NodeSession().Get(macPL.FHDR.DevAddr)
+	if err != nil {
+		return err
+	}
+
+	pl := RXPayload{
+		AppEUI:       appEUI,
+		DevEUI:       ns.DevEUI,
+		TimeReceived: packets[0].RXInfo.Time,
+		GatewayCount: len(packets),
+		FCnt:         macPL.FHDR.FCnt,
+		Port:         int(macPL.FPort),
+		Payload:      data,
+	}
+	if app, err := b.client.Application().Get(appEUI); err != nil {
+		log.WithField("app_eui", appEUI).Errorf("application/kafka: could not get application: %s", err)
+	} else if pl.Object, err = codec.Decode(app.Config.String, macPL.FPort, data); err != nil {
+		log.WithField("app_eui", appEUI).Errorf("application/kafka: could not decode payload: %s", err)
+	}
+
+	msg, err := b.newProducerMessage(pl)
+	if err != nil {
+		return err
+	}
+
+	return b.write(msg)
+}
+
+// SendEvent writes the given event to the event topic of the application,
+// keyed by DevEUI, and waits until the message has been acknowledged.
+func (b *Backend) SendEvent(appEUI lorawan.EUI64, e event.Event) error {
+	msg, err := newProducerMessage(b.eventTopicTemplate, appEUI, e.DevEUI, e)
+	if err != nil {
+		return err
+	}
+	return b.write(msg)
+}
+
+func (b *Backend) write(msg *sarama.ProducerMessage) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBackendClosed
+	}
+
+	partition, offset, err := b.producer.SendMessage(msg)
+	if err != nil {
+		return fmt.Errorf("application/kafka: could not write message: %s", err)
+	}
+	log.WithFields(log.Fields{
+		"topic":     msg.Topic,
+		"partition": partition,
+		"offset":    offset,
+	}).Info("application/kafka: message written")
+	return nil
+}
+
+// newProducerMessage returns the message for the given payload, keyed by
+// DevEUI.
+func (b *Backend) newProducerMessage(pl RXPayload) (*sarama.ProducerMessage, error) {
+	return newProducerMessage(b.topicTemplate, pl.AppEUI, pl.DevEUI, pl)
+}
+
+// newProducerMessage returns the message for the given (JSON encoded) value,
+// keyed by DevEUI and written to the topic of the given template.
+func newProducerMessage(tmpl *template.Template, appEUI, devEUI lorawan.EUI64, v interface{}) (*sarama.ProducerMessage, error) {
+	var topic bytes.Buffer
+	if err := tmpl.Execute(&topic, topicData{AppEUI: appEUI, DevEUI: devEUI}); err != nil {
+		return nil, fmt.Errorf("application/kafka: could not execute topic template: %s", err)
+	}
+
+	value, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sarama.ProducerMessage{
+		Topic: topic.String(),
+		Key:   sarama.StringEncoder(devEUI.String()),
+		Value: sarama.ByteEncoder(value),
+	}, nil
+}
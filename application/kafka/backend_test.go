@@ -0,0 +1,285 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/codec"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type config struct {
+	RedisServer   string
+	RedisPassword string
+}
+
+func getConfig() *config {
+	c := &config{
+		RedisServer:   "localhost:6379",
+		RedisPassword: "",
+	}
+
+	if v := os.Getenv("TEST_REDIS_SERVER"); v != "" {
+		c.RedisServer = v
+	}
+	if v := os.Getenv("TEST_REDIS_PASSWORD"); v != "" {
+		c.RedisPassword = v
+	}
+
+	return c
+}
+
+func TestBackend(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a Backend with a mock producer", t, func() {
+		backend, err := newBackend()
+		So(err, ShouldBeNil)
+		producer := mocks.NewSyncProducer(t, backend.config)
+		backend.producer = producer
+
+		c, err := loracontrol.NewClient(
+			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
+			loracontrol.SetGatewayBackend(&loracontrol.DummyGatewayBackend{}),
+			loracontrol.SetApplicationBackend(backend),
+		)
+		So(err, ShouldBeNil)
+		So(c.Storage().FlushAll(), ShouldBeNil)
+
+		appEUI := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+		devEUI := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+		devAddr := lorawan.DevAddr{1, 2, 3, 4}
+		So(c.NodeSession().CreateExpire(loracontrol.NodeSession{
+			DevAddr: devAddr,
+			DevEUI:  devEUI,
+		}), ShouldBeNil)
+
+		macPL := lorawan.NewMACPayload(true)
+		macPL.FHDR = lorawan.FHDR{
+			DevAddr: devAddr,
+			FCnt:    10,
+		}
+		macPL.FPort = 1
+		macPL.FRMPayload = []lorawan.Payload{
+			&lorawan.DataPayload{Bytes: []byte("hello")},
+		}
+		phy := lorawan.NewPHYPayload(true)
+		phy.MHDR = lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataUp,
+			Major: lorawan.LoRaWANR1,
+		}
+		phy.MACPayload = macPL
+
+		now := time.Now().UTC()
+		packets := loracontrol.RXPackets{
+			{RXInfo: loracontrol.RXInfo{Time: now}, PHYPayload: phy},
+		}
+
+		Convey("When the message is acknowledged by the broker", func() {
+			var pl RXPayload
+			producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+				return json.Unmarshal(val, &pl)
+			})
+			So(backend.Send(appEUI, packets), ShouldBeNil)
+
+			Convey("Then the expected payload was written", func() {
+				So(pl.TimeReceived.Equal(now), ShouldBeTrue)
+				pl.TimeReceived = now
+				So(pl, ShouldResemble, RXPayload{
+					AppEUI:       appEUI,
+					DevEUI:       devEUI,
+					TimeReceived: now,
+					GatewayCount: 1,
+					FCnt:         10,
+					Port:         1,
+					Payload:      []byte("hello"),
+				})
+			})
+		})
+
+		Convey("Given the application has a codec", func() {
+			So(c.Application().Create(loracontrol.Application{
+				AppEUI: appEUI,
+				Config: loracontrol.PropertyBag{
+					String: map[string]string{
+						codec.TypeConfigKey:         string(codec.CustomJSType),
+						codec.DecodeScriptConfigKey: "function Decode(fPort, bytes) { return {length: bytes.length}; }",
+					},
+				},
+			}), ShouldBeNil)
+
+			Convey("Then the decoded object is written", func() {
+				var pl RXPayload
+				producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+					return json.Unmarshal(val, &pl)
+				})
+				So(backend.Send(appEUI, packets), ShouldBeNil)
+				So(pl.Object, ShouldResemble, map[string]interface{}{"length": float64(5)})
+			})
+		})
+
+		Convey("When sending an error event", func() {
+			var e event.Event
+			producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+				return json.Unmarshal(val, &e)
+			})
+			So(backend.SendEvent(appEUI, event.Event{
+				Type:   event.Error,
+				DevEUI: devEUI,
+				Reason: "invalid MIC",
+			}), ShouldBeNil)
+
+			Convey("Then the event was written", func() {
+				So(e.Type, ShouldEqual, event.Error)
+				So(e.DevEUI, ShouldEqual, devEUI)
+				So(e.Reason, ShouldEqual, "invalid MIC")
+			})
+		})
+
+		Convey("When the broker fails to write the message", func() {
+			producer.ExpectSendMessageAndFail(errors.New("BOOM!"))
+
+			Convey("Then Send returns an error", func() {
+				So(backend.Send(appEUI, packets), ShouldNotBeNil)
+			})
+		})
+
+		Convey("When closing the backend", func() {
+			So(backend.Close(), ShouldBeNil)
+
+			Convey("Then the Receive channel is closed", func() {
+				_, ok := <-backend.Receive()
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Then Send returns ErrBackendClosed", func() {
+				So(backend.Send(appEUI, packets), ShouldEqual, ErrBackendClosed)
+			})
+		})
+	})
+}
+
+func TestBackendWithMockBroker(t *testing.T) {
+	appEUI := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+	topic := "application.0101010101010101.rx"
+
+	Convey("Given a mock broker leading two partitions of the topic", t, func() {
+		broker := sarama.NewMockBroker(t, 1)
+		defer broker.Close()
+
+		produceResponse := sarama.NewMockProduceResponse(t)
+		broker.SetHandlerByMap(map[string]sarama.MockResponse{
+			"MetadataRequest": sarama.NewMockMetadataResponse(t).
+				SetBroker(broker.Addr(), broker.BrokerID()).
+				SetLeader(topic, 0, broker.BrokerID()).
+				SetLeader(topic, 1, broker.BrokerID()),
+			"InitProducerIDRequest": sarama.NewMockWrapper(&sarama.InitProducerIDResponse{
+				ProducerID:    1000,
+				ProducerEpoch: 1,
+			}),
+			"ProduceRequest": produceResponse,
+		})
+
+		Convey("Given a Backend connected to the broker", func() {
+			backend, err := newBackend()
+			So(err, ShouldBeNil)
+			backend.config.Producer.Retry.Backoff = time.Millisecond
+			backend.producer, err = sarama.NewSyncProducer([]string{broker.Addr()}, backend.config)
+			So(err, ShouldBeNil)
+			defer backend.Close()
+
+			Convey("Then the messages are partitioned by DevEUI", func() {
+				for _, devEUI := range []lorawan.EUI64{
+					{2, 2, 2, 2, 2, 2, 2, 2},
+					{3, 3, 3, 3, 3, 3, 3, 3},
+				} {
+					msg, err := backend.newProducerMessage(RXPayload{AppEUI: appEUI, DevEUI: devEUI})
+					So(err, ShouldBeNil)
+					expected, err := sarama.NewHashPartitioner(topic).Partition(msg, 2)
+					So(err, ShouldBeNil)
+
+					// the same node is always written to the same partition
+					for i := 0; i < 2; i++ {
+						msg, err := backend.newProducerMessage(RXPayload{AppEUI: appEUI, DevEUI: devEUI})
+						So(err, ShouldBeNil)
+						So(backend.write(msg), ShouldBeNil)
+						So(msg.Partition, ShouldEqual, expected)
+					}
+				}
+			})
+
+			Convey("When the in-sync replicas do not acknowledge the message", func() {
+				produceResponse.SetError(topic, 0, sarama.ErrNotEnoughReplicas)
+				produceResponse.SetError(topic, 1, sarama.ErrNotEnoughReplicas)
+
+				Convey("Then write returns an error", func() {
+					msg, err := backend.newProducerMessage(RXPayload{AppEUI: appEUI, DevEUI: lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}})
+					So(err, ShouldBeNil)
+					So(backend.write(msg), ShouldNotBeNil)
+				})
+			})
+		})
+	})
+}
+
+func TestNewProducerMessage(t *testing.T) {
+	appEUI := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+	devEUI := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+
+	Convey("Given a Backend with the default options", t, func() {
+		backend, err := newBackend()
+		So(err, ShouldBeNil)
+
+		Convey("Then the producer is idempotent and waits for all replicas", func() {
+			So(backend.config.Producer.Idempotent, ShouldBeTrue)
+			So(backend.config.Producer.RequiredAcks, ShouldEqual, sarama.WaitForAll)
+			So(backend.config.Net.MaxOpenRequests, ShouldEqual, 1)
+		})
+
+		Convey("Then an event is written to the default event topic, keyed by DevEUI", func() {
+			msg, err := newProducerMessage(backend.eventTopicTemplate, appEUI, devEUI, event.Event{Type: event.Error, DevEUI: devEUI})
+			So(err, ShouldBeNil)
+			So(msg.Topic, ShouldEqual, "application.0101010101010101.event")
+			So(msg.Key, ShouldEqual, sarama.StringEncoder("0202020202020202"))
+		})
+
+		Convey("Then the message is written to the default topic, keyed by DevEUI", func() {
+			msg, err := backend.newProducerMessage(RXPayload{AppEUI: appEUI, DevEUI: devEUI})
+			So(err, ShouldBeNil)
+			So(msg.Topic, ShouldEqual, "application.0101010101010101.rx")
+			So(msg.Key, ShouldEqual, sarama.StringEncoder("0202020202020202"))
+		})
+	})
+
+	Convey("Given a Backend with a custom topic template and batching", t, func() {
+		backend, err := newBackend(
+			SetTopicTemplate("app-{{ .AppEUI }}-node-{{ .DevEUI }}"),
+			SetBatching(100, time.Second),
+		)
+		So(err, ShouldBeNil)
+
+		Convey("Then the batching is configured", func() {
+			So(backend.config.Producer.Flush.Messages, ShouldEqual, 100)
+			So(backend.config.Producer.Flush.Frequency, ShouldEqual, time.Second)
+		})
+
+		Convey("Then the message is written to the templated topic", func() {
+			msg, err := backend.newProducerMessage(RXPayload{AppEUI: appEUI, DevEUI: devEUI})
+			So(err, ShouldBeNil)
+			So(msg.Topic, ShouldEqual, "app-0101010101010101-node-0202020202020202")
+		})
+	})
+
+	Convey("Then an invalid topic template returns an error", t, func() {
+		_, err := newBackend(SetTopicTemplate("{{ .AppEUI"))
+		So(err, ShouldNotBeNil)
+	})
+}
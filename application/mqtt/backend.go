@@ -0,0 +1,438 @@
+package mqtt
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/codec"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/loraserver/application/session"
+	"github.com/brocaar/lorawan"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// ErrBackendClosed is returned when the backend has been closed.
+var ErrBackendClosed = errors.New("application/mqtt: backend is closed")
+
+// ErrUnknownNode is returned when a payload is published for a node which
+// does not exist (within the application of the topic) or which has no
+// node-session.
+var ErrUnknownNode = errors.New("application/mqtt: no node-session known for node")
+
+// drainTimeout defines how long a received payload is offered on the Receive
+// channel after the backend has been closed.
+const drainTimeout = time.Second
+
+// txTopic is the topic to which the backend subscribes for the payloads to
+// send to the nodes.
+const txTopic = "application/+/node/+/tx"
+
+// NotificationType defines the type of a notification.
+type NotificationType string
+
+// Available notification types (used as last topic level).
+const (
+	JoinNotificationType   NotificationType = "join"
+	ACKNotificationType    NotificationType = "ack"
+	ErrorNotificationType  NotificationType = "error"
+	StatusNotificationType NotificationType = "status"
+)
+
+// RXPayload is the JSON payload of the application/[AppEUI]/node/[DevEUI]/rx
+// topic.
+type RXPayload struct {
+	DevEUI       lorawan.EUI64 `json:"devEUI"`
+	TimeReceived time.Time     `json:"timeReceived"`
+	GatewayCount int           `json:"gatewayCount"`
+	FCnt         uint32        `json:"fCnt"`
+	Port         int           `json:"port"`
+	Payload      []byte        `json:"payload"`
+	Object       interface{}   `json:"object,omitempty"` // decoded by the codec of the application
+}
+
+// TXPayload is the JSON payload of the application/[AppEUI]/node/[DevEUI]/tx
+// topic.
+type TXPayload struct {
+	Confirmed bool            `json:"confirmed"`
+	Port      uint8           `json:"port"` // must be > 0
+	Payload   []byte          `json:"payload"`
+	Object    json.RawMessage `json:"object,omitempty"` // encoded by the codec of the application (instead of Payload)
+}
+
+// JoinNotification is the JSON payload of the
+// application/[AppEUI]/node/[DevEUI]/join topic.
+type JoinNotification struct {
+	DevEUI  lorawan.EUI64   `json:"devEUI"`
+	DevAddr lorawan.DevAddr `json:"devAddr"`
+}
+
+// ACKNotification is the JSON payload of the
+// application/[AppEUI]/node/[DevEUI]/ack topic.
+type ACKNotification struct {
+	DevEUI lorawan.EUI64 `json:"devEUI"`
+	FCnt   uint32        `json:"fCnt"`
+}
+
+// ErrorNotification is the JSON payload of the
+// application/[AppEUI]/node/[DevEUI]/error topic.
+type ErrorNotification struct {
+	DevEUI lorawan.EUI64 `json:"devEUI"`
+	Error  string        `json:"error"`
+}
+
+// StatusNotification is the JSON payload of the
+// application/[AppEUI]/node/[DevEUI]/status topic.
+type StatusNotification struct {
+	DevEUI  lorawan.EUI64 `json:"devEUI"`
+	Battery uint8         `json:"battery"`
+	Margin  int8          `json:"margin"`
+}
+
+// Option defines a Backend option.
+type Option func(*Backend) error
+
+// SetSessionIndex sets the index used to resolve the node-session of the
+// payloads published for the nodes. Without index, these payloads are
+// rejected with ErrUnknownNode.
+func SetSessionIndex(i *session.Index) Option {
+	return func(b *Backend) error {
+		b.sessions = i
+		return nil
+	}
+}
+
+// Backend implements a MQTT application backend.
+type Backend struct {
+	client       *loracontrol.Client
+	conn         mqtt.Client
+	txPacketChan chan loracontrol.TXPacket
+	sessions     *session.Index
+
+	mu      sync.RWMutex // protects closed
+	closed  bool
+	closing chan struct{}
+	wg      sync.WaitGroup // in-flight message handlers
+}
+
+// NewBackend creates a new Backend connected to the given MQTT server
+// (e.g. tcp://localhost:1883).
+func NewBackend(server, username, password string, opts ...Option) (*Backend, error) {
+	b := &Backend{
+		txPacketChan: make(chan loracontrol.TXPacket),
+		closing:      make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+
+	mqttOpts := mqtt.NewClientOptions()
+	mqttOpts.AddBroker(server)
+	mqttOpts.SetUsername(username)
+	mqttOpts.SetPassword(password)
+	mqttOpts.SetAutoReconnect(true)
+	mqttOpts.SetOnConnectHandler(b.onConnected)
+	mqttOpts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Errorf("application/mqtt: connection to mqtt server lost: %s", err)
+	})
+
+	log.WithField("server", server).Info("application/mqtt: connecting to mqtt server")
+	b.conn = mqtt.NewClient(mqttOpts)
+	if token := b.conn.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return b, nil
+}
+
+// SetClient sets the loracontrol.Client and is automatically called by
+// loracontrol.SetApplicationBackend.
+func (b *Backend) SetClient(c *loracontrol.Client) {
+	b.client = c
+}
+
+// Close closes the backend. It unsubscribes from the tx topic, waits until
+// the in-flight messages have been handled and closes the Receive channel.
+// Close is safe to call multiple times.
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.closing)
+	b.mu.Unlock()
+
+	log.Info("application/mqtt: closing backend")
+	if token := b.conn.Unsubscribe(txTopic); token.Wait() && token.Error() != nil {
+		log.Errorf("application/mqtt: could not unsubscribe: %s", token.Error())
+	}
+	b.wg.Wait()
+	b.conn.Disconnect(250)
+	close(b.txPacketChan)
+	return nil
+}
+
+// Receive returns the channel with the packets received from the
+// applications. The TXPacket contains the DevAddr, FPort and the
+// (unencrypted) FRMPayload. The network server must set the TXInfo, FCnt
+// and MIC and encrypt the FRMPayload before sending it to the gateway.
+func (b *Backend) Receive() chan loracontrol.TXPacket {
+	return b.txPacketChan
+}
+
+// Send publishes the given packets as one RXPayload on the rx topic of the
+// node.
+func (b *Backend) Send(appEUI lorawan.EUI64, packets loracontrol.RXPackets) error {
+	if len(packets) == 0 {
+		return errors.New("application/mqtt: packets should have length > 0")
+	}
+
+	macPL, ok := packets[0].PHYPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return fmt.Errorf("application/mqtt: expected *lorawan.MACPayload, got %T", packets[0].PHYPayload.MACPayload)
+	}
+	if len(macPL.FRMPayload) != 1 {
+		return errors.New("application/mqtt: expected exactly 1 FRMPayload")
+	}
+	data, err := macPL.FRMPayload[0].MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	ns, err := b.client.NodeSession().Get(macPL.FHDR.DevAddr)
+	if err != nil {
+		return err
+	}
+
+	pl := RXPayload{
+		DevEUI:       ns.DevEUI,
+		TimeReceived: packets[0].RXInfo.Time,
+		GatewayCount: len(packets),
+		FCnt:         macPL.FHDR.FCnt,
+		Port:         int(macPL.FPort),
+		Payload:      data,
+	}
+	if app, err := b.client.Application().Get(appEUI); err != nil {
+		log.WithField("app_eui", appEUI).Errorf("application/mqtt: could not get application: %s", err)
+	} else if pl.Object, err = codec.Decode(app.Config.String, macPL.FPort, data); err != nil {
+		log.WithField("app_eui", appEUI).Errorf("application/mqtt: could not decode payload: %s", err)
+	}
+
+	return b.publish(appEUI, ns.DevEUI, "rx", pl)
+}
+
+// SendNotification publishes the given notification (e.g. JoinNotification)
+// on the topic of the given notification type.
+func (b *Backend) SendNotification(appEUI, devEUI lorawan.EUI64, typ NotificationType, notification interface{}) error {
+	return b.publish(appEUI, devEUI, string(typ), notification)
+}
+
+// SendEvent publishes the given event as notification on the topic of the
+// event type.
+func (b *Backend) SendEvent(appEUI lorawan.EUI64, e event.Event) error {
+	switch e.Type {
+	case event.Join:
+		if e.DevAddr == nil {
+			return errors.New("application/mqtt: join event must contain DevAddr")
+		}
+		return b.SendNotification(appEUI, e.DevEUI, JoinNotificationType, JoinNotification{
+			DevEUI:  e.DevEUI,
+			DevAddr: *e.DevAddr,
+		})
+	case event.ACK:
+		if e.FCnt == nil {
+			return errors.New("application/mqtt: ack event must contain FCnt")
+		}
+		return b.SendNotification(appEUI, e.DevEUI, ACKNotificationType, ACKNotification{
+			DevEUI: e.DevEUI,
+			FCnt:   *e.FCnt,
+		})
+	case event.Error:
+		return b.SendNotification(appEUI, e.DevEUI, ErrorNotificationType, ErrorNotification{
+			DevEUI: e.DevEUI,
+			Error:  e.Reason,
+		})
+	case event.Status:
+		if e.Battery == nil || e.Margin == nil {
+			return errors.New("application/mqtt: status event must contain Battery and Margin")
+		}
+		return b.SendNotification(appEUI, e.DevEUI, StatusNotificationType, StatusNotification{
+			DevEUI:  e.DevEUI,
+			Battery: *e.Battery,
+			Margin:  *e.Margin,
+		})
+	default:
+		return fmt.Errorf("application/mqtt: unknown event type: %s", e.Type)
+	}
+}
+
+func (b *Backend) publish(appEUI, devEUI lorawan.EUI64, name string, v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if b.isClosed() {
+		return ErrBackendClosed
+	}
+
+	topic := fmt.Sprintf("application/%s/node/%s/%s", appEUI, devEUI, name)
+	log.WithField("topic", topic).Info("application/mqtt: publishing message")
+	if token := b.conn.Publish(topic, 0, false, bytes); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+func (b *Backend) onConnected(c mqtt.Client) {
+	log.Info("application/mqtt: connected to mqtt server")
+	log.WithField("topic", txTopic).Info("application/mqtt: subscribing to topic")
+	if token := c.Subscribe(txTopic, 0, b.txPayloadHandler); token.Wait() && token.Error() != nil {
+		log.Errorf("application/mqtt: could not subscribe to %s: %s", txTopic, token.Error())
+	}
+}
+
+func (b *Backend) txPayloadHandler(c mqtt.Client, msg mqtt.Message) {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return
+	}
+	b.wg.Add(1)
+	b.mu.RUnlock()
+	defer b.wg.Done()
+
+	appEUI, devEUI, err := getEUIsFromTopic(msg.Topic())
+	if err != nil {
+		log.WithField("topic", msg.Topic()).Errorf("application/mqtt: could not handle tx payload: %s", err)
+		return
+	}
+
+	if err := b.handleTXPayload(appEUI, devEUI, msg.Payload()); err != nil {
+		log.WithField("topic", msg.Topic()).Errorf("application/mqtt: could not handle tx payload: %s", err)
+		if err := b.SendNotification(appEUI, devEUI, ErrorNotificationType, ErrorNotification{
+			DevEUI: devEUI,
+			Error:  err.Error(),
+		}); err != nil {
+			log.WithField("topic", msg.Topic()).Errorf("application/mqtt: could not publish error notification: %s", err)
+		}
+	}
+}
+
+func (b *Backend) handleTXPayload(appEUI, devEUI lorawan.EUI64, data []byte) error {
+	var pl TXPayload
+	if err := json.Unmarshal(data, &pl); err != nil {
+		return err
+	}
+	if pl.Port == 0 {
+		return errors.New("application/mqtt: port must be > 0")
+	}
+
+	ns, err := b.getNodeSession(appEUI, devEUI)
+	if err != nil {
+		return err
+	}
+
+	if len(pl.Object) != 0 {
+		app, err := b.client.Application().Get(appEUI)
+		if err != nil {
+			return err
+		}
+		if pl.Payload, err = codec.Encode(app.Config.String, pl.Port, pl.Object); err != nil {
+			return err
+		}
+	}
+
+	macPL := lorawan.NewMACPayload(false)
+	macPL.FHDR.DevAddr = ns.DevAddr
+	macPL.FPort = pl.Port
+	macPL.FRMPayload = []lorawan.Payload{&lorawan.DataPayload{Bytes: pl.Payload}}
+
+	phy := lorawan.NewPHYPayload(false)
+	phy.MHDR = lorawan.MHDR{
+		MType: lorawan.UnconfirmedDataDown,
+		Major: lorawan.LoRaWANR1,
+	}
+	if pl.Confirmed {
+		phy.MHDR.MType = lorawan.ConfirmedDataDown
+	}
+	phy.MACPayload = macPL
+
+	p := loracontrol.TXPacket{PHYPayload: phy}
+	select {
+	case b.txPacketChan <- p:
+	case <-b.closing:
+		// give the consumer some time to receive the in-flight packets
+		select {
+		case b.txPacketChan <- p:
+		case <-time.After(drainTimeout):
+			return ErrBackendClosed
+		}
+	}
+	return nil
+}
+
+// getNodeSession returns the node-session of the given node. It returns
+// ErrUnknownNode when the node does not belong to the given application
+// (the AppEUI of the topic is not trusted) or when it has no node-session.
+func (b *Backend) getNodeSession(appEUI, devEUI lorawan.EUI64) (loracontrol.NodeSession, error) {
+	if b.sessions == nil {
+		return loracontrol.NodeSession{}, ErrUnknownNode
+	}
+	node, err := b.client.Node().Get(devEUI)
+	if err != nil {
+		if err == loracontrol.ErrObjectDoesNotExist {
+			return loracontrol.NodeSession{}, ErrUnknownNode
+		}
+		return loracontrol.NodeSession{}, err
+	}
+	if node.AppEUI != appEUI {
+		return loracontrol.NodeSession{}, ErrUnknownNode
+	}
+	ns, err := b.sessions.Get(b.client, devEUI)
+	if err != nil {
+		if err == loracontrol.ErrObjectDoesNotExist {
+			return loracontrol.NodeSession{}, ErrUnknownNode
+		}
+		return loracontrol.NodeSession{}, err
+	}
+	return ns, nil
+}
+
+func (b *Backend) isClosed() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.closed
+}
+
+// getEUIsFromTopic returns the AppEUI and DevEUI from a
+// application/[AppEUI]/node/[DevEUI]/... topic.
+func getEUIsFromTopic(topic string) (lorawan.EUI64, lorawan.EUI64, error) {
+	var appEUI, devEUI lorawan.EUI64
+	parts := strings.Split(topic, "/")
+	if len(parts) != 5 || parts[0] != "application" || parts[2] != "node" {
+		return appEUI, devEUI, fmt.Errorf("application/mqtt: invalid topic: %s", topic)
+	}
+	for i, eui := range []*lorawan.EUI64{&appEUI, &devEUI} {
+		b, err := hex.DecodeString(parts[1+i*2])
+		if err != nil {
+			return appEUI, devEUI, fmt.Errorf("application/mqtt: invalid EUI in topic %s: %s", topic, err)
+		}
+		if len(b) != len(eui) {
+			return appEUI, devEUI, fmt.Errorf("application/mqtt: an EUI is exactly %d bytes", len(eui))
+		}
+		copy(eui[:], b)
+	}
+	return appEUI, devEUI, nil
+}
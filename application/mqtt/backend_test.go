@@ -0,0 +1,351 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver"
+	"github.com/brocaar/loraserver/application/codec"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/loraserver/application/session"
+	"github.com/brocaar/lorawan"
+	"github.com/eclipse/paho.mqtt.golang"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func init() {
+	log.SetLevel(log.ErrorLevel)
+}
+
+type config struct {
+	RedisServer   string
+	RedisPassword string
+	MQTTServer    string
+	MQTTUsername  string
+	MQTTPassword  string
+}
+
+func getConfig() *config {
+	c := &config{
+		RedisServer:   "localhost:6379",
+		RedisPassword: "",
+		MQTTServer:    "tcp://localhost:1883",
+	}
+
+	if v := os.Getenv("TEST_REDIS_SERVER"); v != "" {
+		c.RedisServer = v
+	}
+	if v := os.Getenv("TEST_REDIS_PASSWORD"); v != "" {
+		c.RedisPassword = v
+	}
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		c.MQTTServer = v
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		c.MQTTUsername = v
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		c.MQTTPassword = v
+	}
+
+	return c
+}
+
+func TestBackend(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a MQTT client and a Backend", t, func() {
+		opts := mqtt.NewClientOptions().AddBroker(conf.MQTTServer).SetUsername(conf.MQTTUsername).SetPassword(conf.MQTTPassword)
+		c := mqtt.NewClient(opts)
+		token := c.Connect()
+		token.Wait()
+		So(token.Error(), ShouldBeNil)
+		defer c.Disconnect(0)
+
+		sessions := session.NewIndex(loraserver.NewRedisPool(conf.RedisServer, conf.RedisPassword))
+		backend, err := NewBackend(conf.MQTTServer, conf.MQTTUsername, conf.MQTTPassword, SetSessionIndex(sessions))
+		So(err, ShouldBeNil)
+		defer backend.Close()
+		time.Sleep(time.Millisecond * 100) // give the backend some time to subscribe
+
+		client, err := loracontrol.NewClient(
+			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
+			loracontrol.SetGatewayBackend(&loracontrol.DummyGatewayBackend{}),
+			loracontrol.SetApplicationBackend(backend),
+		)
+		So(err, ShouldBeNil)
+		So(client.Storage().FlushAll(), ShouldBeNil)
+
+		appEUI := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+		devEUI := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+		devAddr := lorawan.DevAddr{1, 2, 3, 4}
+
+		So(client.Application().Create(loracontrol.Application{
+			AppEUI: appEUI,
+			Config: loracontrol.PropertyBag{
+				String: map[string]string{codec.TypeConfigKey: string(codec.CayenneLPPType)},
+			},
+		}), ShouldBeNil)
+		So(client.Node().Create(loracontrol.Node{
+			DevEUI: devEUI,
+			AppEUI: appEUI,
+		}), ShouldBeNil)
+		ns := loracontrol.NodeSession{
+			DevAddr: devAddr,
+			DevEUI:  devEUI,
+		}
+		So(client.NodeSession().CreateExpire(ns), ShouldBeNil)
+		So(sessions.Save(ns), ShouldBeNil)
+
+		Convey("Given a subscription to the node topics", func() {
+			rxChan := make(chan RXPayload, 1)
+			errChan := make(chan ErrorNotification, 1)
+			joinChan := make(chan JoinNotification, 1)
+			ackChan := make(chan ACKNotification, 1)
+			statusChan := make(chan StatusNotification, 1)
+			for topic, handler := range map[string]mqtt.MessageHandler{
+				"application/+/node/+/rx": func(c mqtt.Client, msg mqtt.Message) {
+					var pl RXPayload
+					if err := json.Unmarshal(msg.Payload(), &pl); err != nil {
+						t.Error(err)
+					}
+					rxChan <- pl
+				},
+				"application/+/node/+/error": func(c mqtt.Client, msg mqtt.Message) {
+					var pl ErrorNotification
+					if err := json.Unmarshal(msg.Payload(), &pl); err != nil {
+						t.Error(err)
+					}
+					errChan <- pl
+				},
+				"application/+/node/+/join": func(c mqtt.Client, msg mqtt.Message) {
+					var pl JoinNotification
+					if err := json.Unmarshal(msg.Payload(), &pl); err != nil {
+						t.Error(err)
+					}
+					joinChan <- pl
+				},
+				"application/+/node/+/ack": func(c mqtt.Client, msg mqtt.Message) {
+					var pl ACKNotification
+					if err := json.Unmarshal(msg.Payload(), &pl); err != nil {
+						t.Error(err)
+					}
+					ackChan <- pl
+				},
+				"application/+/node/+/status": func(c mqtt.Client, msg mqtt.Message) {
+					var pl StatusNotification
+					if err := json.Unmarshal(msg.Payload(), &pl); err != nil {
+						t.Error(err)
+					}
+					statusChan <- pl
+				},
+			} {
+				token := c.Subscribe(topic, 0, handler)
+				token.Wait()
+				So(token.Error(), ShouldBeNil)
+			}
+
+			Convey("When sending a payload for the node within an other application", func() {
+				b, err := json.Marshal(TXPayload{Port: 1, Payload: []byte("hello")})
+				So(err, ShouldBeNil)
+				token := c.Publish(fmt.Sprintf("application/%s/node/%s/tx", lorawan.EUI64{3, 3, 3, 3, 3, 3, 3, 3}, devEUI), 0, false, b)
+				token.Wait()
+				So(token.Error(), ShouldBeNil)
+
+				Convey("Then an error notification is published", func() {
+					pl := <-errChan
+					So(pl, ShouldResemble, ErrorNotification{
+						DevEUI: devEUI,
+						Error:  ErrUnknownNode.Error(),
+					})
+				})
+			})
+
+			Convey("When sending an error event", func() {
+				So(backend.SendEvent(appEUI, event.Event{
+					Type:   event.Error,
+					DevEUI: devEUI,
+					Reason: "invalid MIC",
+				}), ShouldBeNil)
+
+				Convey("Then an error notification is published", func() {
+					pl := <-errChan
+					So(pl, ShouldResemble, ErrorNotification{
+						DevEUI: devEUI,
+						Error:  "invalid MIC",
+					})
+				})
+			})
+
+			Convey("When sending a join event", func() {
+				So(backend.SendEvent(appEUI, event.Event{
+					Type:    event.Join,
+					DevEUI:  devEUI,
+					DevAddr: &devAddr,
+				}), ShouldBeNil)
+
+				Convey("Then a join notification is published", func() {
+					pl := <-joinChan
+					So(pl, ShouldResemble, JoinNotification{
+						DevEUI:  devEUI,
+						DevAddr: devAddr,
+					})
+				})
+			})
+
+			Convey("When sending an ack event", func() {
+				fCnt := uint32(12)
+				So(backend.SendEvent(appEUI, event.Event{
+					Type:   event.ACK,
+					DevEUI: devEUI,
+					FCnt:   &fCnt,
+				}), ShouldBeNil)
+
+				Convey("Then an ack notification is published", func() {
+					pl := <-ackChan
+					So(pl, ShouldResemble, ACKNotification{
+						DevEUI: devEUI,
+						FCnt:   12,
+					})
+				})
+			})
+
+			Convey("When sending a status event", func() {
+				battery, margin := uint8(200), int8(-3)
+				So(backend.SendEvent(appEUI, event.Event{
+					Type:    event.Status,
+					DevEUI:  devEUI,
+					Battery: &battery,
+					Margin:  &margin,
+				}), ShouldBeNil)
+
+				Convey("Then a status notification is published", func() {
+					pl := <-statusChan
+					So(pl, ShouldResemble, StatusNotification{
+						DevEUI:  devEUI,
+						Battery: 200,
+						Margin:  -3,
+					})
+				})
+			})
+
+			Convey("When sending a join event without DevAddr", func() {
+				err := backend.SendEvent(appEUI, event.Event{
+					Type:   event.Join,
+					DevEUI: devEUI,
+				})
+
+				Convey("Then an error is returned", func() {
+					So(err, ShouldResemble, errors.New("application/mqtt: join event must contain DevAddr"))
+				})
+			})
+
+			Convey("When sending RXPackets to the application", func() {
+				macPL := lorawan.NewMACPayload(true)
+				macPL.FHDR = lorawan.FHDR{
+					DevAddr: devAddr,
+					FCnt:    10,
+				}
+				macPL.FPort = 1
+				macPL.FRMPayload = []lorawan.Payload{
+					&lorawan.DataPayload{Bytes: []byte("hello")},
+				}
+				phy := lorawan.NewPHYPayload(true)
+				phy.MHDR = lorawan.MHDR{
+					MType: lorawan.UnconfirmedDataUp,
+					Major: lorawan.LoRaWANR1,
+				}
+				phy.MACPayload = macPL
+
+				now := time.Now().UTC()
+				So(backend.Send(appEUI, loracontrol.RXPackets{
+					{RXInfo: loracontrol.RXInfo{Time: now}, PHYPayload: phy},
+					{RXInfo: loracontrol.RXInfo{Time: now}, PHYPayload: phy},
+				}), ShouldBeNil)
+
+				Convey("Then the payload is published", func() {
+					pl := <-rxChan
+					So(pl.TimeReceived.Equal(now), ShouldBeTrue)
+					pl.TimeReceived = now
+					So(pl, ShouldResemble, RXPayload{
+						DevEUI:       devEUI,
+						TimeReceived: now,
+						GatewayCount: 2,
+						FCnt:         10,
+						Port:         1,
+						Payload:      []byte("hello"),
+					})
+				})
+
+				Convey("When the application sends an object to the node", func() {
+					b, err := json.Marshal(TXPayload{Port: 2, Object: json.RawMessage(`{"digitalOutput": [{"channel": 3, "value": 1}]}`)})
+					So(err, ShouldBeNil)
+					token := c.Publish(fmt.Sprintf("application/%s/node/%s/tx", appEUI, devEUI), 0, false, b)
+					token.Wait()
+					So(token.Error(), ShouldBeNil)
+
+					Convey("Then Receive() returns the TXPacket with the encoded object", func() {
+						p := <-backend.Receive()
+						macPL, ok := p.PHYPayload.MACPayload.(*lorawan.MACPayload)
+						So(ok, ShouldBeTrue)
+						So(macPL.FRMPayload, ShouldResemble, []lorawan.Payload{
+							&lorawan.DataPayload{Bytes: []byte{3, 1, 1}},
+						})
+					})
+				})
+
+				Convey("When the application sends a confirmed payload to the node", func() {
+					b, err := json.Marshal(TXPayload{Confirmed: true, Port: 2, Payload: []byte("world")})
+					So(err, ShouldBeNil)
+					token := c.Publish(fmt.Sprintf("application/%s/node/%s/tx", appEUI, devEUI), 0, false, b)
+					token.Wait()
+					So(token.Error(), ShouldBeNil)
+
+					Convey("Then Receive() returns the TXPacket", func() {
+						p := <-backend.Receive()
+						So(p.PHYPayload.MHDR.MType, ShouldEqual, lorawan.ConfirmedDataDown)
+
+						macPL, ok := p.PHYPayload.MACPayload.(*lorawan.MACPayload)
+						So(ok, ShouldBeTrue)
+						So(macPL.FHDR.DevAddr, ShouldEqual, devAddr)
+						So(macPL.FPort, ShouldEqual, 2)
+						So(macPL.FRMPayload, ShouldResemble, []lorawan.Payload{
+							&lorawan.DataPayload{Bytes: []byte("world")},
+						})
+					})
+				})
+			})
+		})
+	})
+}
+
+func TestGetEUIsFromTopic(t *testing.T) {
+	Convey("Given a set of test topics", t, func() {
+		tests := []struct {
+			Topic  string
+			AppEUI lorawan.EUI64
+			DevEUI lorawan.EUI64
+			Error  bool
+		}{
+			{"application/0101010101010101/node/0202020202020202/tx", lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}, lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}, false},
+			{"application/01010101010101/node/0202020202020202/tx", lorawan.EUI64{}, lorawan.EUI64{}, true},
+			{"application/0101010101010101/node/zz02020202020202/tx", lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}, lorawan.EUI64{}, true},
+			{"application/0101010101010101/gateway/0202020202020202/tx", lorawan.EUI64{}, lorawan.EUI64{}, true},
+		}
+
+		for i, test := range tests {
+			Convey(fmt.Sprintf("Then getEUIsFromTopic returns the expected result for test %d", i), func() {
+				appEUI, devEUI, err := getEUIsFromTopic(test.Topic)
+				So(err != nil, ShouldEqual, test.Error)
+				So(appEUI, ShouldEqual, test.AppEUI)
+				So(devEUI, ShouldEqual, test.DevEUI)
+			})
+		}
+	})
+}
@@ -0,0 +1,15 @@
+/*
+Package mqtt implements a MQTT application backend. It publishes and
+subscribes to the following topics:
+    * application/[AppEUI]/node/[DevEUI]/rx    - received payloads (RXPayload, published by the backend)
+    * application/[AppEUI]/node/[DevEUI]/tx    - payloads to send (TXPayload, published by the application)
+    * application/[AppEUI]/node/[DevEUI]/join  - join notifications (JoinNotification, published by the backend)
+    * application/[AppEUI]/node/[DevEUI]/ack   - ack notifications (ACKNotification, published by the backend)
+    * application/[AppEUI]/node/[DevEUI]/error - error notifications (ErrorNotification, published by the backend)
+    * application/[AppEUI]/node/[DevEUI]/status - status notifications (StatusNotification, published by the backend)
+All payloads are JSON encoded, the (FRM)Payload is encoded as base64.
+When the application has a codec configured (see the codec package), the
+decoded payload is included as object and the payload to send can be given
+as object.
+*/
+package mqtt
@@ -0,0 +1,71 @@
+// Package session implements an index of the node-sessions by DevEUI. The
+// node-sessions are stored by DevAddr, the index is used by the application
+// backends to resolve the node-session of a downlink addressed by DevEUI.
+package session
+
+import (
+	"fmt"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Index maps the DevEUI of a node to the DevAddr of its node-session. The
+// entries are not removed when the node-session expires or is deleted,
+// Get verifies that the node-session still exists.
+type Index struct {
+	pool *redis.Pool
+}
+
+// NewIndex creates a new Index.
+func NewIndex(p *redis.Pool) *Index {
+	return &Index{pool: p}
+}
+
+// Save stores the DevAddr of the given node-session.
+func (i *Index) Save(ns loracontrol.NodeSession) error {
+	c := i.pool.Get()
+	defer c.Close()
+
+	if _, err := c.Do("SET", indexKey(ns.DevEUI), ns.DevAddr[:]); err != nil {
+		return fmt.Errorf("application/session: could not save index: %s", err)
+	}
+	return nil
+}
+
+// Get returns the node-session of the given DevEUI. It returns
+// loracontrol.ErrObjectDoesNotExist when there is no (current) node-session
+// for the DevEUI.
+func (i *Index) Get(client *loracontrol.Client, devEUI lorawan.EUI64) (loracontrol.NodeSession, error) {
+	c := i.pool.Get()
+	defer c.Close()
+
+	b, err := redis.Bytes(c.Do("GET", indexKey(devEUI)))
+	if err != nil {
+		if err == redis.ErrNil {
+			return loracontrol.NodeSession{}, loracontrol.ErrObjectDoesNotExist
+		}
+		return loracontrol.NodeSession{}, fmt.Errorf("application/session: could not get index: %s", err)
+	}
+
+	var devAddr lorawan.DevAddr
+	if len(b) != len(devAddr) {
+		return loracontrol.NodeSession{}, fmt.Errorf("application/session: expected %d bytes DevAddr in index, got %d", len(devAddr), len(b))
+	}
+	copy(devAddr[:], b)
+
+	ns, err := client.NodeSession().Get(devAddr)
+	if err != nil {
+		return ns, err
+	}
+	// the DevAddr could have been re-assigned to an other node
+	if ns.DevEUI != devEUI {
+		return loracontrol.NodeSession{}, loracontrol.ErrObjectDoesNotExist
+	}
+	return ns, nil
+}
+
+func indexKey(devEUI lorawan.EUI64) string {
+	return fmt.Sprintf("node_session_index_%s", devEUI)
+}
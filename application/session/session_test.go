@@ -0,0 +1,104 @@
+package session
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type config struct {
+	RedisServer   string
+	RedisPassword string
+}
+
+func getConfig() *config {
+	c := &config{
+		RedisServer: "localhost:6379",
+	}
+
+	if v := os.Getenv("TEST_REDIS_SERVER"); v != "" {
+		c.RedisServer = v
+	}
+	if v := os.Getenv("TEST_REDIS_PASSWORD"); v != "" {
+		c.RedisPassword = v
+	}
+
+	return c
+}
+
+func TestIndex(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a clean Redis database and an Index", t, func() {
+		client, err := loracontrol.NewClient(
+			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
+			loracontrol.SetGatewayBackend(&loracontrol.DummyGatewayBackend{}),
+			loracontrol.SetApplicationBackend(&loracontrol.DummyApplicationBackend{}),
+		)
+		So(err, ShouldBeNil)
+		So(client.Storage().FlushAll(), ShouldBeNil)
+
+		i := NewIndex(&redis.Pool{
+			MaxIdle:     1,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				c, err := redis.Dial("tcp", conf.RedisServer)
+				if err != nil {
+					return nil, err
+				}
+				if conf.RedisPassword != "" {
+					if _, err := c.Do("AUTH", conf.RedisPassword); err != nil {
+						c.Close()
+						return nil, err
+					}
+				}
+				return c, nil
+			},
+		})
+		devEUI := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+		ns := loracontrol.NodeSession{
+			DevAddr: lorawan.DevAddr{1, 2, 3, 4},
+			DevEUI:  devEUI,
+		}
+
+		Convey("Then Get returns ErrObjectDoesNotExist for an unknown DevEUI", func() {
+			_, err := i.Get(client, devEUI)
+			So(err, ShouldEqual, loracontrol.ErrObjectDoesNotExist)
+		})
+
+		Convey("Given a saved node-session", func() {
+			So(client.NodeSession().CreateExpire(ns), ShouldBeNil)
+			So(i.Save(ns), ShouldBeNil)
+
+			Convey("Then Get returns the node-session", func() {
+				nsGet, err := i.Get(client, devEUI)
+				So(err, ShouldBeNil)
+				So(nsGet.DevAddr, ShouldEqual, ns.DevAddr)
+			})
+
+			Convey("When the DevAddr is assigned to an other node", func() {
+				ns.DevEUI = lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+				So(client.NodeSession().UpdateExpire(ns), ShouldBeNil)
+
+				Convey("Then Get returns ErrObjectDoesNotExist", func() {
+					_, err := i.Get(client, devEUI)
+					So(err, ShouldEqual, loracontrol.ErrObjectDoesNotExist)
+				})
+			})
+
+			Convey("When the node-session is deleted", func() {
+				So(client.NodeSession().Delete(ns.DevAddr), ShouldBeNil)
+
+				Convey("Then Get returns ErrObjectDoesNotExist", func() {
+					_, err := i.Get(client, devEUI)
+					So(err, ShouldEqual, loracontrol.ErrObjectDoesNotExist)
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,91 @@
+// Package airtime implements the time-on-air calculation of LoRa and FSK
+// frames (see Semtech AN1200.13 "LoRa Modem Designer's Guide").
+package airtime
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/brocaar/loracontrol"
+)
+
+// DefaultPreamble is the default number of preamble symbols.
+const DefaultPreamble = 8
+
+// fskOverhead is the number of bytes added to a FSK frame (5 bytes preamble,
+// 3 bytes sync word, 1 byte length and 2 bytes CRC).
+const fskOverhead = 11
+
+// LoRa returns the time-on-air of a LoRa frame. The bandwidth is in kHz and
+// the coding rate is 1 - 4 for 4/5 - 4/8. The low data-rate optimization is
+// enabled when the symbol duration exceeds 16ms.
+func LoRa(payloadSize, sf, bandwidth, preamble, codingRate int, crc, implicitHeader bool) (time.Duration, error) {
+	if sf < 6 || sf > 12 {
+		return 0, fmt.Errorf("airtime: invalid spreading factor: %d", sf)
+	}
+	if bandwidth <= 0 {
+		return 0, fmt.Errorf("airtime: invalid bandwidth: %d", bandwidth)
+	}
+	if codingRate < 1 || codingRate > 4 {
+		return 0, fmt.Errorf("airtime: invalid coding rate: %d", codingRate)
+	}
+
+	// symbol duration in ms
+	tSym := math.Pow(2, float64(sf)) / float64(bandwidth)
+	tPreamble := (float64(preamble) + 4.25) * tSym
+
+	var de, h, c float64
+	if tSym > 16 {
+		de = 1
+	}
+	if implicitHeader {
+		h = 1
+	}
+	if crc {
+		c = 1
+	}
+
+	payloadSymbols := 8 + math.Max(
+		math.Ceil((8*float64(payloadSize)-4*float64(sf)+28+16*c-20*h)/(4*(float64(sf)-2*de)))*float64(codingRate+4),
+		0,
+	)
+	tPayload := payloadSymbols * tSym
+
+	return time.Duration((tPreamble+tPayload)*float64(time.Millisecond) + 0.5), nil
+}
+
+// FSK returns the time-on-air of a FSK frame. The bitrate is in bits per
+// second.
+func FSK(payloadSize, bitrate int) (time.Duration, error) {
+	if bitrate <= 0 {
+		return 0, fmt.Errorf("airtime: invalid bitrate: %d", bitrate)
+	}
+	return time.Duration(float64((payloadSize+fskOverhead)*8)/float64(bitrate)*float64(time.Second) + 0.5), nil
+}
+
+// TXPacket returns the time-on-air of the given TXPacket. When preamble is 0,
+// DefaultPreamble is used.
+func TXPacket(txPacket loracontrol.TXPacket, preamble int) (time.Duration, error) {
+	b, err := txPacket.PHYPayload.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	if txPacket.TXInfo.DataRate.LoRa == "" {
+		return FSK(len(b), int(txPacket.TXInfo.DataRate.FSK))
+	}
+
+	var sf, bandwidth, cr int
+	if _, err := fmt.Sscanf(txPacket.TXInfo.DataRate.LoRa, "SF%dBW%d", &sf, &bandwidth); err != nil {
+		return 0, fmt.Errorf("airtime: invalid data rate %s: %s", txPacket.TXInfo.DataRate.LoRa, err)
+	}
+	if _, err := fmt.Sscanf(txPacket.TXInfo.CodeRate, "4/%d", &cr); err != nil {
+		return 0, fmt.Errorf("airtime: invalid coding rate %s: %s", txPacket.TXInfo.CodeRate, err)
+	}
+	if preamble == 0 {
+		preamble = DefaultPreamble
+	}
+
+	return LoRa(len(b), sf, bandwidth, preamble, cr-4, !txPacket.TXInfo.DisableCRC, false)
+}
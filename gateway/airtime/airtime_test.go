@@ -0,0 +1,50 @@
+package airtime
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoRa(t *testing.T) {
+	Convey("Given a set of LoRa frame parameters", t, func() {
+		testTable := []struct {
+			PayloadSize int
+			SF          int
+			Bandwidth   int
+			Preamble    int
+			CodingRate  int
+			CRC         bool
+			Expected    time.Duration
+		}{
+			{13, 7, 125, 8, 1, true, 46336 * time.Microsecond},
+			{13, 7, 250, 8, 1, true, 23168 * time.Microsecond},
+			{51, 9, 125, 8, 1, true, 328704 * time.Microsecond},
+			{13, 12, 125, 8, 1, true, 1155072 * time.Microsecond}, // low data-rate optimization
+			{20, 10, 125, 8, 1, false, 329728 * time.Microsecond},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Then %d bytes at SF%dBW%d takes %s [%d]", test.PayloadSize, test.SF, test.Bandwidth, test.Expected, i), func() {
+				d, err := LoRa(test.PayloadSize, test.SF, test.Bandwidth, test.Preamble, test.CodingRate, test.CRC, false)
+				So(err, ShouldBeNil)
+				So(d, ShouldEqual, test.Expected)
+			})
+		}
+
+		Convey("Then an invalid spreading factor returns an error", func() {
+			_, err := LoRa(13, 13, 125, 8, 1, true, false)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFSK(t *testing.T) {
+	Convey("Then 13 bytes at 50kbps takes 3.84ms", t, func() {
+		d, err := FSK(13, 50000)
+		So(err, ShouldBeNil)
+		So(d, ShouldEqual, 3840*time.Microsecond)
+	})
+}
@@ -0,0 +1,662 @@
+package basicstation
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/gateway/gps"
+	"github.com/brocaar/loraserver/gateway/profile"
+	"github.com/brocaar/lorawan"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrBackendClosed is returned when the backend has been closed.
+	ErrBackendClosed = errors.New("gateway/basicstation: backend is closed")
+
+	// ErrGatewayNotConnected is returned when sending to a gateway which
+	// is not connected.
+	ErrGatewayNotConnected = errors.New("gateway/basicstation: gateway is not connected")
+
+	// ErrNoTimeReference is returned when sending a timestamp based packet
+	// to a gateway from which no uplink has been received within
+	// maxDownlinkDelay before the timestamp (the xtime of the downlink is
+	// derived from the xtime of the uplink it responds to).
+	ErrNoTimeReference = errors.New("gateway/basicstation: no uplink received from gateway")
+)
+
+const (
+	// drainTimeout defines how long a received packet is offered on the
+	// Receive channel after the backend has been closed.
+	drainTimeout = time.Second
+
+	// writeTimeout defines the timeout for writing a message to a gateway.
+	writeTimeout = 10 * time.Second
+
+	// maxDownlinkDelay defines the max. delay between an uplink and the
+	// downlink responding to it. The time reference of the uplinks is kept
+	// for this long.
+	maxDownlinkDelay = 16 * time.Second
+)
+
+// Option defines a Backend option.
+type Option func(*Backend) error
+
+// SetSeenHandler sets the function which is called every time a message
+// is received from a gateway.
+func SetSeenHandler(f func(lorawan.EUI64) error) Option {
+	return func(b *Backend) error {
+		b.seenHandler = f
+		return nil
+	}
+}
+
+// SetRouterConfig sets the RouterConfig which is sent to the gateways
+// (DefaultRouterConfig by default).
+func SetRouterConfig(conf RouterConfig) Option {
+	return func(b *Backend) error {
+		conf.MessageType = RouterConfigMessage
+		b.routerConfig = conf
+		return nil
+	}
+}
+
+// uplinkContext holds the time reference of a received uplink.
+type uplinkContext struct {
+	xtime int64
+	rctx  int64
+}
+
+// gatewayConn holds the websocket connection of a gateway and the time
+// references of the uplinks received within maxDownlinkDelay.
+type gatewayConn struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex // protects writes to conn
+
+	mu      sync.Mutex      // protects uplinks
+	uplinks []uplinkContext // oldest first
+}
+
+func (c *gatewayConn) writeJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return c.conn.WriteJSON(v)
+}
+
+// addUplink adds the time reference of the given uplink. The uplinks
+// received more than maxDownlinkDelay before it, or in an other session of
+// the gateway (the upper bits of the xtime), are removed.
+func (c *gatewayConn) addUplink(upInfo UplinkInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	maxDelay := int64(maxDownlinkDelay / time.Microsecond)
+	uplinks := c.uplinks[:0]
+	for _, u := range c.uplinks {
+		if d := upInfo.XTime - u.xtime; d >= 0 && d <= maxDelay {
+			uplinks = append(uplinks, u)
+		}
+	}
+	c.uplinks = append(uplinks, uplinkContext{xtime: upInfo.XTime, rctx: upInfo.RCtx})
+}
+
+// timeReference returns the time reference (xtime and rctx) for a downlink
+// at the given (32 bit) concentrator timestamp, taken from the uplink it
+// responds to: the last uplink received a whole number of seconds (the
+// receive delays of the node) before the timestamp, else the last uplink
+// received within maxDownlinkDelay before the timestamp. For an immediate
+// downlink, the time reference of the last uplink is returned. Zero values
+// are returned when there is no such uplink.
+func (c *gatewayConn) timeReference(timestamp uint32, immediately bool) (int64, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.uplinks) == 0 {
+		return 0, 0
+	}
+	if immediately {
+		u := c.uplinks[len(c.uplinks)-1]
+		return u.xtime, u.rctx
+	}
+
+	maxDelay := uint32(maxDownlinkDelay / time.Microsecond)
+	second := uint32(time.Second / time.Microsecond)
+	var ref *uplinkContext
+	for i := len(c.uplinks) - 1; i >= 0; i-- {
+		// the difference of the 32 bit timestamps handles the wrap around
+		d := timestamp - uint32(c.uplinks[i].xtime)
+		if d > maxDelay {
+			continue
+		}
+		if d%second == 0 {
+			ref = &c.uplinks[i]
+			break
+		}
+		if ref == nil {
+			ref = &c.uplinks[i]
+		}
+	}
+	if ref == nil {
+		return 0, 0
+	}
+	return ref.xtime, ref.rctx
+}
+
+// Backend implements a LoRa Basics Station backend.
+type Backend struct {
+	client       *loracontrol.Client
+	ln           net.Listener
+	upgrader     websocket.Upgrader
+	rxChan       chan loracontrol.RXPacket
+	errChan      chan error
+	seenHandler  func(lorawan.EUI64) error
+	routerConfig RouterConfig
+	diid         int64 // downlink id counter, must be accessed atomically
+
+	mu       sync.RWMutex // protects closed and gateways
+	closed   bool
+	closing  chan struct{}
+	gateways map[lorawan.EUI64]*gatewayConn
+	wg       sync.WaitGroup // gateway connection handlers
+}
+
+// NewBackend creates a new Backend listening on the given address
+// (e.g. 0.0.0.0:3001) for the router-info and gateway websocket
+// connections.
+func NewBackend(bind string, opts ...Option) (*Backend, error) {
+	b := &Backend{
+		rxChan:       make(chan loracontrol.RXPacket),
+		errChan:      make(chan error, 1),
+		closing:      make(chan struct{}),
+		gateways:     make(map[lorawan.EUI64]*gatewayConn),
+		routerConfig: DefaultRouterConfig,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+
+	log.WithField("bind", bind).Info("gateway/basicstation: starting websocket listener")
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	b.ln = ln
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/router-info", b.handleRouterInfo)
+	mux.HandleFunc("/gateway/", b.handleGateway)
+
+	go func() {
+		err := http.Serve(ln, mux)
+		if b.isClosed() {
+			return
+		}
+		log.Errorf("gateway/basicstation: websocket listener failed: %s", err)
+		select {
+		case b.errChan <- err:
+		default:
+		}
+	}()
+
+	return b, nil
+}
+
+// SetClient sets the loracontrol.Client and is automatically called by
+// loracontrol.SetGatewayBackend.
+func (b *Backend) SetClient(c *loracontrol.Client) {
+	b.client = c
+}
+
+// Close closes the backend. It stops accepting new connections, closes the
+// gateway connections, waits until the in-flight messages have been handled
+// and closes the Receive channel. Close is safe to call multiple times.
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.closing)
+	err := b.ln.Close()
+	for _, gw := range b.gateways {
+		gw.conn.Close()
+	}
+	b.mu.Unlock()
+
+	log.Info("gateway/basicstation: closing backend")
+	b.wg.Wait()
+	close(b.rxChan)
+	return err
+}
+
+// Receive returns the RXPacket channel.
+func (b *Backend) Receive() chan loracontrol.RXPacket {
+	return b.rxChan
+}
+
+// Errors returns the channel on which a fatal backend error (e.g. the
+// websocket listener failed) is published.
+func (b *Backend) Errors() chan error {
+	return b.errChan
+}
+
+// Send sends the given TXPacket to the gateway.
+func (b *Backend) Send(txPacket loracontrol.TXPacket) error {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrBackendClosed
+	}
+	gw, ok := b.gateways[txPacket.TXInfo.MAC]
+	b.mu.RUnlock()
+	if !ok {
+		return ErrGatewayNotConnected
+	}
+
+	xtime, rctx := gw.timeReference(txPacket.TXInfo.Timestamp, txPacket.TXInfo.Immediately)
+	msg, err := newDownlinkMessageFromTXPacket(txPacket, xtime, rctx, atomic.AddInt64(&b.diid, 1))
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"mac":  txPacket.TXInfo.MAC,
+		"diid": msg.DIID,
+	}).Info("gateway/basicstation: sending downlink message")
+	return gw.writeJSON(msg)
+}
+
+// PushConfig sends the router config, containing the channel plan of the
+// profile of the given gateway, to the gateway. The gateway (re)configures
+// its concentrator on receiving the router config.
+func (b *Backend) PushConfig(gw loracontrol.Gateway) error {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrBackendClosed
+	}
+	conn, ok := b.gateways[gw.MAC]
+	b.mu.RUnlock()
+	if !ok {
+		return ErrGatewayNotConnected
+	}
+
+	conf, err := b.routerConfigForGateway(gw)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("mac", gw.MAC).Info("gateway/basicstation: sending router config")
+	return conn.writeJSON(conf)
+}
+
+func (b *Backend) isClosed() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.closed
+}
+
+// handleRouterInfo returns the LNS uri to the gateway.
+func (b *Backend) handleRouterInfo(w http.ResponseWriter, r *http.Request) {
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("gateway/basicstation: could not upgrade router-info connection: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	var req RouterInfoRequest
+	if err := conn.ReadJSON(&req); err != nil {
+		log.Errorf("gateway/basicstation: could not read router-info request: %s", err)
+		return
+	}
+
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	resp := RouterInfoResponse{
+		Router: req.Router,
+		Muxs:   req.Router,
+		URI:    fmt.Sprintf("%s://%s/gateway/%s", scheme, r.Host, lorawan.EUI64(req.Router)),
+	}
+
+	log.WithFields(log.Fields{
+		"mac": lorawan.EUI64(req.Router),
+		"uri": resp.URI,
+	}).Info("gateway/basicstation: handling router-info request")
+	if err := conn.WriteJSON(resp); err != nil {
+		log.Errorf("gateway/basicstation: could not write router-info response: %s", err)
+	}
+}
+
+// handleGateway handles the LNS websocket connection of a gateway.
+func (b *Backend) handleGateway(w http.ResponseWriter, r *http.Request) {
+	var eui EUI
+	if err := eui.UnmarshalText([]byte(strings.TrimPrefix(r.URL.Path, "/gateway/"))); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mac := lorawan.EUI64(eui)
+
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.WithField("mac", mac).Errorf("gateway/basicstation: could not upgrade gateway connection: %s", err)
+		return
+	}
+
+	gw := &gatewayConn{conn: conn}
+	if !b.registerGateway(mac, gw) {
+		conn.Close()
+		return
+	}
+	defer b.wg.Done()
+	defer b.unregisterGateway(mac, gw)
+
+	log.WithField("mac", mac).Info("gateway/basicstation: gateway connected")
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !b.isClosed() && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.WithField("mac", mac).Errorf("gateway/basicstation: read error: %s", err)
+			}
+			return
+		}
+
+		if err := b.handleMessage(mac, gw, data); err != nil {
+			log.WithField("mac", mac).Errorf("gateway/basicstation: could not handle message: %s", err)
+		}
+	}
+}
+
+// registerGateway registers the connection of the gateway, closing the
+// previous connection of the same gateway. It returns false when the backend
+// has been closed.
+func (b *Backend) registerGateway(mac lorawan.EUI64, gw *gatewayConn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	if prev, ok := b.gateways[mac]; ok {
+		log.WithField("mac", mac).Warning("gateway/basicstation: gateway reconnected, closing previous connection")
+		prev.conn.Close()
+	}
+	b.gateways[mac] = gw
+	b.wg.Add(1)
+	return true
+}
+
+func (b *Backend) unregisterGateway(mac lorawan.EUI64, gw *gatewayConn) {
+	b.mu.Lock()
+	if b.gateways[mac] == gw {
+		delete(b.gateways, mac)
+	}
+	b.mu.Unlock()
+	gw.conn.Close()
+	log.WithField("mac", mac).Info("gateway/basicstation: gateway disconnected")
+}
+
+func (b *Backend) handleMessage(mac lorawan.EUI64, gw *gatewayConn, data []byte) error {
+	b.gatewaySeen(mac)
+
+	var header messageHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+
+	switch header.MessageType {
+	case VersionMessage:
+		return b.handleVersion(mac, gw, data)
+	case UplinkDataFrameMessage:
+		return b.handleUplinkDataFrame(mac, gw, data)
+	case JoinRequestMessage:
+		return b.handleJoinRequest(mac, gw, data)
+	case DownlinkTransmittedMessage:
+		return b.handleDownlinkTransmitted(mac, data)
+	case TimeSyncMessage:
+		return b.handleTimeSync(gw, data)
+	case ProprietaryDataFrameMessage:
+		log.WithField("mac", mac).Debug("gateway/basicstation: ignoring proprietary data frame")
+		return nil
+	default:
+		return fmt.Errorf("unexpected message type: %s", header.MessageType)
+	}
+}
+
+func (b *Backend) handleVersion(mac lorawan.EUI64, gw *gatewayConn, data []byte) error {
+	var version Version
+	if err := json.Unmarshal(data, &version); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"mac":      mac,
+		"station":  version.Station,
+		"firmware": version.Firmware,
+		"model":    version.Model,
+		"protocol": version.Protocol,
+	}).Info("gateway/basicstation: sending router config")
+
+	conf, err := b.getRouterConfig(mac)
+	if err != nil {
+		return err
+	}
+	return gw.writeJSON(conf)
+}
+
+// getRouterConfig returns the RouterConfig for the given gateway. When the
+// gateway has a profile, its channel plan is used.
+func (b *Backend) getRouterConfig(mac lorawan.EUI64) (RouterConfig, error) {
+	if b.client == nil {
+		return b.routerConfig, nil
+	}
+	gw, err := b.client.Gateway().Get(mac)
+	if err != nil {
+		if err == loracontrol.ErrObjectDoesNotExist {
+			return b.routerConfig, nil
+		}
+		return b.routerConfig, err
+	}
+	return b.routerConfigForGateway(gw)
+}
+
+func (b *Backend) routerConfigForGateway(gw loracontrol.Gateway) (RouterConfig, error) {
+	p, err := profile.Get(gw)
+	if err != nil {
+		return b.routerConfig, err
+	}
+	if p == nil {
+		return b.routerConfig, nil
+	}
+	return newRouterConfig(b.routerConfig, *p)
+}
+
+func (b *Backend) handleUplinkDataFrame(mac lorawan.EUI64, gw *gatewayConn, data []byte) error {
+	var frame UplinkDataFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return err
+	}
+	gw.addUplink(frame.UplinkInfo)
+
+	phyB, err := frame.PHYPayloadBytes()
+	if err != nil {
+		return err
+	}
+	rxPacket, err := newRXPacketFromUplink(mac, phyB, frame.DR, frame.Freq, frame.UplinkInfo)
+	if err != nil {
+		return err
+	}
+	return b.collectRXPacket(rxPacket)
+}
+
+func (b *Backend) handleJoinRequest(mac lorawan.EUI64, gw *gatewayConn, data []byte) error {
+	var frame JoinRequest
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return err
+	}
+	gw.addUplink(frame.UplinkInfo)
+
+	rxPacket, err := newRXPacketFromUplink(mac, frame.PHYPayloadBytes(), frame.DR, frame.Freq, frame.UplinkInfo)
+	if err != nil {
+		return err
+	}
+	return b.collectRXPacket(rxPacket)
+}
+
+func (b *Backend) collectRXPacket(rxPacket loracontrol.RXPacket) error {
+	log.WithFields(log.Fields{
+		"mac":  rxPacket.RXInfo.MAC,
+		"size": rxPacket.RXInfo.Size,
+	}).Info("gateway/basicstation: handling received node data")
+
+	select {
+	case b.rxChan <- rxPacket:
+	case <-b.closing:
+		// give the consumer some time to receive the in-flight packets
+		select {
+		case b.rxChan <- rxPacket:
+		case <-time.After(drainTimeout):
+			return ErrBackendClosed
+		}
+	}
+	return nil
+}
+
+func (b *Backend) handleDownlinkTransmitted(mac lorawan.EUI64, data []byte) error {
+	var dntxed DownlinkTransmitted
+	if err := json.Unmarshal(data, &dntxed); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"mac":  mac,
+		"diid": dntxed.DIID,
+	}).Info("gateway/basicstation: downlink message transmitted")
+	return nil
+}
+
+func (b *Backend) handleTimeSync(gw *gatewayConn, data []byte) error {
+	var ts TimeSync
+	if err := json.Unmarshal(data, &ts); err != nil {
+		return err
+	}
+	return gw.writeJSON(TimeSync{
+		MessageType: TimeSyncMessage,
+		TxTime:      ts.TxTime,
+		GPSTime:     int64(time.Duration(gps.NewFromTime(time.Now())) / time.Microsecond),
+	})
+}
+
+func (b *Backend) gatewaySeen(mac lorawan.EUI64) {
+	if b.seenHandler == nil {
+		return
+	}
+	if err := b.seenHandler(mac); err != nil {
+		log.WithField("mac", mac).Errorf("gateway/basicstation: could not handle gateway seen: %s", err)
+	}
+}
+
+// getXTime returns the xtime for the given (32 bit) concentrator timestamp,
+// relative to the xtime of the uplink the downlink responds to (which
+// precedes the timestamp). The lower 48 bits of the xtime hold the
+// concentrator counter in microseconds.
+func getXTime(refXTime int64, timestamp uint32) int64 {
+	// the difference of the 32 bit values handles the wrap around of the
+	// timestamp
+	return refXTime + int64(timestamp-uint32(refXTime))
+}
+
+func newRXPacketFromUplink(mac lorawan.EUI64, phyB []byte, dr int, freq uint32, upInfo UplinkInfo) (loracontrol.RXPacket, error) {
+	// this is always an uplink payload
+	phy := lorawan.NewPHYPayload(true)
+	if err := phy.UnmarshalBinary(phyB); err != nil {
+		return loracontrol.RXPacket{}, fmt.Errorf("basicstation: could not unmarshal PHYPayload: %s", err)
+	}
+
+	dataRate, err := getDataRate(dr)
+	if err != nil {
+		return loracontrol.RXPacket{}, err
+	}
+
+	rxPacket := loracontrol.RXPacket{
+		PHYPayload: phy,
+		RXInfo: loracontrol.RXInfo{
+			MAC:        mac,
+			Timestamp:  uint32(upInfo.XTime),
+			Frequency:  float64(freq) / 1000000,
+			CRCStatus:  1, // only frames with a valid CRC are forwarded
+			Modulation: dataRate.Modulation(),
+			DataRate:   dataRate,
+			CodingRate: "4/5",
+			RSSI:       int(upInfo.RSSI),
+			LoRaSNR:    upInfo.SNR,
+			Size:       uint(len(phyB)),
+		},
+	}
+	if upInfo.RXTime != 0 {
+		sec, frac := math.Modf(upInfo.RXTime)
+		rxPacket.RXInfo.Time = time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC()
+	}
+	return rxPacket, nil
+}
+
+func newDownlinkMessageFromTXPacket(txPacket loracontrol.TXPacket, refXTime, rctx, diid int64) (DownlinkMessage, error) {
+	b, err := txPacket.PHYPayload.MarshalBinary()
+	if err != nil {
+		return DownlinkMessage{}, err
+	}
+	dr, err := getDR(txPacket.TXInfo.DataRate)
+	if err != nil {
+		return DownlinkMessage{}, err
+	}
+	freq := uint32(txPacket.TXInfo.Frequency*1000000 + 0.5)
+
+	msg := DownlinkMessage{
+		MessageType: DownlinkMessageMessage,
+		DIID:        diid,
+		PDU:         hex.EncodeToString(b),
+		RCtx:        rctx,
+	}
+
+	if txPacket.TXInfo.Immediately {
+		// class C downlinks are transmitted immediately using the RX2
+		// parameters
+		msg.DeviceClass = ClassC
+		msg.RX2DR = &dr
+		msg.RX2Freq = &freq
+		return msg, nil
+	}
+
+	if refXTime == 0 {
+		return DownlinkMessage{}, ErrNoTimeReference
+	}
+
+	// the gateway transmits RxDelay seconds after the given xtime
+	msg.DeviceClass = ClassA
+	msg.RxDelay = 1
+	msg.XTime = getXTime(refXTime, txPacket.TXInfo.Timestamp) - int64(time.Second/time.Microsecond)
+	msg.RX1DR = &dr
+	msg.RX1Freq = &freq
+	return msg, nil
+}
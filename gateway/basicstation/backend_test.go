@@ -0,0 +1,303 @@
+package basicstation
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func init() {
+	log.SetLevel(log.ErrorLevel)
+}
+
+func TestBackend(t *testing.T) {
+	Convey("Given a Backend", t, func() {
+		seenChan := make(chan lorawan.EUI64, 10)
+		backend, err := NewBackend("127.0.0.1:0", SetSeenHandler(func(mac lorawan.EUI64) error {
+			seenChan <- mac
+			return nil
+		}))
+		So(err, ShouldBeNil)
+		defer backend.Close()
+
+		addr := backend.ln.Addr().String()
+		mac := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+		Convey("When connecting to the router-info endpoint", func() {
+			conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/router-info", addr), nil)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			So(conn.WriteJSON(RouterInfoRequest{Router: EUI(mac)}), ShouldBeNil)
+
+			Convey("Then the gateway uri is returned", func() {
+				var resp RouterInfoResponse
+				So(conn.ReadJSON(&resp), ShouldBeNil)
+				So(resp, ShouldResemble, RouterInfoResponse{
+					Router: EUI(mac),
+					Muxs:   EUI(mac),
+					URI:    fmt.Sprintf("ws://%s/gateway/0102030405060708", addr),
+				})
+			})
+		})
+
+		Convey("When the gateway connects and sends its version", func() {
+			conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/gateway/0102030405060708", addr), nil)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			So(conn.SetReadDeadline(time.Now().Add(time.Second)), ShouldBeNil)
+
+			So(conn.WriteJSON(Version{
+				MessageType: VersionMessage,
+				Station:     "2.0.0",
+				Protocol:    2,
+			}), ShouldBeNil)
+
+			Convey("Then the router config is returned", func() {
+				var conf RouterConfig
+				So(conn.ReadJSON(&conf), ShouldBeNil)
+				So(conf.MessageType, ShouldEqual, RouterConfigMessage)
+				So(conf.Region, ShouldEqual, "EU863")
+				So(conf.DRs, ShouldResemble, eu868DataRates)
+
+				Convey("Then the seen handler was called", func() {
+					So(<-seenChan, ShouldEqual, mac)
+				})
+
+				Convey("When sending a timestamp based TXPacket before any uplink", func() {
+					err := backend.Send(loracontrol.TXPacket{
+						TXInfo: loracontrol.TXInfo{
+							MAC:       mac,
+							Timestamp: 12345,
+							Frequency: 868.1,
+							DataRate:  loracontrol.DataRate{LoRa: "SF7BW125"},
+						},
+						PHYPayload: lorawan.NewPHYPayload(false),
+					})
+
+					Convey("Then ErrNoTimeReference is returned", func() {
+						So(err, ShouldEqual, ErrNoTimeReference)
+					})
+				})
+
+				Convey("When the gateway sends an uplink data frame", func() {
+					So(conn.WriteJSON(UplinkDataFrame{
+						MessageType: UplinkDataFrameMessage,
+						MHDR:        0x40,
+						DevAddr:     0x01020304,
+						FCnt:        10,
+						FPort:       1,
+						FRMPayload:  "616263",
+						MIC:         0x01020304,
+						DR:          5,
+						Freq:        868100000,
+						UplinkInfo: UplinkInfo{
+							RCtx:   1,
+							XTime:  0x01000000000f4240, // 1 second
+							RSSI:   -51,
+							SNR:    7,
+							RXTime: 1466583960.5,
+						},
+					}), ShouldBeNil)
+
+					Convey("Then the packet is received on the Receive channel", func() {
+						var rxPacket loracontrol.RXPacket
+						select {
+						case rxPacket = <-backend.Receive():
+						case <-time.After(time.Second):
+							t.Fatal("timeout waiting for RXPacket")
+						}
+
+						So(rxPacket.RXInfo, ShouldResemble, loracontrol.RXInfo{
+							MAC:        mac,
+							Time:       time.Unix(1466583960, 500000000).UTC(),
+							Timestamp:  1000000,
+							Frequency:  868.1,
+							CRCStatus:  1,
+							Modulation: "LORA",
+							DataRate:   loracontrol.DataRate{LoRa: "SF7BW125"},
+							CodingRate: "4/5",
+							RSSI:       -51,
+							LoRaSNR:    7,
+							Size:       16,
+						})
+
+						Convey("When sending a TXPacket in RX1", func() {
+							phy := lorawan.NewPHYPayload(false)
+							phy.MHDR = lorawan.MHDR{
+								MType: lorawan.UnconfirmedDataDown,
+								Major: lorawan.LoRaWANR1,
+							}
+							phy.MACPayload = lorawan.NewMACPayload(false)
+							b, err := phy.MarshalBinary()
+							So(err, ShouldBeNil)
+
+							So(backend.Send(loracontrol.TXPacket{
+								TXInfo: loracontrol.TXInfo{
+									MAC:       mac,
+									Timestamp: 2000000,
+									Frequency: 868.1,
+									DataRate:  loracontrol.DataRate{LoRa: "SF7BW125"},
+								},
+								PHYPayload: phy,
+							}), ShouldBeNil)
+
+							Convey("Then the gateway receives the downlink message", func() {
+								var msg DownlinkMessage
+								So(conn.ReadJSON(&msg), ShouldBeNil)
+
+								dr := 5
+								freq := uint32(868100000)
+								So(msg, ShouldResemble, DownlinkMessage{
+									MessageType: DownlinkMessageMessage,
+									DeviceClass: ClassA,
+									DIID:        msg.DIID,
+									PDU:         hex.EncodeToString(b),
+									RxDelay:     1,
+									RX1DR:       &dr,
+									RX1Freq:     &freq,
+									XTime:       0x01000000000f4240,
+									RCtx:        1,
+								})
+							})
+						})
+					})
+				})
+
+				Convey("When the gateway sends a timesync request", func() {
+					So(conn.WriteJSON(TimeSync{
+						MessageType: TimeSyncMessage,
+						TxTime:      123.456,
+					}), ShouldBeNil)
+
+					Convey("Then the GPS time is returned", func() {
+						var ts TimeSync
+						So(conn.ReadJSON(&ts), ShouldBeNil)
+						So(ts.MessageType, ShouldEqual, TimeSyncMessage)
+						So(ts.TxTime, ShouldEqual, 123.456)
+						So(ts.GPSTime, ShouldBeGreaterThan, 0)
+					})
+				})
+			})
+		})
+
+		Convey("When sending to a gateway which is not connected", func() {
+			err := backend.Send(loracontrol.TXPacket{TXInfo: loracontrol.TXInfo{MAC: mac}})
+
+			Convey("Then ErrGatewayNotConnected is returned", func() {
+				So(err, ShouldEqual, ErrGatewayNotConnected)
+			})
+		})
+
+		Convey("When closing the backend", func() {
+			So(backend.Close(), ShouldBeNil)
+
+			Convey("Then the Receive channel is closed", func() {
+				_, ok := <-backend.Receive()
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Then Send returns ErrBackendClosed", func() {
+				So(backend.Send(loracontrol.TXPacket{}), ShouldEqual, ErrBackendClosed)
+			})
+		})
+	})
+}
+
+func TestGetXTime(t *testing.T) {
+	Convey("Given a reference xtime of session 1", t, func() {
+		ref := int64(0x01000000fffff000)
+
+		Convey("Then a later timestamp keeps the upper bits", func() {
+			So(getXTime(ref, 0xfffff100), ShouldEqual, int64(0x01000000fffff100))
+		})
+
+		Convey("Then a wrapped timestamp increments the upper bits", func() {
+			So(getXTime(ref, 0x100), ShouldEqual, int64(0x0100000100000100))
+		})
+	})
+}
+
+func TestTimeReference(t *testing.T) {
+	Convey("Given a gatewayConn", t, func() {
+		gw := &gatewayConn{}
+
+		Convey("Then no time reference is returned before any uplink", func() {
+			xtime, rctx := gw.timeReference(12345, false)
+			So(xtime, ShouldEqual, 0)
+			So(rctx, ShouldEqual, 0)
+		})
+
+		Convey("Given two uplinks received 0.3 seconds apart", func() {
+			a := UplinkInfo{XTime: 0x0100000000100000, RCtx: 1}
+			b := UplinkInfo{XTime: a.XTime + 300000, RCtx: 2}
+			gw.addUplink(a)
+			gw.addUplink(b)
+
+			Convey("Then the RX1 downlink of the first uplink uses its time reference", func() {
+				xtime, rctx := gw.timeReference(uint32(a.XTime)+1000000, false)
+				So(xtime, ShouldEqual, a.XTime)
+				So(rctx, ShouldEqual, 1)
+			})
+
+			Convey("Then the join-accept of the second uplink uses its time reference", func() {
+				xtime, rctx := gw.timeReference(uint32(b.XTime)+5000000, false)
+				So(xtime, ShouldEqual, b.XTime)
+				So(rctx, ShouldEqual, 2)
+			})
+
+			Convey("Then an other timestamp uses the last preceding uplink", func() {
+				xtime, rctx := gw.timeReference(uint32(a.XTime)+1500000, false)
+				So(xtime, ShouldEqual, b.XTime)
+				So(rctx, ShouldEqual, 2)
+			})
+
+			Convey("Then a timestamp preceding the uplinks has no time reference", func() {
+				xtime, _ := gw.timeReference(uint32(a.XTime)-1000000, false)
+				So(xtime, ShouldEqual, 0)
+			})
+
+			Convey("Then an immediate downlink uses the last uplink", func() {
+				xtime, rctx := gw.timeReference(0, true)
+				So(xtime, ShouldEqual, b.XTime)
+				So(rctx, ShouldEqual, 2)
+			})
+
+			Convey("When an uplink is received after maxDownlinkDelay", func() {
+				gw.addUplink(UplinkInfo{XTime: a.XTime + 20000000, RCtx: 3})
+
+				Convey("Then the old uplinks have been removed", func() {
+					So(gw.uplinks, ShouldResemble, []uplinkContext{{xtime: a.XTime + 20000000, rctx: 3}})
+				})
+			})
+
+			Convey("When an uplink of a new gateway session is received", func() {
+				gw.addUplink(UplinkInfo{XTime: 0x0200000000000100, RCtx: 3})
+
+				Convey("Then the uplinks of the previous session have been removed", func() {
+					So(gw.uplinks, ShouldHaveLength, 1)
+				})
+			})
+		})
+
+		Convey("Given an uplink just before the 32 bit timestamp wraps around", func() {
+			a := UplinkInfo{XTime: 0x01000000fff00000, RCtx: 1}
+			gw.addUplink(a)
+
+			Convey("Then the RX1 downlink uses its time reference and a wrapped xtime", func() {
+				ts := uint32(a.XTime) + 1000000
+				xtime, rctx := gw.timeReference(ts, false)
+				So(xtime, ShouldEqual, a.XTime)
+				So(rctx, ShouldEqual, 1)
+				So(getXTime(xtime, ts), ShouldEqual, a.XTime+1000000)
+			})
+		})
+	})
+}
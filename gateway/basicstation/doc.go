@@ -0,0 +1,22 @@
+/*
+Package basicstation implements the LoRa Basics Station gateway backend.
+
+The following endpoints are implemented:
+    * /router-info       - router discovery
+    * /gateway/[EUI]     - LNS websocket connection of the given gateway
+The following upstream message types are implemented:
+    * version
+    * updf
+    * jreq
+    * dntxed
+    * timesync
+The following downstream message types are implemented:
+    * router_config
+    * dnmsg
+    * timesync
+The router_config contains the channel plan of the gateway profile (see the
+profile package) when configured, else the DefaultRouterConfig is used.
+The specification can be found at:
+https://doc.sm.tc/station/tcproto.html
+*/
+package basicstation
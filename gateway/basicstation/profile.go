@@ -0,0 +1,118 @@
+package basicstation
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/brocaar/loraserver/gateway/profile"
+)
+
+// maxRadioSpan is the max. frequency span (Hz) of the channels of a single
+// concentrator radio (the edges of the outer 125kHz channels at IF +/-400kHz).
+const maxRadioSpan = 925000
+
+// defaultChannelBandwidth is the bandwidth (Hz) of the multi-SF and FSK
+// channels.
+const defaultChannelBandwidth = 125000
+
+// concentratorChannel is a channel which must be assigned to a radio.
+type concentratorChannel struct {
+	conf      *SX1301ChanConf
+	frequency int // Hz
+	bandwidth int // Hz
+}
+
+// newRouterConfig returns a copy of the given RouterConfig with the
+// concentrator configuration of the given profile. The channels are assigned
+// to the two radios of the concentrator, the center frequency of each radio
+// is the center of its channels.
+func newRouterConfig(base RouterConfig, p profile.Profile) (RouterConfig, error) {
+	if err := p.Validate(); err != nil {
+		return base, err
+	}
+
+	var conf SX1301Conf
+	var channels []concentratorChannel
+	for i, c := range p.Channels {
+		conf.ChanMultiSF[i] = SX1301ChanConf{Enable: true}
+		channels = append(channels, concentratorChannel{
+			conf:      &conf.ChanMultiSF[i],
+			frequency: toHz(c.Frequency),
+			bandwidth: defaultChannelBandwidth,
+		})
+	}
+	if c := p.LoRaStdChannel; c != nil {
+		conf.ChanLoRaStd = SX1301ChanConf{
+			Enable:       true,
+			Bandwidth:    c.Bandwidth * 1000,
+			SpreadFactor: c.SpreadingFactor,
+		}
+		channels = append(channels, concentratorChannel{
+			conf:      &conf.ChanLoRaStd,
+			frequency: toHz(c.Frequency),
+			bandwidth: c.Bandwidth * 1000,
+		})
+	}
+	if c := p.FSKChannel; c != nil {
+		conf.ChanFSK = SX1301ChanConf{
+			Enable:   true,
+			DataRate: uint32(c.Bitrate),
+		}
+		channels = append(channels, concentratorChannel{
+			conf:      &conf.ChanFSK,
+			frequency: toHz(c.Frequency),
+			bandwidth: defaultChannelBandwidth,
+		})
+	}
+
+	sort.Sort(byLowerEdge(channels))
+
+	radios := []*SX1301RadioConf{&conf.Radio0, &conf.Radio1}
+	var radio int
+	for start := 0; start < len(channels); radio++ {
+		if radio == len(radios) {
+			return base, errors.New("gateway/basicstation: the channels of the profile do not fit on the two concentrator radios")
+		}
+
+		// collect the channels which fit within the span of the radio
+		lower := channels[start].frequency - channels[start].bandwidth/2
+		upper := channels[start].frequency + channels[start].bandwidth/2
+		end := start + 1
+		for ; end < len(channels); end++ {
+			u := channels[end].frequency + channels[end].bandwidth/2
+			if u-lower > maxRadioSpan {
+				break
+			}
+			if u > upper {
+				upper = u
+			}
+		}
+
+		center := (lower + upper) / 2
+		*radios[radio] = SX1301RadioConf{Enable: true, Freq: uint32(center)}
+		for _, c := range channels[start:end] {
+			c.conf.Radio = radio
+			c.conf.IF = c.frequency - center
+		}
+		start = end
+	}
+
+	base.SX1301Conf = []SX1301Conf{conf}
+	return base, nil
+}
+
+// byLowerEdge implements sort.Interface to sort the channels by their lower
+// edge frequency.
+type byLowerEdge []concentratorChannel
+
+func (s byLowerEdge) Len() int      { return len(s) }
+func (s byLowerEdge) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLowerEdge) Less(i, j int) bool {
+	return s[i].frequency-s[i].bandwidth/2 < s[j].frequency-s[j].bandwidth/2
+}
+
+// toHz converts the given frequency in MHz to Hz.
+func toHz(frequency float64) int {
+	return int(math.Floor(frequency*1000000 + 0.5))
+}
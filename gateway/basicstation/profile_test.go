@@ -0,0 +1,63 @@
+package basicstation
+
+import (
+	"testing"
+
+	"github.com/brocaar/loraserver/gateway/profile"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNewRouterConfig(t *testing.T) {
+	Convey("Given the EU868 channel plan as profile", t, func() {
+		p := profile.Profile{
+			Channels: []profile.Channel{
+				{Frequency: 868.1},
+				{Frequency: 868.3},
+				{Frequency: 868.5},
+				{Frequency: 867.1},
+				{Frequency: 867.3},
+				{Frequency: 867.5},
+				{Frequency: 867.7},
+				{Frequency: 867.9},
+			},
+			LoRaStdChannel: &profile.LoRaStdChannel{Frequency: 868.3, Bandwidth: 250, SpreadingFactor: 7},
+			FSKChannel:     &profile.FSKChannel{Frequency: 868.8, Bitrate: 50000},
+		}
+
+		Convey("Then newRouterConfig assigns the channels to the radios", func() {
+			conf, err := newRouterConfig(DefaultRouterConfig, p)
+			So(err, ShouldBeNil)
+			So(conf.Region, ShouldEqual, DefaultRouterConfig.Region)
+			So(conf.SX1301Conf, ShouldHaveLength, 1)
+
+			c := conf.SX1301Conf[0]
+			So(c.Radio0, ShouldResemble, SX1301RadioConf{Enable: true, Freq: 867500000})
+			So(c.Radio1, ShouldResemble, SX1301RadioConf{Enable: true, Freq: 868450000})
+			So(c.ChanMultiSF, ShouldResemble, [8]SX1301ChanConf{
+				{Enable: true, Radio: 1, IF: -350000},
+				{Enable: true, Radio: 1, IF: -150000},
+				{Enable: true, Radio: 1, IF: 50000},
+				{Enable: true, Radio: 0, IF: -400000},
+				{Enable: true, Radio: 0, IF: -200000},
+				{Enable: true, Radio: 0, IF: 0},
+				{Enable: true, Radio: 0, IF: 200000},
+				{Enable: true, Radio: 0, IF: 400000},
+			})
+			So(c.ChanLoRaStd, ShouldResemble, SX1301ChanConf{Enable: true, Radio: 1, IF: -150000, Bandwidth: 250000, SpreadFactor: 7})
+			So(c.ChanFSK, ShouldResemble, SX1301ChanConf{Enable: true, Radio: 1, IF: 350000, DataRate: 50000})
+
+			Convey("Then the DefaultRouterConfig is not modified", func() {
+				So(DefaultRouterConfig.SX1301Conf[0].Radio1.Freq, ShouldEqual, 868500000)
+			})
+		})
+
+		Convey("Given a channel outside the span of the two radios", func() {
+			p.Channels[7].Frequency = 869.525
+
+			Convey("Then newRouterConfig returns an error", func() {
+				_, err := newRouterConfig(DefaultRouterConfig, p)
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,416 @@
+package basicstation
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+)
+
+// MessageType defines the message type.
+type MessageType string
+
+// Available message types.
+const (
+	VersionMessage              MessageType = "version"
+	RouterConfigMessage         MessageType = "router_config"
+	UplinkDataFrameMessage      MessageType = "updf"
+	JoinRequestMessage          MessageType = "jreq"
+	ProprietaryDataFrameMessage MessageType = "propdf"
+	DownlinkMessageMessage      MessageType = "dnmsg"
+	DownlinkTransmittedMessage  MessageType = "dntxed"
+	TimeSyncMessage             MessageType = "timesync"
+)
+
+// Device classes of the DownlinkMessage.
+const (
+	ClassA = 0
+	ClassB = 1
+	ClassC = 2
+)
+
+// EUI implements an EUI which (un)marshals to and from the formats used by
+// the Basics Station. It is marshaled as 01-02-03-04-05-06-07-08 and can be
+// unmarshaled from that format, the ID6 format (e.g. 1:2:3:4 or ::1) or
+// an integer.
+type EUI lorawan.EUI64
+
+// String implements fmt.Stringer.
+func (e EUI) String() string {
+	parts := make([]string, len(e))
+	for i := range e {
+		parts[i] = hex.EncodeToString(e[i : i+1])
+	}
+	return strings.Join(parts, "-")
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (e EUI) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (e *EUI) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// integer notation
+		i, err := strconv.ParseUint(string(data), 10, 64)
+		if err != nil {
+			return fmt.Errorf("basicstation: invalid EUI: %s", data)
+		}
+		binary.BigEndian.PutUint64(e[:], i)
+		return nil
+	}
+	return e.UnmarshalText([]byte(s))
+}
+
+// UnmarshalText decodes the EUI from the EUI (dash separated or plain hex)
+// or ID6 notation.
+func (e *EUI) UnmarshalText(text []byte) error {
+	s := string(text)
+
+	if strings.Contains(s, ":") {
+		return e.unmarshalID6(s)
+	}
+
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil {
+		return fmt.Errorf("basicstation: invalid EUI %s: %s", s, err)
+	}
+	if len(b) != len(e) {
+		return fmt.Errorf("basicstation: an EUI is exactly %d bytes", len(e))
+	}
+	copy(e[:], b)
+	return nil
+}
+
+// unmarshalID6 decodes the ID6 notation, which is the IPv6 notation of the
+// lower 64 bits (four groups of 16 bits, "::" to compress zero groups).
+func (e *EUI) unmarshalID6(s string) error {
+	var groups []string
+	if strings.Contains(s, "::") {
+		parts := strings.SplitN(s, "::", 2)
+		var head, tail []string
+		if parts[0] != "" {
+			head = strings.Split(parts[0], ":")
+		}
+		if parts[1] != "" {
+			tail = strings.Split(parts[1], ":")
+		}
+		if len(head)+len(tail) > 3 {
+			return fmt.Errorf("basicstation: invalid ID6: %s", s)
+		}
+		groups = append(groups, head...)
+		for i := len(head) + len(tail); i < 4; i++ {
+			groups = append(groups, "0")
+		}
+		groups = append(groups, tail...)
+	} else {
+		groups = strings.Split(s, ":")
+	}
+	if len(groups) != 4 {
+		return fmt.Errorf("basicstation: invalid ID6: %s", s)
+	}
+
+	for i, g := range groups {
+		v, err := strconv.ParseUint(g, 16, 16)
+		if err != nil {
+			return fmt.Errorf("basicstation: invalid ID6 %s: %s", s, err)
+		}
+		binary.BigEndian.PutUint16(e[i*2:], uint16(v))
+	}
+	return nil
+}
+
+// RouterInfoRequest is sent by the gateway on the router-info endpoint.
+type RouterInfoRequest struct {
+	Router EUI `json:"router"`
+}
+
+// RouterInfoResponse is the response on the RouterInfoRequest.
+type RouterInfoResponse struct {
+	Router EUI    `json:"router"`
+	Muxs   EUI    `json:"muxs"`
+	URI    string `json:"uri,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// messageHeader contains the message type, which is used to determine the
+// type of the received message.
+type messageHeader struct {
+	MessageType MessageType `json:"msgtype"`
+}
+
+// Version is sent by the gateway after connecting.
+type Version struct {
+	MessageType MessageType `json:"msgtype"`
+	Station     string      `json:"station"`
+	Firmware    string      `json:"firmware"`
+	Package     string      `json:"package"`
+	Model       string      `json:"model"`
+	Protocol    int         `json:"protocol"`
+	Features    string      `json:"features"`
+}
+
+// RouterConfig contains the channel-plan configuration of the gateway and
+// is sent as response on the Version message.
+type RouterConfig struct {
+	MessageType MessageType  `json:"msgtype"`
+	NetID       []uint32     `json:"NetID"`
+	JoinEUI     [][2]uint64  `json:"JoinEui"`
+	Region      string       `json:"region"`
+	HWSpec      string       `json:"hwspec"`
+	FreqRange   [2]uint32    `json:"freq_range"`
+	DRs         [][3]int     `json:"DRs"`
+	SX1301Conf  []SX1301Conf `json:"sx1301_conf"`
+	NoCCA       bool         `json:"nocca"`
+	NoDC        bool         `json:"nodc"`
+	NoDwell     bool         `json:"nodwell"`
+}
+
+// SX1301Conf contains the concentrator configuration.
+type SX1301Conf struct {
+	Radio0      SX1301RadioConf   `json:"radio_0"`
+	Radio1      SX1301RadioConf   `json:"radio_1"`
+	ChanMultiSF [8]SX1301ChanConf `json:"-"`
+	ChanLoRaStd SX1301ChanConf    `json:"chan_Lora_std"`
+	ChanFSK     SX1301ChanConf    `json:"chan_FSK"`
+}
+
+// MarshalJSON implements the json.Marshaler interface. The multi-SF channels
+// are marshaled as chan_multiSF_0 ... chan_multiSF_7.
+func (c SX1301Conf) MarshalJSON() ([]byte, error) {
+	out := map[string]interface{}{
+		"radio_0":       c.Radio0,
+		"radio_1":       c.Radio1,
+		"chan_Lora_std": c.ChanLoRaStd,
+		"chan_FSK":      c.ChanFSK,
+	}
+	for i, ch := range c.ChanMultiSF {
+		out[fmt.Sprintf("chan_multiSF_%d", i)] = ch
+	}
+	return json.Marshal(out)
+}
+
+// SX1301RadioConf contains the configuration of a concentrator radio.
+type SX1301RadioConf struct {
+	Enable bool   `json:"enable"`
+	Freq   uint32 `json:"freq"`
+}
+
+// SX1301ChanConf contains the configuration of a concentrator channel.
+type SX1301ChanConf struct {
+	Enable       bool   `json:"enable"`
+	Radio        int    `json:"radio"`
+	IF           int    `json:"if"`
+	Bandwidth    int    `json:"bandwidth,omitempty"`
+	SpreadFactor int    `json:"spread_factor,omitempty"`
+	DataRate     uint32 `json:"datarate,omitempty"`
+}
+
+// UplinkInfo contains the radio meta-data of an uplink frame.
+type UplinkInfo struct {
+	RCtx    int64   `json:"rctx"`
+	XTime   int64   `json:"xtime"`
+	GPSTime int64   `json:"gpstime"`
+	RSSI    float64 `json:"rssi"`
+	SNR     float64 `json:"snr"`
+	RXTime  float64 `json:"rxtime"` // UTC time in seconds (fractional)
+}
+
+// UplinkDataFrame contains a (parsed) uplink data frame.
+type UplinkDataFrame struct {
+	MessageType MessageType `json:"msgtype"`
+	MHDR        uint8       `json:"MHdr"`
+	DevAddr     int32       `json:"DevAddr"`
+	FCtrl       uint8       `json:"FCtrl"`
+	FCnt        uint16      `json:"FCnt"`
+	FOpts       string      `json:"FOpts"` // hex encoded
+	FPort       int         `json:"FPort"` // -1 when absent
+	FRMPayload  string      `json:"FRMPayload"`
+	MIC         int32       `json:"MIC"`
+	DR          int         `json:"DR"`
+	Freq        uint32      `json:"Freq"`
+	UplinkInfo  UplinkInfo  `json:"upinfo"`
+}
+
+// PHYPayloadBytes returns the PHYPayload bytes of the frame.
+func (f UplinkDataFrame) PHYPayloadBytes() ([]byte, error) {
+	fOpts, err := hex.DecodeString(f.FOpts)
+	if err != nil {
+		return nil, fmt.Errorf("basicstation: could not hex decode FOpts: %s", err)
+	}
+	frmPayload, err := hex.DecodeString(f.FRMPayload)
+	if err != nil {
+		return nil, fmt.Errorf("basicstation: could not hex decode FRMPayload: %s", err)
+	}
+
+	b := make([]byte, 5, 12+len(fOpts)+len(frmPayload))
+	b[0] = f.MHDR
+	binary.LittleEndian.PutUint32(b[1:5], uint32(f.DevAddr))
+	b = append(b, f.FCtrl)
+	b = append(b, byte(f.FCnt), byte(f.FCnt>>8))
+	b = append(b, fOpts...)
+	if f.FPort >= 0 {
+		b = append(b, byte(f.FPort))
+		b = append(b, frmPayload...)
+	}
+	return appendMIC(b, f.MIC), nil
+}
+
+// JoinRequest contains a (parsed) join-request frame.
+type JoinRequest struct {
+	MessageType MessageType `json:"msgtype"`
+	MHDR        uint8       `json:"MHdr"`
+	JoinEUI     EUI         `json:"JoinEui"`
+	DevEUI      EUI         `json:"DevEui"`
+	DevNonce    uint16      `json:"DevNonce"`
+	MIC         int32       `json:"MIC"`
+	DR          int         `json:"DR"`
+	Freq        uint32      `json:"Freq"`
+	UplinkInfo  UplinkInfo  `json:"upinfo"`
+}
+
+// PHYPayloadBytes returns the PHYPayload bytes of the frame.
+func (f JoinRequest) PHYPayloadBytes() []byte {
+	b := make([]byte, 0, 23)
+	b = append(b, f.MHDR)
+	// EUIs are little endian encoded in the PHYPayload
+	for _, eui := range []EUI{f.JoinEUI, f.DevEUI} {
+		for i := len(eui) - 1; i >= 0; i-- {
+			b = append(b, eui[i])
+		}
+	}
+	b = append(b, byte(f.DevNonce), byte(f.DevNonce>>8))
+	return appendMIC(b, f.MIC)
+}
+
+// DownlinkMessage contains a frame to be transmitted by the gateway.
+type DownlinkMessage struct {
+	MessageType MessageType `json:"msgtype"`
+	DevEUI      EUI         `json:"DevEui"`
+	DeviceClass int         `json:"dC"`
+	DIID        int64       `json:"diid"`
+	PDU         string      `json:"pdu"` // hex encoded
+	RxDelay     int         `json:"RxDelay,omitempty"`
+	RX1DR       *int        `json:"RX1DR,omitempty"`
+	RX1Freq     *uint32     `json:"RX1Freq,omitempty"`
+	RX2DR       *int        `json:"RX2DR,omitempty"`
+	RX2Freq     *uint32     `json:"RX2Freq,omitempty"`
+	Priority    int         `json:"priority"`
+	XTime       int64       `json:"xtime,omitempty"`
+	RCtx        int64       `json:"rctx"`
+}
+
+// DownlinkTransmitted is sent by the gateway after transmitting a
+// DownlinkMessage.
+type DownlinkTransmitted struct {
+	MessageType MessageType `json:"msgtype"`
+	DIID        int64       `json:"diid"`
+	DevEUI      EUI         `json:"DevEui"`
+	RCtx        int64       `json:"rctx"`
+	XTime       int64       `json:"xtime"`
+	TxTime      float64     `json:"txtime"`
+	GPSTime     int64       `json:"gpstime"`
+}
+
+// TimeSync is sent by the gateway to request the GPS time. The response
+// contains the TxTime of the request and the GPS time (in microseconds).
+type TimeSync struct {
+	MessageType MessageType `json:"msgtype"`
+	TxTime      float64     `json:"txtime"`
+	GPSTime     int64       `json:"gpstime,omitempty"`
+}
+
+// eu868DataRates contains the EU868 data rates (DR0 - DR7). Data rates are
+// encoded as [SF, BW, DNONLY], SF=0 means FSK.
+var eu868DataRates = [][3]int{
+	{12, 125, 0},
+	{11, 125, 0},
+	{10, 125, 0},
+	{9, 125, 0},
+	{8, 125, 0},
+	{7, 125, 0},
+	{7, 250, 0},
+	{0, 0, 0},
+	{-1, 0, 0},
+	{-1, 0, 0},
+	{-1, 0, 0},
+	{-1, 0, 0},
+	{-1, 0, 0},
+	{-1, 0, 0},
+	{-1, 0, 0},
+	{-1, 0, 0},
+}
+
+// fskDataRate is the bitrate of the FSK data rate.
+const fskDataRate = 50000
+
+// DefaultRouterConfig is the (EU868) RouterConfig sent to the gateways.
+var DefaultRouterConfig = RouterConfig{
+	MessageType: RouterConfigMessage,
+	Region:      "EU863",
+	HWSpec:      "sx1301/1",
+	FreqRange:   [2]uint32{863000000, 870000000},
+	DRs:         eu868DataRates,
+	SX1301Conf: []SX1301Conf{
+		{
+			Radio0: SX1301RadioConf{Enable: true, Freq: 867500000},
+			Radio1: SX1301RadioConf{Enable: true, Freq: 868500000},
+			ChanMultiSF: [8]SX1301ChanConf{
+				{Enable: true, Radio: 1, IF: -400000},
+				{Enable: true, Radio: 1, IF: -200000},
+				{Enable: true, Radio: 1, IF: 0},
+				{Enable: true, Radio: 0, IF: -400000},
+				{Enable: true, Radio: 0, IF: -200000},
+				{Enable: true, Radio: 0, IF: 0},
+				{Enable: true, Radio: 0, IF: 200000},
+				{Enable: true, Radio: 0, IF: 400000},
+			},
+			ChanLoRaStd: SX1301ChanConf{Enable: true, Radio: 1, IF: -200000, Bandwidth: 250000, SpreadFactor: 7},
+			ChanFSK:     SX1301ChanConf{Enable: true, Radio: 1, IF: 300000, DataRate: fskDataRate},
+		},
+	},
+	NoCCA:   true,
+	NoDC:    true,
+	NoDwell: true,
+}
+
+// getDataRate returns the loracontrol.DataRate for the given data rate
+// index.
+func getDataRate(dr int) (loracontrol.DataRate, error) {
+	if dr < 0 || dr >= len(eu868DataRates) || eu868DataRates[dr][0] == -1 {
+		return loracontrol.DataRate{}, fmt.Errorf("basicstation: unknown data rate: %d", dr)
+	}
+	d := eu868DataRates[dr]
+	if d[0] == 0 {
+		return loracontrol.DataRate{FSK: fskDataRate}, nil
+	}
+	return loracontrol.DataRate{LoRa: fmt.Sprintf("SF%dBW%d", d[0], d[1])}, nil
+}
+
+// getDR returns the data rate index for the given loracontrol.DataRate.
+func getDR(dataRate loracontrol.DataRate) (int, error) {
+	for i := range eu868DataRates {
+		d, err := getDataRate(i)
+		if err != nil {
+			continue
+		}
+		if d == dataRate {
+			return i, nil
+		}
+	}
+	return 0, errors.New("basicstation: data rate not supported by the channel plan")
+}
+
+func appendMIC(b []byte, mic int32) []byte {
+	var micB [4]byte
+	binary.LittleEndian.PutUint32(micB[:], uint32(mic))
+	return append(b, micB[:]...)
+}
@@ -0,0 +1,164 @@
+package basicstation
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/brocaar/loracontrol"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEUI(t *testing.T) {
+	Convey("Given an EUI 0102030405060708", t, func() {
+		eui := EUI{1, 2, 3, 4, 5, 6, 7, 8}
+
+		Convey("Then MarshalJSON returns the dash separated notation", func() {
+			b, err := json.Marshal(eui)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `"01-02-03-04-05-06-07-08"`)
+		})
+	})
+
+	Convey("Given a set of valid EUI notations", t, func() {
+		testTable := []struct {
+			JSON string
+			EUI  EUI
+		}{
+			{`"01-02-03-04-05-06-07-08"`, EUI{1, 2, 3, 4, 5, 6, 7, 8}},
+			{`"0102030405060708"`, EUI{1, 2, 3, 4, 5, 6, 7, 8}},
+			{`"102:304:506:708"`, EUI{1, 2, 3, 4, 5, 6, 7, 8}},
+			{`"::1"`, EUI{0, 0, 0, 0, 0, 0, 0, 1}},
+			{`"1::"`, EUI{0, 1, 0, 0, 0, 0, 0, 0}},
+			{`"a:b::c"`, EUI{0, 0xa, 0, 0xb, 0, 0, 0, 0xc}},
+			{`72623859790382856`, EUI{1, 2, 3, 4, 5, 6, 7, 8}},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Then %s is decoded as %s [%d]", test.JSON, test.EUI, i), func() {
+				var eui EUI
+				So(json.Unmarshal([]byte(test.JSON), &eui), ShouldBeNil)
+				So(eui, ShouldEqual, test.EUI)
+			})
+		}
+	})
+
+	Convey("Given a set of invalid EUI notations", t, func() {
+		for i, s := range []string{`"0102"`, `"1:2:3"`, `"1:2::3:4"`, `"zz-02-03-04-05-06-07-08"`, `true`} {
+			Convey(fmt.Sprintf("Then %s returns an error [%d]", s, i), func() {
+				var eui EUI
+				So(json.Unmarshal([]byte(s), &eui), ShouldNotBeNil)
+			})
+		}
+	})
+}
+
+func TestUplinkDataFrame(t *testing.T) {
+	Convey("Given an UplinkDataFrame", t, func() {
+		frame := UplinkDataFrame{
+			MHDR:       0x40,
+			DevAddr:    0x01020304,
+			FCtrl:      0x01,
+			FCnt:       0x0a0b,
+			FOpts:      "02",
+			FPort:      1,
+			FRMPayload: "aabb",
+			MIC:        0x05060708,
+		}
+
+		Convey("Then PHYPayloadBytes returns the expected bytes", func() {
+			b, err := frame.PHYPayloadBytes()
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, []byte{0x40, 4, 3, 2, 1, 1, 0x0b, 0x0a, 2, 1, 0xaa, 0xbb, 8, 7, 6, 5})
+		})
+
+		Convey("Given the FPort is absent", func() {
+			frame.FPort = -1
+			frame.FRMPayload = ""
+
+			Convey("Then PHYPayloadBytes returns the bytes without FPort", func() {
+				b, err := frame.PHYPayloadBytes()
+				So(err, ShouldBeNil)
+				So(b, ShouldResemble, []byte{0x40, 4, 3, 2, 1, 1, 0x0b, 0x0a, 2, 8, 7, 6, 5})
+			})
+		})
+
+		Convey("Given invalid FOpts", func() {
+			frame.FOpts = "zz"
+			Convey("Then PHYPayloadBytes returns an error", func() {
+				_, err := frame.PHYPayloadBytes()
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestJoinRequest(t *testing.T) {
+	Convey("Given a JoinRequest", t, func() {
+		frame := JoinRequest{
+			MHDR:     0x00,
+			JoinEUI:  EUI{1, 2, 3, 4, 5, 6, 7, 8},
+			DevEUI:   EUI{8, 7, 6, 5, 4, 3, 2, 1},
+			DevNonce: 0x0102,
+			MIC:      0x01020304,
+		}
+
+		Convey("Then PHYPayloadBytes returns the expected bytes", func() {
+			So(frame.PHYPayloadBytes(), ShouldResemble, []byte{
+				0x00,
+				8, 7, 6, 5, 4, 3, 2, 1,
+				1, 2, 3, 4, 5, 6, 7, 8,
+				2, 1,
+				4, 3, 2, 1,
+			})
+		})
+	})
+}
+
+func TestDataRate(t *testing.T) {
+	Convey("Given a set of data rates", t, func() {
+		testTable := []struct {
+			DR       int
+			DataRate loracontrol.DataRate
+		}{
+			{0, loracontrol.DataRate{LoRa: "SF12BW125"}},
+			{5, loracontrol.DataRate{LoRa: "SF7BW125"}},
+			{6, loracontrol.DataRate{LoRa: "SF7BW250"}},
+			{7, loracontrol.DataRate{FSK: 50000}},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Then DR%d maps to %v and back [%d]", test.DR, test.DataRate, i), func() {
+				dataRate, err := getDataRate(test.DR)
+				So(err, ShouldBeNil)
+				So(dataRate, ShouldResemble, test.DataRate)
+
+				dr, err := getDR(test.DataRate)
+				So(err, ShouldBeNil)
+				So(dr, ShouldEqual, test.DR)
+			})
+		}
+
+		Convey("Then an unknown data rate returns an error", func() {
+			_, err := getDataRate(8)
+			So(err, ShouldNotBeNil)
+			_, err = getDR(loracontrol.DataRate{LoRa: "SF7BW500"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSX1301Conf(t *testing.T) {
+	Convey("Given the DefaultRouterConfig", t, func() {
+		Convey("Then the multi-SF channels are marshaled as chan_multiSF_N", func() {
+			b, err := json.Marshal(DefaultRouterConfig.SX1301Conf[0])
+			So(err, ShouldBeNil)
+
+			var conf map[string]json.RawMessage
+			So(json.Unmarshal(b, &conf), ShouldBeNil)
+			So(conf, ShouldContainKey, "chan_multiSF_0")
+			So(conf, ShouldContainKey, "chan_multiSF_7")
+			So(string(conf["chan_multiSF_2"]), ShouldEqual, `{"enable":true,"radio":1,"if":0}`)
+		})
+	})
+}
@@ -0,0 +1,24 @@
+// Package gps implements the conversion between GPS time (the duration since
+// the GPS epoch, as reported by GPS synchronized gateways) and UTC time.
+package gps
+
+import "time"
+
+// epoch is the start of the GPS time.
+var epoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+// leapSeconds defines the number of leap seconds between GPS and UTC time.
+const leapSeconds = 18 * time.Second
+
+// Time represents the GPS time (the duration since the GPS epoch).
+type Time time.Duration
+
+// NewFromTime returns the GPS time of the given time.
+func NewFromTime(t time.Time) Time {
+	return Time(t.Sub(epoch) + leapSeconds)
+}
+
+// Time returns the (UTC) time of the GPS time.
+func (t Time) Time() time.Time {
+	return epoch.Add(time.Duration(t) - leapSeconds)
+}
@@ -0,0 +1,26 @@
+package gps
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTime(t *testing.T) {
+	Convey("Given the time 2016-06-22 08:26:00 UTC", t, func() {
+		ts := time.Date(2016, time.June, 22, 8, 26, 0, 0, time.UTC)
+
+		Convey("Then the GPS time includes the leap seconds", func() {
+			So(NewFromTime(ts), ShouldEqual, Time(ts.Sub(epoch)+18*time.Second))
+		})
+
+		Convey("Then converting back returns the same time", func() {
+			So(NewFromTime(ts).Time().Equal(ts), ShouldBeTrue)
+		})
+	})
+
+	Convey("Then the GPS epoch equals the leap seconds", t, func() {
+		So(NewFromTime(epoch), ShouldEqual, Time(leapSeconds))
+	})
+}
@@ -0,0 +1,85 @@
+// Package gwconfig stores the gateway config set through the API under a
+// Redis key of its own. The gateway backends write the complete gateway
+// object (loracontrol.Gateway) when storing the gateway stats. Since they
+// merge the stored config into the gateway object right before writing it,
+// an update of the config is not lost when it is made in between their read
+// and write of the gateway object.
+package gwconfig
+
+import (
+	"fmt"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Storage stores the gateway config set through the API (a hash per
+// gateway). Removed keys are stored with an empty value, so that Merge also
+// removes them from the gateway object.
+type Storage struct {
+	pool *redis.Pool
+}
+
+// NewStorage creates a new Storage.
+func NewStorage(p *redis.Pool) *Storage {
+	return &Storage{pool: p}
+}
+
+// Update updates the given config keys of the given gateway. Keys with an
+// empty value are removed. All keys are updated at once.
+func (s *Storage) Update(mac lorawan.EUI64, config map[string]string) error {
+	if len(config) == 0 {
+		return nil
+	}
+
+	c := s.pool.Get()
+	defer c.Close()
+
+	args := []interface{}{configKey(mac)}
+	for k, v := range config {
+		args = append(args, k, v)
+	}
+	if _, err := c.Do("HMSET", args...); err != nil {
+		return fmt.Errorf("gateway/gwconfig: could not update config: %s", err)
+	}
+	return nil
+}
+
+// Get returns the stored config of the given gateway, including the removed
+// keys (with an empty value).
+func (s *Storage) Get(mac lorawan.EUI64) (map[string]string, error) {
+	c := s.pool.Get()
+	defer c.Close()
+
+	config, err := redis.StringMap(c.Do("HGETALL", configKey(mac)))
+	if err != nil {
+		return nil, fmt.Errorf("gateway/gwconfig: could not get config: %s", err)
+	}
+	return config, nil
+}
+
+// Merge merges the stored config into the config of the given gateway. The
+// other keys of the gateway config (e.g. set by the gateway backends) are
+// left untouched.
+func (s *Storage) Merge(gw *loracontrol.Gateway) error {
+	config, err := s.Get(gw.MAC)
+	if err != nil {
+		return err
+	}
+	if gw.Config.String == nil {
+		gw.Config.String = make(map[string]string)
+	}
+	for k, v := range config {
+		if v == "" {
+			delete(gw.Config.String, k)
+			continue
+		}
+		gw.Config.String[k] = v
+	}
+	return nil
+}
+
+func configKey(mac lorawan.EUI64) string {
+	return fmt.Sprintf("gateway_config_%s", mac)
+}
@@ -0,0 +1,107 @@
+package gwconfig
+
+import (
+	"os"
+	"testing"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type config struct {
+	RedisServer   string
+	RedisPassword string
+}
+
+func getConfig() *config {
+	c := &config{
+		RedisServer: "localhost:6379",
+	}
+
+	if v := os.Getenv("TEST_REDIS_SERVER"); v != "" {
+		c.RedisServer = v
+	}
+	if v := os.Getenv("TEST_REDIS_PASSWORD"); v != "" {
+		c.RedisPassword = v
+	}
+
+	return c
+}
+
+func TestStorage(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a clean Redis database and a Storage", t, func() {
+		p := &redis.Pool{
+			MaxIdle: 1,
+			Dial: func() (redis.Conn, error) {
+				c, err := redis.Dial("tcp", conf.RedisServer)
+				if err != nil {
+					return nil, err
+				}
+				if conf.RedisPassword != "" {
+					if _, err := c.Do("AUTH", conf.RedisPassword); err != nil {
+						c.Close()
+						return nil, err
+					}
+				}
+				return c, nil
+			},
+		}
+		c := p.Get()
+		_, err := c.Do("FLUSHALL")
+		So(err, ShouldBeNil)
+		c.Close()
+
+		s := NewStorage(p)
+		mac := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+		Convey("Then the config of an unknown gateway is empty", func() {
+			config, err := s.Get(mac)
+			So(err, ShouldBeNil)
+			So(config, ShouldBeEmpty)
+		})
+
+		Convey("When updating and removing config keys", func() {
+			So(s.Update(mac, map[string]string{"tx_power_max": "14", "antenna_gain": "3"}), ShouldBeNil)
+			So(s.Update(mac, map[string]string{"antenna_gain": ""}), ShouldBeNil)
+
+			Convey("Then Get returns the removed key with an empty value", func() {
+				config, err := s.Get(mac)
+				So(err, ShouldBeNil)
+				So(config, ShouldResemble, map[string]string{
+					"tx_power_max": "14",
+					"antenna_gain": "",
+				})
+			})
+
+			Convey("Then Merge updates the stored keys of a (stale) gateway object", func() {
+				gw := loracontrol.Gateway{
+					MAC: mac,
+					Config: loracontrol.PropertyBag{
+						String: map[string]string{
+							"udp_addr":     "127.0.0.1:1234",
+							"tx_power_max": "27",
+							"antenna_gain": "3",
+						},
+					},
+				}
+				So(s.Merge(&gw), ShouldBeNil)
+				So(gw.Config.String, ShouldResemble, map[string]string{
+					"udp_addr":     "127.0.0.1:1234",
+					"tx_power_max": "14",
+				})
+			})
+
+			Convey("Then Merge initializes the config of a new gateway object", func() {
+				gw := loracontrol.Gateway{MAC: mac}
+				So(s.Merge(&gw), ShouldBeNil)
+				So(gw.Config.String, ShouldResemble, map[string]string{
+					"tx_power_max": "14",
+				})
+			})
+		})
+	})
+}
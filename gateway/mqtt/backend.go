@@ -0,0 +1,410 @@
+package mqtt
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/gateway/gwconfig"
+	"github.com/brocaar/loraserver/gateway/profile"
+	"github.com/brocaar/lorawan"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// ErrBackendClosed is returned when the backend has been closed.
+var ErrBackendClosed = errors.New("gateway/mqtt: backend is closed")
+
+// drainTimeout defines how long a received packet is offered on the Receive
+// channel after the backend has been closed.
+const drainTimeout = time.Second
+
+// RXPacket is the JSON payload of the gateway/[MAC]/rx topic.
+type RXPacket struct {
+	RXInfo     loracontrol.RXInfo `json:"rxInfo"`
+	PHYPayload []byte             `json:"phyPayload"`
+}
+
+// TXPacket is the JSON payload of the gateway/[MAC]/tx topic.
+type TXPacket struct {
+	TXInfo     loracontrol.TXInfo `json:"txInfo"`
+	PHYPayload []byte             `json:"phyPayload"`
+}
+
+// GatewayStatsPacket is the JSON payload of the gateway/[MAC]/stats topic.
+// The counters contain the values since the previous stats packet.
+type GatewayStatsPacket struct {
+	Time                        time.Time `json:"time"`
+	Latitude                    float64   `json:"latitude"`
+	Longitude                   float64   `json:"longitude"`
+	Altitude                    int       `json:"altitude"`
+	UpstreamPacketsReceived     uint      `json:"upstreamPacketsReceived"`
+	UpstreamPacketsReceivedOK   uint      `json:"upstreamPacketsReceivedOK"`
+	UpstreamPacketsForwarded    uint      `json:"upstreamPacketsForwarded"`
+	UpstreamDatagramsACKRate    float64   `json:"upstreamDatagramsACKRate"`
+	DownstreamDatagramsReceived uint      `json:"downstreamDatagramsReceived"`
+}
+
+// Option defines a Backend option.
+type Option func(*Backend) error
+
+// SetStatsHandler sets the function which is called with the received
+// gateway stats (after these have been stored).
+func SetStatsHandler(f func(loracontrol.Gateway) error) Option {
+	return func(b *Backend) error {
+		b.statsHandler = f
+		return nil
+	}
+}
+
+// SetSeenHandler sets the function which is called every time a message
+// is received from a gateway.
+func SetSeenHandler(f func(lorawan.EUI64) error) Option {
+	return func(b *Backend) error {
+		b.seenHandler = f
+		return nil
+	}
+}
+
+// SetConfigStorage sets the storage of the gateway config set through the
+// API. The stored config is merged into the gateway object when storing the
+// gateway stats, so that a concurrent config update is not overwritten.
+func SetConfigStorage(s *gwconfig.Storage) Option {
+	return func(b *Backend) error {
+		b.configStorage = s
+		return nil
+	}
+}
+
+// Backend implements a MQTT gateway backend.
+type Backend struct {
+	client        *loracontrol.Client
+	conn          mqtt.Client
+	rxChan        chan loracontrol.RXPacket
+	errChan       chan error
+	statsHandler  func(loracontrol.Gateway) error
+	seenHandler   func(lorawan.EUI64) error
+	configStorage *gwconfig.Storage
+
+	mu      sync.RWMutex // protects closed
+	closed  bool
+	closing chan struct{}
+	wg      sync.WaitGroup // in-flight message handlers
+}
+
+// NewBackend creates a new Backend connected to the given MQTT server
+// (e.g. tcp://localhost:1883).
+func NewBackend(server, username, password string, opts ...Option) (*Backend, error) {
+	b := &Backend{
+		rxChan:  make(chan loracontrol.RXPacket),
+		errChan: make(chan error, 1),
+		closing: make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+
+	mqttOpts := mqtt.NewClientOptions()
+	mqttOpts.AddBroker(server)
+	mqttOpts.SetUsername(username)
+	mqttOpts.SetPassword(password)
+	mqttOpts.SetAutoReconnect(true)
+	mqttOpts.SetOnConnectHandler(b.onConnected)
+	mqttOpts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Errorf("gateway/mqtt: connection to mqtt server lost: %s", err)
+	})
+
+	log.WithField("server", server).Info("gateway/mqtt: connecting to mqtt server")
+	b.conn = mqtt.NewClient(mqttOpts)
+	if token := b.conn.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return b, nil
+}
+
+// SetClient sets the loracontrol.Client and is automatically called by
+// loracontrol.SetGatewayBackend.
+func (b *Backend) SetClient(c *loracontrol.Client) {
+	b.client = c
+}
+
+// Close closes the backend. It unsubscribes from the gateway topics, waits
+// until the in-flight messages have been handled and closes the Receive
+// channel. Close is safe to call multiple times.
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.closing)
+	b.mu.Unlock()
+
+	log.Info("gateway/mqtt: closing backend")
+	if token := b.conn.Unsubscribe("gateway/+/rx", "gateway/+/stats"); token.Wait() && token.Error() != nil {
+		log.Errorf("gateway/mqtt: could not unsubscribe: %s", token.Error())
+	}
+	b.wg.Wait()
+	b.conn.Disconnect(250)
+	close(b.rxChan)
+	return nil
+}
+
+// Receive returns the RXPacket channel.
+func (b *Backend) Receive() chan loracontrol.RXPacket {
+	return b.rxChan
+}
+
+// Errors returns the channel on which a fatal backend error (e.g. the
+// backend could not subscribe to the gateway topics) is published.
+func (b *Backend) Errors() chan error {
+	return b.errChan
+}
+
+// Send sends the given TXPacket to the gateway.
+func (b *Backend) Send(txPacket loracontrol.TXPacket) error {
+	phyB, err := txPacket.PHYPayload.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(TXPacket{
+		TXInfo:     txPacket.TXInfo,
+		PHYPayload: phyB,
+	})
+	if err != nil {
+		return err
+	}
+
+	if b.isClosed() {
+		return ErrBackendClosed
+	}
+
+	topic := fmt.Sprintf("gateway/%s/tx", txPacket.TXInfo.MAC)
+	log.WithField("topic", topic).Info("gateway/mqtt: publishing packet")
+	if token := b.conn.Publish(topic, 0, false, bytes); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// PushConfig publishes the profile (channel plan) of the given gateway as
+// retained message, so that it is received by the gateway when it
+// (re)connects. An empty message is published when the gateway has no
+// profile, which removes the retained message.
+func (b *Backend) PushConfig(gw loracontrol.Gateway) error {
+	p, err := profile.Get(gw)
+	if err != nil {
+		return err
+	}
+	var bytes []byte
+	if p != nil {
+		if bytes, err = json.Marshal(p); err != nil {
+			return err
+		}
+	}
+
+	if b.isClosed() {
+		return ErrBackendClosed
+	}
+
+	topic := fmt.Sprintf("gateway/%s/config", gw.MAC)
+	log.WithField("topic", topic).Info("gateway/mqtt: publishing gateway config")
+	if token := b.conn.Publish(topic, 1, true, bytes); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+func (b *Backend) onConnected(c mqtt.Client) {
+	log.Info("gateway/mqtt: connected to mqtt server")
+	for topic, handler := range map[string]mqtt.MessageHandler{
+		"gateway/+/rx":    b.rxPacketHandler,
+		"gateway/+/stats": b.statsPacketHandler,
+	} {
+		log.WithField("topic", topic).Info("gateway/mqtt: subscribing to topic")
+		if token := c.Subscribe(topic, 0, handler); token.Wait() && token.Error() != nil {
+			err := fmt.Errorf("gateway/mqtt: could not subscribe to %s: %s", topic, token.Error())
+			log.Error(err)
+			select {
+			case b.errChan <- err:
+			default:
+			}
+		}
+	}
+}
+
+// beginHandle must be called before handling a received message. It returns
+// false when the backend is closed and the message must be ignored.
+func (b *Backend) beginHandle() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return false
+	}
+	b.wg.Add(1)
+	return true
+}
+
+func (b *Backend) rxPacketHandler(c mqtt.Client, msg mqtt.Message) {
+	if !b.beginHandle() {
+		return
+	}
+	defer b.wg.Done()
+
+	if err := b.handleRXPacket(msg.Topic(), msg.Payload()); err != nil {
+		log.WithField("topic", msg.Topic()).Errorf("gateway/mqtt: could not handle rx packet: %s", err)
+	}
+}
+
+func (b *Backend) statsPacketHandler(c mqtt.Client, msg mqtt.Message) {
+	if !b.beginHandle() {
+		return
+	}
+	defer b.wg.Done()
+
+	if err := b.handleStatsPacket(msg.Topic(), msg.Payload()); err != nil {
+		log.WithField("topic", msg.Topic()).Errorf("gateway/mqtt: could not handle stats packet: %s", err)
+	}
+}
+
+func (b *Backend) handleRXPacket(topic string, data []byte) error {
+	mac, err := getMACFromTopic(topic)
+	if err != nil {
+		return err
+	}
+	b.gatewaySeen(mac)
+
+	var rxPacket RXPacket
+	if err := json.Unmarshal(data, &rxPacket); err != nil {
+		return err
+	}
+	rxPacket.RXInfo.MAC = mac
+
+	log.WithFields(log.Fields{
+		"mac":  mac,
+		"data": rxPacket.PHYPayload,
+	}).Info("gateway/mqtt: handling received node data")
+
+	if rxPacket.RXInfo.CRCStatus != 1 {
+		return fmt.Errorf("invalid CRC: %d", rxPacket.RXInfo.CRCStatus)
+	}
+
+	// this is always an uplink payload
+	phy := lorawan.NewPHYPayload(true)
+	if err := phy.UnmarshalBinary(rxPacket.PHYPayload); err != nil {
+		return fmt.Errorf("could not unmarshal PHYPayload: %s", err)
+	}
+
+	p := loracontrol.RXPacket{
+		RXInfo:     rxPacket.RXInfo,
+		PHYPayload: phy,
+	}
+
+	select {
+	case b.rxChan <- p:
+	case <-b.closing:
+		// give the consumer some time to receive the in-flight packets
+		select {
+		case b.rxChan <- p:
+		case <-time.After(drainTimeout):
+			return ErrBackendClosed
+		}
+	}
+	return nil
+}
+
+func (b *Backend) handleStatsPacket(topic string, data []byte) error {
+	mac, err := getMACFromTopic(topic)
+	if err != nil {
+		return err
+	}
+	b.gatewaySeen(mac)
+
+	var stats GatewayStatsPacket
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return err
+	}
+
+	log.WithField("mac", mac).Info("gateway/mqtt: storing gateway stats")
+	gw := newGatewayFromStatsPacket(mac, stats)
+
+	// keep the config set for the gateway
+	current, err := b.client.Gateway().Get(mac)
+	if err != nil && err != loracontrol.ErrObjectDoesNotExist {
+		return err
+	}
+	gw.Config = current.Config
+	// the gateway object read above is stale when the config has been
+	// updated in the meantime
+	if b.configStorage != nil {
+		if err := b.configStorage.Merge(&gw); err != nil {
+			return err
+		}
+	}
+
+	if err := b.client.Gateway().Upsert(gw); err != nil {
+		return err
+	}
+	if b.statsHandler != nil {
+		return b.statsHandler(gw)
+	}
+	return nil
+}
+
+func (b *Backend) gatewaySeen(mac lorawan.EUI64) {
+	if b.seenHandler == nil {
+		return
+	}
+	if err := b.seenHandler(mac); err != nil {
+		log.WithField("mac", mac).Errorf("gateway/mqtt: could not handle gateway seen: %s", err)
+	}
+}
+
+func (b *Backend) isClosed() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.closed
+}
+
+// getMACFromTopic returns the gateway MAC from a gateway/[MAC]/... topic.
+func getMACFromTopic(topic string) (lorawan.EUI64, error) {
+	var mac lorawan.EUI64
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[0] != "gateway" {
+		return mac, fmt.Errorf("gateway/mqtt: invalid topic: %s", topic)
+	}
+	b, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return mac, fmt.Errorf("gateway/mqtt: invalid MAC in topic %s: %s", topic, err)
+	}
+	if len(b) != len(mac) {
+		return mac, fmt.Errorf("gateway/mqtt: a gateway MAC is exactly %d bytes", len(mac))
+	}
+	copy(mac[:], b)
+	return mac, nil
+}
+
+func newGatewayFromStatsPacket(mac lorawan.EUI64, stats GatewayStatsPacket) loracontrol.Gateway {
+	return loracontrol.Gateway{
+		UpdatedAt:                   stats.Time,
+		MAC:                         mac,
+		Latitude:                    stats.Latitude,
+		Longitude:                   stats.Longitude,
+		Altitude:                    stats.Altitude,
+		UpstreamPacketsReceived:     stats.UpstreamPacketsReceived,
+		UpstreamPacketsReceivedOK:   stats.UpstreamPacketsReceivedOK,
+		UpstreamPacketsForwarded:    stats.UpstreamPacketsForwarded,
+		UpstreamDatagramsACKRate:    stats.UpstreamDatagramsACKRate,
+		DownstreamDatagramsReceived: stats.DownstreamDatagramsReceived,
+	}
+}
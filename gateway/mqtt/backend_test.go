@@ -0,0 +1,248 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/gateway/profile"
+	"github.com/brocaar/lorawan"
+	"github.com/eclipse/paho.mqtt.golang"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func init() {
+	log.SetLevel(log.ErrorLevel)
+}
+
+type config struct {
+	RedisServer   string
+	RedisPassword string
+	MQTTServer    string
+	MQTTUsername  string
+	MQTTPassword  string
+}
+
+func getConfig() *config {
+	c := &config{
+		RedisServer:   "localhost:6379",
+		RedisPassword: "",
+		MQTTServer:    "tcp://localhost:1883",
+	}
+
+	if v := os.Getenv("TEST_REDIS_SERVER"); v != "" {
+		c.RedisServer = v
+	}
+	if v := os.Getenv("TEST_REDIS_PASSWORD"); v != "" {
+		c.RedisPassword = v
+	}
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		c.MQTTServer = v
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		c.MQTTUsername = v
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		c.MQTTPassword = v
+	}
+
+	return c
+}
+
+func TestBackend(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a MQTT client, a Backend and a Client with Redis backend", t, func() {
+		opts := mqtt.NewClientOptions().AddBroker(conf.MQTTServer).SetUsername(conf.MQTTUsername).SetPassword(conf.MQTTPassword)
+		c := mqtt.NewClient(opts)
+		token := c.Connect()
+		token.Wait()
+		So(token.Error(), ShouldBeNil)
+		defer c.Disconnect(0)
+
+		statsChan := make(chan loracontrol.Gateway, 1)
+		seenChan := make(chan lorawan.EUI64, 10)
+		backend, err := NewBackend(conf.MQTTServer, conf.MQTTUsername, conf.MQTTPassword,
+			SetStatsHandler(func(gw loracontrol.Gateway) error {
+				statsChan <- gw
+				return nil
+			}),
+			SetSeenHandler(func(mac lorawan.EUI64) error {
+				seenChan <- mac
+				return nil
+			}),
+		)
+		So(err, ShouldBeNil)
+		defer backend.Close()
+		time.Sleep(time.Millisecond * 100) // give the backend some time to subscribe
+
+		client, err := loracontrol.NewClient(
+			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
+			loracontrol.SetApplicationBackend(&loracontrol.DummyApplicationBackend{}),
+			loracontrol.SetGatewayBackend(backend),
+		)
+		So(err, ShouldBeNil)
+		So(client.Storage().FlushAll(), ShouldBeNil)
+
+		mac := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+		Convey("Given a PHYPayload", func() {
+			var nwkSKey lorawan.AES128Key
+			macPL := lorawan.NewMACPayload(true)
+			macPL.FHDR = lorawan.FHDR{
+				DevAddr: lorawan.DevAddr{1, 2, 3, 4},
+			}
+			phy := lorawan.NewPHYPayload(true)
+			phy.MACPayload = macPL
+			phy.MHDR = lorawan.MHDR{
+				MType: lorawan.UnconfirmedDataUp,
+				Major: lorawan.LoRaWANR1,
+			}
+			So(phy.SetMIC(nwkSKey), ShouldBeNil)
+			phyB, err := phy.MarshalBinary()
+			So(err, ShouldBeNil)
+
+			Convey("When publishing a RXPacket", func() {
+				rxPacket := RXPacket{
+					RXInfo: loracontrol.RXInfo{
+						Time:       time.Now().UTC(),
+						Timestamp:  708016819,
+						Frequency:  868.5,
+						CRCStatus:  1,
+						Modulation: "LORA",
+						DataRate:   loracontrol.DataRate{LoRa: "SF7BW125"},
+						CodingRate: "4/5",
+						RSSI:       -51,
+						LoRaSNR:    7,
+						Size:       uint(len(phyB)),
+					},
+					PHYPayload: phyB,
+				}
+				b, err := json.Marshal(rxPacket)
+				So(err, ShouldBeNil)
+				token := c.Publish("gateway/0102030405060708/rx", 0, false, b)
+				token.Wait()
+				So(token.Error(), ShouldBeNil)
+
+				Convey("Then Receive() returns the packet with the MAC from the topic", func() {
+					p := <-backend.Receive()
+					rxPacket.RXInfo.MAC = mac
+					So(p.RXInfo, ShouldResemble, rxPacket.RXInfo)
+					So(p.PHYPayload.MIC, ShouldResemble, phy.MIC)
+				})
+
+				Convey("Then the seen handler is called", func() {
+					So(<-seenChan, ShouldEqual, mac)
+				})
+			})
+
+			Convey("Given a subscription to the tx topic", func() {
+				txChan := make(chan TXPacket, 1)
+				token := c.Subscribe("gateway/+/tx", 0, func(c mqtt.Client, msg mqtt.Message) {
+					var p TXPacket
+					if err := json.Unmarshal(msg.Payload(), &p); err != nil {
+						t.Error(err)
+					}
+					txChan <- p
+				})
+				token.Wait()
+				So(token.Error(), ShouldBeNil)
+
+				Convey("When sending a TXPacket", func() {
+					txInfo := loracontrol.TXInfo{
+						MAC:       mac,
+						Timestamp: 12345,
+						Frequency: 868.1,
+						Power:     14,
+						DataRate:  loracontrol.DataRate{LoRa: "SF7BW125"},
+						CodeRate:  "4/5",
+					}
+					So(backend.Send(loracontrol.TXPacket{TXInfo: txInfo, PHYPayload: phy}), ShouldBeNil)
+
+					Convey("Then the packet is published", func() {
+						p := <-txChan
+						So(p.TXInfo, ShouldResemble, txInfo)
+						So(p.PHYPayload, ShouldResemble, phyB)
+					})
+				})
+			})
+		})
+
+		Convey("Given a subscription to the config topic", func() {
+			configChan := make(chan []byte, 1)
+			token := c.Subscribe("gateway/+/config", 0, func(c mqtt.Client, msg mqtt.Message) {
+				configChan <- msg.Payload()
+			})
+			token.Wait()
+			So(token.Error(), ShouldBeNil)
+
+			Convey("When pushing the config of a gateway with profile", func() {
+				plan := `{"channels":[{"frequency":868.1}]}`
+				So(backend.PushConfig(loracontrol.Gateway{
+					MAC: mac,
+					Config: loracontrol.PropertyBag{
+						String: map[string]string{profile.ConfigKey: plan},
+					},
+				}), ShouldBeNil)
+
+				Convey("Then the profile is published", func() {
+					So(string(<-configChan), ShouldEqual, plan)
+				})
+			})
+		})
+
+		Convey("When publishing gateway stats", func() {
+			stats := GatewayStatsPacket{
+				Time:                        time.Now().UTC(),
+				Latitude:                    1.234,
+				Longitude:                   2.123,
+				Altitude:                    123,
+				UpstreamPacketsReceived:     1,
+				UpstreamPacketsReceivedOK:   2,
+				UpstreamPacketsForwarded:    3,
+				UpstreamDatagramsACKRate:    33.3,
+				DownstreamDatagramsReceived: 4,
+			}
+			b, err := json.Marshal(stats)
+			So(err, ShouldBeNil)
+			token := c.Publish("gateway/0102030405060708/stats", 0, false, b)
+			token.Wait()
+			So(token.Error(), ShouldBeNil)
+
+			Convey("Then the stats handler is called and the gateway is stored", func() {
+				gw := <-statsChan
+				So(gw, ShouldResemble, newGatewayFromStatsPacket(mac, stats))
+
+				_, err := client.Gateway().Get(mac)
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestGetMACFromTopic(t *testing.T) {
+	Convey("Given a set of test topics", t, func() {
+		tests := []struct {
+			Topic string
+			MAC   lorawan.EUI64
+			Error bool
+		}{
+			{"gateway/0102030405060708/rx", lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, false},
+			{"gateway/01020304050607/rx", lorawan.EUI64{}, true},
+			{"gateway/zz02030405060708/rx", lorawan.EUI64{}, true},
+			{"foo/0102030405060708/rx", lorawan.EUI64{}, true},
+		}
+
+		for i, test := range tests {
+			Convey(fmt.Sprintf("Then getMACFromTopic returns the expected result for test %d", i), func() {
+				mac, err := getMACFromTopic(test.Topic)
+				So(err != nil, ShouldEqual, test.Error)
+				So(mac, ShouldEqual, test.MAC)
+			})
+		}
+	})
+}
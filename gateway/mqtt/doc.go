@@ -0,0 +1,11 @@
+/*
+Package mqtt implements a MQTT gateway backend. It expects a packet-forwarder
+bridge running on (or close to) the gateway, which publishes and subscribes
+to the following topics:
+    * gateway/[MAC]/rx    - received packets (RXPacket, published by the gateway)
+    * gateway/[MAC]/stats - gateway stats (GatewayStatsPacket, published by the gateway)
+    * gateway/[MAC]/tx    - packets to transmit (TXPacket, published by the backend)
+    * gateway/[MAC]/config - channel plan (profile.Profile, retained, published by the backend)
+All payloads are JSON encoded, the PHYPayload is encoded as base64.
+*/
+package mqtt
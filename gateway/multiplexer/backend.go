@@ -0,0 +1,245 @@
+// Package multiplexer implements a gateway backend which combines multiple
+// gateway backends, e.g. to use the semtech and mqtt backends at the same
+// time.
+package multiplexer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/gateway/profile"
+	"github.com/brocaar/lorawan"
+)
+
+// BackendConfigKey is the gateway config key (loracontrol.Gateway
+// Config.String) holding the name of the gateway backend to use for a gateway
+// from which no packet has been received (yet).
+const BackendConfigKey = "backend"
+
+// ErrUnknownGateway is returned when sending to a gateway from which no
+// packet has been received (yet) and which has no (valid) backend config.
+var ErrUnknownGateway = errors.New("gateway/multiplexer: no backend known for gateway")
+
+// ErrSendAtNotSupported is returned by SendAt when the backend of the
+// gateway does not support sending at an absolute time.
+var ErrSendAtNotSupported = errors.New("gateway/multiplexer: backend does not support sending at an absolute time")
+
+// ErrPushConfigNotSupported is returned by PushConfig when the backend of the
+// gateway does not support pushing the gateway config.
+// This is the same error as profile.ErrPushNotSupported.
+var ErrPushConfigNotSupported = profile.ErrPushNotSupported
+
+// configPusher is implemented by the gateway backends supporting pushing
+// the gateway config (channel plan) to the gateway.
+type configPusher interface {
+	PushConfig(gw loracontrol.Gateway) error
+}
+
+// timeSender is implemented by the gateway backends supporting the
+// transmission of packets at an absolute (GPS) time.
+type timeSender interface {
+	SendAt(txPacket loracontrol.TXPacket, t time.Time) error
+}
+
+// errorBackend is implemented by the gateway backends exposing an error
+// channel.
+type errorBackend interface {
+	Errors() chan error
+}
+
+// Backend implements a multiplexing gateway backend. The received packets of
+// all backends are merged into a single Receive channel. Packets are sent
+// through the backend through which the gateway last sent a packet, or when
+// no packet has been received from the gateway (yet), through the backend
+// configured for the gateway (see BackendConfigKey).
+type Backend struct {
+	client    *loracontrol.Client
+	backends  map[string]loracontrol.GatewayBackend
+	rxChan    chan loracontrol.RXPacket
+	errChan   chan error
+	wg        sync.WaitGroup
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.RWMutex // protects routes
+	routes map[lorawan.EUI64]loracontrol.GatewayBackend
+}
+
+// NewBackend creates a new Backend combining the given (named) backends.
+func NewBackend(backends map[string]loracontrol.GatewayBackend) (*Backend, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("gateway/multiplexer: at least one backend must be given")
+	}
+
+	b := &Backend{
+		backends: backends,
+		rxChan:   make(chan loracontrol.RXPacket),
+		errChan:  make(chan error, len(backends)),
+		closing:  make(chan struct{}),
+		routes:   make(map[lorawan.EUI64]loracontrol.GatewayBackend),
+	}
+
+	for _, backend := range backends {
+		b.wg.Add(1)
+		go func(backend loracontrol.GatewayBackend) {
+			b.forwardPackets(backend)
+			b.wg.Done()
+		}(backend)
+
+		if eb, ok := backend.(errorBackend); ok {
+			go b.forwardErrors(eb.Errors())
+		}
+	}
+
+	go func() {
+		b.wg.Wait()
+		close(b.rxChan)
+	}()
+
+	return b, nil
+}
+
+// SetClient sets the loracontrol.Client on all backends and is automatically
+// called by loracontrol.SetGatewayBackend.
+func (b *Backend) SetClient(c *loracontrol.Client) {
+	b.client = c
+	for _, backend := range b.backends {
+		backend.SetClient(c)
+	}
+}
+
+// Close closes all backends. The Receive channel will be closed after the
+// Receive channels of all backends have been closed.
+func (b *Backend) Close() error {
+	var firstErr error
+	b.closeOnce.Do(func() {
+		close(b.closing)
+		for _, backend := range b.backends {
+			if err := backend.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	})
+	return firstErr
+}
+
+// Receive returns the (merged) RXPacket channel.
+func (b *Backend) Receive() chan loracontrol.RXPacket {
+	return b.rxChan
+}
+
+// Errors returns the (merged) error channel of the backends exposing an
+// error channel.
+func (b *Backend) Errors() chan error {
+	return b.errChan
+}
+
+// Send sends the given TXPacket through the backend through which the
+// gateway last sent a packet.
+func (b *Backend) Send(txPacket loracontrol.TXPacket) error {
+	backend, err := b.getBackend(txPacket.TXInfo.MAC, nil)
+	if err != nil {
+		return err
+	}
+	return backend.Send(txPacket)
+}
+
+// SendAt sends the given TXPacket through the backend through which the
+// gateway last sent a packet, to be transmitted at the given time.
+func (b *Backend) SendAt(txPacket loracontrol.TXPacket, t time.Time) error {
+	backend, err := b.getBackend(txPacket.TXInfo.MAC, nil)
+	if err != nil {
+		return err
+	}
+	ts, ok := backend.(timeSender)
+	if !ok {
+		return ErrSendAtNotSupported
+	}
+	return ts.SendAt(txPacket, t)
+}
+
+// PushConfig pushes the config of the given gateway through the backend
+// through which the gateway last sent a packet.
+func (b *Backend) PushConfig(gw loracontrol.Gateway) error {
+	backend, err := b.getBackend(gw.MAC, &gw)
+	if err != nil {
+		return err
+	}
+	cp, ok := backend.(configPusher)
+	if !ok {
+		return ErrPushConfigNotSupported
+	}
+	return cp.PushConfig(gw)
+}
+
+// getBackend returns the backend through which the given gateway last sent
+// a packet, or the backend configured for the gateway. When gw is nil, the
+// gateway is fetched from the storage.
+func (b *Backend) getBackend(mac lorawan.EUI64, gw *loracontrol.Gateway) (loracontrol.GatewayBackend, error) {
+	b.mu.RLock()
+	backend, ok := b.routes[mac]
+	b.mu.RUnlock()
+	if ok {
+		return backend, nil
+	}
+
+	if gw == nil {
+		if b.client == nil {
+			return nil, ErrUnknownGateway
+		}
+		g, err := b.client.Gateway().Get(mac)
+		if err != nil {
+			if err == loracontrol.ErrObjectDoesNotExist {
+				return nil, ErrUnknownGateway
+			}
+			return nil, err
+		}
+		gw = &g
+	}
+
+	backend, ok = b.backends[gw.Config.String[BackendConfigKey]]
+	if !ok {
+		return nil, ErrUnknownGateway
+	}
+	return backend, nil
+}
+
+// forwardErrors forwards the errors of a backend until the Backend is
+// closed.
+func (b *Backend) forwardErrors(errChan chan error) {
+	for {
+		select {
+		case err, ok := <-errChan:
+			if !ok {
+				return
+			}
+			select {
+			case b.errChan <- err:
+			case <-b.closing:
+				return
+			}
+		case <-b.closing:
+			return
+		}
+	}
+}
+
+func (b *Backend) forwardPackets(backend loracontrol.GatewayBackend) {
+	for rxPacket := range backend.Receive() {
+		b.mu.Lock()
+		if b.routes[rxPacket.RXInfo.MAC] != backend {
+			log.WithFields(log.Fields{
+				"mac":     rxPacket.RXInfo.MAC,
+				"backend": fmt.Sprintf("%T", backend),
+			}).Info("gateway/multiplexer: updating gateway route")
+			b.routes[rxPacket.RXInfo.MAC] = backend
+		}
+		b.mu.Unlock()
+
+		b.rxChan <- rxPacket
+	}
+}
@@ -0,0 +1,146 @@
+package multiplexer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testGatewayBackend struct {
+	rxPacketChan chan loracontrol.RXPacket
+	errChan      chan error
+	txPackets    []loracontrol.TXPacket
+	client       *loracontrol.Client
+}
+
+func newTestGatewayBackend() *testGatewayBackend {
+	return &testGatewayBackend{
+		rxPacketChan: make(chan loracontrol.RXPacket),
+		errChan:      make(chan error),
+	}
+}
+
+func (b *testGatewayBackend) SetClient(c *loracontrol.Client) {
+	b.client = c
+}
+
+func (b *testGatewayBackend) Send(txPacket loracontrol.TXPacket) error {
+	b.txPackets = append(b.txPackets, txPacket)
+	return nil
+}
+
+func (b *testGatewayBackend) Receive() chan loracontrol.RXPacket {
+	return b.rxPacketChan
+}
+
+func (b *testGatewayBackend) Errors() chan error {
+	return b.errChan
+}
+
+func (b *testGatewayBackend) Close() error {
+	close(b.rxPacketChan)
+	return nil
+}
+
+func TestBackend(t *testing.T) {
+	Convey("Given a Backend combining two test backends", t, func() {
+		backendA := newTestGatewayBackend()
+		backendB := newTestGatewayBackend()
+		b, err := NewBackend(map[string]loracontrol.GatewayBackend{
+			"a": backendA,
+			"b": backendB,
+		})
+		So(err, ShouldBeNil)
+
+		macA := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+		macB := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+
+		Convey("Then SetClient sets the client on both backends", func() {
+			c := &loracontrol.Client{}
+			b.SetClient(c)
+			So(backendA.client, ShouldEqual, c)
+			So(backendB.client, ShouldEqual, c)
+		})
+
+		Convey("Then sending to an unknown gateway returns an error", func() {
+			err := b.Send(loracontrol.TXPacket{TXInfo: loracontrol.TXInfo{MAC: macA}})
+			So(err, ShouldEqual, ErrUnknownGateway)
+		})
+
+		Convey("Then PushConfig uses the configured backend of an unknown gateway", func() {
+			gw := loracontrol.Gateway{
+				MAC:    macB,
+				Config: loracontrol.PropertyBag{String: map[string]string{BackendConfigKey: "b"}},
+			}
+			So(b.PushConfig(gw), ShouldEqual, ErrPushConfigNotSupported)
+
+			gw.Config.String[BackendConfigKey] = "c"
+			So(b.PushConfig(gw), ShouldEqual, ErrUnknownGateway)
+		})
+
+		Convey("Then the errors of both backends are merged", func() {
+			backendB.errChan <- errors.New("BOOM!")
+			So(<-b.Errors(), ShouldResemble, errors.New("BOOM!"))
+		})
+
+		Convey("When both backends receive a packet", func() {
+			backendA.rxPacketChan <- loracontrol.RXPacket{RXInfo: loracontrol.RXInfo{MAC: macA}}
+			rxA := <-b.Receive()
+			backendB.rxPacketChan <- loracontrol.RXPacket{RXInfo: loracontrol.RXInfo{MAC: macB}}
+			rxB := <-b.Receive()
+
+			Convey("Then Receive returned both packets", func() {
+				So(rxA.RXInfo.MAC, ShouldEqual, macA)
+				So(rxB.RXInfo.MAC, ShouldEqual, macB)
+			})
+
+			Convey("Then packets are sent through the backend of the gateway", func() {
+				So(b.Send(loracontrol.TXPacket{TXInfo: loracontrol.TXInfo{MAC: macA}}), ShouldBeNil)
+				So(b.Send(loracontrol.TXPacket{TXInfo: loracontrol.TXInfo{MAC: macB}}), ShouldBeNil)
+				So(backendA.txPackets, ShouldHaveLength, 1)
+				So(backendA.txPackets[0].TXInfo.MAC, ShouldEqual, macA)
+				So(backendB.txPackets, ShouldHaveLength, 1)
+				So(backendB.txPackets[0].TXInfo.MAC, ShouldEqual, macB)
+			})
+
+			Convey("Then SendAt returns an error when the backend does not support it", func() {
+				err := b.SendAt(loracontrol.TXPacket{TXInfo: loracontrol.TXInfo{MAC: macA}}, time.Now())
+				So(err, ShouldEqual, ErrSendAtNotSupported)
+			})
+
+			Convey("Then PushConfig returns an error when the backend does not support it", func() {
+				err := b.PushConfig(loracontrol.Gateway{MAC: macA})
+				So(err, ShouldEqual, ErrPushConfigNotSupported)
+			})
+
+			Convey("When gateway A moves to backend B", func() {
+				backendB.rxPacketChan <- loracontrol.RXPacket{RXInfo: loracontrol.RXInfo{MAC: macA}}
+				<-b.Receive()
+
+				Convey("Then packets for gateway A are sent through backend B", func() {
+					So(b.Send(loracontrol.TXPacket{TXInfo: loracontrol.TXInfo{MAC: macA}}), ShouldBeNil)
+					So(backendA.txPackets, ShouldHaveLength, 0)
+					So(backendB.txPackets, ShouldHaveLength, 1)
+				})
+			})
+		})
+
+		Convey("When closing the backend", func() {
+			So(b.Close(), ShouldBeNil)
+
+			Convey("Then the Receive channel is closed", func() {
+				_, ok := <-b.Receive()
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Then creating a Backend without backends returns an error", t, func() {
+		_, err := NewBackend(nil)
+		So(err, ShouldNotBeNil)
+	})
+}
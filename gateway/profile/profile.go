@@ -0,0 +1,133 @@
+// Package profile implements the gateway profile (channel plan) which is
+// stored in the gateway config and pushed to the gateways by the gateway
+// backends supporting this.
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/brocaar/loracontrol"
+)
+
+// ConfigKey is the gateway config key (loracontrol.Gateway Config.String)
+// holding the JSON encoded Profile.
+const ConfigKey = "channel_plan"
+
+// ErrPushNotSupported is returned by the gateway backends (wrapping an other
+// backend) when the backend of the gateway does not support pushing the
+// profile to the gateway. Callers can ignore this error, the profile is
+// then only stored in the gateway config.
+var ErrPushNotSupported = errors.New("gateway/profile: backend does not support pushing the gateway config")
+
+// maxMultiSFChannels is the number of multi-SF channels of the SX1301
+// concentrator.
+const maxMultiSFChannels = 8
+
+// Profile contains the channel plan of a gateway.
+type Profile struct {
+	Channels       []Channel       `json:"channels"`                 // multi-SF LoRa channels
+	LoRaStdChannel *LoRaStdChannel `json:"loRaStdChannel,omitempty"` // single-SF LoRa channel
+	FSKChannel     *FSKChannel     `json:"fskChannel,omitempty"`
+}
+
+// Channel contains a multi-SF (125kHz) LoRa channel.
+type Channel struct {
+	Frequency float64 `json:"frequency"` // MHz
+}
+
+// LoRaStdChannel contains the single-SF LoRa channel.
+type LoRaStdChannel struct {
+	Frequency       float64 `json:"frequency"` // MHz
+	Bandwidth       int     `json:"bandwidth"` // kHz
+	SpreadingFactor int     `json:"spreadingFactor"`
+}
+
+// FSKChannel contains the FSK channel.
+type FSKChannel struct {
+	Frequency float64 `json:"frequency"` // MHz
+	Bitrate   int     `json:"bitrate"`
+}
+
+// Validate validates the profile.
+func (p Profile) Validate() error {
+	if len(p.Channels) == 0 {
+		return errors.New("gateway/profile: at least one channel must be given")
+	}
+	if len(p.Channels) > maxMultiSFChannels {
+		return fmt.Errorf("gateway/profile: max. %d channels are supported", maxMultiSFChannels)
+	}
+	for _, c := range p.Channels {
+		if c.Frequency <= 0 {
+			return fmt.Errorf("gateway/profile: invalid channel frequency: %f", c.Frequency)
+		}
+	}
+	if c := p.LoRaStdChannel; c != nil {
+		if c.Frequency <= 0 {
+			return fmt.Errorf("gateway/profile: invalid LoRa std channel frequency: %f", c.Frequency)
+		}
+		if c.Bandwidth != 125 && c.Bandwidth != 250 && c.Bandwidth != 500 {
+			return fmt.Errorf("gateway/profile: invalid LoRa std channel bandwidth: %d", c.Bandwidth)
+		}
+		if c.SpreadingFactor < 7 || c.SpreadingFactor > 12 {
+			return fmt.Errorf("gateway/profile: invalid LoRa std channel spreading-factor: %d", c.SpreadingFactor)
+		}
+	}
+	if c := p.FSKChannel; c != nil {
+		if c.Frequency <= 0 {
+			return fmt.Errorf("gateway/profile: invalid FSK channel frequency: %f", c.Frequency)
+		}
+		if c.Bitrate <= 0 {
+			return fmt.Errorf("gateway/profile: invalid FSK channel bitrate: %d", c.Bitrate)
+		}
+	}
+	return nil
+}
+
+// HasFrequency returns true when the given frequency (MHz) is one of the
+// channels of the profile.
+func (p Profile) HasFrequency(frequency float64) bool {
+	for _, c := range p.Channels {
+		if equalFrequency(c.Frequency, frequency) {
+			return true
+		}
+	}
+	if p.LoRaStdChannel != nil && equalFrequency(p.LoRaStdChannel.Frequency, frequency) {
+		return true
+	}
+	if p.FSKChannel != nil && equalFrequency(p.FSKChannel.Frequency, frequency) {
+		return true
+	}
+	return false
+}
+
+// Parse parses and validates the given JSON encoded profile.
+func Parse(s string) (Profile, error) {
+	var p Profile
+	if err := json.Unmarshal([]byte(s), &p); err != nil {
+		return p, fmt.Errorf("gateway/profile: invalid profile: %s", err)
+	}
+	return p, p.Validate()
+}
+
+// Get returns the profile of the given gateway or nil when no profile has
+// been configured.
+func Get(gw loracontrol.Gateway) (*Profile, error) {
+	s, ok := gw.Config.String[ConfigKey]
+	if !ok {
+		return nil, nil
+	}
+	p, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// equalFrequency compares the given frequencies (MHz) with a precision of
+// 1Hz.
+func equalFrequency(a, b float64) bool {
+	return math.Abs(a-b) < 0.000001
+}
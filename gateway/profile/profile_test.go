@@ -0,0 +1,79 @@
+package profile
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/brocaar/loracontrol"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParse(t *testing.T) {
+	Convey("Given a set of test profiles", t, func() {
+		testTable := []struct {
+			JSON     string
+			Profile  Profile
+			HasError bool
+		}{
+			{
+				JSON: `{"channels":[{"frequency":868.1},{"frequency":868.3}],"loRaStdChannel":{"frequency":868.3,"bandwidth":250,"spreadingFactor":7},"fskChannel":{"frequency":868.8,"bitrate":50000}}`,
+				Profile: Profile{
+					Channels:       []Channel{{Frequency: 868.1}, {Frequency: 868.3}},
+					LoRaStdChannel: &LoRaStdChannel{Frequency: 868.3, Bandwidth: 250, SpreadingFactor: 7},
+					FSKChannel:     &FSKChannel{Frequency: 868.8, Bitrate: 50000},
+				},
+			},
+			{
+				JSON:     `{"channels":[]}`,
+				Profile:  Profile{Channels: []Channel{}},
+				HasError: true,
+			},
+			{
+				JSON:     `{"channels":[{"frequency":868.1}],"loRaStdChannel":{"frequency":868.3,"bandwidth":200,"spreadingFactor":7}}`,
+				Profile:  Profile{Channels: []Channel{{Frequency: 868.1}}, LoRaStdChannel: &LoRaStdChannel{Frequency: 868.3, Bandwidth: 200, SpreadingFactor: 7}},
+				HasError: true,
+			},
+			{
+				JSON:     `{"channels":[{"frequency":1},{"frequency":2},{"frequency":3},{"frequency":4},{"frequency":5},{"frequency":6},{"frequency":7},{"frequency":8},{"frequency":9}]}`,
+				Profile:  Profile{Channels: []Channel{{1}, {2}, {3}, {4}, {5}, {6}, {7}, {8}, {9}}},
+				HasError: true,
+			},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Testing: %s [%d]", test.JSON, i), func() {
+				p, err := Parse(test.JSON)
+				So(err != nil, ShouldEqual, test.HasError)
+				So(p, ShouldResemble, test.Profile)
+			})
+		}
+	})
+}
+
+func TestGet(t *testing.T) {
+	Convey("Given a gateway without profile", t, func() {
+		gw := loracontrol.Gateway{Config: loracontrol.PropertyBag{String: map[string]string{}}}
+
+		Convey("Then Get returns nil", func() {
+			p, err := Get(gw)
+			So(err, ShouldBeNil)
+			So(p, ShouldBeNil)
+		})
+
+		Convey("Given a profile is configured", func() {
+			gw.Config.String[ConfigKey] = `{"channels":[{"frequency":868.1}],"fskChannel":{"frequency":868.8,"bitrate":50000}}`
+
+			Convey("Then Get returns the profile", func() {
+				p, err := Get(gw)
+				So(err, ShouldBeNil)
+				So(p, ShouldNotBeNil)
+
+				Convey("Then HasFrequency returns true for the configured frequencies", func() {
+					So(p.HasFrequency(868.1), ShouldBeTrue)
+					So(p.HasFrequency(868.8), ShouldBeTrue)
+					So(p.HasFrequency(868.3), ShouldBeFalse)
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,565 @@
+// Package scheduler implements a gateway backend which keeps a transmission
+// timeline per gateway, so that downlink transmissions on the same gateway
+// do not overlap. When the requested gateway is busy, the packet is sent
+// through an alternate gateway which received the same uplink.
+package scheduler
+
+import (
+	"errors"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/gateway/airtime"
+	"github.com/brocaar/loraserver/gateway/profile"
+	"github.com/brocaar/loraserver/gateway/txconfig"
+	"github.com/brocaar/lorawan"
+)
+
+var (
+	// collisionCount contains the number of packets that were rejected
+	// because they would overlap with an other transmission.
+	collisionCount = expvar.NewInt("gateway_scheduler_collisions")
+
+	// rescheduledCount contains the number of packets that were sent
+	// through an alternate gateway.
+	rescheduledCount = expvar.NewInt("gateway_scheduler_rescheduled")
+
+	// dutyCycleRefusedCount contains (per sub-band) the number of packets
+	// that were refused because the duty-cycle budget was exceeded.
+	dutyCycleRefusedCount = expvar.NewMap("gateway_scheduler_duty_cycle_refused")
+)
+
+// ErrCollision is returned when the packet overlaps with an other
+// transmission on the gateway and no alternate gateway is available.
+var ErrCollision = errors.New("gateway/scheduler: transmission overlaps with a scheduled transmission")
+
+// ErrDutyCycle is returned when the packet would exceed the duty-cycle
+// budget of the sub-band on the gateway and no alternate gateway is
+// available.
+var ErrDutyCycle = errors.New("gateway/scheduler: transmission exceeds the duty-cycle budget")
+
+// ErrSendAtNotSupported is returned by SendAt when the wrapped backend does
+// not support sending at an absolute time.
+var ErrSendAtNotSupported = errors.New("gateway/scheduler: backend does not support sending at an absolute time")
+
+// uplinkTTL defines how long the received uplinks are kept to find
+// alternate gateways. This covers the Class A receive windows (including
+// the join-accept delay).
+const uplinkTTL = 10 * time.Second
+
+// ErrPushConfigNotSupported is returned by PushConfig when the wrapped
+// backend does not support pushing the gateway config.
+// This is the same error as profile.ErrPushNotSupported.
+var ErrPushConfigNotSupported = profile.ErrPushNotSupported
+
+// Option defines a Backend option.
+type Option func(*Backend) error
+
+// SetDutyCycle enables the duty-cycle accounting for the given sub-bands.
+// The duty-cycle budget of each sub-band is computed over the given (rolling)
+// window.
+func SetDutyCycle(subBands []SubBand, window time.Duration) Option {
+	return func(b *Backend) error {
+		if window <= 0 {
+			return errors.New("gateway/scheduler: the duty-cycle window must be greater than 0")
+		}
+		b.subBands = subBands
+		b.dutyCycleWindow = window
+		return nil
+	}
+}
+
+// configPusher is implemented by the gateway backends supporting pushing
+// the gateway config (channel plan) to the gateway.
+type configPusher interface {
+	PushConfig(gw loracontrol.Gateway) error
+}
+
+// timeSender is implemented by the gateway backends supporting the
+// transmission of packets at an absolute (GPS) time.
+type timeSender interface {
+	SendAt(txPacket loracontrol.TXPacket, t time.Time) error
+}
+
+// errorBackend is implemented by the gateway backends exposing an error
+// channel.
+type errorBackend interface {
+	Errors() chan error
+}
+
+// transmission represents a scheduled transmission.
+type transmission struct {
+	start time.Time
+	end   time.Time
+}
+
+// gatewayState contains the timing reference and transmission timeline
+// of a gateway.
+type gatewayState struct {
+	// the concentrator timestamp and the (local) time of the last uplink,
+	// used to convert TXInfo timestamps to the local time
+	refTimestamp uint32
+	refTime      time.Time
+	hasRef       bool
+
+	timeline []transmission
+
+	// the transmissions per sub-band, used for the duty-cycle accounting
+	usage map[string][]transmission
+}
+
+// getTime returns the local time of the given concentrator timestamp.
+func (s *gatewayState) getTime(timestamp uint32) (time.Time, bool) {
+	if !s.hasRef {
+		return time.Time{}, false
+	}
+	// int32 conversion handles the wrap-around of the timestamp
+	return s.refTime.Add(time.Duration(int32(timestamp-s.refTimestamp)) * time.Microsecond), true
+}
+
+// reserve adds the transmission to the timeline when it does not overlap
+// with an other transmission. Ended transmissions are removed.
+func (s *gatewayState) reserve(tx transmission, now time.Time) bool {
+	timeline := s.timeline[:0]
+	for _, t := range s.timeline {
+		if t.end.After(now) {
+			timeline = append(timeline, t)
+		}
+	}
+	s.timeline = timeline
+
+	for _, t := range s.timeline {
+		if tx.start.Before(t.end) && t.start.Before(tx.end) {
+			return false
+		}
+	}
+	s.timeline = append(s.timeline, tx)
+	return true
+}
+
+func (s *gatewayState) release(tx transmission) {
+	for i, t := range s.timeline {
+		if t == tx {
+			s.timeline = append(s.timeline[:i], s.timeline[i+1:]...)
+			return
+		}
+	}
+}
+
+// dutyCycleAvailable returns true when the transmission fits within the
+// duty-cycle budget of the sub-band. Transmissions which ended before the
+// window are removed.
+func (s *gatewayState) dutyCycleAvailable(band SubBand, tx transmission, window time.Duration, now time.Time) bool {
+	usage := s.usage[band.Name][:0]
+	for _, t := range s.usage[band.Name] {
+		if t.end.After(now.Add(-window)) {
+			usage = append(usage, t)
+		}
+	}
+	if s.usage == nil {
+		s.usage = make(map[string][]transmission)
+	}
+	s.usage[band.Name] = usage
+
+	used := tx.end.Sub(tx.start)
+	for _, t := range usage {
+		if t.end.After(tx.end.Add(-window)) {
+			used += t.end.Sub(t.start)
+		}
+	}
+	return used <= band.budget(window)
+}
+
+func (s *gatewayState) addUsage(band SubBand, tx transmission) {
+	s.usage[band.Name] = append(s.usage[band.Name], tx)
+}
+
+func (s *gatewayState) releaseUsage(band SubBand, tx transmission) {
+	for i, t := range s.usage[band.Name] {
+		if t == tx {
+			s.usage[band.Name] = append(s.usage[band.Name][:i], s.usage[band.Name][i+1:]...)
+			return
+		}
+	}
+}
+
+// uplink contains the RXInfo of all gateways which received the same
+// uplink.
+type uplink struct {
+	expires time.Time
+	rxInfos []loracontrol.RXInfo
+}
+
+// Backend implements a scheduling gateway backend, wrapping an other
+// gateway backend.
+type Backend struct {
+	backend loracontrol.GatewayBackend
+	client  *loracontrol.Client
+	rxChan  chan loracontrol.RXPacket
+
+	subBands        []SubBand
+	dutyCycleWindow time.Duration
+
+	mu       sync.Mutex // protects gateways and uplinks
+	gateways map[lorawan.EUI64]*gatewayState
+	uplinks  map[string]*uplink
+}
+
+// NewBackend creates a new Backend wrapping the given backend.
+func NewBackend(backend loracontrol.GatewayBackend, opts ...Option) (*Backend, error) {
+	b := &Backend{
+		backend:  backend,
+		rxChan:   make(chan loracontrol.RXPacket),
+		gateways: make(map[lorawan.EUI64]*gatewayState),
+		uplinks:  make(map[string]*uplink),
+	}
+
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+
+	go func() {
+		for rxPacket := range backend.Receive() {
+			b.collectUplink(rxPacket, time.Now())
+			b.rxChan <- rxPacket
+		}
+		close(b.rxChan)
+	}()
+
+	return b, nil
+}
+
+// SetClient sets the loracontrol.Client (used to read the gateway tx
+// config) on the backend and the wrapped backend. It is automatically called
+// by loracontrol.SetGatewayBackend.
+func (b *Backend) SetClient(c *loracontrol.Client) {
+	b.client = c
+	b.backend.SetClient(c)
+}
+
+// Close closes the wrapped backend. The Receive channel will be closed after
+// the Receive channel of the wrapped backend has been closed.
+func (b *Backend) Close() error {
+	return b.backend.Close()
+}
+
+// Receive returns the RXPacket channel.
+func (b *Backend) Receive() chan loracontrol.RXPacket {
+	return b.rxChan
+}
+
+// Errors returns the error channel of the wrapped backend (or nil when the
+// wrapped backend does not expose an error channel).
+func (b *Backend) Errors() chan error {
+	if eb, ok := b.backend.(errorBackend); ok {
+		return eb.Errors()
+	}
+	return nil
+}
+
+// Send sends the given TXPacket when it does not overlap with an other
+// transmission on the gateway and fits within the duty-cycle budget. Else it
+// is sent through the first available gateway which received the same
+// uplink. ErrCollision or ErrDutyCycle is returned when no gateway is
+// available. When there is no timing reference for the gateway, the packet
+// can't be placed on the timeline and only its duty-cycle budget is
+// reserved (starting now).
+func (b *Backend) Send(txPacket loracontrol.TXPacket) error {
+	now := time.Now()
+
+	b.mu.Lock()
+	candidates := b.getCandidates(txPacket, now)
+	b.mu.Unlock()
+
+	err := ErrCollision
+	var refusedBand string
+	for i, candidate := range candidates {
+		d, prepErr := b.prepare(&candidate)
+		if prepErr != nil {
+			return prepErr
+		}
+
+		b.mu.Lock()
+		gw := b.getGateway(candidate.TXInfo.MAC)
+		start, hasRef := now, true
+		if !candidate.TXInfo.Immediately {
+			start, hasRef = gw.getTime(candidate.TXInfo.Timestamp)
+		}
+
+		var tx transmission
+		var band SubBand
+		var reserveErr error
+		if hasRef {
+			tx = transmission{start: start, end: start.Add(d)}
+			band, reserveErr = b.reserve(gw, candidate.TXInfo, tx, now)
+		} else {
+			tx = transmission{start: now, end: now.Add(d)}
+			band, reserveErr = b.reserveDutyCycle(gw, candidate.TXInfo, tx, now)
+		}
+		b.mu.Unlock()
+
+		if reserveErr != nil {
+			log.WithFields(log.Fields{
+				"mac":     candidate.TXInfo.MAC,
+				"start":   tx.start,
+				"airtime": d,
+			}).Infof("gateway/scheduler: gateway is not available: %s", reserveErr)
+			if reserveErr == ErrDutyCycle {
+				err = ErrDutyCycle
+				refusedBand = band.Name
+			}
+			continue
+		}
+
+		if i > 0 {
+			rescheduledCount.Add(1)
+			log.WithFields(log.Fields{
+				"mac":           txPacket.TXInfo.MAC,
+				"alternate_mac": candidate.TXInfo.MAC,
+			}).Info("gateway/scheduler: sending packet through alternate gateway")
+		}
+
+		if err := b.backend.Send(candidate); err != nil {
+			b.mu.Lock()
+			b.release(gw, band, tx)
+			b.mu.Unlock()
+			return err
+		}
+		return nil
+	}
+
+	if err == ErrDutyCycle {
+		dutyCycleRefusedCount.Add(refusedBand, 1)
+	} else {
+		collisionCount.Add(1)
+	}
+	return err
+}
+
+// SendAt sends the given TXPacket at the given time when it does not
+// overlap with an other transmission on the gateway and fits within the
+// duty-cycle budget. This requires that the wrapped backend supports sending
+// at an absolute time.
+func (b *Backend) SendAt(txPacket loracontrol.TXPacket, t time.Time) error {
+	ts, ok := b.backend.(timeSender)
+	if !ok {
+		return ErrSendAtNotSupported
+	}
+	d, err := b.prepare(&txPacket)
+	if err != nil {
+		return err
+	}
+
+	tx := transmission{start: t, end: t.Add(d)}
+	b.mu.Lock()
+	gw := b.getGateway(txPacket.TXInfo.MAC)
+	band, err := b.reserve(gw, txPacket.TXInfo, tx, time.Now())
+	b.mu.Unlock()
+	if err != nil {
+		if err == ErrDutyCycle {
+			dutyCycleRefusedCount.Add(band.Name, 1)
+		} else {
+			collisionCount.Add(1)
+		}
+		return err
+	}
+
+	if err := ts.SendAt(txPacket, t); err != nil {
+		b.mu.Lock()
+		b.release(gw, band, tx)
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// PushConfig pushes the config of the given gateway through the wrapped
+// backend. It returns ErrPushConfigNotSupported when the wrapped backend
+// does not support this.
+func (b *Backend) PushConfig(gw loracontrol.Gateway) error {
+	cp, ok := b.backend.(configPusher)
+	if !ok {
+		return ErrPushConfigNotSupported
+	}
+	return cp.PushConfig(gw)
+}
+
+// prepare applies the tx config of the gateway to the given TXPacket and
+// returns its time-on-air (using the configured preamble). The tx power is
+// capped to the max. power of the gateway and the antenna gain is subtracted
+// (see gateway/txconfig), so that this is applied independent of the wrapped
+// backend. It must be called without holding the lock, as the config is read
+// from the storage.
+func (b *Backend) prepare(txPacket *loracontrol.TXPacket) (time.Duration, error) {
+	conf, err := b.getTXConfig(txPacket.TXInfo.MAC)
+	if err != nil {
+		return 0, err
+	}
+	txPacket.TXInfo.Power = conf.Power(txPacket.TXInfo.Power)
+	return airtime.TXPacket(*txPacket, int(conf.Preamble))
+}
+
+// getTXConfig returns the tx config of the given gateway. The default config
+// is returned when the client has not been set or when the gateway does not
+// exist.
+func (b *Backend) getTXConfig(mac lorawan.EUI64) (txconfig.Config, error) {
+	if b.client == nil {
+		return txconfig.Config{}, nil
+	}
+	gw, err := b.client.Gateway().Get(mac)
+	if err != nil {
+		if err == loracontrol.ErrObjectDoesNotExist {
+			return txconfig.Config{}, nil
+		}
+		return txconfig.Config{}, err
+	}
+	return txconfig.Get(gw)
+}
+
+// reserve reserves the transmission on the timeline and (when enabled) the
+// duty-cycle budget of the sub-band. It returns the sub-band of the
+// transmission (the zero value when duty-cycle accounting is disabled or the
+// frequency is not within a sub-band). It expects that the lock is being
+// held.
+func (b *Backend) reserve(gw *gatewayState, txInfo loracontrol.TXInfo, tx transmission, now time.Time) (SubBand, error) {
+	band, hasBand := getSubBand(b.subBands, txInfo.Frequency)
+	if hasBand && !gw.dutyCycleAvailable(band, tx, b.dutyCycleWindow, now) {
+		return band, ErrDutyCycle
+	}
+	if !gw.reserve(tx, now) {
+		return band, ErrCollision
+	}
+	if hasBand {
+		gw.addUsage(band, tx)
+	}
+	return band, nil
+}
+
+// reserveDutyCycle reserves the duty-cycle budget of the sub-band only. This
+// is used for transmissions which can't be placed on the timeline. It
+// expects that the lock is being held.
+func (b *Backend) reserveDutyCycle(gw *gatewayState, txInfo loracontrol.TXInfo, tx transmission, now time.Time) (SubBand, error) {
+	band, hasBand := getSubBand(b.subBands, txInfo.Frequency)
+	if !hasBand {
+		return band, nil
+	}
+	if !gw.dutyCycleAvailable(band, tx, b.dutyCycleWindow, now) {
+		return band, ErrDutyCycle
+	}
+	gw.addUsage(band, tx)
+	return band, nil
+}
+
+// release releases the reserved transmission. It expects that the lock is
+// being held.
+func (b *Backend) release(gw *gatewayState, band SubBand, tx transmission) {
+	gw.release(tx)
+	if band.Name != "" {
+		gw.releaseUsage(band, tx)
+	}
+}
+
+// getGateway returns the state of the given gateway. It expects that the
+// lock is being held.
+func (b *Backend) getGateway(mac lorawan.EUI64) *gatewayState {
+	gw, ok := b.gateways[mac]
+	if !ok {
+		gw = &gatewayState{}
+		b.gateways[mac] = gw
+	}
+	return gw
+}
+
+// collectUplink stores the timing reference of the gateway and the RXInfo
+// of the uplink (to find alternate gateways).
+func (b *Backend) collectUplink(rxPacket loracontrol.RXPacket, now time.Time) {
+	phyB, err := rxPacket.PHYPayload.MarshalBinary()
+	if err != nil {
+		log.Errorf("gateway/scheduler: could not marshal PHYPayload: %s", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	gw := b.getGateway(rxPacket.RXInfo.MAC)
+	gw.refTimestamp = rxPacket.RXInfo.Timestamp
+	gw.refTime = now
+	gw.hasRef = true
+
+	for k, u := range b.uplinks {
+		if now.After(u.expires) {
+			delete(b.uplinks, k)
+		}
+	}
+
+	u, ok := b.uplinks[string(phyB)]
+	if !ok {
+		u = &uplink{expires: now.Add(uplinkTTL)}
+		b.uplinks[string(phyB)] = u
+	}
+	u.rxInfos = append(u.rxInfos, rxPacket.RXInfo)
+}
+
+// getCandidates returns the given TXPacket followed by the TXPackets for the
+// alternate gateways (ordered by SNR) which received the uplink to which
+// the TXPacket is a response. It expects that the lock is being held.
+func (b *Backend) getCandidates(txPacket loracontrol.TXPacket, now time.Time) []loracontrol.TXPacket {
+	candidates := []loracontrol.TXPacket{txPacket}
+	if txPacket.TXInfo.Immediately {
+		return candidates
+	}
+
+	for _, u := range b.uplinks {
+		if now.After(u.expires) {
+			continue
+		}
+
+		// find the uplink received by the gateway, of which the TX
+		// timestamp is a whole number of seconds later (the Class A
+		// receive windows)
+		var delay uint32
+		var found bool
+		for _, rxInfo := range u.rxInfos {
+			d := txPacket.TXInfo.Timestamp - rxInfo.Timestamp
+			if rxInfo.MAC == txPacket.TXInfo.MAC && d%1000000 == 0 && time.Duration(d)*time.Microsecond <= uplinkTTL {
+				delay = d
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		rxInfos := make([]loracontrol.RXInfo, len(u.rxInfos))
+		copy(rxInfos, u.rxInfos)
+		sort.Sort(bySNR(rxInfos))
+
+		for _, rxInfo := range rxInfos {
+			if rxInfo.MAC == txPacket.TXInfo.MAC {
+				continue
+			}
+			alt := txPacket
+			alt.TXInfo.MAC = rxInfo.MAC
+			alt.TXInfo.Timestamp = rxInfo.Timestamp + delay
+			candidates = append(candidates, alt)
+		}
+		break
+	}
+
+	return candidates
+}
+
+// bySNR implements sort.Interface, ordering by the best SNR first.
+type bySNR []loracontrol.RXInfo
+
+func (s bySNR) Len() int           { return len(s) }
+func (s bySNR) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySNR) Less(i, j int) bool { return s[i].LoRaSNR > s[j].LoRaSNR }
@@ -0,0 +1,161 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func init() {
+	log.SetLevel(log.ErrorLevel)
+}
+
+type testGatewayBackend struct {
+	rxPacketChan chan loracontrol.RXPacket
+	txPackets    []loracontrol.TXPacket
+}
+
+func (b *testGatewayBackend) SetClient(c *loracontrol.Client) {}
+
+func (b *testGatewayBackend) Send(txPacket loracontrol.TXPacket) error {
+	b.txPackets = append(b.txPackets, txPacket)
+	return nil
+}
+
+func (b *testGatewayBackend) Receive() chan loracontrol.RXPacket {
+	return b.rxPacketChan
+}
+
+func (b *testGatewayBackend) Close() error {
+	close(b.rxPacketChan)
+	return nil
+}
+
+func TestGatewayState(t *testing.T) {
+	Convey("Given a gatewayState with a scheduled transmission", t, func() {
+		now := time.Now()
+		s := &gatewayState{}
+		So(s.reserve(transmission{start: now.Add(time.Second), end: now.Add(2 * time.Second)}, now), ShouldBeTrue)
+
+		Convey("Then an overlapping transmission is rejected", func() {
+			So(s.reserve(transmission{start: now.Add(1500 * time.Millisecond), end: now.Add(3 * time.Second)}, now), ShouldBeFalse)
+		})
+
+		Convey("Then an adjacent transmission is accepted", func() {
+			So(s.reserve(transmission{start: now.Add(2 * time.Second), end: now.Add(3 * time.Second)}, now), ShouldBeTrue)
+		})
+
+		Convey("Then the ended transmission is removed from the timeline", func() {
+			So(s.reserve(transmission{start: now.Add(3 * time.Second), end: now.Add(4 * time.Second)}, now.Add(5*time.Second)), ShouldBeTrue)
+			So(s.timeline, ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("Given a gatewayState with a timing reference", t, func() {
+		ref := time.Now()
+		s := &gatewayState{refTimestamp: 0xfffff000, refTime: ref, hasRef: true}
+
+		Convey("Then the time of a wrapped timestamp is returned", func() {
+			ts, ok := s.getTime(0x1000)
+			So(ok, ShouldBeTrue)
+			So(ts.Equal(ref.Add(0x2000*time.Microsecond)), ShouldBeTrue)
+		})
+	})
+}
+
+func TestBackend(t *testing.T) {
+	Convey("Given a Backend wrapping a test backend", t, func() {
+		backend := &testGatewayBackend{
+			rxPacketChan: make(chan loracontrol.RXPacket),
+		}
+		b, err := NewBackend(backend)
+		So(err, ShouldBeNil)
+
+		macA := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+		macB := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+
+		phy := lorawan.NewPHYPayload(false)
+		phy.MHDR = lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataDown,
+			Major: lorawan.LoRaWANR1,
+		}
+		phy.MACPayload = lorawan.NewMACPayload(false)
+
+		txPacket := loracontrol.TXPacket{
+			TXInfo: loracontrol.TXInfo{
+				MAC:       macA,
+				Timestamp: 1000000 + 1000000,
+				Frequency: 868.1,
+				DataRate:  loracontrol.DataRate{LoRa: "SF7BW125"},
+				CodeRate:  "4/5",
+			},
+			PHYPayload: phy,
+		}
+
+		Convey("When sending a packet to a gateway without timing reference", func() {
+			So(b.Send(txPacket), ShouldBeNil)
+
+			Convey("Then the packet is sent", func() {
+				So(backend.txPackets, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("Given an uplink received by two gateways", func() {
+			uplinkPHY := lorawan.NewPHYPayload(true)
+			uplinkPHY.MHDR = lorawan.MHDR{
+				MType: lorawan.UnconfirmedDataUp,
+				Major: lorawan.LoRaWANR1,
+			}
+			uplinkPHY.MACPayload = lorawan.NewMACPayload(true)
+
+			for _, rxInfo := range []loracontrol.RXInfo{
+				{MAC: macA, Timestamp: 1000000, LoRaSNR: 5},
+				{MAC: macB, Timestamp: 3000000, LoRaSNR: 3},
+			} {
+				backend.rxPacketChan <- loracontrol.RXPacket{RXInfo: rxInfo, PHYPayload: uplinkPHY}
+				<-b.Receive()
+			}
+
+			Convey("When sending a packet to the first gateway", func() {
+				So(b.Send(txPacket), ShouldBeNil)
+
+				Convey("Then it is sent through the first gateway", func() {
+					So(backend.txPackets, ShouldHaveLength, 1)
+					So(backend.txPackets[0].TXInfo.MAC, ShouldEqual, macA)
+				})
+
+				Convey("When sending an other packet at the same time", func() {
+					So(b.Send(txPacket), ShouldBeNil)
+
+					Convey("Then it is sent through the alternate gateway", func() {
+						So(backend.txPackets, ShouldHaveLength, 2)
+						So(backend.txPackets[1].TXInfo.MAC, ShouldEqual, macB)
+						So(backend.txPackets[1].TXInfo.Timestamp, ShouldEqual, 3000000+1000000)
+					})
+
+					Convey("Then a third packet at the same time is rejected", func() {
+						So(b.Send(txPacket), ShouldEqual, ErrCollision)
+						So(backend.txPackets, ShouldHaveLength, 2)
+					})
+				})
+			})
+		})
+
+		Convey("Then PushConfig returns ErrPushConfigNotSupported", func() {
+			So(b.PushConfig(loracontrol.Gateway{MAC: macA}), ShouldEqual, ErrPushConfigNotSupported)
+		})
+
+		Convey("When closing the backend", func() {
+			So(b.Close(), ShouldBeNil)
+
+			Convey("Then the Receive channel is closed", func() {
+				_, ok := <-b.Receive()
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
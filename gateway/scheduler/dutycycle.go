@@ -0,0 +1,40 @@
+package scheduler
+
+import "time"
+
+// SubBand defines a frequency band with its duty-cycle limit.
+type SubBand struct {
+	Name         string
+	MinFrequency float64 // MHz (inclusive)
+	MaxFrequency float64 // MHz (inclusive)
+	DutyCycle    float64 // e.g. 0.01 for 1%
+}
+
+// budget returns the airtime budget of the sub-band within the given window.
+func (b SubBand) budget(window time.Duration) time.Duration {
+	return time.Duration(float64(window) * b.DutyCycle)
+}
+
+// EU868SubBands contains the EU868 sub-bands (ETSI EN 300 220).
+var EU868SubBands = []SubBand{
+	{Name: "g", MinFrequency: 863.0, MaxFrequency: 868.0, DutyCycle: 0.01},
+	{Name: "g1", MinFrequency: 868.0, MaxFrequency: 868.6, DutyCycle: 0.01},
+	{Name: "g2", MinFrequency: 868.7, MaxFrequency: 869.2, DutyCycle: 0.001},
+	{Name: "g3", MinFrequency: 869.4, MaxFrequency: 869.65, DutyCycle: 0.1},
+	{Name: "g4", MinFrequency: 869.7, MaxFrequency: 870.0, DutyCycle: 0.01},
+}
+
+// DefaultDutyCycleWindow is the (ETSI) observation period of the duty-cycle.
+const DefaultDutyCycleWindow = time.Hour
+
+// getSubBand returns the sub-band of the given frequency. As the sub-bands
+// g and g1 share a border frequency, the first matching sub-band is
+// returned.
+func getSubBand(subBands []SubBand, frequency float64) (SubBand, bool) {
+	for _, b := range subBands {
+		if frequency >= b.MinFrequency && frequency <= b.MaxFrequency {
+			return b, true
+		}
+	}
+	return SubBand{}, false
+}
@@ -0,0 +1,163 @@
+package scheduler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGetSubBand(t *testing.T) {
+	Convey("Given the EU868 sub-bands", t, func() {
+		testTable := []struct {
+			Frequency float64
+			Name      string
+			Found     bool
+		}{
+			{868.1, "g1", true},
+			{868.0, "g", true},
+			{869.525, "g3", true},
+			{869.3, "", false},
+			{915.0, "", false},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Testing: %f [%d]", test.Frequency, i), func() {
+				band, ok := getSubBand(EU868SubBands, test.Frequency)
+				So(ok, ShouldEqual, test.Found)
+				So(band.Name, ShouldEqual, test.Name)
+			})
+		}
+	})
+}
+
+func TestDutyCycleAvailable(t *testing.T) {
+	Convey("Given a gatewayState and a sub-band with a budget of 100ms in 10s", t, func() {
+		s := &gatewayState{}
+		band := SubBand{Name: "test", MinFrequency: 868, MaxFrequency: 869, DutyCycle: 0.01}
+		window := 10 * time.Second
+		now := time.Now()
+
+		tx := func(start time.Time, d time.Duration) transmission {
+			return transmission{start: start, end: start.Add(d)}
+		}
+
+		Convey("Then a transmission of 100ms fits", func() {
+			So(s.dutyCycleAvailable(band, tx(now, 100*time.Millisecond), window, now), ShouldBeTrue)
+		})
+
+		Convey("Then a transmission of 101ms does not fit", func() {
+			So(s.dutyCycleAvailable(band, tx(now, 101*time.Millisecond), window, now), ShouldBeFalse)
+		})
+
+		Convey("Given 60ms of usage", func() {
+			used := tx(now, 60*time.Millisecond)
+			So(s.dutyCycleAvailable(band, used, window, now), ShouldBeTrue)
+			s.addUsage(band, used)
+
+			Convey("Then an other transmission of 60ms does not fit", func() {
+				So(s.dutyCycleAvailable(band, tx(now.Add(time.Second), 60*time.Millisecond), window, now), ShouldBeFalse)
+			})
+
+			Convey("Then an other transmission of 60ms fits after the window", func() {
+				later := now.Add(11 * time.Second)
+				So(s.dutyCycleAvailable(band, tx(later, 60*time.Millisecond), window, later), ShouldBeTrue)
+				So(s.usage["test"], ShouldHaveLength, 0)
+			})
+
+			Convey("When the usage is released", func() {
+				s.releaseUsage(band, used)
+
+				Convey("Then an other transmission of 60ms fits", func() {
+					So(s.dutyCycleAvailable(band, tx(now.Add(time.Second), 60*time.Millisecond), window, now), ShouldBeTrue)
+				})
+			})
+		})
+	})
+}
+
+func TestBackendDutyCycle(t *testing.T) {
+	Convey("Given a Backend with a duty-cycle budget of 50ms", t, func() {
+		backend := &testGatewayBackend{
+			rxPacketChan: make(chan loracontrol.RXPacket),
+		}
+		b, err := NewBackend(backend, SetDutyCycle([]SubBand{
+			{Name: "test", MinFrequency: 868.0, MaxFrequency: 868.6, DutyCycle: 0.01},
+		}, 5*time.Second))
+		So(err, ShouldBeNil)
+
+		mac := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+
+		uplinkPHY := lorawan.NewPHYPayload(true)
+		uplinkPHY.MHDR = lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataUp,
+			Major: lorawan.LoRaWANR1,
+		}
+		uplinkPHY.MACPayload = lorawan.NewMACPayload(true)
+		backend.rxPacketChan <- loracontrol.RXPacket{
+			RXInfo:     loracontrol.RXInfo{MAC: mac, Timestamp: 1000000},
+			PHYPayload: uplinkPHY,
+		}
+		<-b.Receive()
+
+		phy := lorawan.NewPHYPayload(false)
+		phy.MHDR = lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataDown,
+			Major: lorawan.LoRaWANR1,
+		}
+		phy.MACPayload = lorawan.NewMACPayload(false)
+
+		txPacket := loracontrol.TXPacket{
+			TXInfo: loracontrol.TXInfo{
+				MAC:       mac,
+				Timestamp: 2000000,
+				Frequency: 868.1,
+				DataRate:  loracontrol.DataRate{LoRa: "SF7BW125"},
+				CodeRate:  "4/5",
+			},
+			PHYPayload: phy,
+		}
+
+		Convey("When sending a packet", func() {
+			So(b.Send(txPacket), ShouldBeNil)
+
+			Convey("Then the packet is sent", func() {
+				So(backend.txPackets, ShouldHaveLength, 1)
+			})
+
+			Convey("When sending a second packet (not overlapping)", func() {
+				txPacket.TXInfo.Timestamp = 3000000
+				err := b.Send(txPacket)
+
+				Convey("Then ErrDutyCycle is returned", func() {
+					So(err, ShouldEqual, ErrDutyCycle)
+					So(backend.txPackets, ShouldHaveLength, 1)
+				})
+			})
+
+			Convey("When sending a second packet through a gateway without timing reference", func() {
+				txPacket.TXInfo.MAC = lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+				So(b.Send(txPacket), ShouldBeNil)
+
+				Convey("Then a third packet through this gateway returns ErrDutyCycle", func() {
+					txPacket.TXInfo.Timestamp = 3000000
+					So(b.Send(txPacket), ShouldEqual, ErrDutyCycle)
+					So(backend.txPackets, ShouldHaveLength, 2)
+				})
+			})
+
+			Convey("When sending a second packet outside the sub-band", func() {
+				txPacket.TXInfo.Timestamp = 3000000
+				txPacket.TXInfo.Frequency = 869.525
+
+				Convey("Then the packet is sent", func() {
+					So(b.Send(txPacket), ShouldBeNil)
+					So(backend.txPackets, ShouldHaveLength, 2)
+				})
+			})
+		})
+	})
+}
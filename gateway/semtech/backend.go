@@ -3,23 +3,175 @@ package semtech
 import (
 	"encoding/base64"
 	"errors"
+	"expvar"
 	"fmt"
+	"math"
 	"net"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/gateway/gps"
+	"github.com/brocaar/loraserver/gateway/gwconfig"
+	"github.com/brocaar/loraserver/gateway/profile"
+	"github.com/brocaar/loraserver/gateway/txconfig"
 	"github.com/brocaar/lorawan"
 )
 
+var (
+	// crcErrorCount contains the number of received packets with an
+	// invalid CRC, per gateway MAC.
+	crcErrorCount = expvar.NewMap("gateway_semtech_crc_errors")
+
+	// noCRCCount contains the number of received packets without CRC,
+	// per gateway MAC.
+	noCRCCount = expvar.NewMap("gateway_semtech_no_crc")
+
+	// droppedCount contains the number of received UDP packets that were
+	// dropped because the handler queue was full.
+	droppedCount = expvar.NewInt("gateway_semtech_dropped")
+
+	// writeErrorCount contains the number of outgoing packets that could
+	// not be sent.
+	writeErrorCount = expvar.NewInt("gateway_semtech_write_errors")
+
+	// queueLength contains the handler queue length (as seen when the
+	// last packet was queued).
+	queueLength = expvar.NewInt("gateway_semtech_queue_length")
+
+	// channelPlanMismatchCount contains the number of received packets
+	// on a frequency which is not part of the channel plan (profile) of
+	// the gateway, per gateway MAC.
+	channelPlanMismatchCount = expvar.NewMap("gateway_semtech_channel_plan_mismatch")
+)
+
+// ErrBackendClosed is returned when the backend has been closed.
+var ErrBackendClosed = errors.New("gateway/semtech: backend is closed")
+
+// drainTimeout defines how long a received packet is offered on the Receive
+// channel after the backend has been closed.
+const drainTimeout = time.Second
+
+// channelPlanTTL defines how long the channel plan of a gateway is cached
+// for checking the received packets. Updates of the channel plan are picked
+// up after this interval.
+const channelPlanTTL = time.Minute
+
+// Default handler pool settings.
+const (
+	DefaultWorkers   = 10
+	DefaultQueueSize = 100
+)
+
+// channelPlan is a cached (parsed) channel plan of a gateway. The profile is
+// nil when the gateway does not have a channel plan.
+type channelPlan struct {
+	profile *profile.Profile
+	expires time.Time
+}
+
+// channelPlanCache caches the channel plans of the gateways, so that the
+// gateway config is not read and parsed for every received packet.
+type channelPlanCache struct {
+	sync.Mutex
+	plans map[lorawan.EUI64]channelPlan
+}
+
+// get returns the cached channel plan of the given gateway and false when
+// it is not cached or has expired.
+func (c *channelPlanCache) get(mac lorawan.EUI64, now time.Time) (*profile.Profile, bool) {
+	c.Lock()
+	defer c.Unlock()
+	plan, ok := c.plans[mac]
+	if !ok || now.After(plan.expires) {
+		return nil, false
+	}
+	return plan.profile, true
+}
+
+// set caches the given channel plan of the gateway until now + channelPlanTTL.
+// Expired plans are removed.
+func (c *channelPlanCache) set(mac lorawan.EUI64, p *profile.Profile, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if c.plans == nil {
+		c.plans = make(map[lorawan.EUI64]channelPlan)
+	}
+	for k, plan := range c.plans {
+		if now.After(plan.expires) {
+			delete(c.plans, k)
+		}
+	}
+	c.plans[mac] = channelPlan{profile: p, expires: now.Add(channelPlanTTL)}
+}
+
 type udpPacket struct {
 	data []byte
 	addr *net.UDPAddr
 }
 
+// Option defines a Backend option.
+type Option func(*Backend) error
+
+// SetStatsHandler sets the function which is called with the received
+// gateway stats (after these have been stored).
+func SetStatsHandler(f func(loracontrol.Gateway) error) Option {
+	return func(b *Backend) error {
+		b.statsHandler = f
+		return nil
+	}
+}
+
+// SetSeenHandler sets the function which is called every time a PUSH_DATA
+// or PULL_DATA packet is received from a gateway.
+func SetSeenHandler(f func(lorawan.EUI64) error) Option {
+	return func(b *Backend) error {
+		b.seenHandler = f
+		return nil
+	}
+}
+
+// SetConfigStorage sets the storage of the gateway config set through the
+// API. The stored config is merged into the gateway object when storing the
+// gateway stats, so that a concurrent config update is not overwritten.
+func SetConfigStorage(s *gwconfig.Storage) Option {
+	return func(b *Backend) error {
+		b.configStorage = s
+		return nil
+	}
+}
+
+// SetAcceptNoCRC sets if packets without CRC (stat = 0) are accepted.
+// By default these packets are dropped.
+func SetAcceptNoCRC(accept bool) Option {
+	return func(b *Backend) error {
+		b.acceptNoCRC = accept
+		return nil
+	}
+}
+
+// SetHandlerPool sets the number of workers handling the received UDP
+// packets and the size of the queue in front of these workers. When
+// dropWhenFull is set, packets received while the queue is full are dropped,
+// else the reading of new packets blocks until there is room in the queue.
+func SetHandlerPool(workers, queueSize int, dropWhenFull bool) Option {
+	return func(b *Backend) error {
+		if workers < 1 {
+			return errors.New("gateway/semtech: at least one worker is required")
+		}
+		if queueSize < 0 {
+			return errors.New("gateway/semtech: queue size must be >= 0")
+		}
+		b.workers = workers
+		b.queueSize = queueSize
+		b.dropWhenFull = dropWhenFull
+		return nil
+	}
+}
+
 // NewBackend creates a new Backend.
-func NewBackend(port int) (loracontrol.GatewayBackend, error) {
+func NewBackend(port int, opts ...Option) (*Backend, error) {
 	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("0.0.0.0:%d", port))
 	if err != nil {
 		return nil, err
@@ -31,26 +183,44 @@ func NewBackend(port int) (loracontrol.GatewayBackend, error) {
 	}
 
 	b := &Backend{
-		conn:     conn,
-		rxChan:   make(chan loracontrol.RXPacket),
-		sendChan: make(chan udpPacket),
+		conn:      conn,
+		rxChan:    make(chan loracontrol.RXPacket),
+		sendChan:  make(chan udpPacket),
+		closing:   make(chan struct{}),
+		errChan:   make(chan error, 1),
+		workers:   DefaultWorkers,
+		queueSize: DefaultQueueSize,
+	}
+
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
 
-	b.wg.Add(2)
+	b.handleChan = make(chan udpPacket, b.queueSize)
+	b.handlerWG.Add(b.workers)
+	for i := 0; i < b.workers; i++ {
+		go func() {
+			b.handlePackets()
+			b.handlerWG.Done()
+		}()
+	}
 
+	b.readerWG.Add(1)
 	go func() {
-		err := b.readPackets()
-		if !b.closed {
-			log.Fatal(err)
+		if err := b.readPackets(); err != nil {
+			b.setErr(err)
 		}
-		b.wg.Done()
+		close(b.handleChan)
+		b.readerWG.Done()
 	}()
+
+	b.senderWG.Add(1)
 	go func() {
-		err := b.sendPackets()
-		if !b.closed {
-			log.Fatal(err)
-		}
-		b.wg.Done()
+		b.sendPackets()
+		b.senderWG.Done()
 	}()
 
 	return b, nil
@@ -58,12 +228,27 @@ func NewBackend(port int) (loracontrol.GatewayBackend, error) {
 
 // Backend implements a Semtech backend.
 type Backend struct {
-	client   *loracontrol.Client
-	conn     *net.UDPConn
-	rxChan   chan loracontrol.RXPacket
-	sendChan chan udpPacket
-	closed   bool
-	wg       sync.WaitGroup
+	client        *loracontrol.Client
+	conn          *net.UDPConn
+	rxChan        chan loracontrol.RXPacket
+	sendChan      chan udpPacket
+	mu            sync.RWMutex // protects closed and err
+	closed        bool
+	err           error
+	errChan       chan error
+	closing       chan struct{}
+	readerWG      sync.WaitGroup
+	handlerWG     sync.WaitGroup
+	senderWG      sync.WaitGroup
+	statsHandler  func(loracontrol.Gateway) error
+	seenHandler   func(lorawan.EUI64) error
+	configStorage *gwconfig.Storage
+	acceptNoCRC   bool
+	handleChan    chan udpPacket
+	workers       int
+	queueSize     int
+	dropWhenFull  bool
+	channelPlans  channelPlanCache
 }
 
 // SetClient sets the loracontrol.Client and is automatically called by
@@ -72,15 +257,75 @@ func (b *Backend) SetClient(c *loracontrol.Client) {
 	b.client = c
 }
 
-// Close closes the backend.
+// Close closes the backend. It stops reading new packets, waits until the
+// packets in the handler queue have been handled (the Receive channel must be
+// consumed for this), sends out the pending packets and finally closes the
+// Receive channel. Close is safe to call multiple times.
 func (b *Backend) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
 	b.closed = true
+	close(b.closing)
+	b.mu.Unlock()
+
+	// stop reading (this will close the handler queue), when the read
+	// deadline can not be set the connection is closed to unblock the reader
+	// (the channels must be closed in any case)
+	connClosed := false
+	if err := b.conn.SetReadDeadline(time.Now()); err != nil {
+		log.Errorf("gateway/semtech: could not set read deadline: %s", err)
+		b.conn.Close()
+		connClosed = true
+	}
+	b.readerWG.Wait()
+
+	// drain the handler queue
+	b.handlerWG.Wait()
+
+	// flush the pending packets (nothing will be added to sendChan from here)
 	close(b.sendChan)
-	if err := b.conn.Close(); err != nil {
-		return err
+	b.senderWG.Wait()
+
+	close(b.rxChan)
+	if connClosed {
+		return nil
 	}
-	b.wg.Wait()
-	return nil
+	return b.conn.Close()
+}
+
+// Errors returns the channel on which a fatal backend error (e.g. the
+// UDP listener has failed) is published. After such an error the backend
+// does not receive packets anymore, it is up to the caller to close and
+// re-create the backend or to exit.
+func (b *Backend) Errors() chan error {
+	return b.errChan
+}
+
+// Err returns the fatal backend error or nil when the backend is healthy.
+func (b *Backend) Err() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.err
+}
+
+func (b *Backend) setErr(err error) {
+	log.Errorf("gateway/semtech: backend error: %s", err)
+	b.mu.Lock()
+	b.err = err
+	b.mu.Unlock()
+	select {
+	case b.errChan <- err:
+	default:
+	}
+}
+
+func (b *Backend) isClosed() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.closed
 }
 
 // Receive returns the RXPacket channel.
@@ -90,6 +335,18 @@ func (b *Backend) Receive() chan loracontrol.RXPacket {
 
 // Send sends the given TXPacket to the gateway.
 func (b *Backend) Send(txPacket loracontrol.TXPacket) error {
+	return b.send(txPacket, nil)
+}
+
+// SendAt sends the given TXPacket to the gateway, to be transmitted at the
+// given (absolute) time instead of the TXInfo Immediately / Timestamp. This
+// is used for Class B beacons and ping-slots and requires a GPS synchronized
+// gateway.
+func (b *Backend) SendAt(txPacket loracontrol.TXPacket, t time.Time) error {
+	return b.send(txPacket, &t)
+}
+
+func (b *Backend) send(txPacket loracontrol.TXPacket, at *time.Time) error {
 	gw, err := b.client.Gateway().Get(txPacket.TXInfo.MAC)
 	if err != nil {
 		if err == loracontrol.ErrObjectDoesNotExist {
@@ -108,10 +365,23 @@ func (b *Backend) Send(txPacket loracontrol.TXPacket) error {
 		return err
 	}
 
+	conf, err := txconfig.Get(gw)
+	if err != nil {
+		return err
+	}
+
+	// the scheduler converts the tx power to the power at the concentrator
+	// output, it is clamped again in case the backend is used on its own
+	txPacket.TXInfo.Power = conf.Clamp(txPacket.TXInfo.Power)
+
 	txpk, err := newTXPKFromTXPacket(txPacket)
 	if err != nil {
 		return err
 	}
+	txpk.Prea = conf.Preamble
+	if at != nil {
+		setTXPKTime(&txpk, *at)
+	}
 
 	pullResp := PullRespPacket{
 		Payload: PullRespPayload{
@@ -124,38 +394,94 @@ func (b *Backend) Send(txPacket loracontrol.TXPacket) error {
 		return err
 	}
 
-	b.sendChan <- udpPacket{
+	return b.sendUDP(udpPacket{
 		data: data,
 		addr: addr,
+	})
+}
+
+// sendUDP queues the given packet for sending. The read-lock makes sure that
+// sendChan is not closed while sending.
+func (b *Backend) sendUDP(p udpPacket) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBackendClosed
 	}
+	b.sendChan <- p
 	return nil
 }
 
+// sendACK queues the given ACK for sending. The packets which are handled
+// while the backend is closing are not acknowledged anymore.
+func (b *Backend) sendACK(p udpPacket) error {
+	if err := b.sendUDP(p); err != nil && err != ErrBackendClosed {
+		return err
+	}
+	return nil
+}
+
+// readPackets reads packets until the backend is closed (in which case nil
+// is returned) or until a non-temporary read error occurs.
 func (b *Backend) readPackets() error {
 	buf := make([]byte, 65507) // max udp data size
 	for {
 		i, addr, err := b.conn.ReadFromUDP(buf)
 		if err != nil {
+			if b.isClosed() {
+				return nil
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() && !nerr.Timeout() {
+				log.Warningf("temporary udp read error: %s", err)
+				continue
+			}
 			return err
 		}
 		data := make([]byte, i)
 		copy(data, buf[:i])
-		go func() {
-			if err := b.handlePacket(addr, data); err != nil {
-				log.WithFields(log.Fields{
-					"udp_data_base64": base64.StdEncoding.EncodeToString(data),
-					"addr":            addr,
-				}).Errorf("could not handle packet: %s", err)
-			}
-		}()
+		b.enqueue(udpPacket{data: data, addr: addr})
+	}
+}
+
+// enqueue adds the given packet to the handler queue. When the queue is full
+// it either blocks or drops the packet, depending on the drop policy.
+func (b *Backend) enqueue(p udpPacket) {
+	if b.dropWhenFull {
+		select {
+		case b.handleChan <- p:
+		default:
+			droppedCount.Add(1)
+			log.WithField("addr", p.addr).Warning("handler queue is full, dropping packet")
+			return
+		}
+	} else {
+		b.handleChan <- p
+	}
+	queueLength.Set(int64(len(b.handleChan)))
+}
+
+// handlePackets handles the queued packets until the queue is closed.
+func (b *Backend) handlePackets() {
+	for p := range b.handleChan {
+		if err := b.handlePacket(p.addr, p.data); err != nil {
+			log.WithFields(log.Fields{
+				"udp_data_base64": base64.StdEncoding.EncodeToString(p.data),
+				"addr":            p.addr,
+			}).Errorf("could not handle packet: %s", err)
+		}
 	}
 }
 
-func (b *Backend) sendPackets() error {
+// sendPackets sends the queued packets until sendChan is closed. Errors
+// are handled per packet, e.g. a gateway which became unreachable must not
+// affect the other gateways.
+func (b *Backend) sendPackets() {
 	for p := range b.sendChan {
 		pt, err := GetPacketType(p.data)
 		if err != nil {
-			return err
+			writeErrorCount.Add(1)
+			log.WithField("addr", p.addr).Errorf("could not get type of outgoing packet: %s", err)
+			continue
 		}
 		log.WithFields(log.Fields{
 			"addr": p.addr,
@@ -163,10 +489,13 @@ func (b *Backend) sendPackets() error {
 		}).Info("outgoing gateway packet")
 
 		if _, err = b.conn.WriteToUDP(p.data, p.addr); err != nil {
-			return err
+			writeErrorCount.Add(1)
+			log.WithFields(log.Fields{
+				"addr": p.addr,
+				"type": pt,
+			}).Errorf("could not send packet: %s", err)
 		}
 	}
-	return nil
 }
 
 func (b *Backend) handlePacket(addr *net.UDPAddr, data []byte) error {
@@ -195,6 +524,7 @@ func (b *Backend) handlePullData(addr *net.UDPAddr, data []byte) error {
 	if err := p.UnmarshalBinary(data); err != nil {
 		return err
 	}
+	b.gatewaySeen(p.GatewayMAC)
 	ack := PullACKPacket{
 		RandomToken: p.RandomToken,
 	}
@@ -202,11 +532,10 @@ func (b *Backend) handlePullData(addr *net.UDPAddr, data []byte) error {
 	if err != nil {
 		return err
 	}
-	b.sendChan <- udpPacket{
+	return b.sendACK(udpPacket{
 		addr: addr,
 		data: bytes,
-	}
-	return nil
+	})
 }
 
 func (b *Backend) handlePushData(addr *net.UDPAddr, data []byte) error {
@@ -214,6 +543,7 @@ func (b *Backend) handlePushData(addr *net.UDPAddr, data []byte) error {
 	if err := p.UnmarshalBinary(data); err != nil {
 		return err
 	}
+	b.gatewaySeen(p.GatewayMAC)
 
 	// ack the packet
 	ack := PushACKPacket{
@@ -223,9 +553,11 @@ func (b *Backend) handlePushData(addr *net.UDPAddr, data []byte) error {
 	if err != nil {
 		return err
 	}
-	b.sendChan <- udpPacket{
+	if err := b.sendACK(udpPacket{
 		addr: addr,
 		data: bytes,
+	}); err != nil {
+		return err
 	}
 
 	// store gateway stats
@@ -235,23 +567,61 @@ func (b *Backend) handlePushData(addr *net.UDPAddr, data []byte) error {
 		}
 	}
 
-	// collect rx packets
-	for _, rxpk := range p.Payload.RXPK {
-		if err := b.collectRXPacket(addr, p.GatewayMAC, &rxpk); err != nil {
-			return err
+	// collect rx packets, an invalid rxpk must not affect the others
+	for i := range p.Payload.RXPK {
+		if err := b.collectRXPacket(addr, p.GatewayMAC, &p.Payload.RXPK[i]); err != nil {
+			log.WithFields(log.Fields{
+				"addr": addr,
+				"mac":  p.GatewayMAC,
+				"data": p.Payload.RXPK[i].Data,
+			}).Errorf("could not handle rxpk: %s", err)
 		}
 	}
 
 	return nil
 }
 
+func (b *Backend) gatewaySeen(mac lorawan.EUI64) {
+	if b.seenHandler == nil {
+		return
+	}
+	if err := b.seenHandler(mac); err != nil {
+		log.WithField("mac", mac).Errorf("could not handle gateway seen: %s", err)
+	}
+}
+
 func (b *Backend) updateStat(addr *net.UDPAddr, mac lorawan.EUI64, stat *Stat) error {
 	log.WithFields(log.Fields{
 		"addr": addr,
 		"mac":  mac,
 	}).Info("storing gateway stats")
 	gw := newGatewayFromSemtech(addr, mac, stat)
-	return b.client.Gateway().Upsert(gw)
+
+	// keep the config set for the gateway (e.g. the TX power settings)
+	current, err := b.client.Gateway().Get(mac)
+	if err != nil && err != loracontrol.ErrObjectDoesNotExist {
+		return err
+	}
+	for k, v := range current.Config.String {
+		if _, ok := gw.Config.String[k]; !ok {
+			gw.Config.String[k] = v
+		}
+	}
+	// the gateway object read above is stale when the config has been
+	// updated in the meantime
+	if b.configStorage != nil {
+		if err := b.configStorage.Merge(&gw); err != nil {
+			return err
+		}
+	}
+
+	if err := b.client.Gateway().Upsert(gw); err != nil {
+		return err
+	}
+	if b.statsHandler != nil {
+		return b.statsHandler(gw)
+	}
+	return nil
 }
 
 func (b *Backend) collectRXPacket(addr *net.UDPAddr, mac lorawan.EUI64, rxpk *RXPK) error {
@@ -262,19 +632,79 @@ func (b *Backend) collectRXPacket(addr *net.UDPAddr, mac lorawan.EUI64, rxpk *RX
 	}
 	log.WithFields(logFields).Info("handling received node data")
 
+	// check CRC
+	switch rxpk.Stat {
+	case 1:
+	case 0:
+		noCRCCount.Add(mac.String(), 1)
+		if !b.acceptNoCRC {
+			log.WithFields(logFields).Warning("packet without CRC")
+			return errors.New("no CRC")
+		}
+	default:
+		crcErrorCount.Add(mac.String(), 1)
+		log.WithFields(logFields).Warningf("invalid packet CRC: %d", rxpk.Stat)
+		return errors.New("invalid CRC")
+	}
+
+	// the packet is still forwarded as the gateway is not configured by the
+	// network server
+	if err := b.checkChannelPlan(mac, rxpk); err != nil {
+		log.WithFields(logFields).Errorf("could not check channel plan: %s", err)
+	}
+
 	// decode packet
 	rxPacket, err := newRXPacketFromSemtech(mac, rxpk)
 	if err != nil {
 		return err
 	}
 
-	// check CRC
-	if rxPacket.RXInfo.CRCStatus != 1 {
-		log.WithFields(logFields).Warningf("invalid packet CRC: %d", rxPacket.RXInfo.CRCStatus)
-		return errors.New("invalid CRC")
+	select {
+	case b.rxChan <- *rxPacket:
+	case <-b.closing:
+		// give the consumer some time to receive the in-flight packets
+		select {
+		case b.rxChan <- *rxPacket:
+		case <-time.After(drainTimeout):
+			return ErrBackendClosed
+		}
 	}
+	return nil
+}
 
-	b.rxChan <- *rxPacket
+// checkChannelPlan reports the packets received on a frequency which is not
+// part of the profile (channel plan) of the gateway. The channel plan is
+// cached for channelPlanTTL.
+func (b *Backend) checkChannelPlan(mac lorawan.EUI64, rxpk *RXPK) error {
+	if b.client == nil {
+		return nil
+	}
+	now := time.Now()
+	p, ok := b.channelPlans.get(mac, now)
+	if !ok {
+		gw, err := b.client.Gateway().Get(mac)
+		if err != nil && err != loracontrol.ErrObjectDoesNotExist {
+			return err
+		}
+		if err == nil {
+			if p, err = profile.Get(gw); err != nil {
+				// don't parse the invalid plan again for every packet
+				b.channelPlans.set(mac, nil, now)
+				return err
+			}
+		}
+		b.channelPlans.set(mac, p, now)
+	}
+	if p == nil {
+		return nil
+	}
+	if !p.HasFrequency(rxpk.Freq) {
+		channelPlanMismatchCount.Add(mac.String(), 1)
+		log.WithFields(log.Fields{
+			"mac":       mac,
+			"frequency": rxpk.Freq,
+		}).Warning("received packet on a frequency which is not in the channel plan of the gateway")
+	}
 	return nil
 }
 
@@ -309,11 +739,38 @@ func newRXPacketFromSemtech(mac lorawan.EUI64, rxpk *RXPK) (*loracontrol.RXPacke
 		return nil, fmt.Errorf("semtech: could not unmarshal PHYPayload: %s", err)
 	}
 
+	// use the GPS time when the gateway did not report the UTC time
+	rxTime := time.Time(rxpk.Time)
+	if rxTime.IsZero() && rxpk.Tmms != nil {
+		rxTime = gps.Time(time.Duration(*rxpk.Tmms) * time.Millisecond).Time()
+	}
+
+	// multi-antenna gateways report the signal information per antenna,
+	// the best antenna is used. loracontrol.RXInfo has no fields for the
+	// other antennas, the frequency offset (foff) and the encrypted fine
+	// timestamp (etime), these are dropped.
+	rssi := int(rxpk.RSSI)
+	lsnr := rxpk.LSNR
+	fTime := rxpk.FTime
+	if rsig := bestRSig(rxpk.RSig); rsig != nil {
+		rssi = int(rsig.RSSIC)
+		lsnr = rsig.LSNR
+		if rsig.FTime != nil {
+			fTime = rsig.FTime
+		}
+	}
+
+	// the fine timestamp gives the nanosecond precision of the time (used
+	// for TDOA geolocation)
+	if fTime != nil && !rxTime.IsZero() {
+		rxTime = setFineTimestamp(rxTime, *fTime)
+	}
+
 	rxPacket := &loracontrol.RXPacket{
 		PHYPayload: phy,
 		RXInfo: loracontrol.RXInfo{
 			MAC:        mac,
-			Time:       time.Time(rxpk.Time),
+			Time:       rxTime,
 			Timestamp:  rxpk.Tmst,
 			Frequency:  rxpk.Freq,
 			Channel:    uint(rxpk.Chan),
@@ -325,14 +782,42 @@ func newRXPacketFromSemtech(mac lorawan.EUI64, rxpk *RXPK) (*loracontrol.RXPacke
 				FSK:  uint(rxpk.DatR.FSK),
 			},
 			CodingRate: rxpk.CodR,
-			RSSI:       int(rxpk.RSSI),
-			LoRaSNR:    rxpk.LSNR,
+			RSSI:       rssi,
+			LoRaSNR:    lsnr,
 			Size:       uint(rxpk.Size),
 		},
 	}
 	return rxPacket, nil
 }
 
+// bestRSig returns the signal information of the antenna with the best
+// SNR (or RSSI when equal). It returns nil when the slice is empty.
+func bestRSig(rsigs []RSig) *RSig {
+	var best *RSig
+	for i := range rsigs {
+		rsig := &rsigs[i]
+		if best == nil || rsig.LSNR > best.LSNR || (rsig.LSNR == best.LSNR && rsig.RSSIC > best.RSSIC) {
+			best = rsig
+		}
+	}
+	return best
+}
+
+// setFineTimestamp replaces the sub-second part of the given time by the
+// fine timestamp (nanoseconds since the last PPS). As the time and the fine
+// timestamp are not taken at exactly the same moment, the second closest to
+// the given time is used.
+func setFineTimestamp(t time.Time, fTime int64) time.Time {
+	fine := t.Truncate(time.Second).Add(time.Duration(fTime))
+	switch diff := fine.Sub(t); {
+	case diff > 500*time.Millisecond:
+		fine = fine.Add(-time.Second)
+	case diff < -500*time.Millisecond:
+		fine = fine.Add(time.Second)
+	}
+	return fine
+}
+
 func newTXPKFromTXPacket(txPacket loracontrol.TXPacket) (TXPK, error) {
 	b, err := txPacket.PHYPayload.MarshalBinary()
 	if err != nil {
@@ -344,7 +829,7 @@ func newTXPKFromTXPacket(txPacket loracontrol.TXPacket) (TXPK, error) {
 		Tmst: txPacket.TXInfo.Timestamp,
 		Freq: txPacket.TXInfo.Frequency,
 		RFCh: uint8(txPacket.TXInfo.RFChain),
-		Powe: uint8(txPacket.TXInfo.Power),
+		Powe: txPower(txPacket.TXInfo.Power),
 		Modu: txPacket.TXInfo.DataRate.Modulation(),
 		DatR: DatR{
 			LoRa: txPacket.TXInfo.DataRate.LoRa,
@@ -363,3 +848,26 @@ func newTXPKFromTXPacket(txPacket loracontrol.TXPacket) (TXPK, error) {
 
 	return txpk, nil
 }
+
+// txPower returns the given tx power (dBm) as TXPK power, which is
+// unsigned. Out of range powers are limited instead of wrapped around.
+func txPower(power int) uint8 {
+	if power < 0 {
+		return 0
+	}
+	if power > math.MaxUint8 {
+		return math.MaxUint8
+	}
+	return uint8(power)
+}
+
+// setTXPKTime sets the TXPK to be transmitted at the given time. Both the
+// UTC time and the GPS time are set as forwarders support either of them.
+func setTXPKTime(txpk *TXPK, t time.Time) {
+	ct := CompactTime(t)
+	tmms := int64(time.Duration(gps.NewFromTime(t)) / time.Millisecond)
+	txpk.Imme = false
+	txpk.Tmst = 0
+	txpk.Time = &ct
+	txpk.Tmms = &tmms
+}
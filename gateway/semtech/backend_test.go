@@ -3,6 +3,8 @@ package semtech
 import (
 	"encoding/base64"
 	"errors"
+	"expvar"
+	"fmt"
 	"net"
 	"os"
 	"testing"
@@ -10,6 +12,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/gateway/profile"
 	"github.com/brocaar/lorawan"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -39,6 +42,13 @@ func getConfig() *config {
 	return c
 }
 
+func getExpvarCount(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
 func TestBackend(t *testing.T) {
 	c := getConfig()
 
@@ -46,7 +56,11 @@ func TestBackend(t *testing.T) {
 		addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:8123")
 		So(err, ShouldBeNil)
 
-		backend, err := NewBackend(addr.Port)
+		statsChan := make(chan loracontrol.Gateway, 1)
+		backend, err := NewBackend(addr.Port, SetStatsHandler(func(gw loracontrol.Gateway) error {
+			statsChan <- gw
+			return nil
+		}))
 		So(err, ShouldBeNil)
 		defer backend.Close()
 
@@ -123,6 +137,13 @@ func TestBackend(t *testing.T) {
 					_, err := client.Gateway().Get(p.GatewayMAC)
 					So(err, ShouldBeNil)
 				})
+
+				Convey("Then the stats handler is called with the gateway stats", func() {
+					gw := <-statsChan
+					So(gw.MAC, ShouldEqual, p.GatewayMAC)
+					So(gw.UpstreamPacketsReceived, ShouldEqual, 1)
+					So(gw.DownstreamDatagramsReceived, ShouldEqual, 4)
+				})
 			})
 
 			Convey("When sending a PUSH_DATA packet with RXPK", func() {
@@ -174,6 +195,104 @@ func TestBackend(t *testing.T) {
 				})
 			})
 
+			Convey("When sending a PUSH_DATA packet with an invalid, a no CRC and a valid RXPK", func() {
+				crcErrors := getExpvarCount(crcErrorCount, "0102030405060708")
+				rxpk := RXPK{
+					Time: CompactTime(time.Now().UTC()),
+					Tmst: 708016819,
+					Freq: 868.5,
+					Chan: 2,
+					RFCh: 1,
+					Stat: 1,
+					Modu: "LORA",
+					DatR: DatR{LoRa: "SF7BW125"},
+					CodR: "4/5",
+					RSSI: -51,
+					LSNR: 7,
+					Size: 16,
+					Data: "QAEBAQGAAAABVfdjR6YrSw==",
+				}
+				invalidCRC := rxpk
+				invalidCRC.Stat = -1
+				noCRC := rxpk
+				noCRC.Stat = 0
+
+				p := PushDataPacket{
+					RandomToken: 1234,
+					GatewayMAC:  [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+					Payload: PushDataPayload{
+						RXPK: []RXPK{invalidCRC, noCRC, rxpk},
+					},
+				}
+				b, err := p.MarshalBinary()
+				So(err, ShouldBeNil)
+				_, err = conn.WriteToUDP(b, addr)
+				So(err, ShouldBeNil)
+
+				Convey("Then Receive() returns only the valid RXPK", func() {
+					rxPacket := <-backend.Receive()
+					So(rxPacket.RXInfo.CRCStatus, ShouldEqual, 1)
+
+					select {
+					case rxPacket := <-backend.Receive():
+						t.Errorf("unexpected packet received: %v", rxPacket)
+					case <-time.After(time.Millisecond * 100):
+					}
+				})
+
+				Convey("Then the CRC error is counted for the gateway", func() {
+					time.Sleep(time.Millisecond * 100)
+					So(getExpvarCount(crcErrorCount, "0102030405060708"), ShouldEqual, crcErrors+1)
+				})
+			})
+
+			Convey("Given a gateway with a channel plan", func() {
+				So(client.Gateway().Upsert(loracontrol.Gateway{
+					MAC: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+					Config: loracontrol.PropertyBag{
+						String: map[string]string{
+							profile.ConfigKey: `{"channels":[{"frequency":868.1},{"frequency":868.3}]}`,
+						},
+					},
+				}), ShouldBeNil)
+				mismatches := getExpvarCount(channelPlanMismatchCount, "0102030405060708")
+
+				Convey("When sending a PUSH_DATA packet with a RXPK on a frequency outside the channel plan", func() {
+					p := PushDataPacket{
+						RandomToken: 1234,
+						GatewayMAC:  [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+						Payload: PushDataPayload{
+							RXPK: []RXPK{
+								{
+									Time: CompactTime(time.Now().UTC()),
+									Tmst: 708016819,
+									Freq: 868.5,
+									Stat: 1,
+									Modu: "LORA",
+									DatR: DatR{LoRa: "SF7BW125"},
+									CodR: "4/5",
+									Size: 16,
+									Data: "QAEBAQGAAAABVfdjR6YrSw==",
+								},
+							},
+						},
+					}
+					b, err := p.MarshalBinary()
+					So(err, ShouldBeNil)
+					_, err = conn.WriteToUDP(b, addr)
+					So(err, ShouldBeNil)
+
+					Convey("Then the packet is still received", func() {
+						rxPacket := <-backend.Receive()
+						So(rxPacket.RXInfo.Frequency, ShouldEqual, 868.5)
+
+						Convey("Then the mismatch is counted for the gateway", func() {
+							So(getExpvarCount(channelPlanMismatchCount, "0102030405060708"), ShouldEqual, mismatches+1)
+						})
+					})
+				})
+			})
+
 			Convey("Given an TXPacket", func() {
 				var nwkSKey lorawan.AES128Key
 				macPL := lorawan.NewMACPayload(false)
@@ -210,6 +329,33 @@ func TestBackend(t *testing.T) {
 					})
 				})
 
+				Convey("Given a matching gateway with a max. tx power in the database", func() {
+					gw := loracontrol.Gateway{
+						MAC: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+						Config: loracontrol.PropertyBag{
+							String: map[string]string{
+								"udp_addr":     conn.LocalAddr().String(),
+								"tx_power_max": "10",
+								"antenna_gain": "2",
+							},
+						},
+					}
+					So(client.Gateway().Upsert(gw), ShouldBeNil)
+
+					Convey("When sending the packet to the gateway", func() {
+						So(client.Gateway().Send(txPacket), ShouldBeNil)
+
+						Convey("Then the tx power has been clamped", func() {
+							buf := make([]byte, 65507)
+							i, _, err := conn.ReadFromUDP(buf)
+							So(err, ShouldBeNil)
+							pullResp := PullRespPacket{}
+							So(pullResp.UnmarshalBinary(buf[:i]), ShouldBeNil)
+							So(pullResp.Payload.TXPK.Powe, ShouldEqual, 8)
+						})
+					})
+				})
+
 				Convey("Given a matching gateway in the database", func() {
 					gw := loracontrol.Gateway{
 						MAC: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
@@ -263,6 +409,127 @@ func TestBackend(t *testing.T) {
 	})
 }
 
+func TestBackendClose(t *testing.T) {
+	Convey("Given a Backend", t, func() {
+		backend, err := NewBackend(8124)
+		So(err, ShouldBeNil)
+
+		Convey("When closing the backend", func() {
+			So(backend.Close(), ShouldBeNil)
+
+			Convey("Then the Receive channel is closed", func() {
+				_, ok := <-backend.Receive()
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Then closing the backend again does not return an error", func() {
+				So(backend.Close(), ShouldBeNil)
+			})
+
+			Convey("Then sending returns an error", func() {
+				So(backend.sendUDP(udpPacket{}), ShouldEqual, ErrBackendClosed)
+			})
+		})
+	})
+}
+
+func TestSendPackets(t *testing.T) {
+	Convey("Given a Backend and a UDP socket", t, func() {
+		backend, err := NewBackend(8125)
+		So(err, ShouldBeNil)
+		defer backend.Close()
+
+		gwAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		conn, err := net.ListenUDP("udp", gwAddr)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		So(conn.SetDeadline(time.Now().Add(time.Second*1)), ShouldBeNil)
+
+		Convey("When sending an invalid packet followed by a valid packet", func() {
+			addr := conn.LocalAddr().(*net.UDPAddr)
+			So(backend.sendUDP(udpPacket{data: []byte{1}, addr: addr}), ShouldBeNil)
+
+			ack := PullACKPacket{RandomToken: 1234}
+			b, err := ack.MarshalBinary()
+			So(err, ShouldBeNil)
+			So(backend.sendUDP(udpPacket{data: b, addr: addr}), ShouldBeNil)
+
+			Convey("Then the valid packet is received", func() {
+				buf := make([]byte, 65507)
+				i, _, err := conn.ReadFromUDP(buf)
+				So(err, ShouldBeNil)
+				So(buf[:i], ShouldResemble, b)
+			})
+
+			Convey("Then the backend is still healthy", func() {
+				So(backend.Err(), ShouldBeNil)
+				So(backend.Errors(), ShouldHaveLength, 0)
+			})
+		})
+	})
+}
+
+func TestEnqueue(t *testing.T) {
+	Convey("Given a Backend with a queue size of 1 which drops packets when full", t, func() {
+		b := &Backend{
+			handleChan:   make(chan udpPacket, 1),
+			dropWhenFull: true,
+		}
+		dropped := droppedCount.Value()
+
+		Convey("When enqueueing two packets", func() {
+			b.enqueue(udpPacket{data: []byte{1}})
+			b.enqueue(udpPacket{data: []byte{2}})
+
+			Convey("Then only the first packet is queued", func() {
+				So(b.handleChan, ShouldHaveLength, 1)
+				p := <-b.handleChan
+				So(p.data, ShouldResemble, []byte{1})
+			})
+
+			Convey("Then the dropped packet is counted", func() {
+				So(droppedCount.Value(), ShouldEqual, dropped+1)
+			})
+		})
+	})
+}
+
+func TestCollectRXPacket(t *testing.T) {
+	Convey("Given a RXPK without CRC", t, func() {
+		rxpk := RXPK{
+			Time: CompactTime(time.Now().UTC()),
+			Freq: 868.5,
+			Stat: 0,
+			Modu: "LORA",
+			DatR: DatR{LoRa: "SF7BW125"},
+			CodR: "4/5",
+			Size: 16,
+			Data: "QAEBAQGAAAABVfdjR6YrSw==",
+		}
+		mac := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+		Convey("Given a Backend which does not accept packets without CRC", func() {
+			b := &Backend{rxChan: make(chan loracontrol.RXPacket, 1)}
+
+			Convey("Then collectRXPacket returns an error", func() {
+				So(b.collectRXPacket(&net.UDPAddr{}, mac, &rxpk), ShouldResemble, errors.New("no CRC"))
+				So(b.rxChan, ShouldHaveLength, 0)
+			})
+		})
+
+		Convey("Given a Backend which accepts packets without CRC", func() {
+			b := &Backend{rxChan: make(chan loracontrol.RXPacket, 1), acceptNoCRC: true}
+
+			Convey("Then collectRXPacket forwards the packet", func() {
+				So(b.collectRXPacket(&net.UDPAddr{}, mac, &rxpk), ShouldBeNil)
+				rxPacket := <-b.rxChan
+				So(rxPacket.RXInfo.CRCStatus, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
 func TestNewGatewayFromSemtech(t *testing.T) {
 	now := time.Now().UTC()
 
@@ -351,6 +618,40 @@ func TestNewRXPacketFromSemtech(t *testing.T) {
 				})
 			})
 
+			Convey("Given the RXPK has no time but a GPS time", func() {
+				tmms := int64(1150662418000) // 2016-06-22 20:26:40 UTC
+				rxpk.Time = CompactTime{}
+				rxpk.Tmms = &tmms
+
+				Convey("Then the RXInfo time is set from the GPS time", func() {
+					rxPacket, err := newRXPacketFromSemtech(mac, rxpk)
+					So(err, ShouldBeNil)
+					So(rxPacket.RXInfo.Time.Equal(time.Date(2016, time.June, 22, 20, 26, 40, 0, time.UTC)), ShouldBeTrue)
+				})
+			})
+
+			Convey("Given the RXPK contains the signal information of two antennas", func() {
+				fTime := int64(123456789)
+				rxpk.Time = CompactTime(time.Date(2016, time.June, 22, 20, 26, 40, 123457000, time.UTC))
+				rxpk.RSig = []RSig{
+					{Ant: 0, Chan: 2, RSSIC: -80, LSNR: 2},
+					{Ant: 1, Chan: 2, RSSIC: -70, LSNR: 5.5, FTime: &fTime},
+				}
+
+				Convey("Then the RSSI and SNR of the best antenna are used", func() {
+					rxPacket, err := newRXPacketFromSemtech(mac, rxpk)
+					So(err, ShouldBeNil)
+					So(rxPacket.RXInfo.RSSI, ShouldEqual, -70)
+					So(rxPacket.RXInfo.LoRaSNR, ShouldEqual, 5.5)
+				})
+
+				Convey("Then the fine timestamp is merged into the time", func() {
+					rxPacket, err := newRXPacketFromSemtech(mac, rxpk)
+					So(err, ShouldBeNil)
+					So(rxPacket.RXInfo.Time.Equal(time.Date(2016, time.June, 22, 20, 26, 40, 123456789, time.UTC)), ShouldBeTrue)
+				})
+			})
+
 			Convey("Then the PHYPayload contains the expected data", func() {
 				nwkSKey := [16]byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}
 				appSKey := [16]byte{3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3}
@@ -392,3 +693,127 @@ func TestNewRXPacketFromSemtech(t *testing.T) {
 		})
 	})
 }
+
+func TestSetTXPKTime(t *testing.T) {
+	Convey("Given a TXPK with a timestamp", t, func() {
+		txpk := TXPK{Tmst: 12345}
+
+		Convey("When setting the time to 2016-06-22 20:26:40 UTC", func() {
+			ts := time.Date(2016, time.June, 22, 20, 26, 40, 0, time.UTC)
+			setTXPKTime(&txpk, ts)
+
+			Convey("Then the timestamp is cleared and time and tmms are set", func() {
+				So(txpk.Imme, ShouldBeFalse)
+				So(txpk.Tmst, ShouldEqual, 0)
+				So(time.Time(*txpk.Time).Equal(ts), ShouldBeTrue)
+				So(*txpk.Tmms, ShouldEqual, int64(1150662418000))
+			})
+		})
+	})
+}
+
+func TestTXPower(t *testing.T) {
+	Convey("Given a set of tx powers", t, func() {
+		testTable := []struct {
+			Power   int
+			ExpPowe uint8
+		}{
+			{14, 14},
+			{0, 0},
+			{-3, 0},
+			{300, 255},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Then power %d is sent as %d [%d]", test.Power, test.ExpPowe, i), func() {
+				So(txPower(test.Power), ShouldEqual, test.ExpPowe)
+			})
+		}
+	})
+}
+
+func TestBestRSig(t *testing.T) {
+	Convey("Given a set of antenna signals", t, func() {
+		rsigs := []RSig{
+			{Ant: 0, RSSIC: -80, LSNR: 5},
+			{Ant: 1, RSSIC: -70, LSNR: 5},
+			{Ant: 2, RSSIC: -60, LSNR: 3},
+		}
+
+		Convey("Then the antenna with the best SNR and RSSI is returned", func() {
+			So(bestRSig(rsigs).Ant, ShouldEqual, 1)
+		})
+
+		Convey("Then nil is returned for an empty set", func() {
+			So(bestRSig(nil), ShouldBeNil)
+		})
+	})
+}
+
+func TestSetFineTimestamp(t *testing.T) {
+	Convey("Given a set of times and fine timestamps", t, func() {
+		testTable := []struct {
+			Time     time.Time
+			FTime    int64
+			Expected time.Time
+		}{
+			{
+				time.Date(2016, time.June, 22, 20, 26, 40, 500000000, time.UTC),
+				500000123,
+				time.Date(2016, time.June, 22, 20, 26, 40, 500000123, time.UTC),
+			},
+			// the time is just after the PPS, the fine timestamp just before
+			{
+				time.Date(2016, time.June, 22, 20, 26, 40, 1000, time.UTC),
+				999999000,
+				time.Date(2016, time.June, 22, 20, 26, 39, 999999000, time.UTC),
+			},
+			// the time is just before the PPS, the fine timestamp just after
+			{
+				time.Date(2016, time.June, 22, 20, 26, 40, 999999000, time.UTC),
+				1000,
+				time.Date(2016, time.June, 22, 20, 26, 41, 1000, time.UTC),
+			},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Then %s with fine timestamp %d results in %s [%d]", test.Time, test.FTime, test.Expected, i), func() {
+				So(setFineTimestamp(test.Time, test.FTime).Equal(test.Expected), ShouldBeTrue)
+			})
+		}
+	})
+}
+
+func TestChannelPlanCache(t *testing.T) {
+	Convey("Given an empty channelPlanCache", t, func() {
+		var c channelPlanCache
+		mac := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+		now := time.Now()
+
+		Convey("Then the channel plan is not cached", func() {
+			_, ok := c.get(mac, now)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("When caching a channel plan", func() {
+			p := &profile.Profile{}
+			c.set(mac, p, now)
+
+			Convey("Then it is returned within the TTL", func() {
+				cached, ok := c.get(mac, now.Add(channelPlanTTL))
+				So(ok, ShouldBeTrue)
+				So(cached, ShouldEqual, p)
+			})
+
+			Convey("Then it is not returned after the TTL", func() {
+				_, ok := c.get(mac, now.Add(channelPlanTTL+time.Second))
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Then it is removed when caching an other plan after the TTL", func() {
+				c.set(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, nil, now.Add(channelPlanTTL+time.Second))
+				So(c.plans, ShouldHaveLength, 1)
+			})
+		})
+	})
+}
@@ -286,19 +286,37 @@ func (d *DatR) UnmarshalJSON(data []byte) error {
 
 // RXPK contain a RF packet and associated metadata.
 type RXPK struct {
-	Time CompactTime `json:"time"` // UTC time of pkt RX, us precision, ISO 8601 'compact' format (e.g. 2013-03-31T16:21:17.528002Z)
-	Tmst uint32      `json:"tmst"` // Internal timestamp of "RX finished" event (32b unsigned)
-	Freq float64     `json:"freq"` // RX central frequency in MHz (unsigned float, Hz precision)
-	Chan uint8       `json:"chan"` // Concentrator "IF" channel used for RX (unsigned integer)
-	RFCh uint8       `json:"rfch"` // Concentrator "RF chain" used for RX (unsigned integer)
-	Stat int8        `json:"stat"` // CRC status: 1 = OK, -1 = fail, 0 = no CRC
-	Modu string      `json:"modu"` // Modulation identifier "LORA" or "FSK"
-	DatR DatR        `json:"datr"` // LoRa datarate identifier (eg. SF12BW500) || FSK datarate (unsigned, in bits per second)
-	CodR string      `json:"codr"` // LoRa ECC coding rate identifier
-	RSSI int16       `json:"rssi"` // RSSI in dBm (signed integer, 1 dB precision)
-	LSNR float64     `json:"lsnr"` // Lora SNR ratio in dB (signed float, 0.1 dB precision)
-	Size uint16      `json:"size"` // RF packet payload size in bytes (unsigned integer)
-	Data string      `json:"data"` // Base64 encoded RF packet payload, padded
+	Time  CompactTime `json:"time"`            // UTC time of pkt RX, us precision, ISO 8601 'compact' format (e.g. 2013-03-31T16:21:17.528002Z)
+	Tmms  *int64      `json:"tmms,omitempty"`  // GPS time of pkt RX, number of milliseconds since 06.Jan.1980 (only when GPS synchronized)
+	Tmst  uint32      `json:"tmst"`            // Internal timestamp of "RX finished" event (32b unsigned)
+	Freq  float64     `json:"freq"`            // RX central frequency in MHz (unsigned float, Hz precision)
+	Chan  uint8       `json:"chan"`            // Concentrator "IF" channel used for RX (unsigned integer)
+	RFCh  uint8       `json:"rfch"`            // Concentrator "RF chain" used for RX (unsigned integer)
+	Stat  int8        `json:"stat"`            // CRC status: 1 = OK, -1 = fail, 0 = no CRC
+	Modu  string      `json:"modu"`            // Modulation identifier "LORA" or "FSK"
+	DatR  DatR        `json:"datr"`            // LoRa datarate identifier (eg. SF12BW500) || FSK datarate (unsigned, in bits per second)
+	CodR  string      `json:"codr"`            // LoRa ECC coding rate identifier
+	RSSI  int16       `json:"rssi"`            // RSSI in dBm (signed integer, 1 dB precision)
+	LSNR  float64     `json:"lsnr"`            // Lora SNR ratio in dB (signed float, 0.1 dB precision)
+	Size  uint16      `json:"size"`            // RF packet payload size in bytes (unsigned integer)
+	Data  string      `json:"data"`            // Base64 encoded RF packet payload, padded
+	RSSIS *int16      `json:"rssis,omitempty"` // Signal RSSI in dBm (signed integer, 1 dB precision)
+	FOff  *int32      `json:"foff,omitempty"`  // LoRa frequency offset in Hz (signed integer)
+	FTime *int64      `json:"ftime,omitempty"` // Fine timestamp, number of nanoseconds since the last PPS (only when GPS synchronized)
+	RSig  []RSig      `json:"rsig,omitempty"`  // Signal information per antenna (multi-antenna gateways)
+}
+
+// RSig contains the signal information of a received packet per antenna.
+type RSig struct {
+	Ant    uint8   `json:"ant"`              // Antenna number on which the signal has been received
+	Chan   uint8   `json:"chan"`             // Concentrator "IF" channel used for RX (unsigned integer)
+	RSSIC  int16   `json:"rssic"`            // RSSI in dBm of the channel (signed integer, 1 dB precision)
+	RSSIS  *int16  `json:"rssis,omitempty"`  // RSSI in dBm of the signal (signed integer, 1 dB precision)
+	RSSISD *uint16 `json:"rssisd,omitempty"` // Standard deviation of RSSI during preamble (unsigned integer)
+	LSNR   float64 `json:"lsnr"`             // Lora SNR ratio in dB (signed float, 0.1 dB precision)
+	ETime  string  `json:"etime,omitempty"`  // Encrypted fine timestamp, ns precision [0..999999999] (base64)
+	FTime  *int64  `json:"ftime,omitempty"`  // Fine timestamp, number of nanoseconds since the last PPS (unencrypted)
+	FOff   *int32  `json:"foff,omitempty"`   // Frequency offset in Hz (signed integer)
 }
 
 // Stat contains the status of the gateway.
@@ -319,6 +337,7 @@ type TXPK struct {
 	Imme bool         `json:"imme"`           // Send packet immediately (will ignore tmst & time)
 	Tmst uint32       `json:"tmst,omitempty"` // Send packet on a certain timestamp value (will ignore time)
 	Time *CompactTime `json:"time,omitempty"` // Send packet at a certain time (GPS synchronization required)
+	Tmms *int64       `json:"tmms,omitempty"` // Send packet at a certain GPS time, number of milliseconds since 06.Jan.1980 (GPS synchronization required)
 	Freq float64      `json:"freq"`           // TX central frequency in MHz (unsigned float, Hz precision)
 	RFCh uint8        `json:"rfch"`           // Concentrator "RF chain" used for TX (unsigned integer)
 	Powe uint8        `json:"powe"`           // TX output power in dBm (unsigned integer, dBm precision)
@@ -1,6 +1,7 @@
 package semtech
 
 import (
+	"encoding/json"
 	"errors"
 	"testing"
 	"time"
@@ -277,3 +278,22 @@ func TestPullRespPacket(t *testing.T) {
 		})
 	})
 }
+
+func TestRXPK(t *testing.T) {
+	Convey("Given a RXPK JSON with extended fields", t, func() {
+		data := `{"tmst":3512348514,"tmms":1150662418000,"chan":2,"rfch":0,"freq":868.5,"stat":1,"modu":"LORA","datr":"SF7BW125","codr":"4/5","size":16,"data":"QAEBAQGAAAABVfdjR6YrSw==","foff":-123,"rsig":[{"ant":0,"chan":2,"rssic":-73,"lsnr":5.5,"etime":"YWJj","foff":-125,"ftime":12345}]}`
+
+		Convey("Then all fields are unmarshaled", func() {
+			var rxpk RXPK
+			So(json.Unmarshal([]byte(data), &rxpk), ShouldBeNil)
+			So(*rxpk.Tmms, ShouldEqual, 1150662418000)
+			So(*rxpk.FOff, ShouldEqual, -123)
+			So(rxpk.RSig, ShouldHaveLength, 1)
+			So(rxpk.RSig[0].RSSIC, ShouldEqual, -73)
+			So(rxpk.RSig[0].LSNR, ShouldEqual, 5.5)
+			So(rxpk.RSig[0].ETime, ShouldEqual, "YWJj")
+			So(*rxpk.RSig[0].FOff, ShouldEqual, -125)
+			So(*rxpk.RSig[0].FTime, ShouldEqual, 12345)
+		})
+	})
+}
@@ -0,0 +1,98 @@
+// Package txconfig implements the transmission settings of a gateway, stored
+// in the gateway config (loracontrol.Gateway Config.String). The settings
+// are applied to every downlink, independent of the gateway backend.
+package txconfig
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+)
+
+// Gateway config keys holding the transmission settings of the gateway.
+const (
+	TXPowerMaxConfigKey  = "tx_power_max" // max. EIRP in dBm (regulatory limit)
+	AntennaGainConfigKey = "antenna_gain" // antenna gain in dBi
+	TXPreambleConfigKey  = "tx_preamble"  // preamble length in symbols
+)
+
+// Keys contains all the config keys holding the transmission settings.
+var Keys = []string{TXPowerMaxConfigKey, AntennaGainConfigKey, TXPreambleConfigKey}
+
+// Config contains the transmission settings of a gateway.
+type Config struct {
+	MaxPower    *int   // max. EIRP in dBm (nil when not set)
+	AntennaGain int    // antenna gain in dBi
+	Preamble    uint16 // preamble length in symbols (0 = default)
+}
+
+// Get returns the transmission settings of the given gateway.
+func Get(gw loracontrol.Gateway) (Config, error) {
+	return Parse(gw.Config.String)
+}
+
+// Parse parses the transmission settings of the given gateway config. It
+// returns an error when one of the settings is invalid, which makes it
+// usable to validate the config before storing it.
+func Parse(config map[string]string) (Config, error) {
+	var conf Config
+
+	if v, ok := config[TXPowerMaxConfigKey]; ok {
+		maxPower, err := strconv.Atoi(v)
+		if err != nil {
+			return conf, fmt.Errorf("gateway/txconfig: invalid %s config: %s", TXPowerMaxConfigKey, err)
+		}
+		conf.MaxPower = &maxPower
+	}
+
+	if v, ok := config[AntennaGainConfigKey]; ok {
+		gain, err := strconv.Atoi(v)
+		if err != nil {
+			return conf, fmt.Errorf("gateway/txconfig: invalid %s config: %s", AntennaGainConfigKey, err)
+		}
+		conf.AntennaGain = gain
+	}
+
+	if v, ok := config[TXPreambleConfigKey]; ok {
+		preamble, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return conf, fmt.Errorf("gateway/txconfig: invalid %s config: %s", TXPreambleConfigKey, err)
+		}
+		conf.Preamble = uint16(preamble)
+	}
+
+	return conf, nil
+}
+
+// Power returns the power at the concentrator output for the given power
+// (EIRP). The power is capped to the max. power of the gateway and the
+// antenna gain is subtracted.
+func (c Config) Power(power int) int {
+	if c.MaxPower != nil && power > *c.MaxPower {
+		log.WithFields(log.Fields{
+			"power":     power,
+			"max_power": *c.MaxPower,
+		}).Warning("gateway/txconfig: tx power exceeds the max. power of the gateway")
+		power = *c.MaxPower
+	}
+	power -= c.AntennaGain
+	if power < 0 {
+		power = 0
+	}
+	return power
+}
+
+// Clamp limits the given power at the concentrator output (as returned by
+// Power) to the range allowed for the gateway: 0 up to the max. power of
+// the gateway minus the antenna gain.
+func (c Config) Clamp(power int) int {
+	if c.MaxPower != nil && power > *c.MaxPower-c.AntennaGain {
+		power = *c.MaxPower - c.AntennaGain
+	}
+	if power < 0 {
+		power = 0
+	}
+	return power
+}
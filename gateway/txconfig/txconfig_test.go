@@ -0,0 +1,72 @@
+package txconfig
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/brocaar/loracontrol"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfig(t *testing.T) {
+	Convey("Given a set of gateway configs", t, func() {
+		testTable := []struct {
+			Config   map[string]string
+			Power    int
+			ExpPower int
+			Preamble uint16
+			ExpError bool
+		}{
+			{nil, 14, 14, 0, false},
+			{map[string]string{"tx_power_max": "14"}, 20, 14, 0, false},
+			{map[string]string{"tx_power_max": "14", "antenna_gain": "3"}, 20, 11, 0, false},
+			{map[string]string{"antenna_gain": "6"}, 14, 8, 0, false},
+			{map[string]string{"antenna_gain": "6"}, 2, 0, 0, false},
+			{map[string]string{"tx_preamble": "12"}, 14, 14, 12, false},
+			{map[string]string{"tx_power_max": "abc"}, 14, 0, 0, true},
+			{map[string]string{"antenna_gain": "abc"}, 14, 0, 0, true},
+			{map[string]string{"tx_preamble": "-1"}, 14, 0, 0, true},
+			{map[string]string{"tx_preamble": "70000"}, 14, 0, 0, true},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Then config %v with power %d results in power %d and preamble %d [%d]", test.Config, test.Power, test.ExpPower, test.Preamble, i), func() {
+				conf, err := Get(loracontrol.Gateway{
+					Config: loracontrol.PropertyBag{String: test.Config},
+				})
+				if test.ExpError {
+					So(err, ShouldNotBeNil)
+					return
+				}
+				So(err, ShouldBeNil)
+				So(conf.Power(test.Power), ShouldEqual, test.ExpPower)
+				So(conf.Preamble, ShouldEqual, test.Preamble)
+			})
+		}
+	})
+}
+
+func TestClamp(t *testing.T) {
+	Convey("Given a set of gateway configs", t, func() {
+		testTable := []struct {
+			Config   map[string]string
+			Power    int
+			ExpPower int
+		}{
+			{nil, 14, 14},
+			{nil, -3, 0},
+			{map[string]string{"tx_power_max": "14"}, 20, 14},
+			{map[string]string{"tx_power_max": "14", "antenna_gain": "3"}, 14, 11},
+			{map[string]string{"tx_power_max": "14", "antenna_gain": "3"}, 8, 8},
+			{map[string]string{"tx_power_max": "2", "antenna_gain": "3"}, 8, 0},
+		}
+
+		for i, test := range testTable {
+			Convey(fmt.Sprintf("Then config %v clamps power %d to %d [%d]", test.Config, test.Power, test.ExpPower, i), func() {
+				conf, err := Parse(test.Config)
+				So(err, ShouldBeNil)
+				So(conf.Clamp(test.Power), ShouldEqual, test.ExpPower)
+			})
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package loraserver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	"github.com/garyburd/redigo/redis"
+)
+
+// GatewayStatsInterval defines the interval in which the gateway stats
+// are aggregated.
+type GatewayStatsInterval string
+
+// Available gateway stats intervals.
+const (
+	GatewayStatsMinute GatewayStatsInterval = "minute"
+	GatewayStatsHour   GatewayStatsInterval = "hour"
+	GatewayStatsDay    GatewayStatsInterval = "day"
+)
+
+// maxGatewayStatsClockSkew defines how far the time of the gateway stats
+// (set by the gateway clock) may differ from the server time. Stats with a
+// time outside this window are aggregated by the time they are saved.
+const maxGatewayStatsClockSkew = time.Minute
+
+// maxGatewayStatsBuckets defines the max number of aggregation buckets
+// that can be requested at once.
+const maxGatewayStatsBuckets = 1000
+
+// Errors
+var (
+	ErrInvalidGatewayStatsInterval = errors.New("invalid gateway stats interval")
+	ErrInvalidGatewayStatsRange    = errors.New("invalid gateway stats time range")
+)
+
+var gatewayStatsIntervals = map[GatewayStatsInterval]struct {
+	duration time.Duration
+	ttl      time.Duration
+}{
+	GatewayStatsMinute: {time.Minute, time.Hour * 24 * 2},
+	GatewayStatsHour:   {time.Hour, time.Hour * 24 * 62},
+	GatewayStatsDay:    {time.Hour * 24, time.Hour * 24 * 731},
+}
+
+// GatewayStats contains the aggregated stats of a gateway for a
+// single interval.
+type GatewayStats struct {
+	Timestamp                   time.Time `json:"timestamp"`
+	UpstreamPacketsReceived     uint      `json:"upstreamPacketsReceived"`
+	UpstreamPacketsReceivedOK   uint      `json:"upstreamPacketsReceivedOK"`
+	UpstreamPacketsForwarded    uint      `json:"upstreamPacketsForwarded"`
+	UpstreamDatagramsACKRate    float64   `json:"upstreamDatagramsACKRate"` // average over the interval
+	DownstreamDatagramsReceived uint      `json:"downstreamDatagramsReceived"`
+	StatsCount                  uint      `json:"statsCount"` // number of stats messages received within the interval
+}
+
+// GatewayStatsStorage stores the gateway stats aggregated by minute,
+// hour and day in Redis.
+type GatewayStatsStorage struct {
+	pool *redis.Pool
+}
+
+// NewGatewayStatsStorage creates a new GatewayStatsStorage.
+func NewGatewayStatsStorage(p *redis.Pool) *GatewayStatsStorage {
+	return &GatewayStatsStorage{pool: p}
+}
+
+// Save adds the stats of the given gateway to the aggregation buckets
+// containing gw.UpdatedAt. The current time is used instead when
+// gw.UpdatedAt is not set or when the gateway clock is off (see
+// maxGatewayStatsClockSkew). The counters of the gateway are expected to
+// contain the values for a single stats period (as reported by the gateway).
+func (s *GatewayStatsStorage) Save(gw loracontrol.Gateway) error {
+	return s.save(gw, time.Now())
+}
+
+func (s *GatewayStatsStorage) save(gw loracontrol.Gateway, now time.Time) error {
+	ts := gw.UpdatedAt
+	if ts.IsZero() || ts.Before(now.Add(-maxGatewayStatsClockSkew)) || ts.After(now.Add(maxGatewayStatsClockSkew)) {
+		ts = now
+	}
+
+	c := s.pool.Get()
+	defer c.Close()
+
+	if err := c.Send("MULTI"); err != nil {
+		return err
+	}
+	for interval, conf := range gatewayStatsIntervals {
+		key := gatewayStatsKey(gw.MAC, interval, ts.Truncate(conf.duration))
+		c.Send("HINCRBY", key, "rx_nb", gw.UpstreamPacketsReceived)
+		c.Send("HINCRBY", key, "rx_ok", gw.UpstreamPacketsReceivedOK)
+		c.Send("HINCRBY", key, "rx_fw", gw.UpstreamPacketsForwarded)
+		c.Send("HINCRBYFLOAT", key, "ackr_sum", gw.UpstreamDatagramsACKRate)
+		c.Send("HINCRBY", key, "dwn_nb", gw.DownstreamDatagramsReceived)
+		c.Send("HINCRBY", key, "count", 1)
+		c.Send("PEXPIRE", key, int64(conf.ttl/time.Millisecond))
+	}
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// Get returns the aggregated stats of the given gateway for every interval
+// between start and end. Intervals without stats are returned with zero
+// values.
+func (s *GatewayStatsStorage) Get(mac lorawan.EUI64, interval GatewayStatsInterval, start, end time.Time) ([]GatewayStats, error) {
+	conf, ok := gatewayStatsIntervals[interval]
+	if !ok {
+		return nil, ErrInvalidGatewayStatsInterval
+	}
+	start = start.Truncate(conf.duration)
+	if end.Before(start) || end.Sub(start)/conf.duration >= maxGatewayStatsBuckets {
+		return nil, ErrInvalidGatewayStatsRange
+	}
+
+	var stats []GatewayStats
+	for ts := start; !ts.After(end); ts = ts.Add(conf.duration) {
+		stats = append(stats, GatewayStats{Timestamp: ts.UTC()})
+	}
+
+	c := s.pool.Get()
+	defer c.Close()
+
+	for _, st := range stats {
+		if err := c.Send("HGETALL", gatewayStatsKey(mac, interval, st.Timestamp)); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+
+	for i := range stats {
+		values, err := redis.StringMap(c.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if err := stats[i].setValues(values); err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+func (s *GatewayStats) setValues(values map[string]string) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	counters := map[string]*uint{
+		"rx_nb":  &s.UpstreamPacketsReceived,
+		"rx_ok":  &s.UpstreamPacketsReceivedOK,
+		"rx_fw":  &s.UpstreamPacketsForwarded,
+		"dwn_nb": &s.DownstreamDatagramsReceived,
+		"count":  &s.StatsCount,
+	}
+	for field, v := range counters {
+		i, err := strconv.ParseUint(values[field], 10, 64)
+		if err != nil {
+			return fmt.Errorf("could not parse gateway stats field %s: %s", field, err)
+		}
+		*v = uint(i)
+	}
+
+	ackrSum, err := strconv.ParseFloat(values["ackr_sum"], 64)
+	if err != nil {
+		return fmt.Errorf("could not parse gateway stats field ackr_sum: %s", err)
+	}
+	if s.StatsCount > 0 {
+		s.UpstreamDatagramsACKRate = ackrSum / float64(s.StatsCount)
+	}
+	return nil
+}
+
+func gatewayStatsKey(mac lorawan.EUI64, interval GatewayStatsInterval, ts time.Time) string {
+	return fmt.Sprintf("gw_stats_%s_%s_%d", mac, interval, ts.Unix())
+}
@@ -0,0 +1,111 @@
+package loraserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGatewayStatsStorage(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a GatewayStatsStorage connected to a clean Redis database", t, func() {
+		p := NewRedisPool(conf.RedisServer, conf.RedisPassword)
+		c := p.Get()
+		_, err := c.Do("FLUSHALL")
+		So(err, ShouldBeNil)
+		c.Close()
+
+		s := NewGatewayStatsStorage(p)
+		mac := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+		hour := time.Date(2016, 3, 1, 10, 0, 0, 0, time.UTC)
+
+		Convey("When saving two stats messages within the same hour", func() {
+			for i, ts := range []time.Time{hour.Add(time.Minute), hour.Add(time.Minute * 2)} {
+				So(s.save(loracontrol.Gateway{
+					UpdatedAt:                   ts,
+					MAC:                         mac,
+					UpstreamPacketsReceived:     10,
+					UpstreamPacketsReceivedOK:   8,
+					UpstreamPacketsForwarded:    7,
+					UpstreamDatagramsACKRate:    float64(100 - i*50),
+					DownstreamDatagramsReceived: 2,
+				}, ts.Add(time.Second)), ShouldBeNil)
+			}
+
+			Convey("Then the hour stats contain the sum of both messages", func() {
+				stats, err := s.Get(mac, GatewayStatsHour, hour, hour.Add(time.Hour))
+				So(err, ShouldBeNil)
+				So(stats, ShouldResemble, []GatewayStats{
+					{
+						Timestamp:                   hour,
+						UpstreamPacketsReceived:     20,
+						UpstreamPacketsReceivedOK:   16,
+						UpstreamPacketsForwarded:    14,
+						UpstreamDatagramsACKRate:    75,
+						DownstreamDatagramsReceived: 4,
+						StatsCount:                  2,
+					},
+					{
+						Timestamp: hour.Add(time.Hour),
+					},
+				})
+			})
+
+			Convey("Then the minute stats contain each message separately", func() {
+				stats, err := s.Get(mac, GatewayStatsMinute, hour.Add(time.Minute), hour.Add(time.Minute*2))
+				So(err, ShouldBeNil)
+				So(stats, ShouldHaveLength, 2)
+				So(stats[0].UpstreamPacketsReceived, ShouldEqual, 10)
+				So(stats[0].UpstreamDatagramsACKRate, ShouldEqual, 100)
+				So(stats[1].UpstreamPacketsReceived, ShouldEqual, 10)
+				So(stats[1].UpstreamDatagramsACKRate, ShouldEqual, 50)
+			})
+
+			Convey("Then the stats of an other gateway are empty", func() {
+				stats, err := s.Get(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, GatewayStatsDay, hour, hour)
+				So(err, ShouldBeNil)
+				So(stats, ShouldResemble, []GatewayStats{
+					{Timestamp: time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)},
+				})
+			})
+		})
+
+		Convey("When saving stats with a gateway time which is off or not set", func() {
+			for _, ts := range []time.Time{{}, hour.Add(-time.Hour * 24 * 365), hour.Add(time.Hour)} {
+				So(s.save(loracontrol.Gateway{
+					UpdatedAt:               ts,
+					MAC:                     mac,
+					UpstreamPacketsReceived: 10,
+				}, hour.Add(time.Minute)), ShouldBeNil)
+			}
+
+			Convey("Then the stats are aggregated by the server time", func() {
+				stats, err := s.Get(mac, GatewayStatsMinute, hour, hour.Add(time.Minute))
+				So(err, ShouldBeNil)
+				So(stats, ShouldHaveLength, 2)
+				So(stats[0].StatsCount, ShouldEqual, 0)
+				So(stats[1].UpstreamPacketsReceived, ShouldEqual, 30)
+				So(stats[1].StatsCount, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When requesting an invalid interval, an error is returned", func() {
+			_, err := s.Get(mac, GatewayStatsInterval("week"), hour, hour)
+			So(err, ShouldEqual, ErrInvalidGatewayStatsInterval)
+		})
+
+		Convey("When requesting too many intervals, an error is returned", func() {
+			_, err := s.Get(mac, GatewayStatsMinute, hour, hour.Add(time.Hour*24))
+			So(err, ShouldEqual, ErrInvalidGatewayStatsRange)
+		})
+
+		Convey("When the end is before the start, an error is returned", func() {
+			_, err := s.Get(mac, GatewayStatsHour, hour, hour.Add(-time.Hour))
+			So(err, ShouldEqual, ErrInvalidGatewayStatsRange)
+		})
+	})
+}
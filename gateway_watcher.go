@@ -0,0 +1,428 @@
+package loraserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/lorawan"
+	"github.com/garyburd/redigo/redis"
+)
+
+// GatewayState defines the (liveness) state of a gateway.
+type GatewayState string
+
+// Available gateway states.
+const (
+	GatewayOnline  GatewayState = "online"
+	GatewayOffline GatewayState = "offline"
+)
+
+// ErrGatewayStatusUnknown is returned when no status is known for a gateway.
+var ErrGatewayStatusUnknown = errors.New("gateway status unknown")
+
+// maxGatewayTransitions defines the number of state transitions stored
+// per gateway.
+const maxGatewayTransitions = 10
+
+// Webhook delivery settings. The transitions are posted in order, a failed
+// post is retried (with the interval doubled after every attempt) before
+// the next transition is posted.
+const (
+	webhookTimeout       = 10 * time.Second
+	webhookAttempts      = 5
+	webhookRetryInterval = time.Second
+	webhookQueueSize     = 100
+)
+
+// GatewayTransition represents a state transition of a gateway.
+type GatewayTransition struct {
+	MAC        lorawan.EUI64 `json:"mac"`
+	From       GatewayState  `json:"from"`
+	To         GatewayState  `json:"to"`
+	Time       time.Time     `json:"time"`
+	LastSeenAt time.Time     `json:"lastSeenAt"`
+}
+
+// GatewayStatus contains the (liveness) status of a gateway.
+type GatewayStatus struct {
+	State       GatewayState        `json:"state"`
+	LastSeenAt  time.Time           `json:"lastSeenAt"`
+	ChangedAt   time.Time           `json:"changedAt"`
+	Transitions []GatewayTransition `json:"transitions"` // most recent first
+
+	storedAt time.Time // last time LastSeenAt was written to Redis
+	pending  bool      // a state change is being stored
+}
+
+// GatewayWatcher keeps track of the gateways last seen time and marks a
+// gateway offline when nothing was received for the configured timeout.
+// State transitions are stored in Redis and (when set) posted as JSON
+// to the webhook URL. A gateway seen for the first time is stored as online,
+// without a transition.
+type GatewayWatcher struct {
+	pool          *redis.Pool
+	timeout       time.Duration
+	webhookURL    string
+	webhookClient *http.Client
+	webhooks      chan []byte
+
+	mu       sync.Mutex
+	gateways map[lorawan.EUI64]*GatewayStatus
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewGatewayWatcher creates a new GatewayWatcher. It loads the stored
+// gateway states from Redis so that gateways that do not come back after
+// a restart will still be marked offline.
+func NewGatewayWatcher(p *redis.Pool, timeout time.Duration, webhookURL string) (*GatewayWatcher, error) {
+	w := &GatewayWatcher{
+		pool:          p,
+		timeout:       timeout,
+		webhookURL:    webhookURL,
+		webhookClient: &http.Client{Timeout: webhookTimeout},
+		webhooks:      make(chan []byte, webhookQueueSize),
+		gateways:      make(map[lorawan.EUI64]*GatewayStatus),
+		stop:          make(chan struct{}),
+	}
+
+	c := p.Get()
+	defer c.Close()
+
+	macs, err := redis.Strings(c.Do("SMEMBERS", "gw_status_macs"))
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range macs {
+		var mac lorawan.EUI64
+		b, err := hex.DecodeString(m)
+		if err != nil || len(b) != len(mac) {
+			return nil, fmt.Errorf("invalid gateway MAC in gateway status set: %s", m)
+		}
+		copy(mac[:], b)
+		status, err := w.getStoredStatus(c, mac)
+		if err != nil {
+			return nil, err
+		}
+		status.storedAt = status.LastSeenAt
+		w.gateways[mac] = &status
+	}
+
+	w.wg.Add(2)
+	go func() {
+		w.watch()
+		w.wg.Done()
+	}()
+	go func() {
+		w.sendWebhooks()
+		w.wg.Done()
+	}()
+
+	return w, nil
+}
+
+// Close stops the watcher.
+func (w *GatewayWatcher) Close() error {
+	close(w.stop)
+	w.wg.Wait()
+	return nil
+}
+
+// Seen must be called every time data is received from the given gateway.
+// For an online gateway, only the in-memory state is updated; the last seen
+// time is written to Redis (outside the lock) at most every timeout / 4.
+func (w *GatewayWatcher) Seen(mac lorawan.EUI64) error {
+	now := time.Now().UTC()
+
+	w.mu.Lock()
+	status, ok := w.gateways[mac]
+	if !ok {
+		status = &GatewayStatus{}
+		w.gateways[mac] = status
+	}
+	status.LastSeenAt = now
+
+	if status.State != GatewayOnline {
+		t, ok := w.beginTransition(mac, status, GatewayOnline, now)
+		w.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		return w.transition(t)
+	}
+
+	store := now.Sub(status.storedAt) >= w.timeout/4
+	if store {
+		status.storedAt = now
+	}
+	w.mu.Unlock()
+
+	if !store {
+		return nil
+	}
+	c := w.pool.Get()
+	defer c.Close()
+	_, err := c.Do("HSET", gatewayStatusKey(mac), "last_seen_at", now.Format(time.RFC3339Nano))
+	return err
+}
+
+// Status returns the status of the given gateway.
+func (w *GatewayWatcher) Status(mac lorawan.EUI64) (GatewayStatus, error) {
+	c := w.pool.Get()
+	defer c.Close()
+
+	w.mu.Lock()
+	status, ok := w.gateways[mac]
+	var out GatewayStatus
+	if ok {
+		out = *status
+	}
+	w.mu.Unlock()
+
+	if !ok {
+		return GatewayStatus{}, ErrGatewayStatusUnknown
+	}
+
+	values, err := redis.ByteSlices(c.Do("LRANGE", gatewayTransitionsKey(mac), 0, maxGatewayTransitions-1))
+	if err != nil {
+		return GatewayStatus{}, err
+	}
+	out.Transitions = make([]GatewayTransition, 0, len(values))
+	for _, b := range values {
+		var t GatewayTransition
+		if err := json.Unmarshal(b, &t); err != nil {
+			return GatewayStatus{}, err
+		}
+		out.Transitions = append(out.Transitions, t)
+	}
+	return out, nil
+}
+
+// watch periodically marks the gateways offline for which nothing was
+// received within the timeout.
+func (w *GatewayWatcher) watch() {
+	interval := w.timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.markOffline()
+		}
+	}
+}
+
+// markOffline marks the gateways offline for which nothing was received
+// within the timeout. A gateway which could not be marked offline is retried
+// on the next call.
+func (w *GatewayWatcher) markOffline() {
+	now := time.Now().UTC()
+
+	w.mu.Lock()
+	var transitions []GatewayTransition
+	for mac, status := range w.gateways {
+		if status.State == GatewayOnline && now.Sub(status.LastSeenAt) > w.timeout {
+			if t, ok := w.beginTransition(mac, status, GatewayOffline, now); ok {
+				transitions = append(transitions, t)
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	for _, t := range transitions {
+		if err := w.transition(t); err != nil {
+			log.WithField("mac", t.MAC).Errorf("could not mark gateway offline: %s", err)
+		}
+	}
+}
+
+// beginTransition returns the transition of the given gateway to the given
+// state and marks it pending, so that the state changes of a gateway are
+// stored one at a time (and in order). It returns false when a state change
+// is already pending. The From state is empty for a gateway seen for the
+// first time. It expects that the lock is being held.
+func (w *GatewayWatcher) beginTransition(mac lorawan.EUI64, status *GatewayStatus, to GatewayState, now time.Time) (GatewayTransition, bool) {
+	if status.pending {
+		return GatewayTransition{}, false
+	}
+	status.pending = true
+	return GatewayTransition{
+		MAC:        mac,
+		From:       status.State,
+		To:         to,
+		Time:       now,
+		LastSeenAt: status.LastSeenAt,
+	}, true
+}
+
+// transition stores the given (pending) transition and queues it for the
+// webhook. The in-memory state is only changed when the transition has been
+// stored. For a gateway seen for the first time, only its state is stored.
+// When the gateway has been seen while it was being marked offline, it is
+// marked online again. It must be called without holding the lock.
+func (w *GatewayWatcher) transition(t GatewayTransition) error {
+	for {
+		b, err := json.Marshal(t)
+		if err == nil {
+			err = w.storeTransition(t, b)
+		}
+
+		w.mu.Lock()
+		status := w.gateways[t.MAC]
+		status.pending = false
+		if err != nil {
+			w.mu.Unlock()
+			return err
+		}
+		status.State = t.To
+		status.ChangedAt = t.Time
+		status.storedAt = t.LastSeenAt
+
+		if t.From != "" {
+			log.WithFields(log.Fields{
+				"mac":          t.MAC,
+				"from":         t.From,
+				"to":           t.To,
+				"last_seen_at": t.LastSeenAt,
+			}).Info("gateway state changed")
+
+			if w.webhookURL != "" {
+				select {
+				case w.webhooks <- b:
+				default:
+					log.WithField("mac", t.MAC).Error("gateway state webhook queue is full, dropping transition")
+				}
+			}
+		}
+
+		var next bool
+		if t.To == GatewayOffline && status.LastSeenAt.After(t.LastSeenAt) {
+			t, next = w.beginTransition(t.MAC, status, GatewayOnline, time.Now().UTC())
+		}
+		w.mu.Unlock()
+
+		if !next {
+			return nil
+		}
+	}
+}
+
+// storeTransition stores the state of the gateway after the given transition
+// and, unless the gateway was seen for the first time, the transition.
+func (w *GatewayWatcher) storeTransition(t GatewayTransition, b []byte) error {
+	c := w.pool.Get()
+	defer c.Close()
+
+	c.Send("MULTI")
+	c.Send("SADD", "gw_status_macs", t.MAC.String())
+	c.Send("HMSET", gatewayStatusKey(t.MAC),
+		"state", string(t.To),
+		"last_seen_at", t.LastSeenAt.Format(time.RFC3339Nano),
+		"changed_at", t.Time.Format(time.RFC3339Nano),
+	)
+	if t.From != "" {
+		c.Send("LPUSH", gatewayTransitionsKey(t.MAC), b)
+		c.Send("LTRIM", gatewayTransitionsKey(t.MAC), 0, maxGatewayTransitions-1)
+	}
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// sendWebhooks posts the queued transitions to the webhook, in the order in
+// which they were queued.
+func (w *GatewayWatcher) sendWebhooks() {
+	for {
+		select {
+		case <-w.stop:
+			if n := len(w.webhooks); n > 0 {
+				log.WithField("url", w.webhookURL).Warningf("watcher closed, dropping %d gateway state transition(s)", n)
+			}
+			return
+		case b := <-w.webhooks:
+			w.callWebhook(b)
+		}
+	}
+}
+
+// callWebhook posts the given transition to the webhook. Failed posts are
+// retried until the max. number of attempts has been reached or the watcher
+// is closed.
+func (w *GatewayWatcher) callWebhook(data []byte) {
+	interval := webhookRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := w.postWebhook(data)
+		if err == nil {
+			return
+		}
+		if attempt >= webhookAttempts {
+			log.WithField("url", w.webhookURL).Errorf("could not call gateway state webhook after %d attempts: %s", attempt, err)
+			return
+		}
+		log.WithFields(log.Fields{
+			"url":     w.webhookURL,
+			"attempt": attempt,
+		}).Warningf("could not call gateway state webhook, retrying: %s", err)
+
+		select {
+		case <-time.After(interval):
+		case <-w.stop:
+			return
+		}
+		interval *= 2
+	}
+}
+
+func (w *GatewayWatcher) postWebhook(data []byte) error {
+	resp, err := w.webhookClient.Post(w.webhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("gateway state webhook returned status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (w *GatewayWatcher) getStoredStatus(c redis.Conn, mac lorawan.EUI64) (GatewayStatus, error) {
+	values, err := redis.StringMap(c.Do("HGETALL", gatewayStatusKey(mac)))
+	if err != nil {
+		return GatewayStatus{}, err
+	}
+	status := GatewayStatus{
+		State: GatewayState(values["state"]),
+	}
+	for field, t := range map[string]*time.Time{
+		"last_seen_at": &status.LastSeenAt,
+		"changed_at":   &status.ChangedAt,
+	} {
+		if values[field] == "" {
+			continue
+		}
+		if *t, err = time.Parse(time.RFC3339Nano, values[field]); err != nil {
+			return GatewayStatus{}, fmt.Errorf("could not parse gateway status field %s: %s", field, err)
+		}
+	}
+	return status, nil
+}
+
+func gatewayStatusKey(mac lorawan.EUI64) string {
+	return fmt.Sprintf("gw_status_%s", mac)
+}
+
+func gatewayTransitionsKey(mac lorawan.EUI64) string {
+	return fmt.Sprintf("gw_status_transitions_%s", mac)
+}
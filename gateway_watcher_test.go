@@ -0,0 +1,144 @@
+package loraserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testWebhookHandler struct {
+	failures    int // number of requests to fail before handling the transitions
+	transitions chan GatewayTransition
+}
+
+func (h *testWebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.failures > 0 {
+		h.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var t GatewayTransition
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.transitions <- t
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestGatewayWatcher(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a clean Redis database and a test webhook server", t, func() {
+		p := NewRedisPool(conf.RedisServer, conf.RedisPassword)
+		c := p.Get()
+		_, err := c.Do("FLUSHALL")
+		So(err, ShouldBeNil)
+		c.Close()
+
+		h := &testWebhookHandler{transitions: make(chan GatewayTransition, 10)}
+		s := httptest.NewServer(h)
+		defer s.Close()
+
+		mac := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+		Convey("Given a failing webhook and a GatewayWatcher", func() {
+			h.failures = 1
+			w, err := NewGatewayWatcher(p, time.Second, s.URL)
+			So(err, ShouldBeNil)
+			defer w.Close()
+
+			Convey("When the gateway is seen and nothing is received within the timeout", func() {
+				So(w.Seen(mac), ShouldBeNil)
+
+				Convey("Then the webhook call is retried", func() {
+					tr := <-h.transitions
+					So(tr.To, ShouldEqual, GatewayOffline)
+					So(h.failures, ShouldEqual, 0)
+				})
+			})
+		})
+
+		Convey("Given a GatewayWatcher with a timeout of 1 second", func() {
+			w, err := NewGatewayWatcher(p, time.Second, s.URL)
+			So(err, ShouldBeNil)
+			defer w.Close()
+
+			Convey("Then the status of an unknown gateway is unknown", func() {
+				_, err := w.Status(mac)
+				So(err, ShouldEqual, ErrGatewayStatusUnknown)
+			})
+
+			Convey("When the gateway is seen", func() {
+				So(w.Seen(mac), ShouldBeNil)
+
+				Convey("Then the gateway is online without a transition", func() {
+					status, err := w.Status(mac)
+					So(err, ShouldBeNil)
+					So(status.State, ShouldEqual, GatewayOnline)
+					So(status.Transitions, ShouldHaveLength, 0)
+				})
+
+				Convey("Then the webhook is not called", func() {
+					select {
+					case tr := <-h.transitions:
+						t.Fatalf("unexpected transition: %+v", tr)
+					case <-time.After(100 * time.Millisecond):
+					}
+				})
+
+				Convey("Then seeing the gateway again does not change its state", func() {
+					So(w.Seen(mac), ShouldBeNil)
+					status, err := w.Status(mac)
+					So(err, ShouldBeNil)
+					So(status.State, ShouldEqual, GatewayOnline)
+					So(status.Transitions, ShouldHaveLength, 0)
+				})
+
+				Convey("Then a new watcher loads the stored state", func() {
+					w2, err := NewGatewayWatcher(p, time.Second, "")
+					So(err, ShouldBeNil)
+					defer w2.Close()
+
+					status, err := w2.Status(mac)
+					So(err, ShouldBeNil)
+					So(status.State, ShouldEqual, GatewayOnline)
+				})
+
+				Convey("When nothing is received within the timeout", func() {
+					time.Sleep(time.Millisecond * 2500)
+
+					Convey("Then the gateway is offline", func() {
+						status, err := w.Status(mac)
+						So(err, ShouldBeNil)
+						So(status.State, ShouldEqual, GatewayOffline)
+						So(status.Transitions, ShouldHaveLength, 1)
+						So(status.Transitions[0].From, ShouldEqual, GatewayOnline)
+						So(status.Transitions[0].To, ShouldEqual, GatewayOffline)
+					})
+
+					Convey("When the gateway is seen again", func() {
+						So(w.Seen(mac), ShouldBeNil)
+
+						Convey("Then the gateway is online again", func() {
+							status, err := w.Status(mac)
+							So(err, ShouldBeNil)
+							So(status.State, ShouldEqual, GatewayOnline)
+							So(status.Transitions, ShouldHaveLength, 2)
+						})
+
+						Convey("Then the webhook is called with the transitions in order", func() {
+							So((<-h.transitions).To, ShouldEqual, GatewayOffline)
+							So((<-h.transitions).To, ShouldEqual, GatewayOnline)
+						})
+					})
+				})
+			})
+		})
+	})
+}
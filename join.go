@@ -0,0 +1,266 @@
+package loraserver
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/loraserver/application/session"
+	"github.com/brocaar/lorawan"
+	"github.com/garyburd/redigo/redis"
+)
+
+// joinAcceptDelay1 defines the delay between the end of the join-request
+// and the first receive window of the node (JOIN_ACCEPT_DELAY1).
+const joinAcceptDelay1 = 5 * time.Second
+
+// defaultTXPower defines the tx power (dBm) used for the downlink
+// transmissions. It is capped per gateway by the gateway backends (see the
+// txconfig package).
+const defaultTXPower = 14
+
+// ErrDevNonceUsed is returned when the DevNonce of a join-request has already
+// been used by the node.
+var ErrDevNonceUsed = errors.New("DevNonce has already been used")
+
+// JoinConfig contains the configuration of the over-the-air activation of
+// the nodes.
+type JoinConfig struct {
+	// NetID of the network. Its 7 LSB (NwkID) are used as the 7 MSB of the
+	// DevAddr assigned to the joining nodes.
+	NetID [3]byte
+
+	// Nonces (optional) stores the DevNonce values used by the nodes, to
+	// reject replayed join-requests.
+	Nonces *DevNonceStorage
+
+	// Sessions (optional) is updated with the node-session created on join,
+	// so that the application backends can resolve it.
+	Sessions *session.Index
+}
+
+// DevNonceStorage stores the DevNonce values used by the nodes in Redis.
+type DevNonceStorage struct {
+	pool *redis.Pool
+}
+
+// NewDevNonceStorage creates a new DevNonceStorage.
+func NewDevNonceStorage(p *redis.Pool) *DevNonceStorage {
+	return &DevNonceStorage{pool: p}
+}
+
+// Use marks the given DevNonce as used by the given node. It returns
+// ErrDevNonceUsed when it has already been used.
+func (s *DevNonceStorage) Use(devEUI lorawan.EUI64, devNonce [2]byte) error {
+	c := s.pool.Get()
+	defer c.Close()
+
+	added, err := redis.Int(c.Do("SADD", devNonceKey(devEUI), devNonce[:]))
+	if err != nil {
+		return fmt.Errorf("could not save DevNonce: %s", err)
+	}
+	if added == 0 {
+		return ErrDevNonceUsed
+	}
+	return nil
+}
+
+func devNonceKey(devEUI lorawan.EUI64) string {
+	return fmt.Sprintf("node_dev_nonces_%s", devEUI)
+}
+
+// validateJoinRequest validates that the join-request belongs to the given
+// node (AppEUI and MIC).
+func validateJoinRequest(rxPacket loracontrol.RXPacket, jrPL *lorawan.JoinRequestPayload, node loracontrol.Node) error {
+	if jrPL.AppEUI != node.AppEUI {
+		return errors.New("AppEUI of join-request does not match the AppEUI of the node")
+	}
+	micOK, err := rxPacket.PHYPayload.ValidateMIC(node.AppKey)
+	if err != nil {
+		return err
+	}
+	if !micOK {
+		return errors.New("invalid MIC")
+	}
+	return nil
+}
+
+// handleJoinRequestPackets creates a new node-session for the node and
+// sends the join-accept through the gateway which received the join-request
+// with the best signal. A join event is sent to the application.
+func handleJoinRequestPackets(rxPackets loracontrol.RXPackets, client *loracontrol.Client, conf UplinkConfig) error {
+	rxPacket := bestRXPacket(rxPackets)
+	jrPL, ok := rxPacket.PHYPayload.MACPayload.(*lorawan.JoinRequestPayload)
+	if !ok {
+		return fmt.Errorf("expected *lorawan.JoinRequestPayload, got %T", rxPacket.PHYPayload.MACPayload)
+	}
+
+	node, err := client.Node().Get(jrPL.DevEUI)
+	if err != nil {
+		if err == loracontrol.ErrObjectDoesNotExist {
+			return errors.New("node does not exist")
+		}
+		return err
+	}
+
+	if conf.Join.Nonces != nil {
+		if err := conf.Join.Nonces.Use(node.DevEUI, jrPL.DevNonce); err != nil {
+			if err == ErrDevNonceUsed {
+				sendNodeEvent(client, conf.Events, event.Event{
+					Type:   event.Error,
+					DevEUI: node.DevEUI,
+					Time:   rxPacket.RXInfo.Time,
+					Reason: err.Error(),
+				})
+			}
+			return err
+		}
+	}
+
+	var appNonce [3]byte
+	if _, err := rand.Read(appNonce[:]); err != nil {
+		return err
+	}
+	devAddr, err := getRandomDevAddr(conf.Join.NetID)
+	if err != nil {
+		return err
+	}
+	nwkSKey, err := getNwkSKey(node.AppKey, conf.Join.NetID, appNonce, jrPL.DevNonce)
+	if err != nil {
+		return err
+	}
+	appSKey, err := getAppSKey(node.AppKey, conf.Join.NetID, appNonce, jrPL.DevNonce)
+	if err != nil {
+		return err
+	}
+
+	ns := loracontrol.NodeSession{
+		DevAddr: devAddr,
+		DevEUI:  node.DevEUI,
+		AppSKey: appSKey,
+		NwkSKey: nwkSKey,
+	}
+	if err := client.NodeSession().CreateExpire(ns); err != nil {
+		return err
+	}
+	if conf.Join.Sessions != nil {
+		if err := conf.Join.Sessions.Save(ns); err != nil {
+			return err
+		}
+	}
+
+	phy := lorawan.NewPHYPayload(false)
+	phy.MHDR = lorawan.MHDR{
+		MType: lorawan.JoinAccept,
+		Major: lorawan.LoRaWANR1,
+	}
+	phy.MACPayload = &lorawan.JoinAcceptPayload{
+		AppNonce: appNonce,
+		NetID:    conf.Join.NetID,
+		DevAddr:  devAddr,
+	}
+	if err := phy.SetMIC(node.AppKey); err != nil {
+		return err
+	}
+	if err := phy.EncryptJoinAcceptPayload(node.AppKey); err != nil {
+		return err
+	}
+
+	if err := client.Gateway().Send(loracontrol.TXPacket{
+		TXInfo:     newRX1TXInfo(rxPacket.RXInfo, joinAcceptDelay1),
+		PHYPayload: phy,
+	}); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui":  node.DevEUI,
+		"dev_addr": devAddr,
+	}).Info("node joined")
+
+	sendNodeEvent(client, conf.Events, event.Event{
+		Type:    event.Join,
+		DevEUI:  node.DevEUI,
+		Time:    rxPacket.RXInfo.Time,
+		DevAddr: &devAddr,
+	})
+	return nil
+}
+
+// bestRXPacket returns the packet received with the best signal (RSSI).
+func bestRXPacket(rxPackets loracontrol.RXPackets) loracontrol.RXPacket {
+	best := rxPackets[0]
+	for _, p := range rxPackets[1:] {
+		if p.RXInfo.RSSI > best.RXInfo.RSSI {
+			best = p
+		}
+	}
+	return best
+}
+
+// newRX1TXInfo returns the TXInfo for a transmission in the first receive
+// window of the node, opened the given delay after the given uplink. The
+// RX1 window uses the frequency and data-rate of the uplink.
+func newRX1TXInfo(rxInfo loracontrol.RXInfo, delay time.Duration) loracontrol.TXInfo {
+	return loracontrol.TXInfo{
+		MAC:       rxInfo.MAC,
+		Timestamp: rxInfo.Timestamp + uint32(delay/time.Microsecond),
+		Frequency: rxInfo.Frequency,
+		Power:     defaultTXPower,
+		DataRate:  rxInfo.DataRate,
+		CodeRate:  rxInfo.CodingRate,
+	}
+}
+
+// getRandomDevAddr returns a random DevAddr, prefixed with the NwkID of the
+// given NetID.
+func getRandomDevAddr(netID [3]byte) (lorawan.DevAddr, error) {
+	var d lorawan.DevAddr
+	if _, err := rand.Read(d[:]); err != nil {
+		return d, err
+	}
+	d[0] = d[0]&1 | netID[2]<<1
+	return d, nil
+}
+
+// getNwkSKey returns the NwkSKey derived from the given AppKey and
+// join values.
+func getNwkSKey(appKey lorawan.AES128Key, netID [3]byte, appNonce [3]byte, devNonce [2]byte) (lorawan.AES128Key, error) {
+	return getSKey(0x01, appKey, netID, appNonce, devNonce)
+}
+
+// getAppSKey returns the AppSKey derived from the given AppKey and
+// join values.
+func getAppSKey(appKey lorawan.AES128Key, netID [3]byte, appNonce [3]byte, devNonce [2]byte) (lorawan.AES128Key, error) {
+	return getSKey(0x02, appKey, netID, appNonce, devNonce)
+}
+
+// getSKey returns aes128_encrypt(AppKey, typ | AppNonce | NetID | DevNonce | pad16).
+// The values are encoded little endian.
+func getSKey(typ byte, appKey lorawan.AES128Key, netID [3]byte, appNonce [3]byte, devNonce [2]byte) (lorawan.AES128Key, error) {
+	var key lorawan.AES128Key
+	b := make([]byte, 0, len(key))
+	b = append(b, typ)
+	for i := len(appNonce) - 1; i >= 0; i-- {
+		b = append(b, appNonce[i])
+	}
+	for i := len(netID) - 1; i >= 0; i-- {
+		b = append(b, netID[i])
+	}
+	for i := len(devNonce) - 1; i >= 0; i-- {
+		b = append(b, devNonce[i])
+	}
+	b = append(b, make([]byte, len(key)-len(b))...)
+
+	block, err := aes.NewCipher(appKey[:])
+	if err != nil {
+		return key, err
+	}
+	block.Encrypt(key[:], b)
+	return key, nil
+}
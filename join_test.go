@@ -0,0 +1,156 @@
+package loraserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/event"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGetSKey(t *testing.T) {
+	Convey("Given an AppKey, NetID, AppNonce and DevNonce", t, func() {
+		appKey := lorawan.AES128Key{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+		netID := [3]byte{0, 0, 0x13}
+		appNonce := [3]byte{1, 2, 3}
+		devNonce := [2]byte{4, 5}
+
+		Convey("Then getNwkSKey returns the expected key", func() {
+			key, err := getNwkSKey(appKey, netID, appNonce, devNonce)
+			So(err, ShouldBeNil)
+			So(key, ShouldResemble, lorawan.AES128Key{0xb9, 0x9a, 0xf3, 0xd9, 0x63, 0x71, 0x44, 0x6a, 0xdd, 0x48, 0x55, 0x85, 0x2d, 0xa4, 0x9d, 0xb6})
+		})
+
+		Convey("Then getAppSKey returns the expected key", func() {
+			key, err := getAppSKey(appKey, netID, appNonce, devNonce)
+			So(err, ShouldBeNil)
+			So(key, ShouldResemble, lorawan.AES128Key{0xdd, 0x1b, 0x25, 0x9c, 0xd4, 0x2c, 0xb8, 0x0c, 0xda, 0xba, 0xf4, 0xd0, 0xc0, 0x39, 0x99, 0x28})
+		})
+	})
+}
+
+func TestGetRandomDevAddr(t *testing.T) {
+	Convey("Given a NetID", t, func() {
+		netID := [3]byte{1, 2, 0x93}
+
+		Convey("Then the 7 MSB of the DevAddr are the NwkID", func() {
+			for i := 0; i < 10; i++ {
+				d, err := getRandomDevAddr(netID)
+				So(err, ShouldBeNil)
+				So(d[0]>>1, ShouldEqual, 0x13)
+			}
+		})
+	})
+}
+
+func TestHandleJoinRequestPackets(t *testing.T) {
+	config := getConfig()
+
+	Convey("Given a Client connected to a clean Redis database", t, func() {
+		appBackend := &testApplicationBackend{}
+		gwBackend := &testGatewayBackend{}
+		client, err := loracontrol.NewClient(
+			loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(config.RedisServer, config.RedisPassword)),
+			loracontrol.SetApplicationBackend(appBackend),
+			loracontrol.SetGatewayBackend(gwBackend),
+		)
+		So(err, ShouldBeNil)
+		So(client.Storage().FlushAll(), ShouldBeNil)
+
+		conf := UplinkConfig{
+			Events: appBackend,
+			Join: JoinConfig{
+				NetID:  [3]byte{0, 0, 0x13},
+				Nonces: NewDevNonceStorage(NewRedisPool(config.RedisServer, config.RedisPassword)),
+			},
+		}
+
+		node := loracontrol.Node{
+			DevEUI: [8]byte{1, 1, 1, 1, 1, 1, 1, 1},
+			AppEUI: [8]byte{2, 2, 2, 2, 2, 2, 2, 2},
+			AppKey: lorawan.AES128Key{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		}
+		So(client.Node().Create(node), ShouldBeNil)
+
+		Convey("Given a join-request received by two gateways", func() {
+			phy := lorawan.NewPHYPayload(true)
+			phy.MHDR = lorawan.MHDR{
+				MType: lorawan.JoinRequest,
+				Major: lorawan.LoRaWANR1,
+			}
+			phy.MACPayload = &lorawan.JoinRequestPayload{
+				AppEUI:   node.AppEUI,
+				DevEUI:   node.DevEUI,
+				DevNonce: [2]byte{1, 2},
+			}
+			So(phy.SetMIC(node.AppKey), ShouldBeNil)
+
+			rxPackets := loracontrol.RXPackets{
+				{
+					RXInfo: loracontrol.RXInfo{
+						MAC:       lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1},
+						Time:      time.Now().UTC(),
+						Timestamp: 1000000,
+						Frequency: 868.1,
+						RSSI:      -100,
+					},
+					PHYPayload: phy,
+				},
+				{
+					RXInfo: loracontrol.RXInfo{
+						MAC:       lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+						Time:      time.Now().UTC(),
+						Timestamp: 2000000,
+						Frequency: 868.1,
+						RSSI:      -50,
+					},
+					PHYPayload: phy,
+				},
+			}
+
+			Convey("When calling handleJoinRequestPackets", func() {
+				So(handleJoinRequestPackets(rxPackets, client, conf), ShouldBeNil)
+
+				Convey("Then the join-accept is sent in RX1 by the gateway with the best signal", func() {
+					So(gwBackend.txPackets, ShouldHaveLength, 1)
+					txInfo := gwBackend.txPackets[0].TXInfo
+					So(txInfo.MAC, ShouldEqual, lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2})
+					So(txInfo.Timestamp, ShouldEqual, 7000000)
+					So(txInfo.Frequency, ShouldEqual, 868.1)
+					So(gwBackend.txPackets[0].PHYPayload.MHDR.MType, ShouldEqual, lorawan.JoinAccept)
+				})
+
+				Convey("Then a join event is sent to the application", func() {
+					So(appBackend.events, ShouldHaveLength, 1)
+					So(appBackend.events[0].Type, ShouldEqual, event.Join)
+					So(appBackend.events[0].DevEUI, ShouldEqual, node.DevEUI)
+					So(appBackend.events[0].DevAddr, ShouldNotBeNil)
+					So(appBackend.events[0].DevAddr[0]>>1, ShouldEqual, 0x13)
+
+					Convey("Then the node-session has been created", func() {
+						ns, err := client.NodeSession().Get(*appBackend.events[0].DevAddr)
+						So(err, ShouldBeNil)
+						So(ns.DevEUI, ShouldEqual, node.DevEUI)
+						So(ns.FCntUp, ShouldEqual, 0)
+					})
+				})
+
+				Convey("When the join-request is replayed", func() {
+					err := handleJoinRequestPackets(rxPackets, client, conf)
+
+					Convey("Then ErrDevNonceUsed is returned", func() {
+						So(err, ShouldEqual, ErrDevNonceUsed)
+					})
+
+					Convey("Then an error event is sent to the application", func() {
+						So(appBackend.events, ShouldHaveLength, 2)
+						So(appBackend.events[1].Type, ShouldEqual, event.Error)
+						So(appBackend.events[1].Reason, ShouldEqual, ErrDevNonceUsed.Error())
+					})
+				})
+			})
+		})
+	})
+}
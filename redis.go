@@ -0,0 +1,32 @@
+package loraserver
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// NewRedisPool returns a new Redis connection pool.
+func NewRedisPool(redisServer, redisPassword string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial("tcp", redisServer)
+			if err != nil {
+				return nil, err
+			}
+			if redisPassword != "" {
+				if _, err := c.Do("AUTH", redisPassword); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return c, err
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
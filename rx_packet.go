@@ -2,33 +2,134 @@ package loraserver
 
 import (
 	"errors"
+	"expvar"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/delivery"
+	"github.com/brocaar/loraserver/application/event"
 	"github.com/brocaar/lorawan"
 )
 
-// HandleGatewayPackets handles the the packets received by the gateway, each
-// in a separate goroutine. Errors are logged.
-func HandleGatewayPackets(c *loracontrol.Client) {
+var (
+	// uplinkDroppedCount contains the number of received packets that were
+	// dropped because the uplink queue was full.
+	uplinkDroppedCount = expvar.NewInt("uplink_dropped")
+
+	// uplinkQueueLength contains the uplink queue length (as seen when the
+	// last packet was queued).
+	uplinkQueueLength = expvar.NewInt("uplink_queue_length")
+
+	// uplinkErrorCount contains the number of packets for which the
+	// handling returned an error.
+	uplinkErrorCount = expvar.NewInt("uplink_errors")
+)
+
+// UplinkConfig contains the configuration of the uplink packet handler.
+type UplinkConfig struct {
+	Workers      int  // number of packets handled concurrently (min. 1)
+	QueueSize    int  // number of packets waiting to be handled
+	DropWhenFull bool // drop packets when the queue is full instead of blocking
+
+	// Events (optional) receives the events of the nodes, e.g. the rejected
+	// frames, to deliver them to the applications.
+	Events event.Sender
+
+	// Join contains the configuration of the over-the-air activation.
+	Join JoinConfig
+
+	// Downlinks (optional) contains the downlinks queued by the applications
+	// (see HandleApplicationPackets). The first queued downlink of a node is
+	// sent in RX1 of its next uplink.
+	Downlinks *TXPacketQueue
+
+	// Delivery contains the configuration of the delivery of the accepted
+	// frames to the applications.
+	Delivery DeliveryConfig
+}
+
+// HandleGatewayPackets handles the the packets received by the gateway
+// using a bounded pool of workers. Errors are logged. The accepted frames are
+// delivered to the applications asynchronously (see DeliveryConfig). It
+// returns when the gateway receive channel has been closed and all queued
+// packets have been handled and delivered.
+func HandleGatewayPackets(c *loracontrol.Client, conf UplinkConfig) {
+	if conf.Workers < 1 {
+		conf.Workers = 1
+	}
+	queue := make(chan loracontrol.RXPacket, conf.QueueSize)
+	deliverer := newAppDeliverer(c, conf.Delivery)
+
+	var wg sync.WaitGroup
+	wg.Add(conf.Workers)
+	for i := 0; i < conf.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for rxPacket := range queue {
+				if err := handleGatewayPacket(rxPacket, c, conf, deliverer); err != nil {
+					uplinkErrorCount.Add(1)
+					log.Errorf("error processing packet: %s", err)
+				}
+			}
+		}()
+	}
+
 	for rxPacket := range c.Gateway().Receive() {
-		go func(rxPacket loracontrol.RXPacket) {
-			if err := handleGatewayPacket(rxPacket, c); err != nil {
-				log.Errorf("error processing packet: %s", err)
+		if conf.DropWhenFull {
+			select {
+			case queue <- rxPacket:
+			default:
+				uplinkDroppedCount.Add(1)
+				log.WithField("gw_mac", rxPacket.RXInfo.MAC).Warning("uplink queue is full, dropping packet")
+				continue
 			}
-		}(rxPacket)
+		} else {
+			queue <- rxPacket
+		}
+		uplinkQueueLength.Set(int64(len(queue)))
 	}
+
+	close(queue)
+	wg.Wait()
+	deliverer.close()
 }
 
 // handleGatewayPacket first validates the correctness of the packet (FCnt, MIC),
 // it will decrypt the payload and it will call CollectAndCallOnce (to collect
-// packets received by other gateways before proceeding).
-func handleGatewayPacket(rxPacket loracontrol.RXPacket, client *loracontrol.Client) error {
+// packets received by other gateways before proceeding). When the packet of a
+// known node is rejected, an error event is sent to conf.Events (when not
+// nil). The accepted frames are queued on the given deliverer.
+func handleGatewayPacket(rxPacket loracontrol.RXPacket, client *loracontrol.Client, conf UplinkConfig, deliverer *appDeliverer) error {
 	switch rxPacket.PHYPayload.MHDR.MType {
 	case lorawan.JoinRequest:
-		return errors.New("TODO: implement JoinRequest packet handling")
+		// MACPayload must be of type *lorawan.JoinRequestPayload
+		jrPL, ok := rxPacket.PHYPayload.MACPayload.(*lorawan.JoinRequestPayload)
+		if !ok {
+			return fmt.Errorf("expected *lorawan.JoinRequestPayload, got %T", rxPacket.PHYPayload.MACPayload)
+		}
+
+		// get the node data
+		node, err := client.Node().Get(jrPL.DevEUI)
+		if err != nil {
+			if err == loracontrol.ErrObjectDoesNotExist {
+				return errors.New("node does not exist")
+			}
+			return err
+		}
+
+		if err := validateJoinRequest(rxPacket, jrPL, node); err != nil {
+			sendNodeEvent(client, conf.Events, event.Event{
+				Type:   event.Error,
+				DevEUI: node.DevEUI,
+				Time:   rxPacket.RXInfo.Time,
+				Reason: err.Error(),
+			})
+			return err
+		}
 	case lorawan.UnconfirmedDataUp, lorawan.ConfirmedDataUp:
 		// MACPayload must be of type *lorawan.MACPayload
 		macPL, ok := rxPacket.PHYPayload.MACPayload.(*lorawan.MACPayload)
@@ -45,49 +146,83 @@ func handleGatewayPacket(rxPacket loracontrol.RXPacket, client *loracontrol.Clie
 			return err
 		}
 
-		// validate and get the full int32 FCnt
-		fullFCnt, ok := nodeSession.ValidateAndGetFullFCntUp(macPL.FHDR.FCnt)
-		if !ok {
-			log.WithFields(log.Fields{
-				"packet_fcnt": macPL.FHDR.FCnt,
-				"server_fcnt": nodeSession.FCntUp,
-			}).Warning("invalid FCnt")
-			return errors.New("invalid FCnt or too many dropped frames")
-		}
-		macPL.FHDR.FCnt = fullFCnt
-
-		// validate MIC
-		micOK, err := rxPacket.PHYPayload.ValidateMIC(nodeSession.NwkSKey)
-		if err != nil {
+		if err := validateAndDecryptDataPacket(&rxPacket, macPL, nodeSession); err != nil {
+			sendNodeEvent(client, conf.Events, event.Event{
+				Type:   event.Error,
+				DevEUI: nodeSession.DevEUI,
+				Time:   rxPacket.RXInfo.Time,
+				Reason: err.Error(),
+			})
 			return err
 		}
-		if !micOK {
-			return errors.New("invalid MIC")
-		}
-
-		if macPL.FPort == 0 {
-			// decrypt FRMPayload with NwkSKey when FPort == 0
-			if err := macPL.DecryptFRMPayload(nodeSession.NwkSKey); err != nil {
-				return err
-			}
-		} else {
-			// decrypt FRMPayload with AppSKey
-			if err := macPL.DecryptFRMPayload(nodeSession.AppSKey); err != nil {
-				return err
-			}
-			rxPacket.PHYPayload.MACPayload = macPL
-		}
 	default:
 		log.WithField("mtype", rxPacket.PHYPayload.MHDR.MType).Warning("unknown MType received")
 		return errors.New("unknown MType")
 	}
 
 	return client.Packet().CollectAndCallOnce(rxPacket, func(packets loracontrol.RXPackets) error {
-		return handleCollectedPackets(packets, client)
+		return handleCollectedPackets(packets, client, conf, deliverer)
 	})
 }
 
-func handleCollectedPackets(rxPackets loracontrol.RXPackets, c *loracontrol.Client) error {
+// validateAndDecryptDataPacket validates the FCnt and MIC of the given data
+// packet and decrypts the FRMPayload.
+func validateAndDecryptDataPacket(rxPacket *loracontrol.RXPacket, macPL *lorawan.MACPayload, nodeSession loracontrol.NodeSession) error {
+	// validate and get the full int32 FCnt
+	fullFCnt, ok := nodeSession.ValidateAndGetFullFCntUp(macPL.FHDR.FCnt)
+	if !ok {
+		log.WithFields(log.Fields{
+			"packet_fcnt": macPL.FHDR.FCnt,
+			"server_fcnt": nodeSession.FCntUp,
+		}).Warning("invalid FCnt")
+		return errors.New("invalid FCnt or too many dropped frames")
+	}
+	macPL.FHDR.FCnt = fullFCnt
+
+	// validate MIC
+	micOK, err := rxPacket.PHYPayload.ValidateMIC(nodeSession.NwkSKey)
+	if err != nil {
+		return err
+	}
+	if !micOK {
+		return errors.New("invalid MIC")
+	}
+
+	if macPL.FPort == 0 {
+		// decrypt FRMPayload with NwkSKey when FPort == 0
+		if err := macPL.DecryptFRMPayload(nodeSession.NwkSKey); err != nil {
+			return err
+		}
+	} else {
+		// decrypt FRMPayload with AppSKey
+		if err := macPL.DecryptFRMPayload(nodeSession.AppSKey); err != nil {
+			return err
+		}
+		rxPacket.PHYPayload.MACPayload = macPL
+	}
+	return nil
+}
+
+// sendNodeEvent sends the given event to the application of the node. Errors
+// are logged.
+func sendNodeEvent(c *loracontrol.Client, events event.Sender, e event.Event) {
+	if events == nil {
+		return
+	}
+	node, err := c.Node().Get(e.DevEUI)
+	if err != nil {
+		log.WithField("dev_eui", e.DevEUI).Errorf("could not get node for %s event: %s", e.Type, err)
+		return
+	}
+	if err := events.SendEvent(node.AppEUI, e); err != nil && err != event.ErrNotSupported && err != delivery.ErrQueued {
+		log.WithFields(log.Fields{
+			"dev_eui": e.DevEUI,
+			"app_eui": node.AppEUI,
+		}).Errorf("could not send %s event: %s", e.Type, err)
+	}
+}
+
+func handleCollectedPackets(rxPackets loracontrol.RXPackets, c *loracontrol.Client, conf UplinkConfig, deliverer *appDeliverer) error {
 	if len(rxPackets) == 0 {
 		return errors.New("packet collector returned 0 packets")
 	}
@@ -105,9 +240,9 @@ func handleCollectedPackets(rxPackets loracontrol.RXPackets, c *loracontrol.Clie
 
 	switch rxPackets[0].PHYPayload.MHDR.MType {
 	case lorawan.JoinRequest:
-		log.Debug("join request")
+		return handleJoinRequestPackets(rxPackets, c, conf)
 	case lorawan.UnconfirmedDataUp:
-		return handleRXDataPacket(rxPackets, c)
+		return handleRXDataPacket(rxPackets, c, conf, deliverer)
 	case lorawan.ConfirmedDataUp:
 		log.Debug("confirmed data up")
 	default:
@@ -117,7 +252,13 @@ func handleCollectedPackets(rxPackets loracontrol.RXPackets, c *loracontrol.Clie
 	return nil
 }
 
-func handleRXDataPacket(rxPackets loracontrol.RXPackets, client *loracontrol.Client) error {
+// handleRXDataPacket accepts the frame on the network layer (the FCntUp of
+// the node-session is incremented), sends the queued downlink of the node,
+// handles the acknowledgement and MAC commands of the node and queues the
+// FRMPayload for delivery to the application. A failing application does not
+// affect the node-session.
+func handleRXDataPacket(rxPackets loracontrol.RXPackets, client *loracontrol.Client, conf UplinkConfig, deliverer *appDeliverer) error {
+
 	if len(rxPackets) == 0 {
 		return errors.New("at least 1 RXPacket must be given")
 	}
@@ -147,21 +288,6 @@ func handleRXDataPacket(rxPackets loracontrol.RXPackets, client *loracontrol.Cli
 		return err
 	}
 
-	// decrypt FRMPayload with NwkSKey when FPort == 0
-	if macPL.FPort == 0 {
-		// TODO: handle MAC commands
-		log.Warning("TODO: implement MAC commands in FRMPayload")
-		return nil
-	}
-
-	// send the data to the application
-	if err := client.Application().Send(node.AppEUI, rxPackets); err != nil {
-		if err == loracontrol.ErrObjectDoesNotExist {
-			return errors.New("AppEUI does not exist")
-		}
-		return err
-	}
-
 	// increment counter
 	nodeSession.FCntUp = nodeSession.FCntUp + 1
 	if err := client.NodeSession().UpdateExpire(nodeSession); err != nil {
@@ -170,5 +296,80 @@ func handleRXDataPacket(rxPackets loracontrol.RXPackets, client *loracontrol.Cli
 		}
 		return err
 	}
+
+	// the node acknowledges the last (confirmed) downlink, sent before the
+	// queued downlink
+	var ackFCnt *uint32
+	if macPL.FHDR.FCtrl.ACK && nodeSession.FCntDown > 0 {
+		fCnt := nodeSession.FCntDown - 1
+		ackFCnt = &fCnt
+	}
+
+	// the receive window of the node opens shortly after the uplink
+	if conf.Downlinks != nil {
+		if err := sendQueuedTXPacket(rxPackets, client, conf.Downlinks, &nodeSession); err != nil {
+			log.WithField("dev_eui", node.DevEUI).Errorf("could not send queued downlink: %s", err)
+		}
+	}
+
+	if ackFCnt != nil {
+		sendNodeEvent(client, conf.Events, event.Event{
+			Type:   event.ACK,
+			DevEUI: node.DevEUI,
+			Time:   rxPacket.RXInfo.Time,
+			FCnt:   ackFCnt,
+		})
+	}
+
+	handleUplinkMACCommands(client, conf.Events, node.DevEUI, rxPacket.RXInfo.Time, macPL.FHDR.FOpts)
+
+	// the FRMPayload contains MAC commands (decrypted with the NwkSKey)
+	// when FPort == 0
+	if macPL.FPort == 0 {
+		var commands []lorawan.MACCommand
+		for _, pl := range macPL.FRMPayload {
+			if cmd, ok := pl.(*lorawan.MACCommand); ok {
+				commands = append(commands, *cmd)
+			}
+		}
+		handleUplinkMACCommands(client, conf.Events, node.DevEUI, rxPacket.RXInfo.Time, commands)
+		return nil
+	}
+
+	// queue the data for delivery to the application
+	deliverer.enqueue(frameDelivery{
+		appEUI:  node.AppEUI,
+		devEUI:  node.DevEUI,
+		fCnt:    macPL.FHDR.FCnt,
+		packets: rxPackets,
+	})
 	return nil
 }
+
+// handleUplinkMACCommands handles the MAC commands sent by the node. The
+// device status (DevStatusAns) is sent as status event to the application.
+func handleUplinkMACCommands(client *loracontrol.Client, events event.Sender, devEUI lorawan.EUI64, t time.Time, commands []lorawan.MACCommand) {
+	for _, cmd := range commands {
+		switch cmd.CID {
+		case lorawan.DevStatusAns:
+			pl, ok := cmd.Payload.(*lorawan.DevStatusAnsPayload)
+			if !ok {
+				log.WithField("dev_eui", devEUI).Warningf("expected *lorawan.DevStatusAnsPayload, got %T", cmd.Payload)
+				continue
+			}
+			battery, margin := pl.Battery, pl.Margin
+			sendNodeEvent(client, events, event.Event{
+				Type:    event.Status,
+				DevEUI:  devEUI,
+				Time:    t,
+				Battery: &battery,
+				Margin:  &margin,
+			})
+		default:
+			log.WithFields(log.Fields{
+				"dev_eui": devEUI,
+				"cid":     cmd.CID,
+			}).Warning("TODO: implement MAC command")
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/loraserver/application/event"
 	"github.com/brocaar/lorawan"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -13,6 +14,12 @@ import (
 type testApplicationBackend struct {
 	callCount int
 	err       error
+	events    []event.Event
+}
+
+func (b *testApplicationBackend) SendEvent(appEUI lorawan.EUI64, e event.Event) error {
+	b.events = append(b.events, e)
+	return nil
 }
 
 func (b *testApplicationBackend) Send(appEUI lorawan.EUI64, rxPackets loracontrol.RXPackets) error {
@@ -32,11 +39,13 @@ func (b *testApplicationBackend) Receive() chan loracontrol.TXPacket {
 
 type testGatewayBackend struct {
 	rxPacketChan chan loracontrol.RXPacket
+	txPackets    []loracontrol.TXPacket
 }
 
 func (b *testGatewayBackend) SetClient(c *loracontrol.Client) {}
 
 func (b *testGatewayBackend) Send(txPacket loracontrol.TXPacket) error {
+	b.txPackets = append(b.txPackets, txPacket)
 	return nil
 }
 
@@ -64,6 +73,14 @@ func TestHandleGatewayPackets(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(client.Storage().FlushAll(), ShouldBeNil)
 
+		conf := UplinkConfig{Events: appBackend}
+		storage := NewDeliveryStorage(NewRedisPool(config.RedisServer, config.RedisPassword))
+		deliverer := newAppDeliverer(client, DeliveryConfig{
+			Attempts:      2,
+			RetryInterval: time.Millisecond,
+			Storage:       storage,
+		})
+
 		nwkSKey := lorawan.AES128Key{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}
 		appSKey := lorawan.AES128Key{3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3}
 		devAddr := lorawan.DevAddr{1, 1, 1, 1}
@@ -130,7 +147,7 @@ func TestHandleGatewayPackets(t *testing.T) {
 			}
 
 			Convey("When calling handleGatewayPacket", func() {
-				err := handleGatewayPacket(rxPacket, client)
+				err := handleGatewayPacket(rxPacket, client, conf, deliverer)
 				Convey("Then an error is returned that the node-session does not exists", func() {
 					So(err, ShouldResemble, errors.New("node-session does not exist"))
 				})
@@ -160,13 +177,21 @@ func TestHandleGatewayPackets(t *testing.T) {
 						So(client.Application().Create(app), ShouldBeNil)
 
 						Convey("Then handleGatewayPacket does not return an error", func() {
-							err := handleGatewayPacket(rxPacket, client)
+							err := handleGatewayPacket(rxPacket, client, conf, deliverer)
 							So(err, ShouldBeNil)
+							deliverer.close()
 
 							Convey("Then the app backend Send was called once", func() {
 								So(appBackend.callCount, ShouldEqual, 1)
 							})
 
+							Convey("Then the frame has been marked as delivered", func() {
+								d, err := storage.Get(node.DevEUI, 10)
+								So(err, ShouldBeNil)
+								So(d.Status, ShouldEqual, DeliveryDelivered)
+								So(d.Attempts, ShouldEqual, 1)
+							})
+
 							Convey("Then FCntUp on the node-session is incremented", func() {
 								n, err := client.NodeSession().Get(nodeSession.DevAddr)
 								So(err, ShouldBeNil)
@@ -177,10 +202,9 @@ func TestHandleGatewayPackets(t *testing.T) {
 						Convey("When calling HandleGatewayPackets", func() {
 							gwBackend.rxPacketChan <- rxPackets[0]
 							close(gwBackend.rxPacketChan)
-							HandleGatewayPackets(client)
+							HandleGatewayPackets(client, UplinkConfig{Workers: 2})
 
 							Convey("Then the packet has been sent by the app backend", func() {
-								time.Sleep(time.Millisecond * 200)
 								So(appBackend.callCount, ShouldEqual, 1)
 							})
 						})
@@ -190,8 +214,15 @@ func TestHandleGatewayPackets(t *testing.T) {
 							So(client.NodeSession().UpdateExpire(nodeSession), ShouldBeNil)
 
 							Convey("Then handleGatewayPacket returns an invalid FCnt error", func() {
-								err := handleGatewayPacket(rxPacket, client)
+								err := handleGatewayPacket(rxPacket, client, conf, deliverer)
 								So(err, ShouldResemble, errors.New("invalid FCnt or too many dropped frames"))
+
+								Convey("Then an error event was sent to the application", func() {
+									So(appBackend.events, ShouldHaveLength, 1)
+									So(appBackend.events[0].Type, ShouldEqual, event.Error)
+									So(appBackend.events[0].DevEUI, ShouldEqual, nodeSession.DevEUI)
+									So(appBackend.events[0].Reason, ShouldEqual, "invalid FCnt or too many dropped frames")
+								})
 							})
 						})
 
@@ -200,21 +231,129 @@ func TestHandleGatewayPackets(t *testing.T) {
 							So(client.NodeSession().UpdateExpire(nodeSession), ShouldBeNil)
 
 							Convey("Then handleGatewayPacket returns an invalid MIC error", func() {
-								err := handleGatewayPacket(rxPacket, client)
+								err := handleGatewayPacket(rxPacket, client, conf, deliverer)
 								So(err, ShouldResemble, errors.New("invalid MIC"))
+
+								Convey("Then an error event was sent to the application", func() {
+									So(appBackend.events, ShouldHaveLength, 1)
+									So(appBackend.events[0].Reason, ShouldEqual, "invalid MIC")
+								})
+							})
+						})
+
+						Convey("When the node acknowledges a confirmed downlink", func() {
+							nodeSession.FCntDown = 5
+							So(client.NodeSession().UpdateExpire(nodeSession), ShouldBeNil)
+							macPL.FHDR.FCtrl.ACK = true
+							So(rxPacket.PHYPayload.SetMIC(nwkSKey), ShouldBeNil)
+
+							Convey("Then handleGatewayPacket sends an ack event to the application", func() {
+								So(handleGatewayPacket(rxPacket, client, conf, deliverer), ShouldBeNil)
+								deliverer.close()
+
+								So(appBackend.events, ShouldHaveLength, 1)
+								So(appBackend.events[0].Type, ShouldEqual, event.ACK)
+								So(appBackend.events[0].DevEUI, ShouldEqual, node.DevEUI)
+								So(*appBackend.events[0].FCnt, ShouldEqual, 4)
+							})
+						})
+
+						Convey("When the node sends its device status", func() {
+							macPL.FHDR.FOpts = []lorawan.MACCommand{
+								{
+									CID:     lorawan.DevStatusAns,
+									Payload: &lorawan.DevStatusAnsPayload{Battery: 200, Margin: -3},
+								},
+							}
+							So(rxPacket.PHYPayload.SetMIC(nwkSKey), ShouldBeNil)
+
+							Convey("Then handleGatewayPacket sends a status event to the application", func() {
+								So(handleGatewayPacket(rxPacket, client, conf, deliverer), ShouldBeNil)
+								deliverer.close()
+
+								So(appBackend.events, ShouldHaveLength, 1)
+								So(appBackend.events[0].Type, ShouldEqual, event.Status)
+								So(*appBackend.events[0].Battery, ShouldEqual, 200)
+								So(*appBackend.events[0].Margin, ShouldEqual, -3)
+							})
+
+							Convey("Then the frame is still delivered to the application", func() {
+								So(handleGatewayPacket(rxPacket, client, conf, deliverer), ShouldBeNil)
+								deliverer.close()
+								So(appBackend.callCount, ShouldEqual, 1)
+							})
+						})
+
+						Convey("When a downlink has been queued for the node", func() {
+							nodeSession.FCntDown = 5
+							nodeSession.AppSKey = appSKey
+							So(client.NodeSession().UpdateExpire(nodeSession), ShouldBeNil)
+
+							conf.Downlinks = NewTXPacketQueue(NewRedisPool(config.RedisServer, config.RedisPassword))
+							txMACPL := lorawan.NewMACPayload(false)
+							txMACPL.FHDR.DevAddr = devAddr
+							txMACPL.FPort = 2
+							txMACPL.FRMPayload = []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte("hello")}}
+							txPHY := lorawan.NewPHYPayload(false)
+							txPHY.MHDR = lorawan.MHDR{
+								MType: lorawan.UnconfirmedDataDown,
+								Major: lorawan.LoRaWANR1,
+							}
+							txPHY.MACPayload = txMACPL
+							So(conf.Downlinks.Enqueue(loracontrol.TXPacket{PHYPayload: txPHY}), ShouldBeNil)
+
+							Convey("Then handleGatewayPacket sends the downlink in RX1", func() {
+								So(handleGatewayPacket(rxPacket, client, conf, deliverer), ShouldBeNil)
+								deliverer.close()
+
+								So(gwBackend.txPackets, ShouldHaveLength, 1)
+								txPacket := gwBackend.txPackets[0]
+								So(txPacket.TXInfo.MAC, ShouldEqual, rxPacket.RXInfo.MAC)
+								So(txPacket.TXInfo.Timestamp, ShouldEqual, rxPacket.RXInfo.Timestamp+1000000)
+								So(txPacket.TXInfo.Frequency, ShouldEqual, rxPacket.RXInfo.Frequency)
+
+								txMACPL, ok := txPacket.PHYPayload.MACPayload.(*lorawan.MACPayload)
+								So(ok, ShouldBeTrue)
+								So(txMACPL.FHDR.FCnt, ShouldEqual, 5)
+								So(txMACPL.FHDR.FCtrl.FPending, ShouldBeFalse)
+
+								micOK, err := txPacket.PHYPayload.ValidateMIC(nwkSKey)
+								So(err, ShouldBeNil)
+								So(micOK, ShouldBeTrue)
+								So(txMACPL.DecryptFRMPayload(appSKey), ShouldBeNil)
+								So(txMACPL.FRMPayload, ShouldResemble, []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte("hello")}})
+
+								Convey("Then FCntDown on the node-session is incremented", func() {
+									n, err := client.NodeSession().Get(nodeSession.DevAddr)
+									So(err, ShouldBeNil)
+									So(n.FCntDown, ShouldEqual, 6)
+								})
 							})
 						})
 
 						Convey("When the application backend returns an error", func() {
 							appBackend.err = errors.New("BOOM!")
 							Convey("When calling handleGatewayPacket", func() {
-								err := handleGatewayPacket(rxPacket, client)
-								So(err, ShouldResemble, errors.New("BOOM!"))
+								err := handleGatewayPacket(rxPacket, client, conf, deliverer)
+								So(err, ShouldBeNil)
+								deliverer.close()
 
-								Convey("Then FCntUp on the node-session is not incremented", func() {
+								Convey("Then FCntUp on the node-session is incremented", func() {
 									n, err := client.NodeSession().Get(nodeSession.DevAddr)
 									So(err, ShouldBeNil)
-									So(n.FCntUp, ShouldEqual, nodeSession.FCntUp)
+									So(n.FCntUp, ShouldEqual, nodeSession.FCntUp+1)
+								})
+
+								Convey("Then the delivery has been attempted twice", func() {
+									So(appBackend.callCount, ShouldEqual, 2)
+								})
+
+								Convey("Then the frame has been marked as failed", func() {
+									d, err := storage.Get(node.DevEUI, 10)
+									So(err, ShouldBeNil)
+									So(d.Status, ShouldEqual, DeliveryFailed)
+									So(d.Attempts, ShouldEqual, 2)
+									So(d.Error, ShouldEqual, "BOOM!")
 								})
 							})
 						})
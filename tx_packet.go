@@ -0,0 +1,163 @@
+package loraserver
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	"github.com/garyburd/redigo/redis"
+)
+
+// receiveDelay1 defines the delay between the end of the uplink and the
+// first receive window of the node (RECEIVE_DELAY1).
+const receiveDelay1 = time.Second
+
+// txPacketQueueTTL defines how long the downlinks are kept in the queue of a
+// node after the last downlink has been queued.
+const txPacketQueueTTL = time.Hour * 24
+
+// TXPacketQueue stores the downlinks queued by the applications in Redis,
+// per DevAddr. The downlinks are queued unencrypted and without FCnt, these
+// are set when the downlink is sent (see sendQueuedTXPacket).
+type TXPacketQueue struct {
+	pool *redis.Pool
+}
+
+// NewTXPacketQueue creates a new TXPacketQueue.
+func NewTXPacketQueue(p *redis.Pool) *TXPacketQueue {
+	return &TXPacketQueue{pool: p}
+}
+
+// Enqueue adds the given downlink to the queue of its node.
+func (q *TXPacketQueue) Enqueue(txPacket loracontrol.TXPacket) error {
+	macPL, ok := txPacket.PHYPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return fmt.Errorf("expected *lorawan.MACPayload, got %T", txPacket.PHYPayload.MACPayload)
+	}
+	b, err := txPacket.PHYPayload.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	c := q.pool.Get()
+	defer c.Close()
+
+	key := txPacketQueueKey(macPL.FHDR.DevAddr)
+	if err := c.Send("MULTI"); err != nil {
+		return err
+	}
+	c.Send("RPUSH", key, b)
+	c.Send("PEXPIRE", key, int64(txPacketQueueTTL/time.Millisecond))
+	if _, err := c.Do("EXEC"); err != nil {
+		return fmt.Errorf("could not queue downlink: %s", err)
+	}
+	return nil
+}
+
+// Dequeue removes and returns the first downlink queued for the given
+// DevAddr. It returns false when the queue is empty. The returned int
+// contains the number of downlinks which are still queued.
+func (q *TXPacketQueue) Dequeue(devAddr lorawan.DevAddr) (loracontrol.TXPacket, int, bool, error) {
+	c := q.pool.Get()
+	defer c.Close()
+
+	key := txPacketQueueKey(devAddr)
+	if err := c.Send("MULTI"); err != nil {
+		return loracontrol.TXPacket{}, 0, false, err
+	}
+	c.Send("LPOP", key)
+	c.Send("LLEN", key)
+	values, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return loracontrol.TXPacket{}, 0, false, fmt.Errorf("could not get queued downlink: %s", err)
+	}
+	if len(values) != 2 {
+		return loracontrol.TXPacket{}, 0, false, fmt.Errorf("expected 2 values, got %d", len(values))
+	}
+
+	b, err := redis.Bytes(values[0], nil)
+	if err != nil {
+		if err == redis.ErrNil {
+			return loracontrol.TXPacket{}, 0, false, nil
+		}
+		return loracontrol.TXPacket{}, 0, false, err
+	}
+	remaining, err := redis.Int(values[1], nil)
+	if err != nil {
+		return loracontrol.TXPacket{}, 0, false, err
+	}
+
+	phy := lorawan.NewPHYPayload(false)
+	if err := phy.UnmarshalBinary(b); err != nil {
+		return loracontrol.TXPacket{}, 0, false, fmt.Errorf("could not unmarshal queued downlink: %s", err)
+	}
+	return loracontrol.TXPacket{PHYPayload: phy}, remaining, true, nil
+}
+
+func txPacketQueueKey(devAddr lorawan.DevAddr) string {
+	return fmt.Sprintf("node_tx_queue_%s", devAddr)
+}
+
+// HandleApplicationPackets queues the downlinks received from the
+// application backend. The queued downlink of a node is sent after its next
+// uplink (see UplinkConfig.Downlinks). Errors are logged. It returns when
+// the application receive channel has been closed.
+func HandleApplicationPackets(c *loracontrol.Client, queue *TXPacketQueue) {
+	for txPacket := range c.Application().Receive() {
+		if err := queue.Enqueue(txPacket); err != nil {
+			log.Errorf("could not queue downlink: %s", err)
+		}
+	}
+}
+
+// sendQueuedTXPacket sends the first downlink queued for the node of the
+// given node-session in RX1, through the gateway which received the given
+// uplink with the best signal. The FCntDown of the node-session is set and
+// incremented, the FRMPayload is encrypted with the AppSKey and the MIC is
+// set with the NwkSKey. The uplink is acknowledged when it was confirmed.
+func sendQueuedTXPacket(rxPackets loracontrol.RXPackets, client *loracontrol.Client, queue *TXPacketQueue, nodeSession *loracontrol.NodeSession) error {
+	txPacket, remaining, ok, err := queue.Dequeue(nodeSession.DevAddr)
+	if err != nil || !ok {
+		return err
+	}
+	macPL, ok := txPacket.PHYPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return fmt.Errorf("expected *lorawan.MACPayload, got %T", txPacket.PHYPayload.MACPayload)
+	}
+	if macPL.FPort == 0 {
+		return errors.New("queued downlink must have FPort > 0")
+	}
+
+	rxPacket := bestRXPacket(rxPackets)
+	macPL.FHDR.FCnt = nodeSession.FCntDown
+	macPL.FHDR.FCtrl.FPending = remaining > 0
+	macPL.FHDR.FCtrl.ACK = rxPacket.PHYPayload.MHDR.MType == lorawan.ConfirmedDataUp
+	if err := macPL.EncryptFRMPayload(nodeSession.AppSKey); err != nil {
+		return err
+	}
+	txPacket.PHYPayload.MACPayload = macPL
+	if err := txPacket.PHYPayload.SetMIC(nodeSession.NwkSKey); err != nil {
+		return err
+	}
+	txPacket.TXInfo = newRX1TXInfo(rxPacket.RXInfo, receiveDelay1)
+
+	// the FCnt is never re-used, also when the transmission fails
+	nodeSession.FCntDown = nodeSession.FCntDown + 1
+	if err := client.NodeSession().UpdateExpire(*nodeSession); err != nil {
+		return err
+	}
+
+	if err := client.Gateway().Send(txPacket); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"dev_addr": nodeSession.DevAddr,
+		"fcnt":     macPL.FHDR.FCnt,
+		"gw_mac":   rxPacket.RXInfo.MAC,
+	}).Info("downlink sent")
+	return nil
+}
@@ -0,0 +1,109 @@
+package loraserver
+
+import (
+	"testing"
+
+	"github.com/brocaar/loracontrol"
+	"github.com/brocaar/lorawan"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testDownlinkApplicationBackend struct {
+	testApplicationBackend
+	txPacketChan chan loracontrol.TXPacket
+}
+
+func (b *testDownlinkApplicationBackend) Receive() chan loracontrol.TXPacket {
+	return b.txPacketChan
+}
+
+func newTestTXPacket(devAddr lorawan.DevAddr, fPort uint8, data []byte) loracontrol.TXPacket {
+	macPL := lorawan.NewMACPayload(false)
+	macPL.FHDR.DevAddr = devAddr
+	macPL.FPort = fPort
+	macPL.FRMPayload = []lorawan.Payload{&lorawan.DataPayload{Bytes: data}}
+
+	phy := lorawan.NewPHYPayload(false)
+	phy.MHDR = lorawan.MHDR{
+		MType: lorawan.UnconfirmedDataDown,
+		Major: lorawan.LoRaWANR1,
+	}
+	phy.MACPayload = macPL
+	return loracontrol.TXPacket{PHYPayload: phy}
+}
+
+func TestTXPacketQueue(t *testing.T) {
+	conf := getConfig()
+
+	Convey("Given a clean Redis database and a TXPacketQueue", t, func() {
+		p := NewRedisPool(conf.RedisServer, conf.RedisPassword)
+		c := p.Get()
+		_, err := c.Do("FLUSHALL")
+		So(err, ShouldBeNil)
+		c.Close()
+
+		q := NewTXPacketQueue(p)
+		devAddr := lorawan.DevAddr{1, 2, 3, 4}
+
+		Convey("Then the queue of an unknown node is empty", func() {
+			_, _, ok, err := q.Dequeue(devAddr)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("When queueing two downlinks", func() {
+			So(q.Enqueue(newTestTXPacket(devAddr, 1, []byte("first"))), ShouldBeNil)
+			So(q.Enqueue(newTestTXPacket(devAddr, 2, []byte("second"))), ShouldBeNil)
+
+			Convey("Then these are returned in order", func() {
+				txPacket, remaining, ok, err := q.Dequeue(devAddr)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeTrue)
+				So(remaining, ShouldEqual, 1)
+				So(txPacket.PHYPayload.MACPayload.(*lorawan.MACPayload).FPort, ShouldEqual, 1)
+
+				txPacket, remaining, ok, err = q.Dequeue(devAddr)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeTrue)
+				So(remaining, ShouldEqual, 0)
+				So(txPacket.PHYPayload.MACPayload.(*lorawan.MACPayload).FPort, ShouldEqual, 2)
+
+				_, _, ok, err = q.Dequeue(devAddr)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Then the queue of an other node is empty", func() {
+				_, _, ok, err := q.Dequeue(lorawan.DevAddr{4, 3, 2, 1})
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("Given a client with an application backend receiving a downlink", func() {
+			appBackend := &testDownlinkApplicationBackend{
+				txPacketChan: make(chan loracontrol.TXPacket, 1),
+			}
+			client, err := loracontrol.NewClient(
+				loracontrol.SetStorageBackend(loracontrol.NewRedisBackend(conf.RedisServer, conf.RedisPassword)),
+				loracontrol.SetApplicationBackend(appBackend),
+				loracontrol.SetGatewayBackend(&loracontrol.DummyGatewayBackend{}),
+			)
+			So(err, ShouldBeNil)
+
+			appBackend.txPacketChan <- newTestTXPacket(devAddr, 1, []byte("hello"))
+			close(appBackend.txPacketChan)
+
+			Convey("When calling HandleApplicationPackets", func() {
+				HandleApplicationPackets(client, q)
+
+				Convey("Then the downlink has been queued", func() {
+					_, remaining, ok, err := q.Dequeue(devAddr)
+					So(err, ShouldBeNil)
+					So(ok, ShouldBeTrue)
+					So(remaining, ShouldEqual, 0)
+				})
+			})
+		})
+	})
+}